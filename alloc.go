@@ -0,0 +1,149 @@
+package fat
+
+// Allocator is a cluster allocation policy: it decides where the search for
+// free clusters starts when a file or directory gets a new cluster chain, has
+// its chain stretched, or is given a contiguous run by [File.Expand]. The
+// first free cluster, or run of clusters, found from the start on is
+// allocated, wrapping around at the end of the volume.
+//
+// Set one with [FSConfig.Allocator]. Without one the filesystem allocates as
+// FatFs does: a chain is stretched into the next cluster if it is free and
+// anything else is allocated from the last cluster allocated on.
+type Allocator interface {
+	// StartCluster returns the cluster to start the search at. A cluster
+	// outside the volume, [2, vol.NumClusters()+2), starts it at cluster 2.
+	StartCluster(vol AllocVolume, req AllocRequest) uint32
+}
+
+// AllocRequest describes the allocation an [Allocator] is asked to place.
+type AllocRequest struct {
+	// Prev is the last cluster of the chain being stretched, 0 when a new
+	// chain is started.
+	Prev uint32
+	// Count is the number of contiguous clusters needed: 1 except for the
+	// run allocated by [File.Expand].
+	Count uint32
+}
+
+// AllocVolume is the state of the volume an [Allocator] decides on. It is
+// only valid during the call to StartCluster.
+type AllocVolume interface {
+	// NumClusters returns the number of clusters of the volume. They are
+	// numbered from 2.
+	NumClusters() uint32
+	// LastAllocated returns the cluster allocated last since the volume was
+	// mounted, 0 if none.
+	LastAllocated() uint32
+	// IsFree reports whether cluster cl is free. It reads the FAT or exFAT
+	// allocation bitmap unless [FSConfig.AllocMapBytes] holds an exact map.
+	IsFree(cl uint32) (bool, error)
+}
+
+// allocVolume is the AllocVolume of a mounted FS.
+type allocVolume FS
+
+func (v *allocVolume) NumClusters() uint32   { return v.n_fatent - 2 }
+func (v *allocVolume) LastAllocated() uint32 { return v.last_alloc }
+
+func (v *allocVolume) IsFree(cl uint32) (bool, error) {
+	fsys := (*FS)(v)
+	if cl < 2 || cl >= fsys.n_fatent {
+		return false, frInvalidParameter
+	}
+	if fsys.amap_ready() && fsys.amap.shift == 0 {
+		return fsys.amap.bits[(cl-2)/64]&(1<<((cl-2)%64)) == 0, nil
+	}
+	used, fr := fsys.cluster_used(cl)
+	if fr != frOK {
+		return false, fr
+	}
+	return !used, nil
+}
+
+// alloc_start returns the cluster at which to search for ncl free clusters
+// for the chain ending at prev, or a new chain if prev is 0, as decided by
+// the configured Allocator.
+func (fsys *FS) alloc_start(prev, ncl uint32) uint32 {
+	start := fsys.alloc.StartCluster((*allocVolume)(fsys), AllocRequest{Prev: prev, Count: ncl})
+	if start < 2 || start >= fsys.n_fatent {
+		start = 2
+	}
+	return start
+}
+
+// LowestFreeAllocator allocates the free clusters with the lowest numbers,
+// whatever has been allocated before. Allocation depends only on what is
+// free, which makes volume images reproducible in tests.
+type LowestFreeAllocator struct{}
+
+// StartCluster implements [Allocator].
+func (LowestFreeAllocator) StartCluster(vol AllocVolume, req AllocRequest) uint32 {
+	return 2
+}
+
+// RoundRobinAllocator cycles through the volume, allocating from the cluster
+// after the one allocated last. Unlike the default it does not return to fill
+// the space freed when a file is overwritten, so on flash media without wear
+// leveling of their own writes are spread over all free clusters. A chain is
+// still stretched into the next cluster if it is free.
+type RoundRobinAllocator struct{}
+
+// StartCluster implements [Allocator].
+func (RoundRobinAllocator) StartCluster(vol AllocVolume, req AllocRequest) uint32 {
+	if req.Prev != 0 && req.Count == 1 {
+		if free, err := vol.IsFree(req.Prev + 1); err == nil && free {
+			return req.Prev + 1
+		}
+	}
+	return vol.LastAllocated() + 1
+}
+
+// BestFitAllocator places files to keep them contiguous. A run of known
+// length, as allocated by [File.Expand], goes to the smallest free extent
+// that holds it, sparing large extents for large files. A chain of unknown
+// length goes to the start of the largest free extent, where it can grow the
+// furthest before fragmenting, and is stretched into the next cluster while
+// it is free.
+//
+// Finding extents reads the allocation state of the whole volume on every
+// placement: use it with an exact map, see [FSConfig.AllocMapBytes].
+type BestFitAllocator struct{}
+
+// StartCluster implements [Allocator].
+func (BestFitAllocator) StartCluster(vol AllocVolume, req AllocRequest) uint32 {
+	if req.Prev != 0 && req.Count == 1 {
+		if free, err := vol.IsFree(req.Prev + 1); err == nil && free {
+			return req.Prev + 1
+		}
+	}
+	var best, bestLen, start, n uint32
+	end := vol.NumClusters() + 2
+	for cl := uint32(2); cl <= end; cl++ {
+		free := false
+		if cl < end {
+			var err error
+			free, err = vol.IsFree(cl)
+			if err != nil {
+				return 0 // Fall back to the first free cluster.
+			}
+		}
+		if free {
+			if n == 0 {
+				start = cl
+			}
+			n++
+			continue
+		}
+		if n >= req.Count {
+			better := n > bestLen // Largest extent for a chain of unknown length.
+			if req.Count > 1 {
+				better = bestLen == 0 || n < bestLen // Smallest extent that fits.
+			}
+			if better {
+				best, bestLen = start, n
+			}
+		}
+		n = 0
+	}
+	return best
+}
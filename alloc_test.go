@@ -0,0 +1,158 @@
+package fat
+
+import (
+	"fmt"
+	"testing"
+)
+
+// firstCluster returns the first cluster of the file at path.
+func firstCluster(t *testing.T, fsys *FS, path string) uint32 {
+	t.Helper()
+	var f File
+	if err := fsys.OpenFile(&f, path, ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return f.obj.sclust
+}
+
+// recordingAllocator wraps an Allocator and records the requests made.
+type recordingAllocator struct {
+	Allocator
+	reqs []AllocRequest
+}
+
+func (ra *recordingAllocator) StartCluster(vol AllocVolume, req AllocRequest) uint32 {
+	ra.reqs = append(ra.reqs, req)
+	return ra.Allocator.StartCluster(vol, req)
+}
+
+func TestAllocator(t *testing.T) {
+	t.Run("FAT", func(t *testing.T) { testAllocator(t, FormatFAT16) })
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		testAllocator(t, FormatExFAT)
+	})
+}
+
+func testAllocator(t *testing.T, format Format) {
+	// newVolume returns a volume laid out as a.dat (2 clusters), b.dat (1),
+	// c.dat (1) with a.dat then removed, leaving a 2-cluster hole first.
+	newVolume := func(alloc Allocator) (*FS, uint32) {
+		fsys, _ := formatAndMount(t, 8192, FormatParams{Format: format, ClusterSize: 1})
+		fsys.Configure(FSConfig{Allocator: alloc})
+		// Grow the root directory up front so that it takes no clusters later.
+		for i := 0; i < 30; i++ {
+			createPat(t, fsys, fmt.Sprintf("tmp%d", i), 0, 0)
+		}
+		for i := 0; i < 30; i++ {
+			if err := fsys.Remove(fmt.Sprintf("tmp%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		createPat(t, fsys, "a.dat", 1, 2*512)
+		createPat(t, fsys, "b.dat", 2, 512)
+		createPat(t, fsys, "c.dat", 3, 512)
+		hole := firstCluster(t, fsys, "a.dat")
+		if err := fsys.Remove("a.dat"); err != nil {
+			t.Fatal(err)
+		}
+		return fsys, hole
+	}
+
+	t.Run("default", func(t *testing.T) {
+		fsys, hole := newVolume(nil)
+		createPat(t, fsys, "d.dat", 4, 512)
+		if got := firstCluster(t, fsys, "d.dat"); got == hole {
+			t.Errorf("d.dat at %d: FatFs allocates after the last allocated cluster", got)
+		}
+	})
+
+	t.Run("lowest", func(t *testing.T) {
+		ra := &recordingAllocator{Allocator: LowestFreeAllocator{}}
+		fsys, hole := newVolume(ra)
+		createPat(t, fsys, "d.dat", 4, 3*512)
+		var f File
+		if err := fsys.OpenFile(&f, "d.dat", ModeRead); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if f.obj.sclust != hole || f.obj.clusterstat(hole) != hole+1 {
+			t.Errorf("d.dat starts at %d, want the hole at %d", f.obj.sclust, hole)
+		}
+		// The third cluster lies past b.dat and c.dat.
+		if got := f.obj.clusterstat(hole + 1); got == hole+2 {
+			t.Errorf("d.dat stretched into b.dat's cluster %d", got)
+		}
+		n := len(ra.reqs)
+		if n < 3 || ra.reqs[n-3] != (AllocRequest{Count: 1}) || ra.reqs[n-1] != (AllocRequest{Prev: hole + 1, Count: 1}) {
+			t.Errorf("requests = %+v", ra.reqs)
+		}
+	})
+
+	t.Run("roundrobin", func(t *testing.T) {
+		fsys, hole := newVolume(RoundRobinAllocator{})
+		c := firstCluster(t, fsys, "c.dat")
+		// Overwriting c.dat does not reuse its cluster, nor the hole.
+		createPat(t, fsys, "c.dat", 4, 3*512)
+		if got := firstCluster(t, fsys, "c.dat"); got == c || got == hole {
+			t.Errorf("rewritten c.dat at %d reuses freed space", got)
+		}
+		got := readAllFile(t, fsys, "c.dat")
+		for i := range got {
+			if got[i] != pat(4, i) {
+				t.Fatalf("c.dat content mismatch at %d", i)
+			}
+		}
+		if format == FormatExFAT {
+			var f File
+			if err := fsys.OpenFile(&f, "c.dat", ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			if f.obj.stat != 2 {
+				t.Error("stretched file lost its contiguous status")
+			}
+			f.Close()
+		}
+	})
+
+	t.Run("bestfit", func(t *testing.T) {
+		fsys, hole := newVolume(BestFitAllocator{})
+		// Holes of 2 clusters, 5 clusters, and the free tail of the volume.
+		createPat(t, fsys, "e.dat", 5, 5*512)
+		createPat(t, fsys, "f.dat", 6, 512)
+		hole5 := firstCluster(t, fsys, "e.dat")
+		if err := fsys.Remove("e.dat"); err != nil {
+			t.Fatal(err)
+		}
+		var f File
+		for _, tc := range []struct {
+			size int64
+			want uint32
+		}{
+			{4 * 512, hole5}, // Smallest hole that fits.
+			{2 * 512, hole},
+		} {
+			if err := fsys.OpenFile(&f, "x.dat", ModeCreateAlways|ModeWrite); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Expand(tc.size, false); err != nil {
+				t.Fatal(err)
+			}
+			if f.obj.sclust != tc.want {
+				t.Errorf("Expand(%d) at cluster %d, want %d", tc.size, f.obj.sclust, tc.want)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.Rename("x.dat", fmt.Sprintf("x%d.dat", tc.size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// A chain of unknown length goes to the largest extent, past f.dat.
+		createPat(t, fsys, "g.dat", 7, 2*512)
+		if got, tail := firstCluster(t, fsys, "g.dat"), firstCluster(t, fsys, "f.dat")+1; got != tail {
+			t.Errorf("g.dat at %d, want the free tail at %d", got, tail)
+		}
+	})
+}
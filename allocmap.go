@@ -0,0 +1,249 @@
+package fat
+
+import (
+	"log/slog"
+	"math/bits"
+	"runtime"
+)
+
+// allocMap is the optional in-RAM allocation map sized by
+// [FSConfig.AllocMapBytes]. Bit g summarizes the group of 1<<shift clusters
+// starting at cluster 2+g<<shift, and is set if every cluster of the group is
+// in use.
+//
+// With shift zero the map is an exact copy of the allocation state, on exFAT
+// the allocation bitmap held in memory, and searching for free clusters does
+// not touch the device. A coarser map only lets a search skip the groups known
+// to be full and probe the others on the FAT or allocation bitmap. Its bits
+// are set as searches find groups full and cleared as clusters are freed, so
+// a set bit is always right and a clear one may be stale.
+type allocMap struct {
+	bits  []uint64
+	shift uint
+	built bool
+}
+
+// amap_reset drops the map on mount, to be rebuilt on first use for the
+// newly mounted volume.
+func (fsys *FS) amap_reset() {
+	if fsys.amapBytes <= 0 {
+		fsys.amap = nil
+	} else if fsys.amap == nil {
+		fsys.amap = &allocMap{}
+	} else {
+		fsys.amap.built = false
+	}
+}
+
+// amap_ready reports whether the allocation map can be used, building it on
+// first use. A map that fails to build is retried on the next use; the
+// caller falls back to scanning the FAT or allocation bitmap meanwhile.
+func (fsys *FS) amap_ready() bool {
+	m := fsys.amap
+	if m == nil {
+		return false
+	} else if m.built {
+		return true
+	}
+	fr := fsys.amap_build()
+	if fr != frOK {
+		fsys.logerror("amap_build", slog.Int("fr", int(fr)))
+	}
+	return m.built
+}
+
+// amap_build reads the allocation state of every cluster into the map, with
+// the finest grouping that fits the budget.
+func (fsys *FS) amap_build() fileResult {
+	m := fsys.amap
+	nclst := fsys.n_fatent - 2
+	shift := uint(0)
+	for uint64(nclst) > uint64(fsys.amapBytes)*8<<shift {
+		shift++
+	}
+	ngroups := (uint64(nclst) + 1<<shift - 1) >> shift
+	nwords := int((ngroups + 63) / 64)
+	if cap(m.bits) >= nwords {
+		m.bits = m.bits[:nwords]
+		clear(m.bits)
+	} else {
+		m.bits = make([]uint64, nwords)
+	}
+	m.shift = shift
+	gmask := uint32(1)<<shift - 1
+	gfree := false // Free cluster seen in the current group.
+	for cl := uint32(2); cl < fsys.n_fatent; cl++ {
+		used, fr := fsys.cluster_used(cl)
+		if fr != frOK {
+			return fr
+		}
+		if !used {
+			gfree = true
+		}
+		if (cl-2)&gmask == gmask || cl == fsys.n_fatent-1 {
+			// Last cluster of the group.
+			if !gfree {
+				g := (cl - 2) >> shift
+				m.bits[g/64] |= 1 << (g % 64)
+			}
+			gfree = false
+		}
+		if cl%4096 == 0 {
+			runtime.Gosched()
+		}
+	}
+	m.built = true
+	return frOK
+}
+
+// cluster_used reads whether cluster cl is allocated from the FAT or, on
+// exFAT, the allocation bitmap.
+func (fsys *FS) cluster_used(cl uint32) (bool, fileResult) {
+	if fsys.isExfat() {
+		bit := cl - 2 // The first bit in the bitmap corresponds to cluster #2.
+		ss := uint32(fsys.ssize)
+		fr := fsys.move_window(fsys.bitbase + lba(bit/8/ss))
+		if fr != frOK {
+			return false, fr
+		}
+		return fsys.win[bit/8%ss]&(1<<(bit%8)) != 0, frOK
+	}
+	obj := objid{fs: fsys}
+	switch val := obj.clusterstat(cl); val {
+	case 1:
+		return false, frIntErr
+	case badCluster:
+		return false, frDiskErr
+	default:
+		return val != 0, frOK
+	}
+}
+
+// cluster_marked is called as cluster cl is allocated or freed on the FAT or
+// allocation bitmap.
+func (fsys *FS) cluster_marked(cl uint32, used bool) {
+	fsys.amap_mark(cl, used)
+	if used {
+		fsys.trim_cancel(cl)
+	}
+}
+
+// amap_mark records a change of allocation of cluster cl in the map.
+func (fsys *FS) amap_mark(cl uint32, used bool) {
+	m := fsys.amap
+	if m == nil || !m.built {
+		return
+	}
+	g := (cl - 2) >> m.shift
+	if !used {
+		m.bits[g/64] &^= 1 << (g % 64)
+	} else if m.shift == 0 {
+		m.bits[g/64] |= 1 << (g % 64)
+	}
+}
+
+// amap_find searches for a block of ncl contiguous free clusters from clst
+// on, wrapping around at the end of the volume, with the help of the map.
+// A block does not wrap. Returns the first cluster of the block found, 0 if
+// not found, 1 on internal error or badCluster on disk error.
+func (fsys *FS) amap_find(clst, ncl uint32) uint32 {
+	fsys.trace("fs:amap_find", slog.Uint64("clst", uint64(clst)), slog.Uint64("ncl", uint64(ncl)))
+	m := fsys.amap
+	if clst < 2 || clst >= fsys.n_fatent {
+		clst = 2
+	}
+	gmask := uint32(1)<<m.shift - 1
+	cl := clst
+	scl, ctr := cl, uint32(0)
+	gwhole := (cl-2)&gmask == 0 // Scan of the current group started at its first cluster.
+	gfree := false              // Free cluster seen in the current group.
+	for n := uint32(0); n < fsys.n_fatent-2; {
+		g := (cl - 2) >> m.shift
+		var used bool
+		if m.bits[g/64]&(1<<(g%64)) != 0 {
+			if m.shift != 0 {
+				// The whole group is in use: skip it.
+				next := uint64(g+1)<<m.shift + 2
+				if next > uint64(fsys.n_fatent) {
+					next = uint64(fsys.n_fatent)
+				}
+				n += uint32(next) - cl
+				cl = uint32(next)
+				if cl >= fsys.n_fatent {
+					cl = 2
+				}
+				scl, ctr = cl, 0
+				gwhole, gfree = true, false
+				continue
+			}
+			used = true
+		} else if m.shift != 0 {
+			var fr fileResult
+			used, fr = fsys.cluster_used(cl)
+			if fr == frDiskErr {
+				return badCluster
+			} else if fr != frOK {
+				return 1
+			}
+		}
+		if !used {
+			// A free cluster: check if run length is sufficient.
+			ctr++
+			if ctr == ncl {
+				return scl
+			}
+			gfree = true
+		} else {
+			ctr = 0 // Encountered a cluster in-use, restart the run.
+		}
+		n++
+		cl++
+		if (cl-2)&gmask == 0 || cl >= fsys.n_fatent {
+			// Left the group: remember it is full if all of it was probed.
+			if m.shift != 0 && gwhole && !gfree {
+				m.bits[g/64] |= 1 << (g % 64)
+			}
+			gwhole, gfree = true, false
+		}
+		if cl >= fsys.n_fatent {
+			cl = 2 // Wrap around. A block does not wrap.
+			ctr = 0
+		}
+		if ctr == 0 {
+			scl = cl
+		}
+	}
+	return 0 // All clusters scanned.
+}
+
+// f_getfree returns the number of free clusters on the volume, counting
+// them on an exact allocation map, or the FAT or allocation bitmap, if not
+// known.
+func (fsys *FS) f_getfree() (uint32, fileResult) {
+	fsys.trace("f_getfree")
+	nclst := fsys.n_fatent - 2
+	if fsys.free_clst <= nclst {
+		return fsys.free_clst, frOK
+	}
+	if fsys.amap_ready() && fsys.amap.shift == 0 {
+		nused := 0
+		for _, w := range fsys.amap.bits {
+			nused += bits.OnesCount64(w)
+		}
+		fsys.free_clst = nclst - uint32(nused)
+	} else {
+		var nfree uint32
+		for cl := uint32(2); cl < fsys.n_fatent; cl++ {
+			used, fr := fsys.cluster_used(cl)
+			if fr != frOK {
+				return 0, fr
+			}
+			if !used {
+				nfree++
+			}
+		}
+		fsys.free_clst = nfree
+	}
+	fsys.fsi_flag |= 1 // FSInfo is to be updated.
+	return fsys.free_clst, frOK
+}
@@ -0,0 +1,191 @@
+package fat
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestAllocMapGoldenTorture runs the golden torture scripts with exact and
+// coarse allocation maps: the map changes how free clusters are found, never
+// which.
+func TestAllocMapGoldenTorture(t *testing.T) {
+	skipIfNoLFN(t)
+	for _, budget := range []int{1 << 20, 8} {
+		for _, test := range []struct {
+			baseline, torture string
+			exfat             bool
+			script            func(*testing.T, *FS)
+		}{
+			{"golden-fmt16.img", "golden-torture16.img", false, tortureScriptSmall},
+			{"golden-fmt32.img", "golden-torture32.img", false, tortureScript32},
+			{"golden-fmtex.img", "golden-tortureex.img", true, func(t *testing.T, fsys *FS) {
+				tortureScript32(t, fsys)
+				tortureScriptExFAT(t, fsys)
+			}},
+		} {
+			t.Run(fmt.Sprintf("%s/%d", test.torture, budget), func(t *testing.T) {
+				if test.exfat {
+					skipIfNoExFAT(t)
+				}
+				dev := goldenDevice(t, test.baseline)
+				var fsys FS
+				fsys.Configure(FSConfig{NoZeroFilling: true, AllocMapBytes: budget})
+				if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+					t.Fatal(err)
+				}
+				test.script(t, &fsys)
+				if fsys.amap == nil || !fsys.amap.built {
+					t.Fatal("allocation map not built")
+				}
+				if err := fsys.Unmount(); err != nil {
+					t.Fatal(err)
+				}
+				compareGolden(t, dev, test.torture)
+			})
+		}
+	}
+}
+
+// TestAllocMapReducesReads searches a nearly full volume for contiguous runs
+// of clusters that are not there. Without a map every search reads the whole
+// FAT; with one only the first, to build it.
+func TestAllocMapReducesReads(t *testing.T) {
+	run := func(budget int) int {
+		fsys, dev := fullVolume(t, FormatFAT16)
+		cd := &countingDevice{BlockDeviceExtended: dev}
+		fsys.Configure(FSConfig{AllocMapBytes: budget})
+		if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		var f File
+		if err := fsys.OpenFile(&f, "new.dat", ModeCreateNew|ModeWrite); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			if err := f.Expand(8*512, false); err == nil {
+				t.Fatal("expand into a 4-cluster hole succeeded")
+			}
+		}
+		f.Close()
+		return cd.reads
+	}
+	r0 := run(0)
+	r1 := run(1 << 20)
+	r2 := run(64) // 512 bits for 8000 clusters: 16 clusters per bit.
+	t.Logf("reads: no map %d, exact map %d, coarse map %d", r0, r1, r2)
+	if r1*4 > r0 {
+		t.Errorf("exact map reads = %d, want at most a quarter of %d", r1, r0)
+	}
+	if r2*4 > r0 {
+		t.Errorf("coarse map reads = %d, want at most a quarter of %d", r2, r0)
+	}
+}
+
+// fullVolume returns a mounted volume filled up but for a hole of four
+// clusters near its start, left by removing hole.dat.
+func fullVolume(t *testing.T, format Format) (*FS, *BlockByteSlice) {
+	t.Helper()
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: format, ClusterSize: 1})
+	createPat(t, fsys, "first.dat", 1, 512)
+	createPat(t, fsys, "hole.dat", 2, 4*512)
+	var f File
+	if err := fsys.OpenFile(&f, "fill.dat", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	for {
+		if _, err := f.Write(buf); err != nil {
+			break // Disk full.
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("hole.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	return fsys, dev
+}
+
+// TestAllocMapConsistent churns files on a volume with an allocation map and
+// checks the map against the FAT or allocation bitmap, and the free space
+// against a count taken without one.
+func TestAllocMapConsistent(t *testing.T) {
+	for _, format := range []Format{FormatFAT16, FormatFAT32, FormatExFAT} {
+		for _, budget := range []int{1 << 20, 100} {
+			t.Run(fmt.Sprintf("%v/%d", format, budget), func(t *testing.T) {
+				if format == FormatExFAT {
+					skipIfNoExFAT(t)
+				}
+				numBlocks := 8192
+				if format == FormatFAT32 {
+					numBlocks = 80000
+				}
+				fsys, dev := formatAndMount(t, numBlocks, FormatParams{Format: format, ClusterSize: 1})
+				fsys.Configure(FSConfig{AllocMapBytes: budget})
+				if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+					t.Fatal(err)
+				}
+				rng := rand.New(rand.NewSource(1))
+				live := map[string]bool{}
+				for i := 0; i < 200; i++ {
+					name := fmt.Sprintf("f%d.dat", rng.Intn(30))
+					if live[name] && rng.Intn(2) == 0 {
+						if err := fsys.Remove(name); err != nil {
+							t.Fatal(err)
+						}
+						delete(live, name)
+						continue
+					}
+					createPat(t, fsys, name, i, rng.Intn(20*512))
+					live[name] = true
+				}
+				var f File
+				if err := fsys.OpenFile(&f, "big.dat", ModeCreateNew|ModeWrite); err != nil {
+					t.Fatal(err)
+				} else if err = f.Expand(200*512, false); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+				if !fsys.amap_ready() {
+					t.Fatal("map not built")
+				}
+				m := fsys.amap
+				for cl := uint32(2); cl < fsys.n_fatent; cl++ {
+					used, fr := fsys.cluster_used(cl)
+					if fr != frOK {
+						t.Fatal(fr)
+					}
+					g := (cl - 2) >> m.shift
+					full := m.bits[g/64]&(1<<(g%64)) != 0
+					if full && !used || m.shift == 0 && used != full {
+						t.Fatalf("cluster %d: used=%v, map group %d full=%v", cl, used, g, full)
+					}
+				}
+				got, err := fsys.FreeSpace()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := fsys.Unmount(); err != nil {
+					t.Fatal(err)
+				}
+				fsys.Configure(FSConfig{})
+				if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+					t.Fatal(err)
+				}
+				fsys.free_clst = 0xffff_ffff // Force a count.
+				want, err := fsys.FreeSpace()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("FreeSpace = %d with map, %d counted", got, want)
+				}
+			})
+		}
+	}
+}
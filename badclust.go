@@ -0,0 +1,303 @@
+package fat
+
+import (
+	"bytes"
+	"log/slog"
+)
+
+// badRemapTries bounds the clusters a write of file data may be moved to
+// before its device error is returned, see [FSConfig.RemapBadClusters].
+const badRemapTries = 4
+
+// scanChunkSectors is the most sectors ScanSurface transfers at once.
+const scanChunkSectors = 64
+
+// ScanConfig configures [FS.ScanSurface]. The zero value only reads.
+type ScanConfig struct {
+	// Write also writes each free cluster with a test pattern and reads it
+	// back, finding clusters that read but do not hold what is written. The
+	// free clusters are left holding the pattern.
+	Write bool
+}
+
+// ScanReport is the result of [FS.ScanSurface].
+type ScanReport struct {
+	// Scanned counts the free clusters scanned.
+	Scanned uint32
+	// Bad lists the clusters that failed, now marked bad.
+	Bad []uint32
+}
+
+// ScanSurface reads every free cluster of the volume, and writes it if
+// cfg.Write, as chkdsk /r and badblocks do, and marks those that fail bad:
+// 0xFF7, 0xFFF7 or 0x0FFFFFF7 on the FAT, and on exFAT 0xFFFFFFF7 on the FAT
+// and in use on the allocation bitmap. A cluster marked bad is never
+// allocated and is not free space, and [FS.Check] counts it in
+// [CheckReport.BadClusters]. Clusters held by files are not scanned: see
+// [FSConfig.RemapBadClusters] to move file data off clusters found bad
+// when written.
+//
+// The error is only non-nil if the FAT or the allocation bitmap could not be
+// read or written: data sectors failing are what the scan looks for.
+func (fsys *FS) ScanSurface(cfg *ScanConfig) (_ *ScanReport, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	defer fsys.wrapErr(&err, "scansurface", "/")
+	if fsys.fstype == _FormatUnknown {
+		return nil, frNotEnabled
+	} else if fsys.perm&ModeWrite == 0 {
+		return nil, frWriteProtected
+	}
+	if cfg == nil {
+		cfg = &ScanConfig{}
+	}
+	if fr := fsys.sync(); fr != frOK {
+		return nil, fr
+	}
+	rep := &ScanReport{}
+	fr := fsys.scan_surface(cfg.Write, rep)
+	if fr == frOK {
+		fr = fsys.sync()
+	}
+	if fr != frOK {
+		return nil, fr
+	}
+	return rep, nil
+}
+
+// scan_surface scans the free clusters and marks those failing bad.
+func (fsys *FS) scan_surface(write bool, rep *ScanReport) fileResult {
+	ss := int(fsys.ssize)
+	chunk := int(fsys.csize)
+	if chunk > scanChunkSectors {
+		chunk = scanChunkSectors
+	}
+	buf := make([]byte, chunk*ss)
+	var pat []byte
+	if write {
+		pat = make([]byte, len(buf))
+		for i := range pat {
+			pat[i] = 0x55
+			if i&1 != 0 {
+				pat[i] = 0xAA
+			}
+		}
+	}
+	for cl := uint32(2); cl < fsys.n_fatent; cl++ {
+		used, fr := fsys.cluster_used(cl)
+		if fr != frOK {
+			return fr
+		} else if used {
+			continue
+		}
+		rep.Scanned++
+		ok := true
+		sect := fsys.clst2sect(cl)
+		for i := 0; ok && i < int(fsys.csize); i += chunk {
+			n := chunk
+			if rest := int(fsys.csize) - i; n > rest {
+				n = rest
+			}
+			s := sect + lba(i)
+			ok = fsys.disk_read(buf[:n*ss], s, n) == drOK
+			if ok && write {
+				ok = fsys.disk_write(pat[:n*ss], s, n) == drOK &&
+					fsys.disk_read(buf[:n*ss], s, n) == drOK &&
+					bytes.Equal(buf[:n*ss], pat[:n*ss])
+			}
+		}
+		if ok {
+			continue
+		}
+		fsys.deverr = nil // Failing is what the scan looks for.
+		fsys.trace("scan_surface:bad", slog.Uint64("clst", uint64(cl)))
+		if fr = fsys.mark_bad(cl); fr != frOK {
+			return fr
+		}
+		rep.Bad = append(rep.Bad, cl)
+	}
+	return frOK
+}
+
+// bad_mark returns the FAT value marking a bad cluster.
+func (fsys *FS) bad_mark() uint32 {
+	switch fsys.fstype {
+	case FormatFAT12:
+		return 0xFF7
+	case FormatFAT16:
+		return 0xFFF7
+	case FormatFAT32:
+		return 0x0FFF_FFF7
+	}
+	return 0xFFFF_FFF7
+}
+
+// mark_bad marks the free cluster cl bad on the FAT, and in use on the exFAT
+// allocation bitmap, so that it is never allocated.
+func (fsys *FS) mark_bad(cl uint32) fileResult {
+	if fr := fsys.put_clusterstat(cl, fsys.bad_mark()); fr != frOK {
+		return fr
+	}
+	if fsys.isExfat() {
+		if fr := fsys.change_bitmap(cl, 1, true); fr != frOK {
+			return fr
+		}
+	}
+	if fsys.free_clst > 0 && fsys.free_clst <= fsys.n_fatent-2 {
+		fsys.free_clst--
+		fsys.fsi_flag |= 1
+	}
+	return frOK
+}
+
+// remappable reports whether fr, of data_write_dev, is a write the device
+// failed or did not keep, which moving the data to another cluster may cure.
+// A failure to read the sectors back for VerifyWrites is not: the device
+// acknowledged the write.
+func (fsys *FS) remappable(fr fileResult) bool {
+	switch fr {
+	case frVerifyErr:
+		return true
+	case frDiskErr:
+		return fsys.deverr == nil || fsys.deverr.Op != "read"
+	}
+	return false
+}
+
+// sect2clst returns the cluster holding data sector sect.
+func (fsys *FS) sect2clst(sect lba) uint32 {
+	return uint32((sect-fsys.database)/lba(fsys.csize)) + 2
+}
+
+// remap_write retries a write of file data that the device failed, or that
+// did not read back, cluster by cluster: a cluster whose sectors fail again
+// is replaced in the chain by remap and the sectors written to the new one,
+// up to badRemapTries times.
+func (fp *File) remap_write(buf []byte, sector lba, numsectors int) fileResult {
+	fsys := fp.obj.fs
+	if fsys.perm&ModeWrite == 0 {
+		return frDiskErr
+	}
+	ss := int(fsys.ssize)
+	tries := 0
+	for numsectors > 0 {
+		cl := fsys.sect2clst(sector)
+		csect := sector - fsys.clst2sect(cl)
+		n := int(lba(fsys.csize) - csect) // Up to the end of the cluster.
+		if n > numsectors {
+			n = numsectors
+		}
+		sect := sector
+		fr := fp.data_write_dev(buf[:n*ss], sect, n)
+		for fsys.remappable(fr) {
+			if tries == badRemapTries {
+				return fr
+			}
+			tries++
+			fsys.logerror("remap_write:bad", slog.Uint64("clst", uint64(cl)))
+			if cl, fr = fp.remap(cl); fr != frOK {
+				return fr
+			}
+			sect = fsys.clst2sect(cl) + csect
+			fr = fp.data_write_dev(buf[:n*ss], sect, n)
+		}
+		if fr != frOK {
+			return fr
+		}
+		buf = buf[n*ss:]
+		sector += lba(n) // The chain past cl is as it was.
+		numsectors -= n
+	}
+	return frOK
+}
+
+// remap replaces cluster cl of the chain of fp by a free cluster, to which
+// the sectors of cl are copied, and marks cl bad. It returns the new
+// cluster, or frDiskErr if there is none free or cl cannot be read.
+func (fp *File) remap(cl uint32) (uint32, fileResult) {
+	fsys := fp.obj.fs
+	obj := &fp.obj
+	if fp.cltbl != nil {
+		return 0, frDiskErr // The fast seek table maps cl.
+	}
+	if fsys.isExfat() {
+		if fr := fp.chain_fat(); fr != frOK {
+			return 0, fr
+		}
+	}
+	// Find the cluster before cl in the chain.
+	var prev uint32
+	for c := obj.sclust; c != cl; {
+		if c < 2 || c >= fsys.n_fatent {
+			return 0, frIntErr // cl is not in the chain.
+		}
+		prev = c
+		if c = obj.clusterstat(c); c == badCluster {
+			return 0, frDiskErr
+		}
+	}
+	next := obj.clusterstat(cl)
+	if next == badCluster || next < 2 {
+		return 0, frDiskErr
+	} else if next >= fsys.n_fatent {
+		next = badCluster // End of chain.
+	}
+	nobj := objid{fs: fsys}
+	ncl := nobj.create_chain(0)
+	switch ncl {
+	case 0, badCluster:
+		return 0, frDiskErr
+	case 1:
+		return 0, frIntErr
+	}
+	// Copy the sectors of cl, with those held for it in the coalescing
+	// buffer, which is newer.
+	ss := int(fsys.ssize)
+	src, dst := fsys.clst2sect(cl), fsys.clst2sect(ncl)
+	var sect [512]byte
+	for i := lba(0); i < lba(fsys.csize); i++ {
+		if fsys.disk_read(sect[:ss], src+i, 1) != drOK {
+			return 0, frDiskErr
+		}
+		fp.wc_overlay(sect[:ss], src+i, 1)
+		if fsys.disk_write(sect[:ss], dst+i, 1) != drOK {
+			return 0, frDiskErr
+		}
+	}
+	if fp.wc_overlaps(src, int(fsys.csize)) {
+		// Write the sectors held for the clusters around cl.
+		ws, wn := fp.wcSect, lba(fp.wcN)
+		end, cend := ws+wn, src+lba(fsys.csize)
+		fp.wcN = 0
+		if ws < src && fp.data_write_dev(fp.wc[:(src-ws)*lba(ss)], ws, int(src-ws)) != frOK {
+			return 0, frDiskErr
+		}
+		if end > cend && fp.data_write_dev(fp.wc[(cend-ws)*lba(ss):wn*lba(ss)], cend, int(end-cend)) != frOK {
+			return 0, frDiskErr
+		}
+	}
+	// Link the new cluster in place of cl.
+	fr := fsys.put_clusterstat(ncl, next)
+	if fr == frOK && prev != 0 {
+		fr = fsys.put_clusterstat(prev, ncl)
+	}
+	if fr == frOK {
+		fr = fsys.put_clusterstat(cl, fsys.bad_mark())
+	}
+	if fr != frOK {
+		return 0, fr
+	}
+	if prev == 0 {
+		obj.sclust = ncl
+	}
+	if fp.clust == cl {
+		fp.clust = ncl
+	}
+	if fp.sect-src < lba(fsys.csize) {
+		fp.sect = dst + (fp.sect - src)
+	}
+	fp.raN = 0
+	fp.flag |= faMODIFIED
+	fsys.vstats.Remapped++
+	return ncl, frOK
+}
@@ -0,0 +1,261 @@
+package fat
+
+import (
+	"errors"
+	"testing"
+)
+
+var errBadSector = errors.New("bad sector")
+
+// badDevice fails the reads of the sectors in badRead and the writes of
+// those in badWrite, and silently drops the writes of those in drop.
+type badDevice struct {
+	*BlockByteSlice
+	badRead, badWrite, drop map[int64]bool
+}
+
+func newBadDevice(dev *BlockByteSlice) *badDevice {
+	return &badDevice{BlockByteSlice: dev, badRead: map[int64]bool{}, badWrite: map[int64]bool{}, drop: map[int64]bool{}}
+}
+
+func (bd *badDevice) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	for i := int64(0); i < int64(len(dst))/512; i++ {
+		if bd.badRead[startBlock+i] {
+			return 0, errBadSector
+		}
+	}
+	return bd.BlockByteSlice.ReadBlocks(dst, startBlock)
+}
+
+func (bd *badDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	n := int64(len(data)) / 512
+	for i := int64(0); i < n; i++ {
+		if bd.badWrite[startBlock+i] {
+			return 0, errBadSector
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		if !bd.drop[startBlock+i] {
+			bd.BlockByteSlice.WriteBlocks(data[i*512:(i+1)*512], startBlock+i)
+		}
+	}
+	return len(data), nil
+}
+
+// remountBad remounts fsys on a badDevice over dev.
+func remountBad(t *testing.T, fsys *FS, dev *BlockByteSlice, cfg FSConfig) *badDevice {
+	t.Helper()
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	bd := newBadDevice(dev)
+	fsys.Configure(cfg)
+	if err := fsys.Mount(bd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	return bd
+}
+
+// fileExtents returns the extents of the file at path.
+func fileExtents(t *testing.T, fsys *FS, path string) []Extent {
+	t.Helper()
+	var fp File
+	if err := fsys.OpenFile(&fp, path, ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	ext, err := fp.Extents(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ext
+}
+
+// avoidClusters requires the file at path not to hold the clusters bad.
+func avoidClusters(t *testing.T, fsys *FS, path string, bad ...uint32) {
+	t.Helper()
+	for _, e := range fileExtents(t, fsys, path) {
+		for _, cl := range bad {
+			if s := int64(fsys.clst2sect(cl)); s < e.Block+e.NumBlocks && e.Block < s+int64(fsys.csize) {
+				t.Errorf("%s holds bad cluster %d", path, cl)
+			}
+		}
+	}
+}
+
+func TestScanSurface(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4}, false},
+		{"FAT32", 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1}, false},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 2}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+			createPat(t, fsys, "a.bin", 1, 3000)
+			bd := remountBad(t, fsys, dev, FSConfig{})
+			free, err := fsys.FreeSpace()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clsz := int64(fsys.csize) * 512
+			rd, wr := fsys.n_fatent-5, fsys.n_fatent-9
+			bd.badRead[int64(fsys.clst2sect(rd))+int64(fsys.csize)-1] = true
+			bd.drop[int64(fsys.clst2sect(wr))] = true
+
+			// A read scan finds the cluster that does not read, a write
+			// scan the one that does not hold what is written.
+			rep, err := fsys.ScanSurface(nil)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(rep.Bad) != 1 || rep.Bad[0] != rd || int64(rep.Scanned) != free/clsz {
+				t.Fatalf("read scan: %d scanned, bad %v, want %d and [%d]", rep.Scanned, rep.Bad, free/clsz, rd)
+			}
+			rep, err = fsys.ScanSurface(&ScanConfig{Write: true})
+			if err != nil {
+				t.Fatal(err)
+			} else if len(rep.Bad) != 1 || rep.Bad[0] != wr || int64(rep.Scanned) != free/clsz-1 {
+				t.Fatalf("write scan: %d scanned, bad %v, want %d and [%d]", rep.Scanned, rep.Bad, free/clsz-1, wr)
+			}
+			for _, cl := range []uint32{rd, wr} {
+				if v := (&objid{fs: fsys}).clusterstat(cl); v != fsys.bad_mark()&0x7FFF_FFFF {
+					t.Errorf("cluster %d FAT value %#x, want bad mark", cl, v)
+				}
+			}
+			if got, _ := fsys.FreeSpace(); got != free-2*clsz {
+				t.Errorf("free space %d, want %d", got, free-2*clsz)
+			}
+			crep, err := fsys.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, crep)
+			if crep.BadClusters != 2 || int64(crep.FreeClusters) != free/clsz-2 {
+				t.Errorf("check counts %d bad, %d free clusters", crep.BadClusters, crep.FreeClusters)
+			}
+
+			// Allocation skips the bad clusters, up to a full volume.
+			if test.numBlocks <= 8192 {
+				createPat(t, fsys, "fill.bin", 2, int(free-2*clsz))
+				avoidClusters(t, fsys, "fill.bin", rd, wr)
+				if got, _ := fsys.FreeSpace(); got != 0 {
+					t.Errorf("free space %d after filling the volume", got)
+				}
+			}
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			var plain FS
+			if err := plain.Mount(dev, 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			crep, err = plain.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, crep)
+			if crep.BadClusters != 2 {
+				t.Errorf("check after remount counts %d bad clusters, want 2", crep.BadClusters)
+			}
+			checkPat(t, &plain, "a.bin", 1, 3000)
+		})
+	}
+}
+
+func TestRemapBadClusters(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+		cfg       FSConfig
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4}, false, FSConfig{}},
+		{"FAT32", 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1}, false, FSConfig{WriteCoalesceSectors: 4, CacheFATSectors: 4, CacheDirSectors: 4}},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 2}, true, FSConfig{WriteCoalesceSectors: 4}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+			test.cfg.RemapBadClusters = true
+			bd := remountBad(t, fsys, dev, test.cfg)
+			clsz := int(fsys.csize) * 512
+			createPat(t, fsys, "a.bin", 1, 3*clsz)
+			ext := fileExtents(t, fsys, "a.bin")
+			if len(ext) != 1 {
+				t.Fatalf("a.bin in %d extents", len(ext))
+			}
+			first := fsys.sect2clst(lba(ext[0].Block))
+
+			// The file grows onto the cluster after its end, which fails.
+			grow := first + 3
+			bd.badWrite[int64(fsys.clst2sect(grow))] = true
+			appendPat(t, fsys, "a.bin", 1, 3*clsz, 2*clsz)
+
+			// The data of its middle cluster is rewritten, partly, where it
+			// now fails: the rest of the cluster moves with it.
+			mid := first + 1
+			bd.badWrite[int64(fsys.clst2sect(mid))+int64(fsys.csize)-1] = true
+			want := make([]byte, 5*clsz)
+			for i := range want {
+				want[i] = pat(1, i)
+			}
+			var fp File
+			if err := fsys.OpenFile(&fp, "a.bin", ModeWrite); err != nil {
+				t.Fatal(err)
+			}
+			over := want[clsz+clsz/2 : 2*clsz+100]
+			for i := range over {
+				over[i] = pat(3, i)
+			}
+			if _, err := fp.WriteAt(over, int64(clsz+clsz/2)); err != nil {
+				t.Fatal(err)
+			} else if err = fp.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readAllFile(t, fsys, "a.bin"); string(got) != string(want) {
+				t.Error("a.bin content differs after remapping")
+			}
+			avoidClusters(t, fsys, "a.bin", grow, mid)
+			rep, err := fsys.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, rep)
+			if rep.BadClusters != 2 {
+				t.Errorf("check counts %d bad clusters, want 2", rep.BadClusters)
+			}
+
+			// Without RemapBadClusters a failing write fails.
+			fsys.Configure(FSConfig{})
+			ext = fileExtents(t, fsys, "a.bin")
+			bd.badWrite[ext[0].Block] = true
+			if err := fsys.OpenFile(&fp, "a.bin", ModeWrite); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fp.Write(want[:clsz]); err == nil {
+				t.Error("write to a bad sector succeeded without RemapBadClusters")
+			}
+			fp.Close()
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			var plain FS
+			if err := plain.Mount(dev, 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			if got := readAllFile(t, &plain, "a.bin"); string(got) != string(want) {
+				t.Error("a.bin content differs after remount")
+			}
+		})
+	}
+}
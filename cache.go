@@ -0,0 +1,233 @@
+package fat
+
+import "log/slog"
+
+// sectorCache is the optional write-back sector cache under the disk access
+// window, sized by [FSConfig.CacheFATSectors] and [FSConfig.CacheDirSectors].
+// move_window is served from it and sync_window writes into it instead of to
+// the device, so metadata sectors that a FAT chain walk and a directory scan
+// alternate between are read once and written once per sync.
+//
+// Slots are split in two pools so that walking a long FAT chain cannot evict
+// the directory sectors being scanned, nor the other way around: sectors of
+// the FAT region go to the FAT pool and every other sector going through the
+// window (directories, the exFAT allocation bitmap, boot sectors) to the
+// directory pool. Each pool is replaced least recently used first.
+//
+// Dirty sectors reach the device in the order they were last modified, which
+// is the order the single window would have written them: a FAT chain is
+// written before the directory entry that comes to point to it when a file
+// grows, and a directory entry is removed before its chain is freed. Evicting
+// a dirty slot first writes every slot modified before it.
+type sectorCache struct {
+	buf   []byte      // Slot data, len(FS.win) bytes per slot.
+	slots []cacheSlot // slots[:nfat] is the FAT pool, slots[nfat:] the directory pool.
+	nfat  int
+	tick  uint64 // LRU clock.
+	seq   uint64 // Modification order counter.
+}
+
+type cacheSlot struct {
+	sect  lba
+	used  uint64 // Tick of the last access. 0 if the slot is empty.
+	dirty uint64 // Sequence number of the last modification. 0 if clean.
+}
+
+// newSectorCache returns a cache with nfat FAT slots and ndir directory
+// slots, or nil if both are zero.
+func newSectorCache(nfat, ndir int) *sectorCache {
+	if nfat <= 0 && ndir <= 0 {
+		return nil
+	}
+	nfat = max(nfat, 0)
+	ndir = max(ndir, 0)
+	const ssize = len(FS{}.win)
+	return &sectorCache{
+		buf:   make([]byte, (nfat+ndir)*ssize),
+		slots: make([]cacheSlot, nfat+ndir),
+		nfat:  nfat,
+	}
+}
+
+func (c *sectorCache) data(i int) []byte {
+	const ssize = len(FS{}.win)
+	return c.buf[i*ssize : (i+1)*ssize]
+}
+
+// lookup returns the index of the slot holding sect, or -1.
+func (c *sectorCache) lookup(sect lba) int {
+	for i := range c.slots {
+		if c.slots[i].used != 0 && c.slots[i].sect == sect {
+			return i
+		}
+	}
+	return -1
+}
+
+// cache_pool returns the slot index range of the pool sect belongs to. With
+// one pool sized zero the other caches every sector.
+func (fsys *FS) cache_pool(sect lba) (start, end int) {
+	c := fsys.cache
+	isFAT := sect >= fsys.fatbase && sect-fsys.fatbase < lba(fsys.nFATs)*lba(fsys.fsize)
+	if isFAT && c.nfat > 0 || c.nfat == len(c.slots) {
+		return 0, c.nfat
+	}
+	return c.nfat, len(c.slots)
+}
+
+// cache_reset drops every slot without writing it. Called on mount.
+func (fsys *FS) cache_reset() {
+	if fsys.cache == nil {
+		return
+	}
+	clear(fsys.cache.slots)
+	fsys.cache.tick = 0
+	fsys.cache.seq = 0
+}
+
+// cache_read loads sector into the window from the cache, reading it from
+// the device and caching it on a miss.
+func (fsys *FS) cache_read(sector lba) diskresult {
+	c := fsys.cache
+	c.tick++
+	if i := c.lookup(sector); i >= 0 {
+		c.slots[i].used = c.tick
+		copy(fsys.win[:], c.data(i))
+		return drOK
+	}
+	dr := fsys.disk_read(fsys.win[:], sector, 1)
+	if dr != drOK {
+		return dr
+	}
+	i, fr := fsys.cache_alloc(sector)
+	if fr == frOK {
+		copy(c.data(i), fsys.win[:])
+	}
+	// A failed eviction leaves the sector uncached, the window is still valid.
+	return drOK
+}
+
+// cache_write stores the window into the cache as the latest modification
+// of winsect, in place of writing it to the device.
+func (fsys *FS) cache_write() fileResult {
+	c := fsys.cache
+	c.tick++
+	i := c.lookup(fsys.winsect)
+	if i < 0 {
+		var fr fileResult
+		i, fr = fsys.cache_alloc(fsys.winsect)
+		if fr != frOK {
+			return fr
+		}
+	}
+	c.seq++
+	c.slots[i].used = c.tick
+	c.slots[i].dirty = c.seq
+	copy(c.data(i), fsys.win[:])
+	return frOK
+}
+
+// cache_alloc claims the least recently used slot of the pool of sector for
+// it, writing back the slot's contents first if dirty.
+func (fsys *FS) cache_alloc(sector lba) (int, fileResult) {
+	c := fsys.cache
+	start, end := fsys.cache_pool(sector)
+	victim := start
+	for i := start; i < end; i++ {
+		if c.slots[i].used < c.slots[victim].used {
+			victim = i
+		}
+	}
+	if seq := c.slots[victim].dirty; seq != 0 {
+		fr := fsys.cache_flush(seq)
+		if fr != frOK {
+			return -1, fr
+		}
+	}
+	c.slots[victim] = cacheSlot{sect: sector, used: c.tick}
+	return victim, frOK
+}
+
+// cache_flush writes dirty slots modified up to sequence number upto to the
+// device in modification order, mirroring FAT sectors to the second FAT
+// like sync_window.
+func (fsys *FS) cache_flush(upto uint64) fileResult {
+	c := fsys.cache
+	if c == nil {
+		return frOK
+	} else if fsys.jnl.base != 0 {
+		return fsys.jnl_commit(upto)
+	}
+	for {
+		next := -1
+		for i := range c.slots {
+			seq := c.slots[i].dirty
+			if seq != 0 && seq <= upto && (next < 0 || seq < c.slots[next].dirty) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return frOK
+		}
+		sect := c.slots[next].sect
+		// disk_write marks the slot clean through cache_update.
+		ret := fsys.disk_write(c.data(next), sect, 1)
+		if ret != drOK {
+			fsys.logerror("cache_flush:dw", slog.Int("dret", int(ret)))
+			return ret.write_result()
+		}
+		if fsys.nFATs == 2 && sect-fsys.fatbase < lba(fsys.fsize) { // Is in 1st FAT?
+			fsys.disk_write(c.data(next), sect+lba(fsys.fsize), 1) // Redundancy write, ignore error.
+		}
+	}
+}
+
+// cache_seq returns the sequence number of the latest modification.
+func (fsys *FS) cache_seq() uint64 {
+	if fsys.cache == nil {
+		return 0
+	}
+	return fsys.cache.seq
+}
+
+// cache_update keeps cached copies of sectors written directly to the device
+// coherent: they take the written contents and become clean, superseding any
+// pending write-back.
+func (fsys *FS) cache_update(buf []byte, sector lba, numsectors int) {
+	c := fsys.cache
+	const ssize = len(FS{}.win)
+	for i := range c.slots {
+		s := &c.slots[i]
+		if s.used != 0 && s.sect >= sector && s.sect-sector < lba(numsectors) {
+			off := int(s.sect-sector) * ssize
+			copy(c.data(i), buf[off:off+ssize])
+			s.dirty = 0
+		}
+	}
+}
+
+// cache_overlay patches sectors read directly from the device with cached
+// modifications not yet written back.
+func (fsys *FS) cache_overlay(dst []byte, sector lba, numsectors int) {
+	c := fsys.cache
+	const ssize = len(FS{}.win)
+	for i := range c.slots {
+		s := &c.slots[i]
+		if s.dirty != 0 && s.sect >= sector && s.sect-sector < lba(numsectors) {
+			off := int(s.sect-sector) * ssize
+			copy(dst[off:off+ssize], c.data(i))
+		}
+	}
+}
+
+// cache_discard drops cached copies of erased sectors, including pending
+// write-backs the erase supersedes.
+func (fsys *FS) cache_discard(sector lba, numsectors int) {
+	c := fsys.cache
+	for i := range c.slots {
+		s := &c.slots[i]
+		if s.used != 0 && s.sect >= sector && s.sect-sector < lba(numsectors) {
+			*s = cacheSlot{}
+		}
+	}
+}
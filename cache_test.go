@@ -0,0 +1,239 @@
+package fat
+
+import (
+	"testing"
+)
+
+// countingDevice wraps a BlockDevice and counts the sectors read and written
+// and the calls doing so, recording the order in which sectors are written.
+type countingDevice struct {
+	BlockDeviceExtended
+	reads, writes         int
+	readCalls, writeCalls int
+	log                   []int64 // Written sectors, in order.
+}
+
+func (cd *countingDevice) ReadBlocks(dst []byte, start int64) (int, error) {
+	cd.reads += len(dst) / cd.BlockSize()
+	cd.readCalls++
+	return cd.BlockDeviceExtended.ReadBlocks(dst, start)
+}
+
+func (cd *countingDevice) WriteBlocks(data []byte, start int64) (int, error) {
+	n := len(data) / cd.BlockSize()
+	cd.writes += n
+	cd.writeCalls++
+	for i := int64(0); i < int64(n); i++ {
+		cd.log = append(cd.log, start+i)
+	}
+	return cd.BlockDeviceExtended.WriteBlocks(data, start)
+}
+
+// lastWrite returns the index in the write log of the last write to sector,
+// or -1.
+func (cd *countingDevice) lastWrite(sector int64) int {
+	for i := len(cd.log) - 1; i >= 0; i-- {
+		if cd.log[i] == sector {
+			return i
+		}
+	}
+	return -1
+}
+
+// TestCacheGoldenTorture runs the golden torture scripts with the sector
+// cache enabled: caching changes when sectors are written, never what ends
+// up on the device.
+func TestCacheGoldenTorture(t *testing.T) {
+	skipIfNoLFN(t)
+	for _, test := range []struct {
+		baseline, torture string
+		exfat             bool
+		script            func(*testing.T, *FS)
+	}{
+		{"golden-fmt16.img", "golden-torture16.img", false, tortureScriptSmall},
+		{"golden-fmt32.img", "golden-torture32.img", false, tortureScript32},
+		{"golden-fmtex.img", "golden-tortureex.img", true, func(t *testing.T, fsys *FS) {
+			tortureScript32(t, fsys)
+			tortureScriptExFAT(t, fsys)
+		}},
+	} {
+		t.Run(test.torture, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			dev := goldenDevice(t, test.baseline)
+			var fsys FS
+			// Small pools so the scripts exercise eviction of dirty slots.
+			fsys.Configure(FSConfig{NoZeroFilling: true, CacheFATSectors: 2, CacheDirSectors: 3})
+			if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+				t.Fatal(err)
+			}
+			if fsys.cache == nil {
+				t.Fatal("cache not allocated on mount")
+			}
+			test.script(t, &fsys)
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			compareGolden(t, dev, test.torture)
+		})
+	}
+}
+
+// TestCacheReducesIO lists and modifies a directory whose entries span
+// several sectors while a FAT chain is followed, and requires the cache to
+// cut device reads and writes.
+func TestCacheReducesIO(t *testing.T) {
+	run := func(cfg FSConfig) (reads, writes int) {
+		fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+		if err := fsys.Mkdir("dir"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 40; i++ {
+			writeStr(t, fsys, "dir/f"+string(rune('a'+i%26))+string(rune('a'+i/26)), "x")
+		}
+		if err := fsys.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+		cd := &countingDevice{BlockDeviceExtended: dev}
+		fsys.Configure(cfg)
+		if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		var dp Dir
+		if err := fsys.OpenDir(&dp, "dir"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := dp.ForEachFile(func(*FileInfo) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+			var fp File
+			if err := fsys.OpenFile(&fp, "dir/new", ModeCreateNew|ModeWrite); err != nil {
+				t.Fatal(err)
+			}
+			if err := fp.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.Remove("dir/new"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return cd.reads, cd.writes
+	}
+	r0, w0 := run(FSConfig{})
+	r1, w1 := run(FSConfig{CacheFATSectors: 4, CacheDirSectors: 8})
+	t.Logf("uncached: %d reads %d writes; cached: %d reads %d writes", r0, w0, r1, w1)
+	if r1*2 > r0 {
+		t.Errorf("cached reads = %d, want at most half of %d", r1, r0)
+	}
+	if w1 > w0 {
+		t.Errorf("cached writes = %d, more than uncached %d", w1, w0)
+	}
+}
+
+// TestCacheWriteOrder checks write-back ordering: growing a file writes its
+// FAT chain before the directory entry pointing to it, and removing it
+// writes the directory entry before freeing the chain. Nothing is written
+// back before the filesystem is synced.
+func TestCacheWriteOrder(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	cd := &countingDevice{BlockDeviceExtended: dev}
+	fsys.Configure(FSConfig{CacheFATSectors: 4, CacheDirSectors: 4})
+	if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	fatSect := int64(fsys.fatbase)
+	dirSect := int64(fsys.dirbase)
+
+	var fp File
+	if err := fsys.OpenFile(&fp, "order.bin", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	cd.log = cd.log[:0]
+	writePat(t, &fp, 1, 0, 4*512)
+	if i := cd.lastWrite(fatSect); i >= 0 {
+		t.Error("FAT sector written back before sync")
+	}
+	if err := fp.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fat, dir := cd.lastWrite(fatSect), cd.lastWrite(dirSect)
+	if fat < 0 || dir < 0 || fat > dir {
+		t.Errorf("grow: FAT written at %d, directory at %d; want FAT first", fat, dir)
+	}
+	if cd.lastWrite(fatSect+int64(fsys.fsize)) < fat {
+		t.Error("second FAT not mirrored")
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cd.log = cd.log[:0]
+	if err := fsys.Remove("order.bin"); err != nil {
+		t.Fatal(err)
+	}
+	fat, dir = cd.lastWrite(fatSect), cd.lastWrite(dirSect)
+	if fat < 0 || dir < 0 || dir > fat {
+		t.Errorf("remove: FAT written at %d, directory at %d; want directory first", fat, dir)
+	}
+	var info FileInfo
+	if err := fsys.Stat("order.bin", &info); err == nil {
+		t.Error("removed file still present")
+	}
+}
+
+func BenchmarkDirListCached(b *testing.B) {
+	dev := DefaultFATByteBlocks(32000)
+	cd := &countingDevice{BlockDeviceExtended: dev}
+	var fsys FS
+	fsys.Configure(FSConfig{CacheFATSectors: 4, CacheDirSectors: 8})
+	if err := fsys.Mount(cd, dev.BlockSize(), ModeRW); err != nil {
+		b.Fatal(err)
+	}
+	var dp Dir
+	if err := fsys.OpenDir(&dp, "rootdir"); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	cd.reads = 0
+	for i := 0; i < b.N; i++ {
+		err := dp.ForEachFile(func(info *FileInfo) error { return nil })
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(cd.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkCreateRemoveCached(b *testing.B) {
+	dev := DefaultFATByteBlocks(32000)
+	cd := &countingDevice{BlockDeviceExtended: dev}
+	var fsys FS
+	fsys.Configure(FSConfig{CacheFATSectors: 4, CacheDirSectors: 8})
+	if err := fsys.Mount(cd, dev.BlockSize(), ModeRW); err != nil {
+		b.Fatal(err)
+	}
+	var fp File
+	b.ReportAllocs()
+	b.ResetTimer()
+	cd.reads, cd.writes = 0, 0
+	for i := 0; i < b.N; i++ {
+		if err := fsys.OpenFile(&fp, "gone.bin", ModeCreateNew|ModeWrite); err != nil {
+			b.Fatal(err)
+		}
+		if err := fp.Close(); err != nil {
+			b.Fatal(err)
+		}
+		if err := fsys.Remove("gone.bin"); err != nil {
+			b.Fatal(err)
+		}
+		cd.log = cd.log[:0]
+	}
+	b.ReportMetric(float64(cd.reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(cd.writes)/float64(b.N), "writes/op")
+}
@@ -0,0 +1,822 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strconv"
+	"unicode/utf16"
+)
+
+// ProblemKind classifies a [Problem] found by [FS.Check].
+type ProblemKind uint8
+
+const (
+	_ ProblemKind = iota
+	// ProblemLostChain is a run of clusters allocated on the FAT, or on the
+	// exFAT allocation bitmap, that no file or directory holds. Cluster is
+	// its first cluster and Count its length.
+	ProblemLostChain
+	// ProblemCrossLinked is a cluster held by two chains, Path's and Other's,
+	// or held twice by Path's chain, which then loops.
+	ProblemCrossLinked
+	// ProblemChainShort is a file whose cluster chain holds fewer clusters,
+	// Got, than its size needs, Want.
+	ProblemChainShort
+	// ProblemChainLong is a file whose cluster chain holds more clusters,
+	// Got, than its size needs, Want.
+	ProblemChainLong
+	// ProblemBadCluster is a chain linking to a free, reserved or out of range
+	// cluster, Got. Cluster is the last cluster of the chain before the bad
+	// link, 0 if it is the first cluster in the directory entry.
+	ProblemBadCluster
+	// ProblemOrphanLFN is a run of Count long file name entries of directory
+	// Path not followed by the short name entry they belong to.
+	ProblemOrphanLFN
+	// ProblemLFNChecksum is a run of Count long file name entries whose short
+	// name checksum, Got, is not that of the short name entry of Path
+	// following them, Want.
+	ProblemLFNChecksum
+	// ProblemBadDot is a "." or ".." entry of directory Path missing or not
+	// pointing to the directory or its parent: Got is the cluster in the
+	// entry, -1 if missing, and Want the cluster expected.
+	ProblemBadDot
+	// ProblemFATMismatch is a run of Count sectors of the first FAT, from
+	// Block, that differ from the second FAT.
+	ProblemFATMismatch
+	// ProblemFreeCount is the free cluster count of the FAT32 FSInfo sector,
+	// Got, differing from the clusters free on the FAT, Want.
+	ProblemFreeCount
+	// ProblemBadEntrySet is an exFAT directory entry set with a checksum,
+	// Got, not that of its entries, Want, or not well formed.
+	ProblemBadEntrySet
+	// ProblemBitmap is a run of Count clusters from Cluster held by files or
+	// directories but free on the exFAT allocation bitmap.
+	ProblemBitmap
+	// ProblemUpcaseChecksum is an exFAT up-case table whose checksum, Got,
+	// differs from that recorded in its directory entry, Want.
+	ProblemUpcaseChecksum
+)
+
+var problemKindNames = [...]string{
+	ProblemLostChain:      "lost chain",
+	ProblemCrossLinked:    "cross-linked cluster",
+	ProblemChainShort:     "chain shorter than file size",
+	ProblemChainLong:      "chain longer than file size",
+	ProblemBadCluster:     "bad cluster link",
+	ProblemOrphanLFN:      "orphaned LFN entries",
+	ProblemLFNChecksum:    "LFN checksum mismatch",
+	ProblemBadDot:         "bad dot entry",
+	ProblemFATMismatch:    "FAT copies differ",
+	ProblemFreeCount:      "wrong FSInfo free count",
+	ProblemBadEntrySet:    "bad exFAT entry set",
+	ProblemBitmap:         "allocation bitmap mismatch",
+	ProblemUpcaseChecksum: "up-case table checksum mismatch",
+}
+
+func (k ProblemKind) String() string {
+	if k == 0 || int(k) >= len(problemKindNames) {
+		return "unknown problem"
+	}
+	return problemKindNames[k]
+}
+
+// Problem is an inconsistency of the volume found by [FS.Check]. The fields
+// that apply depend on Kind, see [ProblemKind]; the others are zero.
+type Problem struct {
+	Kind ProblemKind
+	// Path is the file or directory concerned, "/" for the root directory.
+	Path string
+	// Other is the other file or directory holding the cluster of a cross-link.
+	Other string
+	// Cluster is the cluster concerned.
+	Cluster uint32
+	// Count is the number of clusters, sectors or entries concerned.
+	Count uint32
+	// Block and Offset locate the directory entry concerned, the first of
+	// its entry set or LFN run: Block is its device block and Offset its
+	// byte offset in the block. Block is also the first FAT sector of a
+	// FAT mismatch and the FSInfo sector of a free count.
+	Block  int64
+	Offset int
+	// Got is the value found on the volume and Want the value expected.
+	Got, Want int64
+	// Fixed reports whether [FS.Repair] fixed the problem.
+	Fixed bool
+}
+
+func (p Problem) String() string {
+	return string(p.AppendTo(nil))
+}
+
+// AppendTo appends a one line description of p to dst.
+func (p Problem) AppendTo(dst []byte) []byte {
+	dst = append(dst, p.Kind.String()...)
+	if p.Path != "" {
+		dst = append(dst, ' ')
+		dst = append(dst, p.Path...)
+	}
+	if p.Other != "" {
+		dst = append(dst, " and "...)
+		dst = append(dst, p.Other...)
+	}
+	appendField := func(name string, v int64) {
+		dst = append(dst, ' ')
+		dst = append(dst, name...)
+		dst = append(dst, '=')
+		dst = strconv.AppendInt(dst, v, 10)
+	}
+	if p.Cluster != 0 {
+		appendField("cluster", int64(p.Cluster))
+	}
+	if p.Count != 0 {
+		appendField("count", int64(p.Count))
+	}
+	if p.Block != 0 {
+		appendField("block", p.Block)
+		appendField("offset", int64(p.Offset))
+	}
+	if p.Got != 0 || p.Want != 0 {
+		appendField("got", p.Got)
+		appendField("want", p.Want)
+	}
+	if p.Fixed {
+		dst = append(dst, " (fixed)"...)
+	}
+	return dst
+}
+
+// CheckReport is the result of [FS.Check].
+type CheckReport struct {
+	Problems []Problem
+	// Files and Dirs count the files and directories found, the root excluded.
+	Files, Dirs int
+	// UsedClusters counts the clusters held by files and directories, and the
+	// exFAT allocation bitmap and up-case table. FreeClusters counts those
+	// free on the FAT, or on the exFAT allocation bitmap.
+	UsedClusters, FreeClusters uint32
+	// BadClusters counts the clusters marked bad on the FAT, see
+	// [FS.ScanSurface].
+	BadClusters uint32
+}
+
+// OK reports whether the check found no problem.
+func (r *CheckReport) OK() bool { return len(r.Problems) == 0 }
+
+// Check verifies the consistency of the mounted volume without modifying it,
+// as dosfsck -n and fsck.exfat -n do, and returns the problems found, which
+// [FS.Repair] fixes. It follows the cluster chain of every file and
+// directory, checking it against the file size and against the others, and
+// the directory entries along the way; compares the FAT copies, FAT32's
+// FSInfo free count, and on exFAT the allocation bitmap and the up-case table
+// checksum.
+//
+// Writes pending on a volume mounted for writing are flushed first, so that
+// the volume is checked as it stands on the device. Open files should not be
+// written meanwhile. Check keeps a word of memory per cluster of the volume.
+// The error is only non-nil if the volume could not be read.
+func (fsys *FS) Check() (_ *CheckReport, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	defer fsys.wrapErr(&err, "check", "/")
+	if fsys.fstype == _FormatUnknown {
+		return nil, frNotEnabled
+	}
+	if fsys.perm&ModeWrite != 0 {
+		if fr := fsys.sync(); fr != frOK {
+			return nil, fr
+		}
+	}
+	c := newChecker(fsys, nil)
+	if fr := c.run(); fr != frOK {
+		return nil, fr
+	}
+	return c.rep, nil
+}
+
+// checker is the state of a Check, or of a pass of a Repair.
+type checker struct {
+	fsys  *FS
+	rep   *CheckReport
+	fix   *RepairConfig // Non-nil to fix the problems found.
+	found []Problem     // Lost chains to recover.
+	owner []uint32      // Per cluster, 1 + the index in paths of the object holding it, 0 if none, or ownLost or ownLinked.
+	paths []string
+	queue []checkDir // Directories found and not yet checked.
+	sect  [512]byte  // Directory sector being checked, out of the window that chain walks move.
+
+	// Run of LFN entries being read on FAT.
+	lfnN     int   // Entries in the run, 0 if none.
+	lfnOrd   byte  // Order of the last entry of the run.
+	lfnSum   byte  // SFN checksum of the run.
+	lfnBlock int64 // Location of the first entry of the run, as Problem's.
+	lfnOfs   int
+	lfnName  []uint16 // Name of the run, as read so far.
+	lfnLocs  []entLoc // Locations of the entries of the run.
+
+	x xcheck // exFAT state.
+}
+
+// checkDir is a directory found by Check, or a file being checked.
+type checkDir struct {
+	path   string
+	sclust uint32   // Start cluster, 0 for the FAT12/16 root directory.
+	parent uint32   // Start cluster of the parent, 0 for the root directory.
+	size   int64    // exFAT directory size.
+	contig bool     // exFAT directory without FAT chain.
+	dir    bool     // Directory, not file.
+	fix    bool     // Repairs may change its chain, not that of volume metadata.
+	cls    []uint32 // Clusters of the directory, as far as its chain is sound.
+}
+
+// entLoc locates a directory entry: its sector and byte offset in it.
+type entLoc struct {
+	sect lba
+	ofs  int
+}
+
+// Owner values of the clusters of lost chains, allocated and held by no
+// object, set by check_fat.
+const (
+	ownLinked = ^uint32(0) - 1 // Linked from another lost cluster.
+	ownLost   = ^uint32(0)     // Not linked from another lost cluster, as far as known.
+)
+
+func newChecker(fsys *FS, fix *RepairConfig) checker {
+	return checker{fsys: fsys, rep: &CheckReport{}, owner: make([]uint32, fsys.n_fatent), fix: fix}
+}
+
+func (c *checker) report(p Problem) { c.rep.Problems = append(c.rep.Problems, p) }
+
+// run checks the volume.
+func (c *checker) run() fileResult {
+	fsys := c.fsys
+	root := checkDir{path: "/", dir: true, fix: true}
+	if fsys.fstype == FormatFAT32 || fsys.isExfat() {
+		root.sclust = uint32(fsys.dirbase)
+		_, cls, _, fr := c.chain(c.object("/"), &root, 0, 0, true)
+		if fr != frOK {
+			return fr
+		}
+		root.cls = cls
+	}
+	c.queue = append(c.queue, root)
+	for len(c.queue) > 0 {
+		d := c.queue[0]
+		c.queue = c.queue[1:]
+		if fr := c.check_dir(&d); fr != frOK {
+			return fr
+		}
+	}
+	var fr fileResult
+	if fsys.isExfat() {
+		fr = c.check_exfat()
+	} else {
+		fr = c.check_fat()
+	}
+	if fr != frOK {
+		return fr
+	}
+	if c.fix != nil {
+		fsys.free_clst = c.rep.FreeClusters
+	}
+	return c.check_fsinfo()
+}
+
+// object registers an object holding clusters and returns its owner value.
+func (c *checker) object(path string) uint32 {
+	c.paths = append(c.paths, path)
+	return uint32(len(c.paths))
+}
+
+// eoc reports whether FAT value v, as returned by clusterstat, marks the end
+// of a chain.
+func (c *checker) eoc(v uint32) bool {
+	switch c.fsys.fstype {
+	case FormatFAT12:
+		return v >= 0xFF8
+	case FormatFAT16:
+		return v >= 0xFFF8
+	case FormatFAT32:
+		return v >= 0x0FFF_FFF8
+	}
+	return v >= 0x7FFF_FFF8 // exFAT, as masked by clusterstat.
+}
+
+// bad reports whether FAT value v marks a bad cluster.
+func (c *checker) bad(v uint32) bool {
+	switch c.fsys.fstype {
+	case FormatFAT12:
+		return v == 0xFF7
+	case FormatFAT16:
+		return v == 0xFFF7
+	case FormatFAT32:
+		return v == 0x0FFF_FFF7
+	}
+	return v == 0x7FFF_FFF7
+}
+
+// chain follows the cluster chain of object obj starting at d.sclust,
+// marking its clusters as held by obj. The chain of a contig directory or
+// file is of contiguous clusters, as many as d.size needs, without FAT
+// chain. Problems with the chain are reported with the location of the
+// directory entry, block and ofs. It returns the number of clusters held, the
+// clusters themselves if list is set, and ok false if the chain is broken.
+// When repairing, a broken chain is cut short, or for a cross-link on FAT
+// continued on copies of the clusters of the other chain, and ok is true.
+func (c *checker) chain(obj uint32, d *checkDir, block int64, ofs int, list bool) (n int64, cls []uint32, ok bool, fr fileResult) {
+	fsys := c.fsys
+	clsz := int64(fsys.csize) * int64(fsys.ssize)
+	ncont := (d.size + clsz - 1) / clsz
+	var prev uint32
+	cl := d.sclust
+	for ; !d.contig || n < ncont; n++ {
+		if d.contig {
+			cl = d.sclust + uint32(n)
+		}
+		if cl < 2 || cl >= fsys.n_fatent {
+			p := Problem{Kind: ProblemBadCluster, Path: d.path, Cluster: prev, Block: block, Offset: ofs, Got: int64(cl)}
+			if c.fix != nil {
+				p.Fixed, fr = c.cut(d, prev, block, ofs)
+			}
+			c.report(p)
+			return n, cls, p.Fixed, fr
+		}
+		if own := c.owner[cl]; own != 0 {
+			p := Problem{Kind: ProblemCrossLinked, Path: d.path, Other: c.paths[own-1], Cluster: cl, Block: block, Offset: ofs}
+			if c.fix != nil && own != obj && !fsys.isExfat() {
+				n, cls, p.Fixed, fr = c.copy_tail(obj, d, n, cls, list, prev, cl, block, ofs)
+			} else if c.fix != nil {
+				p.Fixed, fr = c.cut(d, prev, block, ofs)
+			}
+			c.report(p)
+			return n, cls, p.Fixed, fr
+		}
+		c.owner[cl] = obj
+		c.rep.UsedClusters++
+		if list {
+			cls = append(cls, cl)
+		}
+		prev = cl
+		if d.contig {
+			continue
+		}
+		next := (&objid{fs: fsys}).clusterstat(cl)
+		if next == badCluster {
+			return n, cls, false, frDiskErr
+		} else if c.eoc(next) {
+			return n + 1, cls, true, frOK
+		} else if next < 2 || next >= fsys.n_fatent {
+			p := Problem{Kind: ProblemBadCluster, Path: d.path, Cluster: cl, Block: block, Offset: ofs, Got: int64(next)}
+			if c.fix != nil {
+				p.Fixed, fr = c.cut(d, cl, block, ofs)
+			}
+			c.report(p)
+			return n + 1, cls, p.Fixed, fr
+		}
+		cl = next
+	}
+	return n, cls, true, frOK
+}
+
+// check_file follows the chain of the file or directory d found in a
+// directory entry at block and ofs, checking it against its size, and queues
+// a directory to be checked. A FAT directory has no size to check.
+func (c *checker) check_file(d checkDir, isDir bool, block int64, ofs int) fileResult {
+	fsys := c.fsys
+	if isDir {
+		c.rep.Dirs++
+	} else {
+		c.rep.Files++
+	}
+	clsz := int64(fsys.csize) * int64(fsys.ssize)
+	want := (d.size + clsz - 1) / clsz
+	var got int64
+	obj := c.object(d.path)
+	if d.sclust != 0 {
+		n, cls, ok, fr := c.chain(obj, &d, block, ofs, isDir)
+		if fr != frOK || !ok {
+			return fr
+		}
+		got, d.cls = n, cls
+	}
+	if !isDir || fsys.isExfat() {
+		var fr fileResult
+		if got < want {
+			p := Problem{Kind: ProblemChainShort, Path: d.path, Cluster: d.sclust, Block: block, Offset: ofs, Got: got, Want: want}
+			if c.fix != nil {
+				d.size = got * clsz // Down to what the chain holds.
+				p.Fixed, fr = c.rewrite(&d, block, ofs)
+			}
+			c.report(p)
+		} else if got > want {
+			p := Problem{Kind: ProblemChainLong, Path: d.path, Cluster: d.sclust, Block: block, Offset: ofs, Got: got, Want: want}
+			if c.fix != nil {
+				p.Fixed, fr = c.trim(obj, &d, want, block, ofs)
+			}
+			c.report(p)
+		}
+		if fr != frOK {
+			return fr
+		}
+	}
+	if isDir && d.sclust != 0 {
+		c.queue = append(c.queue, d)
+	} else if isDir && !fsys.isExfat() {
+		// A directory without clusters has no entries, not even dots.
+		c.report(Problem{Kind: ProblemBadDot, Path: d.path, Block: block, Offset: ofs, Got: -1, Want: 0})
+	}
+	return frOK
+}
+
+// check_dir checks the entries of directory d, queueing its subdirectories.
+func (c *checker) check_dir(d *checkDir) fileResult {
+	fsys := c.fsys
+	ss := int(fsys.ssize)
+	var sects []lba // Sectors of the directory, in order.
+	if d.sclust == 0 {
+		for i := 0; i < int(fsys.nrootdir)*sizeDirEntry/ss; i++ {
+			sects = append(sects, fsys.dirbase+lba(i))
+		}
+	}
+	for _, cl := range d.cls {
+		for i := lba(0); i < lba(fsys.csize); i++ {
+			sects = append(sects, fsys.clst2sect(cl)+i)
+		}
+	}
+	c.lfnN = 0
+	c.x.reset()
+	idx := 0 // Entry index in the directory.
+	for _, sect := range sects {
+		if fsys.move_window(sect) != frOK {
+			return frDiskErr
+		}
+		copy(c.sect[:], fsys.win[:])
+		for ofs := 0; ofs < ss; ofs += sizeDirEntry {
+			ent := c.sect[ofs : ofs+sizeDirEntry]
+			var end bool
+			var fr fileResult
+			if fsys.isExfat() {
+				end, fr = c.xdir_entry(d, ent, int64(sect), ofs)
+			} else {
+				end, fr = c.dir_entry(d, idx, ent, int64(sect), ofs)
+			}
+			if fr != frOK {
+				return fr
+			} else if end {
+				return c.dir_end(d)
+			}
+			idx++
+		}
+	}
+	return c.dir_end(d)
+}
+
+// dir_end completes the check of a directory at its end.
+func (c *checker) dir_end(d *checkDir) fileResult {
+	if c.lfnN > 0 {
+		if fr := c.orphan_lfn(d); fr != frOK {
+			return fr
+		}
+	}
+	c.x.dir_end(c, d)
+	return frOK
+}
+
+// orphan_lfn reports the LFN run being read in directory d as orphaned,
+// deleting its entries when repairing.
+func (c *checker) orphan_lfn(d *checkDir) (fr fileResult) {
+	p := Problem{Kind: ProblemOrphanLFN, Path: d.path, Count: uint32(c.lfnN), Block: c.lfnBlock, Offset: c.lfnOfs}
+	if c.fix != nil {
+		p.Fixed, fr = c.delete_entries(c.lfnLocs)
+	}
+	c.report(p)
+	c.lfnN = 0
+	return fr
+}
+
+// orphan_one reports the LFN entry at block and ofs of directory d as
+// orphaned, deleting it when repairing, unless fr is an error to return.
+func (c *checker) orphan_one(d *checkDir, block int64, ofs int, fr fileResult) fileResult {
+	if fr != frOK {
+		return fr
+	}
+	p := Problem{Kind: ProblemOrphanLFN, Path: d.path, Count: 1, Block: block, Offset: ofs}
+	if c.fix != nil {
+		p.Fixed, fr = c.delete_entries([]entLoc{{lba(block), ofs}})
+	}
+	c.report(p)
+	return fr
+}
+
+// dir_entry checks the FAT directory entry ent, the idx-th of directory d.
+// It reports end at the end of the directory.
+func (c *checker) dir_entry(d *checkDir, idx int, ent []byte, block int64, ofs int) (end bool, fr fileResult) {
+	fsys := c.fsys
+	orphan := func() {
+		if c.lfnN > 0 {
+			fr = c.orphan_lfn(d)
+		}
+	}
+	if d.path != "/" && idx < 2 {
+		return false, c.check_dot(d, idx, ent, block, ofs)
+	}
+	c0, attr := ent[dirNameOff], ent[dirAttrOff]&amMASK
+	switch {
+	case c0 == 0:
+		return true, frOK
+	case c0 == mskDDEM:
+		orphan()
+		return false, fr
+	case attr == amLFN:
+		ord := ent[ldirOrdOff]
+		if ord&mskLLEF != 0 {
+			orphan()
+			n := int(ord&^mskLLEF) * 13
+			if fr != frOK || ord&^mskLLEF == 0 || n > 20*13 {
+				return false, c.orphan_one(d, block, ofs, fr)
+			}
+			c.lfnN, c.lfnOrd, c.lfnSum = 1, ord&^mskLLEF, ent[ldirChksumOff]
+			c.lfnBlock, c.lfnOfs = block, ofs
+			c.lfnName = append(c.lfnName[:0], make([]uint16, n)...)
+			c.lfnLocs = append(c.lfnLocs[:0], entLoc{lba(block), ofs})
+		} else if c.lfnN > 0 && ord == c.lfnOrd-1 && ent[ldirChksumOff] == c.lfnSum {
+			c.lfnN++
+			c.lfnOrd = ord
+			c.lfnLocs = append(c.lfnLocs, entLoc{lba(block), ofs})
+		} else {
+			orphan()
+			return false, c.orphan_one(d, block, ofs, fr)
+		}
+		base := int(c.lfnOrd-1) * 13
+		for i, off := range lfnOffsets {
+			c.lfnName[base+i] = binary.LittleEndian.Uint16(ent[off:])
+		}
+		return false, frOK
+	case attr&amVOL != 0:
+		orphan() // Volume label, not a file.
+		return false, fr
+	case c0 == '.':
+		orphan() // Dot entry out of place, not followed.
+		return false, fr
+	}
+	name := sfn_string(ent)
+	if c.lfnN > 0 {
+		if c.lfnOrd != 1 {
+			orphan() // Run cut short.
+		} else if sum := sum_sfn(ent); sum != c.lfnSum {
+			p := Problem{Kind: ProblemLFNChecksum, Path: join_path(d.path, name), Count: uint32(c.lfnN), Block: c.lfnBlock, Offset: c.lfnOfs, Got: int64(c.lfnSum), Want: int64(sum)}
+			if c.fix != nil {
+				p.Fixed, fr = c.delete_entries(c.lfnLocs) // The short name stands alone.
+			}
+			c.report(p)
+			c.lfnN = 0
+		} else {
+			name = lfn_string(c.lfnName)
+			c.lfnN = 0
+		}
+		if fr != frOK {
+			return false, fr
+		}
+	}
+	sub := checkDir{
+		path:   join_path(d.path, name),
+		sclust: fsys.ld_clust(ent),
+		parent: d.sclust,
+		size:   int64(binary.LittleEndian.Uint32(ent[dirFileSizeOff:])),
+	}
+	if sub.parent == uint32(fsys.dirbase) {
+		sub.parent = 0 // ".." of a FAT32 root subdirectory holds 0.
+	}
+	isDir := attr&amDIR != 0
+	if isDir {
+		sub.size = 0
+	}
+	sub.dir, sub.fix = isDir, true
+	return false, c.check_file(sub, isDir, block, ofs)
+}
+
+// check_dot checks the idx-th entry of subdirectory d, "." for idx 0 and ".."
+// for 1. A dot entry pointing elsewhere is repaired, a missing one is not.
+func (c *checker) check_dot(d *checkDir, idx int, ent []byte, block int64, ofs int) (fr fileResult) {
+	name := ".          "
+	want := d.sclust
+	if idx == 1 {
+		name, want = "..         ", d.parent
+	}
+	got := int64(-1)
+	if string(ent[dirNameOff:dirNameOff+11]) == name && ent[dirAttrOff]&amDIR != 0 {
+		got = int64(c.fsys.ld_clust(ent))
+	}
+	if got != int64(want) {
+		p := Problem{Kind: ProblemBadDot, Path: d.path, Block: block, Offset: ofs, Got: got, Want: int64(want)}
+		if c.fix != nil && got >= 0 {
+			if fr = c.fsys.move_window(lba(block)); fr == frOK {
+				c.fsys.st_clust(c.fsys.win[ofs:], want)
+				c.fsys.wflag = 1
+				p.Fixed = true
+			}
+		}
+		c.report(p)
+	}
+	return fr
+}
+
+// check_fat scans the FAT for lost chains and the free cluster count, and
+// compares the FAT copies.
+func (c *checker) check_fat() fileResult {
+	fsys := c.fsys
+	obj := objid{fs: fsys}
+	for cl := uint32(2); cl < fsys.n_fatent; cl++ {
+		v := obj.clusterstat(cl)
+		switch {
+		case v == badCluster:
+			return frDiskErr
+		case v == 0:
+			c.rep.FreeClusters++
+		case c.owner[cl] == 0 && c.bad(v):
+			c.rep.BadClusters++
+		case c.owner[cl] == 0:
+			c.owner[cl] = ownLost
+		}
+	}
+	if fr := c.lost(); fr != frOK {
+		return fr
+	}
+	if fsys.nFATs != 2 {
+		return frOK
+	}
+	if c.fix != nil {
+		if fr := fsys.sync(); fr != frOK { // Compare the FATs as repaired.
+			return fr
+		}
+	}
+	var fat2 [512]byte
+	ss := lba(fsys.ssize)
+	var run Problem
+	for i := lba(0); i < lba(fsys.fsize); i++ {
+		if fsys.disk_read(c.sect[:ss], fsys.fatbase+i, 1) != drOK ||
+			fsys.disk_read(fat2[:ss], fsys.fatbase+lba(fsys.fsize)+i, 1) != drOK {
+			return frDiskErr
+		}
+		if string(c.sect[:ss]) == string(fat2[:ss]) {
+			continue
+		}
+		if c.fix != nil {
+			// Write the sector back through the window, which mirrors it.
+			if fr := fsys.move_window(fsys.fatbase + i); fr != frOK {
+				return fr
+			}
+			fsys.wflag = 1
+		}
+		if run.Count > 0 && run.Block+int64(run.Count) == int64(fsys.fatbase+i) {
+			run.Count++
+			continue
+		} else if run.Count > 0 {
+			c.report(run)
+		}
+		run = Problem{Kind: ProblemFATMismatch, Block: int64(fsys.fatbase + i), Count: 1, Fixed: c.fix != nil}
+	}
+	if run.Count > 0 {
+		c.report(run)
+	}
+	return frOK
+}
+
+// lost reports the lost chains, of the clusters check_fat marked ownLost.
+// Their links are read again from the FAT rather than kept, and each is
+// given owner 0 once its chain is reported. When repairing, lost chains are
+// freed, or ended to be recovered.
+func (c *checker) lost() fileResult {
+	obj := objid{fs: c.fsys}
+	n := uint32(len(c.owner))
+	for cl := uint32(2); cl < n; cl++ {
+		if c.owner[cl] >= ownLinked {
+			v := obj.clusterstat(cl)
+			if v == badCluster {
+				return frDiskErr
+			} else if c.lost_clust(v) {
+				c.owner[v] = ownLinked
+			}
+		}
+	}
+	follow := func(head uint32) fileResult {
+		p := Problem{Kind: ProblemLostChain, Cluster: head}
+		var fr fileResult
+		for cl := head; c.lost_clust(cl); {
+			p.Count++
+			nx := obj.clusterstat(cl)
+			if nx == badCluster {
+				return frDiskErr
+			}
+			c.owner[cl] = 0
+			switch {
+			case c.fix == nil:
+			case !c.fix.RecoverLost:
+				fr = c.fsys.put_clusterstat(cl, 0)
+				c.rep.FreeClusters++
+			case !c.lost_clust(nx):
+				fr = c.fsys.put_clusterstat(cl, 0xFFFF_FFFF) // End the chain where it leaves the lost clusters.
+			}
+			if fr != frOK {
+				return fr
+			}
+			cl = nx
+		}
+		c.found_chain(&p)
+		return frOK
+	}
+	for cl := uint32(2); cl < n; cl++ {
+		if c.owner[cl] == ownLost {
+			if fr := follow(cl); fr != frOK {
+				return fr
+			}
+		}
+	}
+	for cl := uint32(2); cl < n; cl++ {
+		if c.owner[cl] == ownLinked {
+			if fr := follow(cl); fr != frOK { // A loop without head.
+				return fr
+			}
+		}
+	}
+	return frOK
+}
+
+// lost_clust reports whether cl is a cluster of a lost chain not yet
+// reported.
+func (c *checker) lost_clust(cl uint32) bool {
+	return cl >= 2 && cl < uint32(len(c.owner)) && c.owner[cl] >= ownLinked
+}
+
+// found_chain reports the lost chain p, queueing it for recovery when
+// repairing so.
+func (c *checker) found_chain(p *Problem) {
+	if c.fix != nil {
+		p.Fixed = true
+		if c.fix.RecoverLost {
+			c.found = append(c.found, *p)
+		}
+	}
+	c.report(*p)
+}
+
+// check_fsinfo checks the free cluster count of the FAT32 FSInfo sector.
+func (c *checker) check_fsinfo() fileResult {
+	fsys := c.fsys
+	if fsys.fstype != FormatFAT32 || fsys.fsi_flag&0x80 != 0 {
+		return frOK // No FSInfo.
+	}
+	if fsys.move_window(fsys.volbase+1) != frOK {
+		return frDiskErr
+	}
+	if fsys.window_u16(bs55AA) != 0xaa55 || fsys.window_u32(fsiLeadSig) != 0x41615252 ||
+		fsys.window_u32(fsiStrucSig) != 0x61417272 {
+		return frOK
+	}
+	if free := fsys.window_u32(fsiFree_Count); free != 0xffff_ffff && free != c.rep.FreeClusters {
+		p := Problem{Kind: ProblemFreeCount, Block: int64(fsys.volbase + 1), Got: int64(free), Want: int64(c.rep.FreeClusters)}
+		if c.fix != nil {
+			fsys.fsi_flag = 1 // Rewritten on sync.
+			p.Fixed = true
+		}
+		c.report(p)
+	}
+	return frOK
+}
+
+// sfn_string returns the short name of entry ent as NAME.EXT.
+func sfn_string(ent []byte) string {
+	var buf [12]byte
+	n := 0
+	for i := 0; i < 11; i++ {
+		ch := ent[dirNameOff+i]
+		if ch == ' ' {
+			continue
+		} else if i == 0 && ch == mskRDDEM {
+			ch = mskDDEM
+		}
+		if i == 8 && n > 0 && buf[n-1] != '.' {
+			buf[n] = '.'
+			n++
+		}
+		buf[n] = ch
+		n++
+	}
+	return string(buf[:n])
+}
+
+// lfn_string returns the null or 0xFFFF padded UTF-16 name lfn as a string.
+func lfn_string(lfn []uint16) string {
+	n := 0
+	for n < len(lfn) && lfn[n] != 0 && lfn[n] != 0xffff {
+		n++
+	}
+	return string(utf16.Decode(lfn[:n]))
+}
+
+// join_path returns the path of name in directory dir.
+func join_path(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
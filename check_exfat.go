@@ -0,0 +1,257 @@
+//go:build !fat_noexfat && !fat_nolfn
+
+package fat
+
+import "encoding/binary"
+
+// xcheck is the exFAT state of a Check.
+type xcheck struct {
+	set     [19 * sizeDirEntry]byte // Entry set being read.
+	n, need int                     // Entries of set read and in the set, need 0 if none.
+	block   int64                   // Location of the file entry of set.
+	ofs     int
+	locs    [19]entLoc // Locations of the entries of set.
+	upSum   uint32     // Up-case table checksum recorded in its entry.
+	upLoc   entLoc     // Location of the up-case table entry.
+	upSize  int64      // Up-case table size.
+	upCls   []uint32   // Up-case table clusters, nil if not found.
+}
+
+func (x *xcheck) reset() { x.need = 0 }
+
+// dir_end reports an entry set cut short by the end of directory d.
+func (x *xcheck) dir_end(c *checker, d *checkDir) {
+	if x.need > 0 {
+		c.report(Problem{Kind: ProblemBadEntrySet, Path: d.path, Count: uint32(x.n), Block: x.block, Offset: x.ofs})
+		x.need = 0
+	}
+}
+
+// xdir_entry checks the exFAT directory entry ent of directory d. It reports
+// end at the end of the directory.
+func (c *checker) xdir_entry(d *checkDir, ent []byte, block int64, ofs int) (end bool, fr fileResult) {
+	x := &c.x
+	typ := ent[xdirType]
+	if x.need > 0 {
+		if typ&0xC0 == 0xC0 { // Secondary entry in use.
+			copy(x.set[x.n*sizeDirEntry:], ent)
+			x.locs[x.n] = entLoc{lba(block), ofs}
+			x.n++
+			if x.n < x.need {
+				return false, frOK
+			}
+			x.need = 0
+			return false, c.xcheck_set(d)
+		}
+		c.report(Problem{Kind: ProblemBadEntrySet, Path: d.path, Count: uint32(x.n), Block: x.block, Offset: x.ofs})
+		x.need = 0
+	}
+	switch {
+	case typ == 0:
+		return true, frOK
+	case typ == etFILEDIR:
+		nsec := int(ent[xdirNumSec])
+		if nsec < 2 || nsec >= len(x.set)/sizeDirEntry {
+			c.report(Problem{Kind: ProblemBadEntrySet, Path: d.path, Count: 1, Block: block, Offset: ofs})
+			return false, frOK
+		}
+		copy(x.set[:], ent)
+		x.n, x.need = 1, nsec+1
+		x.block, x.ofs = block, ofs
+		x.locs[0] = entLoc{lba(block), ofs}
+	case (typ == etBITMAP || typ == etUPCASE) && d.path == "/":
+		meta := checkDir{
+			path:   "<allocation bitmap>",
+			sclust: binary.LittleEndian.Uint32(ent[20:]),
+			size:   int64(binary.LittleEndian.Uint64(ent[24:])),
+		}
+		if typ == etUPCASE {
+			meta.path = "<up-case table>"
+		}
+		n, cls, ok, fr := c.chain(c.object(meta.path), &meta, block, ofs, typ == etUPCASE)
+		if fr != frOK || !ok {
+			return false, fr
+		}
+		clsz := int64(c.fsys.csize) * int64(c.fsys.ssize)
+		if want := (meta.size + clsz - 1) / clsz; n != want {
+			kind := ProblemChainShort
+			if n > want {
+				kind = ProblemChainLong
+			}
+			c.report(Problem{Kind: kind, Path: meta.path, Cluster: meta.sclust, Block: block, Offset: ofs, Got: n, Want: want})
+		} else if typ == etUPCASE {
+			x.upCls, x.upSize = cls, meta.size
+			x.upSum = binary.LittleEndian.Uint32(ent[xdirCaseSum:])
+			x.upLoc = entLoc{lba(block), ofs}
+		}
+	case typ&0xC0 == 0xC0:
+		// Secondary entry in use out of a set.
+		c.report(Problem{Kind: ProblemBadEntrySet, Path: d.path, Count: 1, Block: block, Offset: ofs})
+	}
+	return false, frOK
+}
+
+// xcheck_set checks the entry set read in directory d and the file or
+// directory it holds.
+func (c *checker) xcheck_set(d *checkDir) fileResult {
+	x := &c.x
+	set := x.set[:x.n*sizeDirEntry]
+	bad := Problem{Kind: ProblemBadEntrySet, Path: d.path, Count: uint32(x.n), Block: x.block, Offset: x.ofs}
+	if set[sizeDirEntry] != etSTREAM {
+		c.report(bad)
+		return frOK
+	}
+	var name [255]uint16
+	nlen := int(set[xdirNumName])
+	for i, k := 2*sizeDirEntry, 0; i < len(set) && set[i] == etFILENAME; i += sizeDirEntry {
+		for j := 2; j < sizeDirEntry && k < nlen; j, k = j+2, k+1 {
+			name[k] = binary.LittleEndian.Uint16(set[i+j:])
+		}
+	}
+	sub := checkDir{
+		path:   join_path(d.path, lfn_string(name[:nlen])),
+		sclust: binary.LittleEndian.Uint32(set[xdirFstClus:]),
+		size:   int64(binary.LittleEndian.Uint64(set[xdirFileSize:])),
+		contig: set[xdirGenFlags]&2 != 0,
+		fix:    true,
+	}
+	isDir := binary.LittleEndian.Uint16(set[xdirAttr:])&amDIR != 0
+	sub.dir = isDir
+	if got, want := binary.LittleEndian.Uint16(set[xdirSetSum:]), xdir_sum(set); got != want {
+		bad.Path, bad.Got, bad.Want = sub.path, int64(got), int64(want)
+		if c.fix != nil {
+			if fr := x.store(c, &sub); fr != frOK {
+				return fr
+			}
+			bad.Fixed = true
+		}
+		c.report(bad)
+	}
+	return c.check_file(sub, isDir, x.block, x.ofs)
+}
+
+// store writes the entry set read back, with the start cluster and size of
+// d, the object it holds, and its checksum.
+func (x *xcheck) store(c *checker, d *checkDir) fileResult {
+	fsys := c.fsys
+	set := x.set[:x.n*sizeDirEntry]
+	if d.sclust == 0 && binary.LittleEndian.Uint32(set[xdirFstClus:]) != 0 {
+		set[xdirGenFlags] = 1 // No clusters to be contiguous.
+	}
+	binary.LittleEndian.PutUint32(set[xdirFstClus:], d.sclust)
+	binary.LittleEndian.PutUint64(set[xdirFileSize:], uint64(d.size))
+	if binary.LittleEndian.Uint64(set[xdirValidFileSize:]) > uint64(d.size) {
+		binary.LittleEndian.PutUint64(set[xdirValidFileSize:], uint64(d.size))
+	}
+	binary.LittleEndian.PutUint16(set[xdirSetSum:], xdir_sum(set))
+	for i, loc := range x.locs[:x.n] {
+		if fr := fsys.move_window(loc.sect); fr != frOK {
+			return fr
+		}
+		copy(fsys.win[loc.ofs:loc.ofs+sizeDirEntry], set[i*sizeDirEntry:])
+		fsys.wflag = 1
+	}
+	return frOK
+}
+
+// check_exfat checks the up-case table checksum and the allocation bitmap
+// against the clusters held.
+func (c *checker) check_exfat() fileResult {
+	fsys := c.fsys
+	x := &c.x
+	if x.upCls != nil {
+		var sum uint32
+		remain := x.upSize
+		for _, cl := range x.upCls {
+			for i := lba(0); i < lba(fsys.csize) && remain > 0; i++ {
+				if fsys.move_window(fsys.clst2sect(cl)+i) != frOK {
+					return frDiskErr
+				}
+				n := min(remain, int64(fsys.ssize))
+				for _, b := range fsys.win[:n] {
+					sum = xsum32(b, sum)
+				}
+				remain -= n
+			}
+		}
+		if sum != x.upSum {
+			p := Problem{Kind: ProblemUpcaseChecksum, Path: "<up-case table>", Cluster: x.upCls[0], Block: int64(x.upLoc.sect), Offset: x.upLoc.ofs, Got: int64(sum), Want: int64(x.upSum)}
+			if c.fix != nil {
+				// Record the checksum of the table as it stands.
+				if fr := fsys.move_window(x.upLoc.sect); fr != frOK {
+					return fr
+				}
+				binary.LittleEndian.PutUint32(fsys.win[x.upLoc.ofs+xdirCaseSum:], sum)
+				fsys.wflag = 1
+				p.Fixed = true
+			}
+			c.report(p)
+		}
+	}
+	ss := uint32(fsys.ssize)
+	var run Problem
+	for cl := uint32(2); cl < fsys.n_fatent; cl++ {
+		bit := cl - 2
+		if fsys.move_window(fsys.bitbase+lba(bit/8/ss)) != frOK {
+			return frDiskErr
+		}
+		used := fsys.win[bit/8%ss]&(1<<(bit%8)) != 0
+		if !used {
+			c.rep.FreeClusters++
+		}
+		var kind ProblemKind
+		if used && c.owner[cl] == 0 {
+			kind = ProblemLostChain
+			v := (&objid{fs: fsys}).clusterstat(cl)
+			if v == badCluster {
+				return frDiskErr
+			} else if c.bad(v) {
+				c.rep.BadClusters++ // In use so as not to be allocated.
+				kind = 0
+			}
+		} else if !used && c.owner[cl] != 0 {
+			kind = ProblemBitmap
+		}
+		if run.Count > 0 && (kind != run.Kind || cl != run.Cluster+run.Count) {
+			if fr := c.bitmap_run(&run); fr != frOK {
+				return fr
+			}
+			run.Count = 0
+		}
+		if kind == 0 {
+			continue
+		} else if run.Count == 0 {
+			run = Problem{Kind: kind, Cluster: cl}
+		}
+		run.Count++
+	}
+	if run.Count > 0 {
+		return c.bitmap_run(&run)
+	}
+	return frOK
+}
+
+// bitmap_run reports the run of clusters lost, or held and free, on the
+// allocation bitmap. When repairing, their bits are set to the clusters held,
+// or those lost are recovered.
+func (c *checker) bitmap_run(run *Problem) fileResult {
+	if c.fix == nil {
+		c.report(*run)
+		return frOK
+	} else if run.Kind == ProblemLostChain && c.fix.RecoverLost {
+		c.found_chain(run)
+		return frOK
+	}
+	used := run.Kind == ProblemBitmap
+	if fr := c.fsys.change_bitmap(run.Cluster, run.Count, used); fr != frOK {
+		return fr
+	}
+	if used {
+		c.rep.FreeClusters -= run.Count
+	} else {
+		c.rep.FreeClusters += run.Count
+	}
+	run.Fixed = true
+	c.report(*run)
+	return frOK
+}
@@ -0,0 +1,278 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// checkVolume is a small volume with a few files and a directory, unmounted,
+// to be corrupted on copies and checked.
+type checkVolume struct {
+	img               []byte
+	fatbase, fsize    int64 // First FAT sector and FAT size in sectors.
+	database, bitbase int64
+	csize             int64 // Cluster size in sectors.
+	volbase           int64
+}
+
+func newCheckVolume(t *testing.T, numBlocks int, cfg FormatParams) *checkVolume {
+	t.Helper()
+	fsys, dev := formatAndMount(t, numBlocks, cfg)
+	createPat(t, fsys, "a.bin", 1, 6*int(cfg.ClusterSize)*512-100)
+	createPat(t, fsys, "b.bin", 2, 1000)
+	if err := fsys.Mkdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	createPat(t, fsys, "sub/c.bin", 3, 3000)
+	if lfnEnabled {
+		createPat(t, fsys, "Long file name.txt", 4, 700)
+	}
+	cv := &checkVolume{
+		fatbase: int64(fsys.fatbase), fsize: int64(fsys.fsize),
+		database: int64(fsys.database), bitbase: int64(fsys.bitbase),
+		csize: int64(fsys.csize), volbase: int64(fsys.volbase),
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	cv.img = dev.buf
+	return cv
+}
+
+// check checks a copy of the volume corrupted by corrupt.
+func (cv *checkVolume) check(t *testing.T, corrupt func(img []byte)) *CheckReport {
+	t.Helper()
+	img := append([]byte(nil), cv.img...)
+	corrupt(img)
+	blk, _ := makeBlockIndexer(512)
+	var fsys FS
+	if err := fsys.Mount(&BlockByteSlice{blk: blk, buf: img}, 512, ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := fsys.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+// entry returns the image offset of the short name entry of sfn, an 11 byte
+// name as stored, skipping deleted entries.
+func (cv *checkVolume) entry(t *testing.T, sfn string) int {
+	t.Helper()
+	for off := 0; off+sizeDirEntry <= len(cv.img); off += sizeDirEntry {
+		if string(cv.img[off:off+11]) == sfn && cv.img[off+dirAttrOff]&amMASK != amLFN {
+			return off
+		}
+	}
+	t.Fatalf("entry %q not found", sfn)
+	return 0
+}
+
+// xentry returns the image offset of the file entry of the exFAT entry set
+// of the ASCII name.
+func (cv *checkVolume) xentry(t *testing.T, name string) int {
+	t.Helper()
+	for off := 0; off+3*sizeDirEntry <= len(cv.img); off += sizeDirEntry {
+		set := cv.img[off:]
+		if set[0] != etFILEDIR || set[sizeDirEntry] != etSTREAM || int(set[xdirNumName]) != len(name) {
+			continue
+		}
+		var got []byte
+		for i := 0; i < len(name); i++ {
+			got = append(got, set[2*sizeDirEntry+2+i/15*sizeDirEntry+i%15*2])
+		}
+		if string(got) == name {
+			return off
+		}
+	}
+	t.Fatalf("entry set %q not found", name)
+	return 0
+}
+
+// clusterOf returns the first cluster in the entry at off.
+func (cv *checkVolume) clusterOf(off int) uint32 {
+	return uint32(binary.LittleEndian.Uint16(cv.img[off+dirFstClusLOOff:])) |
+		uint32(binary.LittleEndian.Uint16(cv.img[off+dirFstClusHIOff:]))<<16
+}
+
+func (cv *checkVolume) clusterOffset(cl uint32) int {
+	return int(cv.database+int64(cl-2)*cv.csize) * 512
+}
+
+// setFAT16 sets the entry of cl in both FATs to v.
+func (cv *checkVolume) setFAT16(img []byte, cl uint32, v uint16) {
+	binary.LittleEndian.PutUint16(img[cv.fatbase*512+int64(cl)*2:], v)
+	binary.LittleEndian.PutUint16(img[(cv.fatbase+cv.fsize)*512+int64(cl)*2:], v)
+}
+
+// wantProblems requires rep to hold problems of the kinds of want, in any
+// order, with the fields set in want.
+func wantProblems(t *testing.T, rep *CheckReport, want ...Problem) {
+	t.Helper()
+	var b strings.Builder
+	for _, p := range rep.Problems {
+		b.WriteString("\n\t" + p.String())
+	}
+	if len(rep.Problems) != len(want) {
+		t.Fatalf("got %d problems, want %d:%s", len(rep.Problems), len(want), b.String())
+	}
+next:
+	for _, w := range want {
+		for _, p := range rep.Problems {
+			if p.Kind == w.Kind && (w.Path == "" || p.Path == w.Path) && (w.Cluster == 0 || p.Cluster == w.Cluster) &&
+				(w.Count == 0 || p.Count == w.Count) && (w.Got == 0 || p.Got == w.Got) && (w.Want == 0 || p.Want == w.Want) {
+				continue next
+			}
+		}
+		t.Errorf("missing %v in:%s", w, b.String())
+	}
+}
+
+func TestCheckGolden(t *testing.T) {
+	for _, name := range []string{"golden-fmt12.img", "golden-torture12.img", "golden-fmt16.img", "golden-torture16.img",
+		"golden-fmt32.img", "golden-torture32.img", "golden-fmtex.img", "golden-tortureex.img"} {
+		t.Run(name, func(t *testing.T) {
+			if strings.Contains(name, "ex") {
+				skipIfNoExFAT(t)
+			}
+			var fsys FS
+			if err := fsys.Mount(goldenDevice(t, name), 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			rep, err := fsys.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, rep)
+			if strings.Contains(name, "torture") && (rep.Files == 0 || rep.Dirs == 0) {
+				t.Errorf("found %d files and %d directories", rep.Files, rep.Dirs)
+			}
+		})
+	}
+}
+
+func TestCheckFAT(t *testing.T) {
+	cv := newCheckVolume(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	a := cv.entry(t, "A       BIN")
+	b := cv.entry(t, "B       BIN")
+	acl := cv.clusterOf(a)
+	sub := cv.clusterOf(cv.entry(t, "SUB        "))
+
+	rep := cv.check(t, func([]byte) {})
+	wantProblems(t, rep)
+	wantFiles := 3 // a.bin, b.bin and sub/c.bin.
+	if lfnEnabled {
+		wantFiles++
+	}
+	if rep.Files != wantFiles || rep.Dirs != 1 {
+		t.Errorf("found %d files and %d directories, want %d and 1", rep.Files, rep.Dirs, wantFiles)
+	}
+
+	t.Run("lost", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			cv.setFAT16(img, 4000, 4001)
+			cv.setFAT16(img, 4001, 0xFFFF)
+			cv.setFAT16(img, 5000, 0xFFFF)
+		}), Problem{Kind: ProblemLostChain, Cluster: 4000, Count: 2}, Problem{Kind: ProblemLostChain, Cluster: 5000, Count: 1})
+	})
+	t.Run("lostloop", func(t *testing.T) {
+		// A chain joining another, and a loop without head.
+		wantProblems(t, cv.check(t, func(img []byte) {
+			cv.setFAT16(img, 4002, 4000)
+			cv.setFAT16(img, 4000, 4001)
+			cv.setFAT16(img, 4001, 0xFFFF)
+			cv.setFAT16(img, 6000, 6001)
+			cv.setFAT16(img, 6001, 6000)
+		}), Problem{Kind: ProblemLostChain, Cluster: 4002, Count: 3}, Problem{Kind: ProblemLostChain, Cluster: 6000, Count: 2})
+	})
+	t.Run("crosslink", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			copy(img[b+dirFstClusLOOff:b+dirFstClusLOOff+2], img[a+dirFstClusLOOff:])
+		}), Problem{Kind: ProblemCrossLinked, Path: "/B.BIN", Cluster: acl},
+			Problem{Kind: ProblemLostChain, Count: 2}) // b's own clusters.
+	})
+	t.Run("short", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			binary.LittleEndian.PutUint32(img[a+dirFileSizeOff:], 10*512)
+		}), Problem{Kind: ProblemChainShort, Path: "/A.BIN", Cluster: acl, Got: 6, Want: 10})
+	})
+	t.Run("long", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			binary.LittleEndian.PutUint32(img[a+dirFileSizeOff:], 100)
+		}), Problem{Kind: ProblemChainLong, Path: "/A.BIN", Got: 6, Want: 1})
+	})
+	t.Run("badcluster", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			cv.setFAT16(img, acl+2, 0)
+		}), Problem{Kind: ProblemBadCluster, Path: "/A.BIN", Cluster: acl + 2},
+			Problem{Kind: ProblemLostChain, Cluster: acl + 3, Count: 3})
+	})
+	t.Run("dotdot", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			binary.LittleEndian.PutUint16(img[cv.clusterOffset(sub)+sizeDirEntry+dirFstClusLOOff:], 7)
+		}), Problem{Kind: ProblemBadDot, Path: "/SUB", Got: 7})
+	})
+	t.Run("fatcopy", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			img[(cv.fatbase+cv.fsize+3)*512+10] ^= 1
+		}), Problem{Kind: ProblemFATMismatch, Count: 1})
+	})
+	t.Run("lfn", func(t *testing.T) {
+		skipIfNoLFN(t)
+		l := cv.entry(t, "LONGFI~1TXT")
+		wantProblems(t, cv.check(t, func(img []byte) {
+			img[l] = mskDDEM
+		}), Problem{Kind: ProblemOrphanLFN, Path: "/", Count: 2}, Problem{Kind: ProblemLostChain, Count: 2})
+		wantProblems(t, cv.check(t, func(img []byte) {
+			img[l+8] = 'X'
+		}), Problem{Kind: ProblemLFNChecksum, Path: "/LONGFI~1.XXT", Count: 2})
+	})
+}
+
+func TestCheckFSInfo(t *testing.T) {
+	cv := newCheckVolume(t, 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1})
+	rep := cv.check(t, func([]byte) {})
+	wantProblems(t, rep)
+	wantProblems(t, cv.check(t, func(img []byte) {
+		binary.LittleEndian.PutUint32(img[(cv.volbase+1)*512+fsiFree_Count:], 1234)
+	}), Problem{Kind: ProblemFreeCount, Got: 1234, Want: int64(rep.FreeClusters)})
+}
+
+func TestCheckExFAT(t *testing.T) {
+	skipIfNoExFAT(t)
+	cv := newCheckVolume(t, 8192, FormatParams{Format: FormatExFAT, ClusterSize: 1})
+	wantProblems(t, cv.check(t, func([]byte) {}))
+	a := cv.xentry(t, "a.bin")
+	acl := binary.LittleEndian.Uint32(cv.img[a+xdirFstClus:])
+
+	t.Run("setsum", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			img[a+xdirModTime] ^= 1
+		}), Problem{Kind: ProblemBadEntrySet, Path: "/a.bin"})
+	})
+	bit := func(img []byte, cl uint32) *byte {
+		return &img[cv.bitbase*512+int64(cl-2)/8]
+	}
+	t.Run("bitmap", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			*bit(img, acl+1) &^= 1 << ((acl - 1) % 8)
+		}), Problem{Kind: ProblemBitmap, Cluster: acl + 1, Count: 1})
+	})
+	t.Run("lost", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			*bit(img, 7000) |= 1 << (6998 % 8)
+		}), Problem{Kind: ProblemLostChain, Cluster: 7000, Count: 1})
+	})
+	t.Run("upcase", func(t *testing.T) {
+		wantProblems(t, cv.check(t, func(img []byte) {
+			for off := cv.clusterOffset(uint32(binary.LittleEndian.Uint32(img[int(cv.volbase)*512+bpbRootClusEx:]))); ; off += sizeDirEntry {
+				if img[off] == etUPCASE {
+					img[cv.clusterOffset(binary.LittleEndian.Uint32(img[off+20:]))+100] ^= 1
+					return
+				}
+			}
+		}), Problem{Kind: ProblemUpcaseChecksum})
+	})
+}
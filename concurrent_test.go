@@ -2,10 +2,13 @@ package fat
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestConcurrentMixedOps hammers one FS from several goroutines doing
@@ -148,7 +151,7 @@ func TestConcurrentCloseRace(t *testing.T) {
 				for {
 					_, err := fp.ReadAt(buf, 0)
 					if err != nil && err != io.EOF {
-						if err != frInvalidObject {
+						if !errors.Is(err, ErrInvalidObject) {
 							t.Errorf("ReadAt after close: %v", err)
 						}
 						return
@@ -162,3 +165,279 @@ func TestConcurrentCloseRace(t *testing.T) {
 		wg.Wait()
 	}
 }
+
+// gateDevice holds back multi-sector reads, which only file data transfers
+// issue, until want of them are in flight at once. Reads that are serialized
+// never meet and time out.
+type gateDevice struct {
+	BlockDeviceExtended
+	armed   atomic.Bool
+	want    int32
+	n       atomic.Int32
+	release chan struct{}
+}
+
+func (gd *gateDevice) ReadBlocks(dst []byte, start int64) (int, error) {
+	if gd.armed.Load() && len(dst) > gd.BlockSize() {
+		if gd.n.Add(1) == gd.want {
+			close(gd.release)
+		}
+		select {
+		case <-gd.release:
+		case <-time.After(5 * time.Second):
+			return 0, errors.New("data transfers did not overlap")
+		}
+	}
+	return gd.BlockDeviceExtended.ReadBlocks(dst, start)
+}
+
+// TestConcurrentReadsOverlap reads two files from two goroutines on a device
+// that completes a transfer only while the other one is in flight too: with
+// ConcurrentDevice the FS lock must not be held during data transfers.
+func TestConcurrentReadsOverlap(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16})
+	const readers = 2
+	const size = 8192
+	for i := 0; i < readers; i++ {
+		createPat(t, fsys, fmt.Sprintf("f%d.bin", i), i, size)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	gd := &gateDevice{BlockDeviceExtended: dev, want: readers, release: make(chan struct{})}
+	fsys.Configure(FSConfig{ConcurrentDevice: true})
+	if err := fsys.Mount(gd, 512, ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	gd.armed.Store(true)
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var fp File
+			if err := fsys.OpenFile(&fp, fmt.Sprintf("f%d.bin", i), ModeRead); err != nil {
+				errs <- err
+				return
+			}
+			defer fp.Close()
+			got := make([]byte, size)
+			if _, err := io.ReadFull(&fp, got); err != nil {
+				errs <- fmt.Errorf("f%d: %w", i, err)
+				return
+			}
+			for j, b := range got {
+				if b != pat(i, j) {
+					errs <- fmt.Errorf("f%d: byte %d = %#x, want %#x", i, j, b, pat(i, j))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// exclusiveDevice fails any call made while another one is in progress.
+type exclusiveDevice struct {
+	BlockDeviceExtended
+	busy atomic.Bool
+}
+
+func (ed *exclusiveDevice) enter() error {
+	if !ed.busy.CompareAndSwap(false, true) {
+		return errors.New("device called concurrently")
+	}
+	time.Sleep(50 * time.Microsecond) // Give another caller time to collide.
+	return nil
+}
+
+func (ed *exclusiveDevice) ReadBlocks(dst []byte, start int64) (int, error) {
+	if err := ed.enter(); err != nil {
+		return 0, err
+	}
+	defer ed.busy.Store(false)
+	return ed.BlockDeviceExtended.ReadBlocks(dst, start)
+}
+
+func (ed *exclusiveDevice) WriteBlocks(data []byte, start int64) (int, error) {
+	if err := ed.enter(); err != nil {
+		return 0, err
+	}
+	defer ed.busy.Store(false)
+	return ed.BlockDeviceExtended.WriteBlocks(data, start)
+}
+
+// TestConcurrentDeviceExclusive streams files from several goroutines on a
+// device that fails calls that overlap: without ConcurrentDevice the device
+// is called one at a time.
+func TestConcurrentDeviceExclusive(t *testing.T) {
+	fsys, dev := formatAndMount(t, 32768, FormatParams{Format: FormatFAT16, ClusterSize: 2})
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	ed := &exclusiveDevice{BlockDeviceExtended: dev}
+	if err := fsys.Mount(ed, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			data := make([]byte, 8192)
+			for i := range data {
+				data[i] = pat(g, i)
+			}
+			var fp File
+			path := fmt.Sprintf("x%d.bin", g)
+			if err := fsys.OpenFile(&fp, path, ModeRW|ModeCreateAlways); err != nil {
+				errs <- err
+				return
+			}
+			defer fp.Close()
+			if _, err := fp.Write(data); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := fp.ReadAt(data, 0); err != nil {
+				errs <- err
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentStreams writes and reads back multi-cluster files from several
+// goroutines at once, with the data transfers of each running in parallel
+// with the cluster allocation of the others.
+func TestConcurrentStreams(t *testing.T) {
+	fsys, _ := formatAndMount(t, 32768, FormatParams{Format: FormatFAT16, ClusterSize: 2})
+	runConcurrentStreams(t, fsys)
+}
+
+func TestConcurrentStreamsExFAT(t *testing.T) {
+	skipIfNoExFAT(t)
+	fsys, _, err := initTestExFAT(32768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runConcurrentStreams(t, fsys)
+}
+
+func runConcurrentStreams(t *testing.T, fsys *FS) {
+	fsys.Configure(FSConfig{ConcurrentDevice: true})
+	const goroutines = 4
+	const iters = 3
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			path := fmt.Sprintf("s%d.bin", g)
+			size := 20000 + 3001*g
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = pat(g, i)
+			}
+			for it := 0; it < iters; it++ {
+				var fp File
+				if err := fsys.OpenFile(&fp, path, ModeRW|ModeCreateAlways); err != nil {
+					errs <- fmt.Errorf("g%d OpenFile: %w", g, err)
+					return
+				}
+				// Odd chunk sizes mix partial sector and multi-sector transfers.
+				for off := 0; off < size; off += 1500 + g {
+					end := off + 1500 + g
+					if end > size {
+						end = size
+					}
+					if _, err := fp.Write(data[off:end]); err != nil {
+						errs <- fmt.Errorf("g%d Write: %w", g, err)
+						return
+					}
+				}
+				if err := fp.Sync(); err != nil {
+					errs <- fmt.Errorf("g%d Sync: %w", g, err)
+					return
+				}
+				got := make([]byte, size)
+				if _, err := fp.ReadAt(got, 0); err != nil {
+					errs <- fmt.Errorf("g%d ReadAt: %w", g, err)
+					return
+				}
+				if err := fp.Close(); err != nil {
+					errs <- fmt.Errorf("g%d Close: %w", g, err)
+					return
+				}
+				if !bytes.Equal(got, data) {
+					errs <- fmt.Errorf("g%d iteration %d: data mismatch", g, it)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for g := 0; g < goroutines; g++ {
+		got := readAllFile(t, fsys, fmt.Sprintf("s%d.bin", g))
+		for i, b := range got {
+			if b != pat(g, i) {
+				t.Fatalf("s%d.bin: byte %d = %#x", g, i, b)
+			}
+		}
+	}
+}
+
+// TestConcurrentUnmountRace unmounts while files are being read: reads in
+// flight finish against the device and then report frInvalidObject.
+func TestConcurrentUnmountRace(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16})
+	fsys.Configure(FSConfig{ConcurrentDevice: true})
+	for i := 0; i < 4; i++ {
+		createPat(t, fsys, fmt.Sprintf("f%d.bin", i), i, 16384)
+	}
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			var fp File
+			if err := fsys.OpenFile(&fp, fmt.Sprintf("f%d.bin", i), ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			wg.Add(1)
+			go func(fp *File) {
+				defer wg.Done()
+				buf := make([]byte, 4096)
+				for {
+					_, err := fp.ReadAt(buf, 0)
+					if err != nil && err != io.EOF {
+						if !errors.Is(err, ErrInvalidObject) {
+							t.Errorf("ReadAt during unmount: %v", err)
+						}
+						return
+					}
+				}
+			}(&fp)
+		}
+		if err := fsys.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
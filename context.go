@@ -0,0 +1,215 @@
+package fat
+
+import (
+	"context"
+	"io"
+)
+
+// BlockDeviceContext is implemented by a [BlockDevice] whose transfers can be
+// abandoned, such as one backed by a network or a slow bus. It is detected by
+// type assertion. The Context variants of operations that only read pass
+// their context to ReadBlocksContext in place of calling ReadBlocks, for the
+// reads each documents; a device without it is only checked for cancellation
+// in between transfers. WriteBlocksContext is called by FormatContext alone:
+// the writes of a mounted volume are never abandoned, see
+// [File.WriteContext].
+type BlockDeviceContext interface {
+	ReadBlocksContext(ctx context.Context, dst []byte, startBlock int64) (int, error)
+	WriteBlocksContext(ctx context.Context, data []byte, startBlock int64) (int, error)
+}
+
+// readBlocks reads from dev on behalf of an operation with context ctx, nil
+// for an operation without one.
+func readBlocks(ctx context.Context, dev BlockDevice, dst []byte, startBlock int64) (int, error) {
+	if ctx == nil {
+		return dev.ReadBlocks(dst, startBlock)
+	} else if err := ctx.Err(); err != nil {
+		return 0, err
+	} else if dc, ok := dev.(BlockDeviceContext); ok {
+		return dc.ReadBlocksContext(ctx, dst, startBlock)
+	}
+	return dev.ReadBlocks(dst, startBlock)
+}
+
+// ctxDevice is the device of FormatContext: every transfer carries its context.
+type ctxDevice struct {
+	BlockDevice
+	ctx   context.Context
+	wrote bool // A write was attempted: the device no longer holds what it did.
+}
+
+func (d *ctxDevice) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	return readBlocks(d.ctx, d.BlockDevice, dst, startBlock)
+}
+
+func (d *ctxDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	if err := d.ctx.Err(); err != nil {
+		return 0, err
+	}
+	d.wrote = true
+	if dc, ok := d.BlockDevice.(BlockDeviceContext); ok {
+		return dc.WriteBlocksContext(d.ctx, data, startBlock)
+	}
+	return d.BlockDevice.WriteBlocks(data, startBlock)
+}
+
+// FormatContext is [Formatter.Format] with a context. Cancelling it abandons
+// the format between sector writes, or during one if bd implements
+// [BlockDeviceContext], and returns the context's error. A half formatted
+// device is not left looking like a volume: if anything was written, its boot
+// record is cleared, so mounting it fails rather than finding a volume with
+// a partly written FAT.
+func (f *Formatter) FormatContext(ctx context.Context, bd BlockDevice, blocksize, fsSizeInBlocks int, cfg FormatParams) error {
+	if bd == nil {
+		return f.Format(bd, blocksize, fsSizeInBlocks, cfg)
+	}
+	cd := &ctxDevice{BlockDevice: bd, ctx: ctx}
+	err := f.Format(cd, blocksize, fsSizeInBlocks, cfg)
+	f.bd = bd
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if cd.wrote {
+		clear(f.window[:blocksize])
+		bd.WriteBlocks(f.window[:blocksize], 0) // Best effort; the format failed anyway.
+		f.windowaddr = ^lba(0)
+	}
+	return ctx.Err()
+}
+
+// fileCursor is the position of a File, saved to rewind an interrupted read.
+type fileCursor struct {
+	pos, fptr int64
+	clust     uint32
+	sect      lba
+	flag      uint8
+	err       fileResult
+	buf       [512]byte
+}
+
+// ReadContext is [File.Read] with a context. The read proceeds a cluster at a
+// time and stops when ctx is done, returning the bytes read until then and
+// the context's error. Reads of the file's data are abandoned half way if the
+// device implements [BlockDeviceContext]; the file is then rewound to the end
+// of the last cluster read, where a following Read resumes. Only those are
+// cancellable: the reads of the FAT that follow the file's cluster chain are
+// completed, with ctx checked before the next cluster.
+func (fp *File) ReadContext(ctx context.Context, buf []byte) (_ int, err error) {
+	fsys, err := fp.lock("read")
+	if err != nil {
+		return 0, err
+	}
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "read", fp.name)
+	fp.ctx = ctx
+	defer func() { fp.ctx = nil }()
+	csz := int64(fsys.csize) * int64(fsys.ssize)
+	n := 0
+	for n < len(buf) {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		chunk := len(buf) - n
+		if rem := csz - fp.pos%csz; int64(chunk) > rem {
+			chunk = int(rem) // Up to the end of the cluster.
+		}
+		saved := fileCursor{pos: fp.pos, fptr: fp.fptr, clust: fp.clust, sect: fp.sect, flag: fp.flag, err: fp.err, buf: fp.buf}
+		br, err := fp.read(buf[n : n+chunk])
+		if err != nil && ctx.Err() != nil {
+			// The transfer was abandoned at an arbitrary point of f_read.
+			fp.pos, fp.fptr, fp.clust, fp.sect = saved.pos, saved.fptr, saved.clust, saved.sect
+			fp.flag, fp.err, fp.buf = saved.flag, saved.err, saved.buf
+			return n, ctx.Err()
+		}
+		n += br
+		if err == io.EOF && n > 0 {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		} else if br < chunk {
+			break // End of file.
+		}
+	}
+	return n, nil
+}
+
+// WriteContext is [File.Write] with a context. The write proceeds a cluster
+// at a time and stops when ctx is done, returning the bytes written until
+// then and the context's error. Writes in progress are never abandoned, and
+// are not passed to [BlockDeviceContext], so the file and the volume are
+// left as after a shorter write: the file holds the bytes reported written,
+// and the clusters holding them, no more.
+func (fp *File) WriteContext(ctx context.Context, buf []byte) (_ int, err error) {
+	fsys, err := fp.lock("write")
+	if err != nil {
+		return 0, err
+	}
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "write", fp.name)
+	csz := int64(fsys.csize) * int64(fsys.ssize)
+	n := 0
+	for n < len(buf) {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		pos := fp.pos
+		if fp.flag&faAppend != 0 {
+			pos = fp.obj.objsize
+		}
+		chunk := len(buf) - n
+		if rem := csz - pos%csz; int64(chunk) > rem {
+			chunk = int(rem) // Up to the end of the cluster.
+		}
+		bw, err := fp.write(buf[n : n+chunk])
+		n += bw
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ForEachFileContext is [Dir.ForEachFile] with a context. The walk stops when
+// ctx is done, before the next call to callback, and returns the context's
+// error. Reads of the device are abandoned half way if it implements
+// [BlockDeviceContext].
+func (dp *Dir) ForEachFileContext(ctx context.Context, callback func(*FileInfo) error) error {
+	fsys, err := dp.lock("readdir")
+	if err != nil {
+		return err
+	}
+	defer fsys.mu.Unlock()
+	fsys.ctx = ctx
+	defer func() { fsys.ctx = nil }()
+	err = dp.forEachFile(func(fi *FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return callback(fi)
+	})
+	if err != nil && ctx.Err() != nil {
+		return fsys.pathErr("readdir", dp.name, ctx.Err())
+	}
+	return err
+}
+
+// FreeSpaceContext is [FS.FreeSpace] with a context. Counting the free
+// clusters on the FAT is abandoned when ctx is done, returning the context's
+// error, and is started over by the next call.
+func (fsys *FS) FreeSpaceContext(ctx context.Context) (int64, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.fstype == _FormatUnknown {
+		return 0, fsys.pathErr("freespace", "/", frNotEnabled)
+	}
+	fsys.ctx = ctx
+	defer func() { fsys.ctx = nil }()
+	nfree, fr := fsys.f_getfree()
+	if fr != frOK {
+		if err := ctx.Err(); err != nil {
+			return 0, fsys.pathErr("freespace", "/", err)
+		}
+		return 0, fsys.pathErr("freespace", "/", fr)
+	}
+	return int64(nfree) * int64(fsys.csize) * int64(fsys.ssize), nil
+}
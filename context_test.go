@@ -0,0 +1,234 @@
+package fat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// cancelingDevice cancels a context once a number of writes have been made.
+type cancelingDevice struct {
+	BlockDeviceExtended
+	cancel func()
+	after  int // Writes left until cancel; cancel is not called below 0.
+	writes int
+}
+
+func (cd *cancelingDevice) WriteBlocks(data []byte, start int64) (int, error) {
+	cd.writes++
+	if cd.after--; cd.after == 0 {
+		cd.cancel()
+	}
+	return cd.BlockDeviceExtended.WriteBlocks(data, start)
+}
+
+// stallingDevice implements BlockDeviceContext. Its stallAt-th multi-sector
+// read, counting from 1, stalls until the context is cancelled, which it does
+// itself, as a read held up on the bus and abandoned would.
+type stallingDevice struct {
+	BlockDeviceExtended
+	cancel  func()
+	stallAt int
+	reads   int
+}
+
+func (sd *stallingDevice) ReadBlocksContext(ctx context.Context, dst []byte, start int64) (int, error) {
+	if len(dst) > sd.BlockSize() {
+		sd.reads++
+		if sd.reads == sd.stallAt {
+			sd.cancel()
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+	}
+	return sd.BlockDeviceExtended.ReadBlocks(dst, start)
+}
+
+func (sd *stallingDevice) WriteBlocksContext(ctx context.Context, data []byte, start int64) (int, error) {
+	return sd.BlockDeviceExtended.WriteBlocks(data, start)
+}
+
+func TestReadContext(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+	const size = 10000
+	createPat(t, fsys, "f.bin", 1, size)
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sd := &stallingDevice{BlockDeviceExtended: dev, cancel: cancel, stallAt: 2}
+	if err := fsys.Mount(sd, 512, ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	var fp File
+	if err := fsys.OpenFile(&fp, "f.bin", ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	got := make([]byte, size)
+	n, err := fp.ReadContext(ctx, got)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReadContext error = %v, want context.Canceled", err)
+	} else if n != 2048 {
+		t.Fatalf("ReadContext read %d bytes, want the first cluster", n)
+	}
+	// The file was rewound to the end of the first cluster: Read resumes there.
+	for n < size {
+		m, err := fp.Read(got[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	for i, b := range got {
+		if b != pat(1, i) {
+			t.Fatalf("byte %d = %#x, want %#x", i, b, pat(1, i))
+		}
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+	free0, err := fsys.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cd := &cancelingDevice{BlockDeviceExtended: dev, cancel: cancel, after: 3}
+	if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = pat(2, i)
+	}
+	var fp File
+	if err := fsys.OpenFile(&fp, "f.bin", ModeWrite|ModeCreateAlways); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fp.WriteContext(ctx, data)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteContext error = %v, want context.Canceled", err)
+	} else if n == 0 || n >= len(data) || n%2048 != 0 {
+		t.Fatalf("WriteContext wrote %d bytes, want whole clusters", n)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remounted, the free clusters are counted anew: the file must hold
+	// exactly the clusters of the bytes reported written.
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	got := readAllFile(t, fsys, "f.bin")
+	if !bytes.Equal(got, data[:n]) {
+		t.Fatalf("file holds %d bytes, want the %d written", len(got), n)
+	}
+	free, err := fsys.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free0-free != int64(n) {
+		t.Errorf("free space dropped by %d, want %d", free0-free, n)
+	}
+}
+
+func TestFormatContext(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16})
+	createPat(t, fsys, "f.bin", 3, 1000)
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelled before it starts: the device is not touched.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cd := &cancelingDevice{BlockDeviceExtended: dev, cancel: cancel}
+	var fmtr Formatter
+	err := fmtr.FormatContext(ctx, cd, 512, 8192, FormatParams{Format: FormatFAT16})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("FormatContext error = %v, want context.Canceled", err)
+	} else if cd.writes != 0 {
+		t.Fatalf("cancelled FormatContext wrote %d sectors", cd.writes)
+	}
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllFile(t, fsys, "f.bin"); len(got) != 1000 {
+		t.Fatalf("file holds %d bytes after cancelled format", len(got))
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelled half way: the device no longer mounts.
+	ctx, cancel = context.WithCancel(context.Background())
+	cd = &cancelingDevice{BlockDeviceExtended: dev, cancel: cancel, after: 5}
+	err = fmtr.FormatContext(ctx, cd, 512, 8192, FormatParams{Format: FormatFAT16})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("FormatContext error = %v, want context.Canceled", err)
+	}
+	if err := fsys.Mount(dev, 512, ModeRW); err == nil {
+		t.Fatal("half formatted device mounted")
+	}
+
+	// Formatting to the end works as Format.
+	if err := fmtr.FormatContext(context.Background(), dev, 512, 8192, FormatParams{Format: FormatFAT16}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForEachFileContext(t *testing.T) {
+	fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16})
+	for i := 0; i < 5; i++ {
+		createPat(t, fsys, fmt.Sprintf("f%d.bin", i), i, 10)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var dp Dir
+	if err := fsys.OpenDir(&dp, "/"); err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	calls := 0
+	err := dp.ForEachFileContext(ctx, func(*FileInfo) error {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ForEachFileContext error = %v, want context.Canceled", err)
+	} else if calls != 2 {
+		t.Fatalf("callback called %d times after cancel at 2", calls)
+	}
+
+	// The free cluster count of a FAT16 volume has to be counted on the FAT,
+	// which is abandoned.
+	if _, err := fsys.FreeSpaceContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("FreeSpaceContext error = %v, want context.Canceled", err)
+	}
+	want, err := fsys.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fsys.FreeSpaceContext(context.Background())
+	if err != nil || got != want {
+		t.Fatalf("FreeSpaceContext = %d, %v; want %d", got, err, want)
+	}
+}
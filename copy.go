@@ -0,0 +1,279 @@
+package fat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// CopyConfig configures how [FS.ImportFS] and [FS.ExportDir] map names and
+// attributes between a FAT volume and the host. The zero value copies names
+// verbatim.
+type CopyConfig struct {
+	// MapName, if non-nil, is called with the name of every file and
+	// directory copied and returns the name to give it at the destination,
+	// or "" to skip the entry along with, for a directory, its contents.
+	// Without MapName a name the destination cannot represent aborts the
+	// copy. [SanitizeName] is a mapping suited to imports.
+	MapName func(name string, isDir bool) string
+	// HiddenDotFiles maps FAT's hidden attribute to the Unix convention of
+	// a leading dot: ImportFS sets AttrHidden on entries whose source name
+	// starts with '.', and ExportDir prefixes the names of hidden entries
+	// that lack one with '.'. Without it the hidden attribute is neither
+	// set on import nor represented on export.
+	HiddenDotFiles bool
+}
+
+// ImportFS recursively copies the contents of src into the existing
+// directory dst of the volume, creating files and directories and
+// overwriting files that exist, read-only ones included. Use [os.DirFS] to
+// import a host directory and [fs.Sub] to import part of a tree.
+//
+// Modification times are preserved to the FAT resolution, see Chtimes, and
+// files without write permission in src are marked AttrReadOnly. Entries
+// that are neither regular files nor directories, after following symbolic
+// links, are skipped, and so are links to a directory being imported, which
+// would nest copies of it endlessly; these are recognized with [os.SameFile]
+// and so only in the host filesystem. Errors are reported as [*fs.PathError]
+// naming the source path.
+func (fsys *FS) ImportFS(dst string, src fs.FS, cfg *CopyConfig) error {
+	if cfg == nil {
+		cfg = &CopyConfig{}
+	}
+	if !isRootPath(dst) {
+		var info FileInfo
+		if err := fsys.Stat(dst, &info); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return &fs.PathError{Op: "import", Path: dst, Err: frNoPath}
+		}
+	}
+	root, err := fs.Stat(src, ".")
+	if err != nil {
+		return &fs.PathError{Op: "import", Path: ".", Err: err}
+	}
+	buf := make([]byte, copyBufSize)
+	return fsys.importDir(dst, src, ".", cfg, buf, []fs.FileInfo{root})
+}
+
+// importDir imports the directory dir of src into dst. parents holds the
+// directories of src being imported, dir last.
+func (fsys *FS) importDir(dst string, src fs.FS, dir string, cfg *CopyConfig, buf []byte, parents []fs.FileInfo) error {
+	entries, err := fs.ReadDir(src, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		spath := path.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err == nil && !entry.IsDir() && !entry.Type().IsRegular() {
+			info, err = fs.Stat(src, spath) // Follow symbolic links.
+		}
+		if err != nil {
+			return &fs.PathError{Op: "import", Path: spath, Err: err}
+		}
+		isDir := info.IsDir()
+		if !isDir && !info.Mode().IsRegular() {
+			continue // Devices, pipes, sockets and dangling links.
+		} else if isDir && isParent(parents, info) {
+			continue // A link to a directory being imported.
+		}
+		name := entry.Name()
+		if cfg.MapName != nil {
+			name = cfg.MapName(name, isDir)
+			if name == "" {
+				continue
+			}
+		}
+		dpath := path.Join(dst, name)
+		if isDir {
+			err = fsys.Mkdir(dpath)
+			if errors.Is(err, fs.ErrExist) {
+				var dinfo FileInfo
+				if err = fsys.Stat(dpath, &dinfo); err == nil && !dinfo.IsDir() {
+					err = frExist
+				}
+			}
+			if err == nil {
+				err = fsys.importDir(dpath, src, spath, cfg, buf, append(parents, info))
+			}
+		} else {
+			err = fsys.importFile(dpath, src, spath, buf)
+		}
+		var attr byte
+		if !isDir && info.Mode().Perm()&0o200 == 0 {
+			attr |= AttrReadOnly
+		}
+		if cfg.HiddenDotFiles && strings.HasPrefix(entry.Name(), ".") {
+			attr |= AttrHidden
+		}
+		if err == nil && attr != 0 {
+			err = fsys.Chmod(dpath, attr, attr)
+		}
+		if err == nil {
+			err = fsys.Chtimes(dpath, info.ModTime())
+		}
+		if err != nil {
+			var perr *fs.PathError
+			if !errors.As(err, &perr) {
+				err = &fs.PathError{Op: "import", Path: spath, Err: err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// isParent reports whether info is that of a directory of parents.
+func isParent(parents []fs.FileInfo, info fs.FileInfo) bool {
+	for _, p := range parents {
+		if os.SameFile(p, info) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsys *FS) importFile(dpath string, src fs.FS, spath string, buf []byte) error {
+	sf, err := src.Open(spath)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	var info FileInfo
+	if fsys.Stat(dpath, &info) == nil && info.Sys().(byte)&AttrReadOnly != 0 {
+		// Imported read-only before: importDir sets the attribute again.
+		if err = fsys.Chmod(dpath, 0, AttrReadOnly); err != nil {
+			return err
+		}
+	}
+	var fp File
+	err = fsys.OpenFile(&fp, dpath, ModeCreateAlways|ModeWrite)
+	if err != nil {
+		return err
+	}
+	_, err = fp.readFrom(sf, buf)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ExportDir recursively copies the directory src of the volume into the
+// host directory hostDir, which is created if missing. Existing host files
+// are overwritten unless they are read-only.
+//
+// Modification times are preserved and files with AttrReadOnly are left
+// without write permission. Errors are reported as [*fs.PathError] naming
+// the volume path, or the host path for errors of the host filesystem.
+func (fsys *FS) ExportDir(hostDir, src string, cfg *CopyConfig) error {
+	if cfg == nil {
+		cfg = &CopyConfig{}
+	}
+	if err := os.MkdirAll(hostDir, 0o777); err != nil {
+		return err
+	}
+	buf := make([]byte, copyBufSize)
+	return fsys.exportDir(hostDir, src, cfg, buf)
+}
+
+func (fsys *FS) exportDir(hostDir, src string, cfg *CopyConfig, buf []byte) error {
+	var dp Dir
+	if err := fsys.OpenDir(&dp, src); err != nil {
+		return &fs.PathError{Op: "export", Path: src, Err: err}
+	}
+	defer dp.Close()
+	var info FileInfo
+	for {
+		err := dp.ReadNext(&info)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &fs.PathError{Op: "export", Path: src, Err: err}
+		}
+		spath := path.Join(src, info.Name())
+		isDir := info.IsDir()
+		name := info.Name()
+		if cfg.MapName != nil {
+			name = cfg.MapName(name, isDir)
+			if name == "" {
+				continue
+			}
+		}
+		if cfg.HiddenDotFiles && info.fattrib&amHID != 0 && !strings.HasPrefix(name, ".") {
+			name = "." + name
+		}
+		if !filepath.IsLocal(name) || filepath.Base(name) != name {
+			return &fs.PathError{Op: "export", Path: spath, Err: fs.ErrInvalid}
+		}
+		hpath := filepath.Join(hostDir, name)
+		mtime := info.ModTime()
+		if isDir {
+			err = os.Mkdir(hpath, 0o777)
+			if errors.Is(err, fs.ErrExist) {
+				err = nil // Merge into an existing directory.
+			}
+			if err == nil {
+				err = fsys.exportDir(hpath, spath, cfg, buf)
+			}
+		} else {
+			err = fsys.exportFile(hpath, spath, buf)
+			if err == nil && info.fattrib&amRDO != 0 {
+				err = os.Chmod(hpath, 0o444)
+			}
+		}
+		if err == nil {
+			err = os.Chtimes(hpath, mtime, mtime)
+		}
+		if err != nil {
+			var perr *fs.PathError
+			if !errors.As(err, &perr) {
+				err = &fs.PathError{Op: "export", Path: spath, Err: err}
+			}
+			return err
+		}
+	}
+}
+
+func (fsys *FS) exportFile(hpath, spath string, buf []byte) error {
+	var fp File
+	err := fsys.OpenFile(&fp, spath, ModeRead)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	hf, err := os.OpenFile(hpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	_, err = fp.writeTo(hf, buf)
+	if cerr := hf.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copyBufSize is the transfer buffer size of ImportFS and ExportDir.
+const copyBufSize = 32 * 1024
+
+// SanitizeName is a [CopyConfig.MapName] function that replaces the
+// characters FAT forbids in names, including control characters and path
+// separators, with '_'. It does not shorten names: on builds without long
+// file name support (fat_nolfn) names must still fit the 8.3 format.
+func SanitizeName(name string, isDir bool) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || (r < 0x80 && strings.IndexByte(forbiddenChars, byte(r)) >= 0) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// isRootPath reports whether path names the root directory of the volume.
+func isRootPath(path string) bool {
+	return strings.Trim(path, `/\`) == ""
+}
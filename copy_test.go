@@ -0,0 +1,258 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestChmodChtimes(t *testing.T) {
+	t.Run("FAT", func(t *testing.T) {
+		fsys, _ := initTestFAT()
+		testChmodChtimes(t, fsys)
+	})
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		fsys, _, err := initTestExFAT(0x1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testChmodChtimes(t, fsys)
+	})
+}
+
+func testChmodChtimes(t *testing.T, fsys *FS) {
+	writeStr(t, fsys, "rootdir/attr.txt", "attributes")
+	mtime := time.Date(2021, 7, 14, 13, 37, 42, 0, time.UTC)
+	for _, path := range []string{"rootdir/attr.txt", "rootdir"} {
+		if err := fsys.Chtimes(path, mtime); err != nil {
+			t.Fatalf("Chtimes(%q): %v", path, err)
+		}
+		var info FileInfo
+		if err := fsys.Stat(path, &info); err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: ModTime = %v, want %v", path, info.ModTime(), mtime)
+		}
+	}
+	// Out of range times are clamped.
+	if err := fsys.Chtimes("rootdir/attr.txt", time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var info FileInfo
+	if err := fsys.Stat("rootdir/attr.txt", &info); err != nil {
+		t.Fatal(err)
+	}
+	if y := info.ModTime().Year(); y != 1980 {
+		t.Errorf("clamped year = %d, want 1980", y)
+	}
+
+	const path = "rootdir/attr.txt"
+	if err := fsys.Chmod(path, AttrReadOnly|AttrHidden, AttrReadOnly|AttrHidden|AttrDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Stat(path, &info); err != nil {
+		t.Fatal(err)
+	}
+	if attr := info.Sys().(byte); attr&(AttrReadOnly|AttrHidden) != AttrReadOnly|AttrHidden || attr&AttrDir != 0 {
+		t.Errorf("attributes = %#x after Chmod", attr)
+	}
+	if info.Mode().Perm() != 0o444 {
+		t.Errorf("read-only mode = %v", info.Mode())
+	}
+	if err := fsys.Remove(path); err == nil {
+		t.Error("removed read-only file")
+	}
+	// Clear only the read-only bit.
+	if err := fsys.Chmod(path, 0, AttrReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Stat(path, &info); err != nil {
+		t.Fatal(err)
+	}
+	if attr := info.Sys().(byte); attr&(AttrReadOnly|AttrHidden) != AttrHidden {
+		t.Errorf("attributes = %#x after clearing read-only", attr)
+	}
+	if err := fsys.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Chmod("nofile", AttrHidden, AttrHidden); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chmod of missing file = %v", err)
+	}
+	if err := fsys.Chtimes("/", mtime); err == nil {
+		t.Error("Chtimes of root directory succeeded")
+	}
+}
+
+// TestImportExport copies a tree into a volume and back out to the host,
+// checking contents, timestamps and attribute mapping survive both ways.
+func TestImportExport(t *testing.T) {
+	mtime := time.Date(2020, 2, 29, 10, 20, 30, 0, time.UTC)
+	data := bytes.Repeat([]byte("import export "), 1000)
+	src := fstest.MapFS{
+		"top.txt":          {Data: []byte("top"), Mode: 0o644, ModTime: mtime},
+		"ro.txt":           {Data: []byte("read only"), Mode: 0o444, ModTime: mtime.Add(time.Hour)},
+		"sub/big.bin":      {Data: data, Mode: 0o644, ModTime: mtime},
+		"sub/deep/x.dat":   {Data: []byte("deep"), Mode: 0o600, ModTime: mtime},
+		"sub":              {Mode: fs.ModeDir | 0o755, ModTime: mtime.Add(2 * time.Hour)},
+		"skip/ignored.txt": {Data: []byte("ignored")},
+	}
+	// Names only representable with long file names.
+	if lfnEnabled {
+		src["a:b.txt"] = &fstest.MapFile{Data: []byte("colon"), Mode: 0o644, ModTime: mtime}
+		src[".hidden"] = &fstest.MapFile{Data: []byte("dot"), Mode: 0o644, ModTime: mtime}
+	}
+	cfg := &CopyConfig{
+		MapName: func(name string, isDir bool) string {
+			if isDir && name == "skip" {
+				return ""
+			}
+			return SanitizeName(name, isDir)
+		},
+		HiddenDotFiles: true,
+	}
+	fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16})
+	if err := fsys.Mkdir("in"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.ImportFS("in", src, cfg); err != nil {
+		t.Fatal("import:", err)
+	}
+	if got := readAllFile(t, fsys, "in/sub/big.bin"); !bytes.Equal(got, data) {
+		t.Error("in/sub/big.bin content mismatch")
+	}
+	var info FileInfo
+	if err := fsys.Stat("in/skip", &info); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("skipped directory imported: %v", err)
+	}
+	if err := fsys.Stat("in/ro.txt", &info); err != nil {
+		t.Fatal(err)
+	} else if info.Sys().(byte)&AttrReadOnly == 0 {
+		t.Error("in/ro.txt not read-only")
+	}
+	if lfnEnabled {
+		if got := readAllFile(t, fsys, "in/a_b.txt"); string(got) != "colon" {
+			t.Errorf("sanitized name content = %q", got)
+		}
+		if err := fsys.Stat("in/.hidden", &info); err != nil {
+			t.Fatal(err)
+		} else if info.Sys().(byte)&AttrHidden == 0 {
+			t.Error("dot file not hidden")
+		}
+	}
+	// Importing again overwrites files, read-only ones included, and merges
+	// into existing directories.
+	src["ro.txt"].Data = []byte("read only again")
+	if err := fsys.ImportFS("in", src, cfg); err != nil {
+		t.Fatal("second import:", err)
+	}
+	if got := readAllFile(t, fsys, "in/ro.txt"); string(got) != "read only again" {
+		t.Errorf("in/ro.txt content after the second import = %q", got)
+	} else if err := fsys.Stat("in/ro.txt", &info); err != nil {
+		t.Fatal(err)
+	} else if info.Sys().(byte)&AttrReadOnly == 0 {
+		t.Error("in/ro.txt not read-only after the second import")
+	}
+	if err := fsys.ImportFS("in/top.txt", src, cfg); err == nil {
+		t.Error("import into a file succeeded")
+	}
+
+	// Export back to the host and compare.
+	host := t.TempDir()
+	if err := fsys.ExportDir(host, "in", cfg); err != nil {
+		t.Fatal("export:", err)
+	}
+	hostName := func(name string) string {
+		if !lfnEnabled {
+			return strings.ToUpper(name) // 8.3 names are listed in upper case.
+		}
+		return name
+	}
+	for name, want := range map[string]string{
+		"top.txt":        "top",
+		"ro.txt":         "read only again",
+		"sub/big.bin":    string(data),
+		"sub/deep/x.dat": "deep",
+	} {
+		hpath := filepath.Join(host, hostName(name))
+		got, err := os.ReadFile(hpath)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Errorf("%s: exported content mismatch", name)
+		}
+		hinfo, err := os.Stat(hpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantTime := mtime
+		if name == "ro.txt" {
+			wantTime = mtime.Add(time.Hour)
+		}
+		if !hinfo.ModTime().Equal(wantTime) {
+			t.Errorf("%s: exported ModTime = %v, want %v", name, hinfo.ModTime(), wantTime)
+		}
+		if wantRO := name == "ro.txt"; (hinfo.Mode().Perm()&0o200 == 0) != wantRO {
+			t.Errorf("%s: exported mode = %v", name, hinfo.Mode())
+		}
+	}
+	hinfo, err := os.Stat(filepath.Join(host, hostName("sub")))
+	if err != nil {
+		t.Fatal(err)
+	} else if !hinfo.IsDir() || !hinfo.ModTime().Equal(mtime.Add(2*time.Hour)) {
+		t.Errorf("exported sub: dir=%v ModTime=%v", hinfo.IsDir(), hinfo.ModTime())
+	}
+	if lfnEnabled {
+		if _, err := os.Stat(filepath.Join(host, ".hidden")); err != nil {
+			t.Errorf("hidden file not exported as dot file: %v", err)
+		}
+	}
+	// Make the read-only export removable by the temporary directory cleanup.
+	os.Chmod(filepath.Join(host, hostName("ro.txt")), 0o644)
+}
+
+// TestImportSymlinkLoop imports a host tree holding links to directories
+// that contain them, which are skipped, and a link to another directory,
+// which is followed.
+func TestImportSymlinkLoop(t *testing.T) {
+	host := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(host, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(host, "a", "x.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(host, "b", "y.txt"), []byte("y"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"a/up": "..", "a/self": ".", "a/tob": "../b"} {
+		if err := os.Symlink(target, filepath.Join(host, link)); err != nil {
+			t.Skip("symbolic links unsupported:", err)
+		}
+	}
+	fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16})
+	if err := fsys.ImportFS("/", os.DirFS(host), nil); err != nil {
+		t.Fatal("import:", err)
+	}
+	var info FileInfo
+	for _, path := range []string{"a/up", "a/self"} {
+		if err := fsys.Stat(path, &info); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("link to a parent %s imported: %v", path, err)
+		}
+	}
+	if got := readAllFile(t, fsys, "a/tob/y.txt"); string(got) != "y" {
+		t.Errorf("a/tob/y.txt = %q through a link to a directory", got)
+	}
+	if got := readAllFile(t, fsys, "a/x.txt"); string(got) != "x" {
+		t.Errorf("a/x.txt = %q", got)
+	}
+}
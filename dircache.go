@@ -0,0 +1,241 @@
+package fat
+
+// dirCache is the optional directory lookup cache sized by
+// [FSConfig.DirCacheEntries]. It holds an index of the entries of the most
+// recently searched directories, each complete: a name that is not in the
+// index of its directory is not in the directory.
+//
+// The index only narrows the search. An entry found by name hash is still
+// read and compared on the device, so hash collisions cost a sector read
+// each and never a wrong match.
+type dirCache struct {
+	dirs  []*dirIndex
+	nents int    // Entries held by all of dirs.
+	seq   uint64 // Use counter, for least recently used eviction.
+}
+
+// dirIndex is the index of the directory starting at cluster sclust, 0 for
+// the root directory.
+type dirIndex struct {
+	sclust uint32
+	ents   []dirIndexEnt
+	big    bool // The directory does not fit the budget and is not indexed.
+	used   uint64
+}
+
+// dirIndexEnt locates an object in its directory. pos is the offset of its
+// first entry. hash is the hash of its long name, upcased, and shash of its
+// short name; 0 when it has none. On exFAT hash is the NameHash of the entry
+// set.
+type dirIndexEnt struct {
+	pos, hash, shash uint32
+}
+
+// sfn_hash returns the FNV-1a hash of the 11 byte short name sfn.
+func sfn_hash(sfn []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range sfn[:11] {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return h | 1
+}
+
+// dcache_reset drops every index, on mount or when the cache is resized.
+func (fsys *FS) dcache_reset() {
+	if fsys.dcacheEntries <= 0 {
+		fsys.dcache = nil
+		return
+	}
+	if fsys.dcache == nil {
+		fsys.dcache = &dirCache{}
+	}
+	clear(fsys.dcache.dirs)
+	fsys.dcache.dirs = fsys.dcache.dirs[:0]
+	fsys.dcache.nents = 0
+}
+
+// dindex_get returns the index of the directory at sclust, nil if none.
+func (fsys *FS) dindex_get(sclust uint32) *dirIndex {
+	dc := fsys.dcache
+	if dc == nil {
+		return nil
+	}
+	for _, idx := range dc.dirs {
+		if idx.sclust == sclust {
+			dc.seq++
+			idx.used = dc.seq
+			return idx
+		}
+	}
+	return nil
+}
+
+// dindex_drop drops the index of the directory at sclust, as it is removed
+// or created anew on clusters that may have held another directory.
+func (fsys *FS) dindex_drop(sclust uint32) {
+	dc := fsys.dcache
+	if dc == nil {
+		return
+	}
+	for i, idx := range dc.dirs {
+		if idx.sclust == sclust {
+			dc.nents -= len(idx.ents)
+			dc.dirs = append(dc.dirs[:i], dc.dirs[i+1:]...)
+			return
+		}
+	}
+}
+
+// dindex_reserve evicts the least recently used indexes until n more entries
+// fit the budget, keeping keep. It reports false if they cannot fit.
+func (fsys *FS) dindex_reserve(n int, keep *dirIndex) bool {
+	dc := fsys.dcache
+	for dc.nents+n > fsys.dcacheEntries {
+		var lru *dirIndex
+		for _, idx := range dc.dirs {
+			if idx != keep && (lru == nil || idx.used < lru.used) {
+				lru = idx
+			}
+		}
+		if lru == nil {
+			return false
+		}
+		fsys.dindex_drop(lru.sclust)
+	}
+	return true
+}
+
+// dindex returns the index of directory dp, reading the directory to build
+// it if not cached. The index of a directory too large for the budget has
+// big set. The name to find, in fsys.lfnbuf, is preserved.
+func (dp *dir) dindex() (*dirIndex, fileResult) {
+	fsys := dp.obj.fs
+	if idx := fsys.dindex_get(dp.obj.sclust); idx != nil {
+		return idx, frOK
+	}
+	fsys.trace("dir:dindex_build")
+	lfn := fsys.lfnbuf // Reading the directory picks names into lfnbuf.
+	defer func() { fsys.lfnbuf = lfn }()
+	idx := &dirIndex{sclust: dp.obj.sclust}
+	fr := dp.sdi(0)
+	for fr == frOK {
+		fr = dp.read(false)
+		if fr != frOK {
+			break
+		}
+		if len(idx.ents) == fsys.dcacheEntries {
+			idx.ents, idx.big = nil, true
+			fr = frNoFile
+			break
+		}
+		var ent dirIndexEnt
+		if fsys.isExfat() {
+			ent.pos = dp.blk_ofs
+			ent.hash = fsys.xdir_key()
+		} else {
+			ent.pos = dp.dptr
+			if dp.blk_ofs != badLBA {
+				ent.pos = dp.blk_ofs
+				ent.hash = lfn_hash(fsys.lfnbuf[:])
+			}
+			ent.shash = sfn_hash(dp.dir)
+		}
+		idx.ents = append(idx.ents, ent)
+		fr = dp.next(false)
+	}
+	if fr != frNoFile {
+		return nil, fr
+	}
+	if !fsys.dindex_reserve(len(idx.ents), nil) {
+		idx.ents, idx.big = nil, true
+	}
+	dc := fsys.dcache
+	dc.seq++
+	idx.used = dc.seq
+	dc.dirs = append(dc.dirs, idx)
+	dc.nents += len(idx.ents)
+	return idx, frOK
+}
+
+// find_indexed is dir.find through the directory's index. It reports false
+// if the directory is not indexed, leaving the search to a scan.
+func (dp *dir) find_indexed() (fileResult, bool) {
+	fsys := dp.obj.fs
+	if dp.fn[nsFLAG]&nsDOT != 0 {
+		return frOK, false // Dot entries are not indexed.
+	}
+	idx, fr := dp.dindex()
+	if fr != frOK {
+		return fr, true
+	} else if idx.big {
+		return frOK, false
+	}
+	var hash, shash uint32
+	if fsys.isExfat() {
+		hash = fsys.xname_key()
+	} else {
+		if dp.fn[nsFLAG]&nsNOLFN == 0 {
+			hash = lfn_hash(fsys.lfnbuf[:])
+		}
+		if dp.fn[nsFLAG]&nsLOSS == 0 {
+			shash = sfn_hash(dp.fn[:])
+		}
+	}
+	for _, ent := range idx.ents {
+		if (hash == 0 || ent.hash != hash) && (shash == 0 || ent.shash != shash) {
+			continue
+		}
+		if fr = dp.sdi(ent.pos); fr != frOK {
+			return fr, true
+		}
+		if fr = dp.find_at(); fr != frNoFile {
+			return fr, true // Found, or disk error.
+		}
+	}
+	return frNoFile, true
+}
+
+// dindex_add records the object just registered in directory dp, whose
+// first entry is at pos, in the directory's index.
+func (dp *dir) dindex_add(pos uint32, hasLFN bool) {
+	fsys := dp.obj.fs
+	idx := fsys.dindex_get(dp.obj.sclust)
+	if idx == nil || idx.big {
+		return
+	}
+	ent := dirIndexEnt{pos: pos}
+	if fsys.isExfat() {
+		ent.hash = fsys.xname_key()
+	} else {
+		if hasLFN {
+			ent.hash = lfn_hash(fsys.lfnbuf[:])
+		}
+		ent.shash = sfn_hash(dp.fn[:])
+	}
+	if !fsys.dindex_reserve(1, idx) {
+		fsys.dindex_drop(idx.sclust) // The directory outgrew the budget.
+		return
+	}
+	idx.ents = append(idx.ents, ent)
+	fsys.dcache.nents++
+}
+
+// dindex_remove removes the object of directory dp about to be removed from
+// the directory's index.
+func (dp *dir) dindex_remove() {
+	idx := dp.obj.fs.dindex_get(dp.obj.sclust)
+	if idx == nil || idx.big {
+		return
+	}
+	pos := dp.blk_ofs
+	if pos == badLBA {
+		pos = dp.dptr
+	}
+	for i, ent := range idx.ents {
+		if ent.pos == pos {
+			idx.ents = append(idx.ents[:i], idx.ents[i+1:]...)
+			dp.obj.fs.dcache.nents--
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package fat
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestDirCacheGoldenTorture runs the golden torture scripts with the
+// directory lookup cache enabled, small enough to evict: the cache changes
+// how entries are found, never what ends up on the device.
+func TestDirCacheGoldenTorture(t *testing.T) {
+	skipIfNoLFN(t)
+	for _, test := range []struct {
+		baseline, torture string
+		exfat             bool
+		script            func(*testing.T, *FS)
+	}{
+		{"golden-fmt16.img", "golden-torture16.img", false, tortureScriptSmall},
+		{"golden-fmt32.img", "golden-torture32.img", false, tortureScript32},
+		{"golden-fmtex.img", "golden-tortureex.img", true, func(t *testing.T, fsys *FS) {
+			tortureScript32(t, fsys)
+			tortureScriptExFAT(t, fsys)
+		}},
+	} {
+		t.Run(test.torture, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			dev := goldenDevice(t, test.baseline)
+			var fsys FS
+			fsys.Configure(FSConfig{NoZeroFilling: true, DirCacheEntries: 24})
+			if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+				t.Fatal(err)
+			}
+			test.script(t, &fsys)
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			compareGolden(t, dev, test.torture)
+		})
+	}
+}
+
+// TestDirCacheReducesReads stats every file of a large directory and
+// requires the cache to cut the sectors read.
+func TestDirCacheReducesReads(t *testing.T) {
+	const nfiles = 600
+	fsys, dev := formatAndMount(t, 16384, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	if err := fsys.Mkdir("big"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nfiles; i++ {
+		writeStr(t, fsys, fmt.Sprintf("big/f%04d.txt", i), "x")
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	cd := &countingDevice{BlockDeviceExtended: dev}
+	run := func(entries int) int {
+		fsys.Configure(FSConfig{DirCacheEntries: entries})
+		if err := fsys.Mount(cd, 512, ModeRead); err != nil {
+			t.Fatal(err)
+		}
+		defer fsys.Unmount()
+		cd.reads = 0
+		var fi FileInfo
+		for i := nfiles - 1; i >= 0; i-- {
+			if err := fsys.Stat(fmt.Sprintf("big/f%04d.txt", i), &fi); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fsys.Stat("big/missing.txt", &fi); err == nil {
+			t.Fatal("stat of a missing file succeeded")
+		}
+		return cd.reads
+	}
+	r0 := run(0)
+	r1 := run(1024)
+	rbig := run(100) // Directory over budget: scanned as without cache.
+	t.Logf("sectors read: %d -> %d, %d over budget", r0, r1, rbig)
+	if r1*8 > r0 {
+		t.Errorf("cache read %d sectors, want well under %d", r1, r0)
+	}
+	if rbig > r0+r0/8 {
+		t.Errorf("over budget cache read %d sectors, want about %d", rbig, r0)
+	}
+}
+
+// TestDirCacheRandom creates, removes, renames and recreates files and
+// directories in a few directories with a cache too small for all of them,
+// checking every lookup against a model.
+func TestDirCacheRandom(t *testing.T) {
+	t.Run("FAT16", func(t *testing.T) {
+		fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+		runDirCacheRandom(t, fsys, dev)
+	})
+	t.Run("FAT32", func(t *testing.T) {
+		fsys, dev := formatAndMount(t, 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1})
+		runDirCacheRandom(t, fsys, dev)
+	})
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatExFAT, ClusterSize: 4})
+		runDirCacheRandom(t, fsys, dev)
+	})
+}
+
+func runDirCacheRandom(t *testing.T, fsys *FS, dev BlockDevice) {
+	fsys.Configure(FSConfig{DirCacheEntries: 40})
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	dirs := []string{"", "d0/", "d1/"}
+	for _, d := range dirs[1:] {
+		if err := fsys.Mkdir(d[:len(d)-1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := func(rng *rand.Rand) string {
+		if lfnEnabled && rng.Intn(2) == 0 {
+			return fmt.Sprintf("Long Name %d.text", rng.Intn(12))
+		}
+		return fmt.Sprintf("N%d.TXT", rng.Intn(12))
+	}
+	model := map[string]string{} // Path to contents; "/" for a directory.
+	rng := rand.New(rand.NewSource(1))
+	for step := 0; step < 2000; step++ {
+		path := dirs[rng.Intn(len(dirs))] + name(rng)
+		_, exists := model[path]
+		switch op := rng.Intn(10); {
+		case op < 4: // Create or overwrite a file.
+			if model[path] == "/" {
+				continue
+			}
+			s := fmt.Sprint(step)
+			writeStr(t, fsys, path, s)
+			model[path] = s
+		case op < 5: // Make a directory, possibly on clusters of one removed.
+			err := fsys.Mkdir(path)
+			if exists != (err != nil) {
+				t.Fatalf("step %d: mkdir %s: %v, exists %v", step, path, err, exists)
+			}
+			if !exists {
+				model[path] = "/"
+			}
+		case op < 7: // Remove.
+			err := fsys.Remove(path)
+			if exists != (err == nil) {
+				t.Fatalf("step %d: remove %s: %v, exists %v", step, path, err, exists)
+			}
+			delete(model, path)
+		case op < 8: // Rename, possibly across directories.
+			to := dirs[rng.Intn(len(dirs))] + name(rng)
+			if _, taken := model[to]; !exists || taken {
+				continue
+			}
+			if err := fsys.Rename(path, to); err != nil {
+				t.Fatalf("step %d: rename %s %s: %v", step, path, to, err)
+			}
+			model[to] = model[path]
+			delete(model, path)
+		default: // Look up.
+			var fi FileInfo
+			err := fsys.Stat(path, &fi)
+			if exists != (err == nil) {
+				t.Fatalf("step %d: stat %s: %v, exists %v", step, path, err, exists)
+			}
+			if exists && model[path] != "/" && fi.Size() != int64(len(model[path])) {
+				t.Fatalf("step %d: stat %s: size %d, want %d", step, path, fi.Size(), len(model[path]))
+			}
+		}
+	}
+	for path, s := range model {
+		if s != "/" {
+			if got := string(readAllFile(t, fsys, path)); got != s {
+				t.Errorf("%s holds %q, want %q", path, got, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package fat
+
+import (
+	"io"
+	"io/fs"
+	"strconv"
+)
+
+// Errors of the filesystem, the results of FatFs. The operations of FS, File
+// and Dir return them wrapped in an [*fs.PathError] naming the operation and
+// the path: test for them with [errors.Is]. Those that have one also match
+// their [fs.ErrNotExist], [fs.ErrExist], [fs.ErrInvalid] or
+// [fs.ErrPermission], and ErrDiskFull matches [io.ErrShortWrite].
+var (
+	// ErrDisk is a transfer the device failed. The error is then a
+	// [*DeviceError] holding that of the device, if it returned one.
+	ErrDisk error = frDiskErr
+	// ErrInternal is a structure of the volume found inconsistent, or an
+	// internal error.
+	ErrInternal error = frIntErr
+	// ErrNotReady is a device that is not ready.
+	ErrNotReady error = frNotReady
+	// ErrNoFile is a file or directory that does not exist.
+	ErrNoFile error = frNoFile
+	// ErrNoPath is a directory of the path that does not exist.
+	ErrNoPath error = frNoPath
+	// ErrInvalidName is a path or name not valid on FAT.
+	ErrInvalidName error = frInvalidName
+	// ErrDenied is an access denied: to a read-only or open file, to remove a
+	// directory not empty, or to create an entry in a full directory or on a
+	// full volume.
+	ErrDenied error = frDenied
+	// ErrExist is a file or directory that exists.
+	ErrExist error = frExist
+	// ErrInvalidObject is a File or Dir that is closed, or whose volume was
+	// unmounted.
+	ErrInvalidObject error = frInvalidObject
+	// ErrWriteProtected is a write to a volume or file not open for writing.
+	ErrWriteProtected error = frWriteProtected
+	// ErrInvalidDrive is an invalid drive.
+	ErrInvalidDrive error = frInvalidDrive
+	// ErrNotEnabled is an operation on a filesystem not mounted.
+	ErrNotEnabled error = frNotEnabled
+	// ErrNoFilesystem is a device holding no FAT or exFAT volume, or an
+	// Unmount of a filesystem not mounted.
+	ErrNoFilesystem error = frNoFilesystem
+	// ErrMkfsAborted is a format that cannot be made with its parameters.
+	ErrMkfsAborted error = frMkfsAborted
+	// ErrTimeout is a volume that could not be accessed in time.
+	ErrTimeout error = frTimeout
+	// ErrLocked is an operation rejected by the file sharing policy.
+	ErrLocked error = frLocked
+	// ErrNotEnoughCore is a buffer too small for the operation.
+	ErrNotEnoughCore error = frNotEnoughCore
+	// ErrTooManyOpenFiles is an open past the limit of open files.
+	ErrTooManyOpenFiles error = frTooManyOpenFiles
+	// ErrInvalidParameter is a parameter not valid.
+	ErrInvalidParameter error = frInvalidParameter
+	// ErrUnsupported is an operation not supported on the volume.
+	ErrUnsupported error = frUnsupported
+	// ErrClosed is a closed file.
+	ErrClosed error = frClosed
+	// ErrGeneric is any other error.
+	ErrGeneric error = frGeneric
+	// ErrVerify is written data that read back different, see
+	// [FSConfig.VerifyWrites].
+	ErrVerify error = frVerifyErr
+	// ErrDiskFull is a write that found no free cluster for its data.
+	ErrDiskFull error = frDiskFull
+)
+
+// DeviceError is the error of a [BlockDevice] transfer that failed an
+// operation, which matches both [ErrDisk] and the error of the device with
+// [errors.Is] and [errors.As].
+type DeviceError struct {
+	Op    string // "read", "write" or "erase".
+	Block int64  // First block of the transfer.
+	Err   error  // Error of the device.
+}
+
+func (e *DeviceError) Error() string {
+	return "fat: device " + e.Op + " at block " + strconv.FormatInt(e.Block, 10) + ": " + e.Err.Error()
+}
+
+// Unwrap returns ErrDisk and the error of the device.
+func (e *DeviceError) Unwrap() []error {
+	return []error{ErrDisk, e.Err}
+}
+
+// device_error records err of the device, failing op of the blocks from
+// sector, for the operation under way to return.
+func (fsys *FS) device_error(op string, sector lba, err error) {
+	fsys.deverr = &DeviceError{Op: op, Block: int64(sector), Err: err}
+}
+
+// pathErr returns err of operation op on path as an *fs.PathError, or nil if
+// err is nil or frOK. A frDiskErr of a device transfer is replaced by its
+// DeviceError. io.EOF and errors that already are an *fs.PathError are
+// returned as they are. It takes the DeviceError recorded, so fsys must be
+// locked, or nil.
+func (fsys *FS) pathErr(op, path string, err error) error {
+	var dev *DeviceError
+	if fsys != nil {
+		dev, fsys.deverr = fsys.deverr, nil
+	}
+	if err == nil || err == error(frOK) {
+		return nil
+	} else if err == io.EOF {
+		return err
+	} else if _, ok := err.(*fs.PathError); ok {
+		return err
+	} else if err == error(frDiskErr) && dev != nil {
+		err = dev
+	}
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// wrapErr sets *err to fsys.pathErr(op, path, *err), deferred by operations
+// returning from several places.
+func (fsys *FS) wrapErr(err *error, op, path string) {
+	*err = fsys.pathErr(op, path, *err)
+}
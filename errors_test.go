@@ -0,0 +1,155 @@
+package fat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strconv"
+	"testing"
+)
+
+// driverError is the error type of a device driver, which callers find with
+// errors.As.
+type driverError struct {
+	block int64
+}
+
+func (e *driverError) Error() string {
+	return "driver: CRC error at block " + strconv.FormatInt(e.block, 10)
+}
+
+// driverDevice fails the transfers of block fail with a driverError.
+type driverDevice struct {
+	*BlockByteSlice
+	fail int64
+}
+
+func (dd *driverDevice) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	if dd.fail >= startBlock && dd.fail < startBlock+int64(len(dst))/512 {
+		return 0, &driverError{block: dd.fail}
+	}
+	return dd.BlockByteSlice.ReadBlocks(dst, startBlock)
+}
+
+func (dd *driverDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	if dd.fail >= startBlock && dd.fail < startBlock+int64(len(data))/512 {
+		return 0, &driverError{block: dd.fail}
+	}
+	return dd.BlockByteSlice.WriteBlocks(data, startBlock)
+}
+
+// wantPathError requires err to be an *fs.PathError of operation op on path
+// matching target.
+func wantPathError(t *testing.T, err error, op, path string, target error) {
+	t.Helper()
+	var perr *fs.PathError
+	if !errors.As(err, &perr) {
+		t.Errorf("error %v (%T) is not an *fs.PathError", err, err)
+	} else if perr.Op != op || perr.Path != path {
+		t.Errorf("error %v: op %q, path %q, want %q and %q", err, perr.Op, perr.Path, op, path)
+	}
+	if !errors.Is(err, target) {
+		t.Errorf("error %v does not match %v", err, target)
+	}
+}
+
+func TestPathErrors(t *testing.T) {
+	fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	var info FileInfo
+	err := fsys.Stat("nofile", &info)
+	wantPathError(t, err, "stat", "nofile", ErrNoFile)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat error %v does not match fs.ErrNotExist", err)
+	}
+	wantPathError(t, fsys.Mkdir("nodir/sub"), "mkdir", "nodir/sub", ErrNoPath)
+	createPat(t, fsys, "a.bin", 1, 100)
+	createPat(t, fsys, "b.bin", 2, 100)
+	wantPathError(t, fsys.Rename("a.bin", "b.bin"), "rename", "a.bin", ErrExist)
+	var dir Dir
+	wantPathError(t, fsys.OpenDir(&dir, "a.bin"), "open", "a.bin", ErrNoPath)
+
+	var fp File
+	if err := fsys.OpenFile(&fp, "a.bin", ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.Write([]byte("x"))
+	wantPathError(t, err, "write", "a.bin", ErrWriteProtected)
+	buf := make([]byte, 200)
+	if _, err := fp.ReadAt(buf, 100); err != io.EOF {
+		t.Errorf("read at the end of the file: %v, want io.EOF itself", err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.Read(buf)
+	wantPathError(t, err, "read", "a.bin", ErrInvalidObject)
+
+	// Writing past the free space fails short with ErrDiskFull.
+	free, err := fsys.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.OpenFile(&fp, "full.bin", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fp.Write(make([]byte, free+512))
+	if int64(n) != free {
+		t.Errorf("wrote %d bytes to a volume with %d free", n, free)
+	}
+	wantPathError(t, err, "write", "full.bin", ErrDiskFull)
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("write error %v does not match io.ErrShortWrite", err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	wantPathError(t, fsys.Unmount(), "unmount", "/", ErrNoFilesystem)
+}
+
+func TestDeviceError(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	createPat(t, fsys, "a.bin", 1, 3000)
+	ext := fileExtents(t, fsys, "a.bin")
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	dd := &driverDevice{BlockByteSlice: dev, fail: ext[0].Block + 2}
+	if err := fsys.Mount(dd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	var fp File
+	for _, test := range []struct {
+		op string
+		do func() error
+	}{
+		{"read", func() error { _, err := fp.ReadAt(make([]byte, 3000), 0); return err }},
+		{"write", func() error { _, err := fp.WriteAt(make([]byte, 1024), 1024); return err }},
+	} {
+		// A failed transfer aborts the file: open it again for each.
+		if err := fsys.OpenFile(&fp, "a.bin", ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		err := test.do()
+		fp.Close()
+		wantPathError(t, err, test.op, "a.bin", ErrDisk)
+		var derr *DeviceError
+		if !errors.As(err, &derr) {
+			t.Fatalf("%s error %v holds no *DeviceError", test.op, err)
+		} else if derr.Op != test.op || derr.Block != dd.fail {
+			t.Errorf("%s device error: op %q, block %d, want %q and %d", test.op, derr.Op, derr.Block, test.op, dd.fail)
+		}
+		var drv *driverError
+		if !errors.As(err, &drv) || drv.block != dd.fail {
+			t.Errorf("%s error %v does not unwrap to the driver error", test.op, err)
+		}
+	}
+	// An error that is not the device's holds none.
+	var info FileInfo
+	var derr *DeviceError
+	if err := fsys.Stat("nofile", &info); errors.As(err, &derr) {
+		t.Errorf("stat error %v holds a device error", err)
+	}
+}
@@ -416,6 +416,9 @@ func xsum32(dat byte, sum uint32) uint32 {
 // 0 if not found or badCluster on disk error.
 func (fsys *FS) find_bitmap(clst, ncl uint32) uint32 {
 	fsys.trace("fs:find_bitmap", slog.Uint64("clst", uint64(clst)), slog.Uint64("ncl", uint64(ncl)))
+	if fsys.amap_ready() {
+		return fsys.amap_find(clst, ncl)
+	}
 	ss := uint32(fsys.ssize)
 	clst -= 2 // The first bit in the bitmap corresponds to cluster #2.
 	if clst >= fsys.n_fatent-2 {
@@ -524,10 +527,10 @@ func (obj *objid) create_chain_exfat(clst, scl uint32) (uint32, fileResult) {
 	}
 	if clst == 0 {
 		obj.stat = 2 // New chain: set status 'contiguous'.
-	} else if obj.stat == 2 && ncl != scl+1 {
+	} else if obj.stat == 2 && ncl != clst+1 {
 		// Stretched chain got fragmented.
-		obj.n_cont = scl - obj.sclust // Size of the contiguous part.
-		obj.stat = 3                  // Change status 'just fragmented'.
+		obj.n_cont = clst - obj.sclust // Size of the contiguous part.
+		obj.stat = 3                   // Change status 'just fragmented'.
 	}
 	if obj.stat != 2 {
 		// The file is non-contiguous.
@@ -552,6 +555,34 @@ func (obj *objid) create_chain_exfat(clst, scl uint32) (uint32, fileResult) {
 	return ncl, fr
 }
 
+// chain_fat writes the chain of the exFAT file fp on the FAT, contiguous
+// parts included, so that a cluster of it can be replaced.
+func (fp *File) chain_fat() fileResult {
+	obj := &fp.obj
+	fsys := obj.fs
+	if obj.stat == 2 {
+		clsz := int64(fsys.csize) * int64(fsys.ssize)
+		n := uint32((obj.objsize + clsz - 1) / clsz)
+		if fp.clust >= obj.sclust {
+			n = max(n, fp.clust-obj.sclust+1) // Allocated past the size.
+		}
+		if n == 0 {
+			return frIntErr
+		}
+		obj.stat = 3
+		obj.n_cont = n - 1
+		if fr := obj.fill_first_frag(); fr != frOK {
+			return fr
+		}
+		return fsys.put_clusterstat(obj.sclust+n-1, badCluster)
+	}
+	fr := obj.fill_first_frag()
+	if fr == frOK {
+		fr = obj.fill_last_frag(fp.clust, badCluster)
+	}
+	return fr
+}
+
 // remove_chain_exfat_post updates the object's chain status after
 // remove_chain shortened or removed its chain on an exFAT volume.
 func (obj *objid) remove_chain_exfat_post(pclst uint32) fileResult {
@@ -824,6 +855,7 @@ func (dp *dir) register_exfat() (fr fileResult) {
 	}
 
 	create_xdir(fsys.dirbuf[:], fsys.lfnbuf[:]) // Create on-memory directory block to be written later.
+	dp.dindex_add(dp.blk_ofs, true)
 	return frOK
 }
 
@@ -887,6 +919,113 @@ func (fp *File) open_trunc_exfat(dj *dir, tm uint32) (res fileResult) {
 	return res
 }
 
+// chmod_exfat applies an attribute change to the entry set of the object
+// found by follow_path, held in fsys.dirbuf, and stores it.
+func (dj *dir) chmod_exfat(attr, mask byte) fileResult {
+	dirb := dj.obj.fs.dirbuf[:]
+	dirb[xdirAttr] = attr&mask | dirb[xdirAttr]&^mask
+	return dj.store_xdir()
+}
+
+// utime_exfat sets the modified time of the entry set of the object found
+// by follow_path, held in fsys.dirbuf, and stores it.
+func (dj *dir) utime_exfat(tm uint32) fileResult {
+	binary.LittleEndian.PutUint32(dj.obj.fs.dirbuf[xdirModTime:], tm)
+	return dj.store_xdir()
+}
+
+// undelete_exfat gives the entry set of the object found by follow_path, held
+// in fsys.dirbuf, the attributes and times of a restored file, and stores it.
+func (dj *dir) undelete_exfat(attr byte, crt, mod uint32) fileResult {
+	dirb := dj.obj.fs.dirbuf[:]
+	dirb[xdirAttr] = attr
+	binary.LittleEndian.PutUint32(dirb[xdirCrtTime:], crt)
+	binary.LittleEndian.PutUint32(dirb[xdirModTime:], mod)
+	return dj.store_xdir()
+}
+
+// read_deleted_exfat appends the deleted entry sets of the exFAT directory
+// dp, rewound, to dst.
+func (dp *dir) read_deleted_exfat(dst []DeletedFile) ([]DeletedFile, fileResult) {
+	fsys := dp.obj.fs
+	for {
+		fr := fsys.move_window(dp.sect)
+		if fr != frOK {
+			return dst, fr
+		}
+		et := dp.dir[xdirType]
+		if et == 0 {
+			return dst, frOK // End of the directory.
+		}
+		if et == etFILEDIR&^etMaskUsed {
+			start := dp.dptr
+			ok, fr := dp.load_deleted_xdir()
+			if fr == frNoFile {
+				return dst, frOK
+			} else if fr != frOK {
+				return dst, fr
+			}
+			if ok {
+				dirb := fsys.dirbuf[:]
+				var d DeletedFile
+				dp.get_fileinfo_exfat(&d.FileInfo)
+				d.Cluster = binary.LittleEndian.Uint32(dirb[xdirFstClus:])
+				d.size = int64(binary.LittleEndian.Uint64(dirb[xdirFileSize:]))
+				d.Exact = dirb[xdirGenFlags]&2 != 0
+				d.crt = binary.LittleEndian.Uint32(dirb[xdirCrtTime:])
+				d.mod = binary.LittleEndian.Uint32(dirb[xdirModTime:])
+				dst = append(dst, d)
+			} else if dp.dptr != start {
+				continue // Look at the entry that ended the set.
+			}
+		}
+		fr = dp.next(false)
+		if fr == frNoFile {
+			return dst, frOK
+		} else if fr != frOK {
+			return dst, fr
+		}
+	}
+}
+
+// load_deleted_xdir loads the deleted entry set at dp into fsys.dirbuf with
+// its in use bits set back, leaving dp at its last entry. It reports false,
+// leaving dp at the entry that ends it, if the set is not whole or its
+// checksum does not match.
+func (dp *dir) load_deleted_xdir() (bool, fileResult) {
+	fsys := dp.obj.fs
+	dirb := fsys.dirbuf[:]
+	copy(dirb[:sizeDirEntry], dp.dir[:sizeDirEntry])
+	n := int(dirb[xdirNumSec]) + 1
+	if n < 3 || n > 19 {
+		return false, frOK // Invalid block size.
+	}
+	for i := 1; i < n; i++ {
+		fr := dp.next(false)
+		if fr == frOK {
+			fr = fsys.move_window(dp.sect)
+		}
+		if fr != frOK {
+			return false, fr
+		}
+		et := byte(etFILENAME)
+		if i == 1 {
+			et = etSTREAM
+		}
+		if dp.dir[xdirType] != et&^etMaskUsed {
+			return false, frOK
+		}
+		copy(dirb[i*sizeDirEntry:], dp.dir[:sizeDirEntry])
+	}
+	for i := 0; i < n; i++ {
+		dirb[i*sizeDirEntry+xdirType] |= etMaskUsed
+	}
+	if int(maxdirb(uint32(dirb[xdirNumName]))) > n*sizeDirEntry {
+		return false, frOK // Invalid block size for the name.
+	}
+	return xdir_sum(dirb) == binary.LittleEndian.Uint16(dirb[xdirSetSum:]), frOK
+}
+
 // mkdir_fin_exfat initializes the entry set of a directory just registered
 // by register_exfat and stores it. dcl is the directory table cluster.
 func (dj *dir) mkdir_fin_exfat(dcl, tm uint32) fileResult {
@@ -997,11 +1136,14 @@ func (fsys *FS) getlabel_exfat(dst, dir []byte) []byte {
 
 // find_exfat is the exFAT branch of dir.find: the name to find is in
 // fsys.lfnbuf. Matching is by name hash first, then case-insensitive
-// UTF-16 comparison.
-func (dp *dir) find_exfat() (fr fileResult) {
+// UTF-16 comparison. With one set it gives up after the first entry set.
+func (dp *dir) find_exfat(one bool) (fr fileResult) {
 	fsys := dp.obj.fs
 	hash := xname_sum(fsys.lfnbuf[:]) // Hash value of the name to find.
-	for {
+	for first := true; ; first = false {
+		if one && !first {
+			return frNoFile
+		}
 		fr = dp.read_exfat(false)
 		if fr != frOK {
 			break
@@ -1029,6 +1171,17 @@ func (dp *dir) find_exfat() (fr fileResult) {
 	return fr
 }
 
+// xdir_key returns the directory lookup cache key of the entry set loaded in
+// fsys.dirbuf: its name hash, made nonzero.
+func (fsys *FS) xdir_key() uint32 {
+	return uint32(binary.LittleEndian.Uint16(fsys.dirbuf[xdirNameHash:])) | 1<<16
+}
+
+// xname_key returns the directory lookup cache key of the name in fsys.lfnbuf.
+func (fsys *FS) xname_key() uint32 {
+	return uint32(xname_sum(fsys.lfnbuf[:])) | 1<<16
+}
+
 // get_fileinfo_exfat fills fno from the entry set loaded in fsys.dirbuf.
 func (dp *dir) get_fileinfo_exfat(fno *FileInfo) {
 	fsys := dp.obj.fs
@@ -1088,6 +1241,7 @@ func (dp *dir) get_fileinfo_exfat(fno *FileInfo) {
 
 func (fs *FS) change_bitmap(clst, ncl uint32, bv bool) fileResult {
 	fs.trace("fs:change_bitmap", slog.Uint64("clst", uint64(clst)), slog.Uint64("ncl", uint64(ncl)), slog.Bool("bv", bv))
+	cl := clst
 	clst -= 2 // First bit corresponds to cluster #2.
 	clstDiv8 := clst / 8
 	sect := fs.bitbase + lba(fs.divSS(clstDiv8))
@@ -1106,6 +1260,8 @@ func (fs *FS) change_bitmap(clst, ncl uint32, bv bool) fileResult {
 				}
 				fs.win[i] ^= mask
 				fs.wflag = 1
+				fs.cluster_marked(cl, bv)
+				cl++
 				ncl--
 				mask <<= 1
 				if ncl == 0 {
@@ -13,6 +13,8 @@ func (fsys *FS) init_exfat() fileResult { return frUnsupported }
 
 func (fs *FS) change_bitmap(clst, ncl uint32, bv bool) fileResult { return frUnsupported }
 
+func (fsys *FS) find_bitmap(clst, ncl uint32) uint32 { return 1 }
+
 func (obj *objid) init_alloc_info() {}
 
 func (obj *objid) clusterstat_exfat(clst uint32) uint32 { return 1 }
@@ -23,7 +25,10 @@ func (obj *objid) remove_chain_exfat_post(pclst uint32) fileResult { return frUn
 
 func (dp *dir) read_exfat(vol bool) fileResult { return frUnsupported }
 
-func (dp *dir) find_exfat() fileResult { return frUnsupported }
+func (dp *dir) find_exfat(one bool) fileResult { return frUnsupported }
+
+func (fsys *FS) xdir_key() uint32  { return 0 }
+func (fsys *FS) xname_key() uint32 { return 0 }
 
 func (dp *dir) register_exfat() fileResult { return frUnsupported }
 
@@ -31,10 +36,22 @@ func (obj *objid) fill_last_frag(lcl, term uint32) fileResult { return frUnsuppo
 
 func (fsys *FS) f_sync_exfat(fp *File, tm uint32) fileResult { return frUnsupported }
 
+func (fp *File) chain_fat() fileResult { return frUnsupported }
+
 func (fp *File) open_trunc_exfat(dj *dir, tm uint32) fileResult { return frUnsupported }
 
 func (dj *dir) mkdir_fin_exfat(dcl, tm uint32) fileResult { return frUnsupported }
 
+func (dj *dir) chmod_exfat(attr, mask byte) fileResult { return frUnsupported }
+
+func (dj *dir) utime_exfat(tm uint32) fileResult { return frUnsupported }
+
+func (dj *dir) undelete_exfat(attr byte, crt, mod uint32) fileResult { return frUnsupported }
+
+func (dp *dir) read_deleted_exfat(dst []DeletedFile) ([]DeletedFile, fileResult) {
+	return dst, frUnsupported
+}
+
 func (djn *dir) rename_restore_exfat(buf *[2 * sizeDirEntry]byte) fileResult { return frUnsupported }
 
 func (f *Formatter) formatExFAT(blocksize, fsSizeInBlocks int, cfg FormatParams) error {
@@ -44,3 +61,17 @@ func (f *Formatter) formatExFAT(blocksize, fsSizeInBlocks int, cfg FormatParams)
 func (dp *dir) get_fileinfo_exfat(fno *FileInfo) {}
 
 func (fsys *FS) getlabel_exfat(dst, dir []byte) []byte { return dst }
+
+// xcheck is the exFAT state of a Check, none without exFAT support.
+type xcheck struct{}
+
+func (x *xcheck) reset()                          {}
+func (x *xcheck) dir_end(c *checker, d *checkDir) {}
+
+func (x *xcheck) store(c *checker, d *checkDir) fileResult { return frUnsupported }
+
+func (c *checker) xdir_entry(d *checkDir, ent []byte, block int64, ofs int) (bool, fileResult) {
+	return true, frUnsupported
+}
+
+func (c *checker) check_exfat() fileResult { return frUnsupported }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"iter"
 	"math"
 	"time"
 	"unsafe"
@@ -34,6 +35,16 @@ const (
 	allowedModes = ModeRead | ModeWrite | ModeCreateNew | ModeCreateAlways | ModeOpenExisting | ModeOpenAppend | ModeOpenAlways
 )
 
+// Attribute bits of a directory entry, as returned by [FileInfo.Sys].
+// All but AttrDir can be changed with [FS.Chmod].
+const (
+	AttrReadOnly byte = amRDO
+	AttrHidden   byte = amHID
+	AttrSystem   byte = amSYS
+	AttrDir      byte = amDIR
+	AttrArchive  byte = amARC
+)
+
 var (
 	errInvalidMode    = errors.New("invalid fat access mode")
 	errForbiddenMode  = errors.New("forbidden fat access mode")
@@ -54,7 +65,7 @@ func (fsys *FS) FormatParams() (FormatParams, error) {
 	defer fsys.mu.Unlock()
 	label, fr := fsys.f_getlabel(nil)
 	if fr != frOK {
-		return FormatParams{}, fr
+		return FormatParams{}, fsys.pathErr("formatparams", "/", fr)
 	}
 	return FormatParams{
 		Label:       string(label),
@@ -71,6 +82,20 @@ func (fsys *FS) BlockSize() int {
 	return int(fsys.ssize)
 }
 
+// VolumeBase returns the device block at which the mounted volume starts: 0
+// on a device without a partition table, else the first block of the
+// partition mounted. Subtract it from device blocks, such as those of
+// [File.Extents], for addresses relative to the volume. It is zero if not
+// mounted.
+func (fsys *FS) VolumeBase() int64 {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.fstype == _FormatUnknown {
+		return 0
+	}
+	return int64(fsys.volbase)
+}
+
 // FSConfig holds the behavioral choices an FS makes that the FAT format itself
 // does not decide. It may be set at any time; the zero value is the default.
 type FSConfig struct {
@@ -94,6 +119,246 @@ type FSConfig struct {
 	// back, exactly: for byte-for-byte compatibility with a reference image, or
 	// when the write bandwidth matters more than what the gap discloses.
 	NoZeroFilling bool
+
+	// CacheFATSectors and CacheDirSectors size an optional write-back cache
+	// of metadata sectors, in sectors. Zero for both, the default, disables
+	// it and the filesystem uses no memory beyond its single sector window.
+	//
+	// Every FAT, directory and exFAT allocation bitmap access goes through
+	// that window, which holds one sector. Following a cluster chain while
+	// scanning a directory alternates between a FAT sector and a directory
+	// sector and rereads each from the device on every switch, and every
+	// modified sector is written as soon as the window moves off it. The
+	// cache keeps the most recently used sectors of the FAT in
+	// CacheFATSectors slots and those of everything else in CacheDirSectors
+	// slots, so a long chain walk does not flush out the directory being
+	// listed. Modified sectors are held until the filesystem is synced, as
+	// Close, Sync and every directory-modifying operation do, and are then
+	// written in the order they were last modified: the order in which the
+	// single window would have written them.
+	//
+	// The cache costs 512 bytes per slot and lookups scan the slots, so a few
+	// to a few dozen of each is the intended size. A new size takes effect at
+	// the next Mount.
+	CacheFATSectors int
+	CacheDirSectors int
+
+	// AllocMapBytes is the memory budget, in bytes, of an optional in-RAM map
+	// of which clusters are allocated. Zero, the default, disables it.
+	//
+	// Without the map, finding a free cluster means reading the FAT entry by
+	// entry from the last cluster allocated, or on exFAT the allocation
+	// bitmap bit by bit, until one turns up. On a nearly full volume that can
+	// be thousands of sector reads per allocation, and counting free space
+	// with FreeSpace reads the whole FAT. The map is built with one such pass
+	// on the first allocation or FreeSpace after mount and kept up to date
+	// from then on.
+	//
+	// A budget of one bit per cluster, (clusters+7)/8 bytes, holds the
+	// allocation state exactly, so free clusters are found without reading
+	// the FAT: 128 KiB for a million clusters, a 32 GB volume with 32 KiB
+	// clusters. A smaller
+	// budget makes the map a coarser summary, one bit per group of clusters
+	// telling whether the whole group is in use, so that searches skip full
+	// groups and read only the others. A new budget takes effect at the next
+	// Mount.
+	AllocMapBytes int
+
+	// Trim tells the device which sectors no longer hold data by erasing,
+	// through [BlockDevice.EraseBlocks], the clusters freed by Remove,
+	// Truncate and ModeCreateAlways. Flash media use it to skip copying
+	// stale data during garbage collection, which wears them less and keeps
+	// writes fast; it is FatFs' FF_USE_TRIM. A device that cannot erase may
+	// return an error, which is ignored.
+	//
+	// Freed runs are batched until the filesystem is synced, so that no
+	// cluster is erased while the FAT or a directory on the device still
+	// references it, and runs freed in that time that adjoin are merged into
+	// one erase. A cluster allocated again before the sync is not erased.
+	// Runs shorter than TrimMinBlocks blocks after merging are left alone;
+	// zero erases runs of any length.
+	Trim          bool
+	TrimMinBlocks int
+
+	// Allocator is the policy deciding where clusters are allocated. nil,
+	// the default, allocates as FatFs does. See [Allocator] for the policies
+	// this package provides.
+	Allocator Allocator
+
+	// ReadAheadSectors and WriteCoalesceSectors size optional per-file
+	// buffers, in sectors, for data transfers smaller than a sector. Values
+	// below two, the default, disable them.
+	//
+	// A File transfers whole sectors between the device and the caller's
+	// buffer directly, but anything smaller, such as the reads of a
+	// [bufio.Reader] with a 512-byte buffer or a stream of small writes, goes
+	// through its single sector buffer: one device call per sector. With
+	// read-ahead, a read that misses that buffer reads up to ReadAheadSectors
+	// sectors at once, across cluster boundaries while the cluster chain is
+	// contiguous, and the following sectors come from memory. With write
+	// coalescing, sectors written back in sequence accumulate until
+	// WriteCoalesceSectors of them, or a sector out of sequence, and go to
+	// the device in one call; on SD cards, where each command has a large
+	// fixed cost, that is most of the write time. Coalesced sectors are
+	// written by Sync and Close at the latest.
+	//
+	// Each open File allocates its own buffers, of 512 bytes per sector, at
+	// open: write coalescing only for files opened for writing. Data read
+	// ahead is not refreshed when another File writes the same file. A new
+	// size applies to files opened afterwards.
+	ReadAheadSectors     int
+	WriteCoalesceSectors int
+
+	// DirCacheEntries is the number of directory entries an optional
+	// directory lookup cache may index. Zero, the default, disables it.
+	//
+	// Finding a name in a directory, for every path element of every open,
+	// stat, create and remove, reads the directory from the start, decoding
+	// and comparing every long name until it matches; a name that is not
+	// there costs the whole directory. Creating a file whose long name does
+	// not fit 8.3 tries generated short names until one is free, up to a
+	// hundred whole-directory searches. The cache keeps an index of the
+	// names of the most recently searched directories, built with one read
+	// of the directory and kept up to date as entries are added and
+	// removed, so that a search reads only the entries whose name hash
+	// matches and finds that a name is absent without reading anything.
+	//
+	// Each indexed entry costs 12 bytes. A directory with more entries than
+	// the budget is not indexed, and less recently searched directories are
+	// dropped to make room. A new size takes effect at the next Mount.
+	DirCacheEntries int
+
+	// Journal makes metadata updates safe against power loss. FAT writes
+	// its metadata in place, one sector at a time, so that a power loss in
+	// the middle of an operation can leave clusters allocated that no file
+	// holds, or a directory entry pointing to freed clusters: problems
+	// [FS.Check] reports and [FS.Repair] fixes.
+	//
+	// With Journal the FAT, allocation bitmap and directory sectors modified
+	// gather in the sector cache and are written in transactions, first to
+	// a journal, then in place: a transaction is applied whole or not at
+	// all. Mount replays a transaction cut short once its journal write
+	// completed, and discards one cut short before. The journal is a
+	// contiguous file, JOURNAL.SYS, hidden and system, at the root, of about
+	// 60 KiB, created by Mount on a volume mounted for writing that lacks
+	// it. Once a sync returns every update is in place and the journal
+	// clean, so the volume remains an ordinary FAT volume for other drivers.
+	//
+	// A sync commits the sectors modified since the last one as a single
+	// transaction if they fit both the cache and the journal's 120 sectors.
+	// Otherwise they are committed in several, as the cache evicts them or
+	// the journal fills, and a power loss between two leaves the earlier
+	// ones applied: the problems Check reports are then possible again.
+	// Without CacheFATSectors and CacheDirSectors a cache of 8 sectors each
+	// is used.
+	//
+	// Each modified metadata sector is written twice, and the journal header
+	// twice per transaction. File data is not journaled, and is written
+	// before the metadata that refers to it. A volume mounted read-only is
+	// not replayed. Journal takes effect at the next Mount.
+	Journal bool
+
+	// RemapBadClusters moves file data off clusters that fail to be written.
+	// By default a device error writing a file's data fails the write and
+	// every later operation on the File until it is reopened.
+	//
+	// With RemapBadClusters a cluster whose sectors fail twice in a row is
+	// replaced in the file's chain by a free cluster, the sectors of the file
+	// it held copied to it, and marked bad, as [FS.ScanSurface] marks them,
+	// so it is never allocated again. The write is then retried on the new
+	// cluster, up to 4 clusters per write. A cluster that can no longer be
+	// read, a volume without free clusters, or a File with a fast seek table
+	// (see [File.BuildLinkMap]) fails the write as before. With VerifyWrites
+	// a write that does not read back is retried the same way.
+	RemapBadClusters bool
+
+	// VerifyWrites reads back every sector written, file data and metadata
+	// alike, and compares it with what was written. Some SD cards, counterfeit
+	// ones first, acknowledge writes they never keep, and the loss shows only
+	// when the data is read again, long after. A sector that reads back
+	// different fails the operation writing it with an error of its own,
+	// distinct from a device error; see RemapBadClusters to move file data
+	// off the cluster instead, and [FS.VerifyStats] for the counts.
+	//
+	// Every write is followed by a read of the same sectors, which roughly
+	// halves write throughput, into a buffer of up to 64 sectors. A device
+	// caching writes may return them from its cache, which verifies the
+	// transfer and not the media.
+	VerifyWrites bool
+
+	// Scrub destroys the data Remove, Truncate and ModeCreateAlways leave
+	// behind, which by default stays on the device, readable by anyone with
+	// the device and by [FS.ListDeleted], until the clusters are reused. See
+	// [ScrubMode]. The default, ScrubOff, only unlinks.
+	//
+	// The clusters freed are overwritten or erased before they are freed on
+	// the FAT, and so is the rest of the last cluster a Truncate keeps. The
+	// directory entries Remove and Rename drop, long name entries included,
+	// are cleared but for the byte marking them deleted. Data a file held
+	// in clusters it no longer does, after [FSConfig.RemapBadClusters] or
+	// [FS.Repair] moved it, is not scrubbed.
+	Scrub ScrubMode
+
+	// Retry retries the reads, writes and erases of the device that fail, the
+	// reads back of VerifyWrites included, as SD cards over SPI and USB
+	// bridges do now and then with a timeout that a second try gets past. By
+	// default the first error fails the operation, and a File whose data
+	// failed to transfer fails every later operation until it is reopened.
+	// See [RetryPolicy], and [FS.RetryStats] for the counts.
+	//
+	// A write that fails after reaching part of its blocks, as the count
+	// WriteBlocks returns tells, is retried from the first block it did not
+	// wholly write, so that no block it did write is written again. With
+	// ConcurrentDevice the transfers of file data wait out the backoff with
+	// the FS unlocked; otherwise every transfer waits with it locked. A
+	// transfer that still fails is then handled as without Retry, by
+	// RemapBadClusters first.
+	Retry RetryPolicy
+
+	// ConcurrentDevice declares the BlockDevice safe for concurrent use, so
+	// that file data transfers need not hold the filesystem lock. By default
+	// every call to the device is made under the lock, one at a time, as a
+	// driver that owns a single bus, such as an SD card over SPI, requires:
+	// an operation of one open file waits for the data transfer of another
+	// to complete.
+	//
+	// With ConcurrentDevice the reads and writes of the data of distinct
+	// open files release the lock for their device calls, so that the
+	// device may be called for the data of several files, and for the FAT
+	// and directories of the volume, at once. It may be set at any time.
+	ConcurrentDevice bool
+}
+
+// ScrubMode is how freed file data is destroyed, see [FSConfig.Scrub].
+type ScrubMode uint8
+
+const (
+	// ScrubOff leaves freed data on the device.
+	ScrubOff ScrubMode = iota
+	// ScrubZero overwrites freed data with zeros.
+	ScrubZero
+	// ScrubErase erases freed data with [BlockDevice.EraseBlocks], and
+	// overwrites it with zeros if the device fails to erase. It is only as
+	// secure as the erase of the device: flash translation layers may erase
+	// by unmapping, leaving the data in flash cells no longer addressed.
+	ScrubErase
+)
+
+// FreeSpace returns the number of bytes in free clusters on the volume. The
+// free cluster count is kept by the filesystem once known, but may have to be
+// counted on the FAT first: on FAT12, FAT16 and exFAT volumes, and on FAT32
+// volumes whose FSInfo sector does not hold it. See [FSConfig.AllocMapBytes].
+func (fsys *FS) FreeSpace() (int64, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.fstype == _FormatUnknown {
+		return 0, fsys.pathErr("freespace", "/", frNotEnabled)
+	}
+	nfree, fr := fsys.f_getfree()
+	if fr != frOK {
+		return 0, fsys.pathErr("freespace", "/", fr)
+	}
+	return int64(nfree) * int64(fsys.csize) * int64(fsys.ssize), nil
 }
 
 // Configure applies cfg to the filesystem. It may be called before or after
@@ -102,6 +367,21 @@ func (fsys *FS) Configure(cfg FSConfig) {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
 	fsys.noZeroFill = cfg.NoZeroFilling
+	fsys.cacheFAT = max(cfg.CacheFATSectors, 0)
+	fsys.cacheDir = max(cfg.CacheDirSectors, 0)
+	fsys.amapBytes = max(cfg.AllocMapBytes, 0)
+	fsys.trimOn = cfg.Trim
+	fsys.trimMin = max(cfg.TrimMinBlocks, 0)
+	fsys.alloc = cfg.Allocator
+	fsys.raSectors = max(cfg.ReadAheadSectors, 0)
+	fsys.wcSectors = max(cfg.WriteCoalesceSectors, 0)
+	fsys.dcacheEntries = max(cfg.DirCacheEntries, 0)
+	fsys.jnlOn = cfg.Journal
+	fsys.remapBad = cfg.RemapBadClusters
+	fsys.scrubMode = cfg.Scrub
+	fsys.verifyOn = cfg.VerifyWrites
+	fsys.retry = cfg.Retry
+	fsys.concurrentDev = cfg.ConcurrentDevice
 }
 
 // zeros is the source for zero-filling a gap. It is read-only and shared:
@@ -125,7 +405,13 @@ func (fp *File) growTo(ofs int64) fileResult {
 		return frDenied // Only a writable handle can extend a file.
 	}
 	if fsys.noZeroFill {
-		return fp.f_lseek(ofs) // FatFs: stretch the chain and leave the gap as it lies.
+		// FatFs: stretch the chain and leave the gap as it lies. Fast seek clips
+		// at the file size instead of stretching, so the link map is set aside.
+		tbl := fp.cltbl
+		fp.cltbl = nil
+		fr := fp.f_lseek(ofs)
+		fp.cltbl = tbl
+		return fr
 	}
 	if fr := fp.f_lseek(fp.obj.objsize); fr != frOK {
 		return fr
@@ -136,7 +422,7 @@ func (fp *File) growTo(ofs int64) fileResult {
 		if fr != frOK {
 			return fr
 		} else if int64(bw) < n {
-			return frDenied // The device filled up before the gap was covered.
+			return frDiskFull // The device filled up before the gap was covered.
 		}
 	}
 	return frOK
@@ -150,7 +436,7 @@ func (fsys *FS) AppendLabel(dst []byte) ([]byte, error) {
 	defer fsys.mu.Unlock()
 	label, fr := fsys.f_getlabel(dst)
 	if fr != frOK {
-		return dst, fr
+		return dst, fsys.pathErr("label", "/", fr)
 	}
 	return label, nil
 }
@@ -159,6 +445,7 @@ func (fsys *FS) AppendLabel(dst []byte) ([]byte, error) {
 type Dir struct {
 	dir
 	inlineInfo FileInfo
+	name       string // Path opened, in the errors of the Dir.
 }
 
 // Mount mounts the FAT file system on the given block device and sector size.
@@ -167,76 +454,95 @@ type Dir struct {
 func (fsys *FS) Mount(bd BlockDevice, blockSize int, mode Mode) error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
+	fsys.inflight.Wait() // Let data transfers of open files finish with the device.
 	if mode&^(ModeRead|ModeWrite) != 0 {
-		return errInvalidMode
+		return fsys.pathErr("mount", "/", errInvalidMode)
 	} else if blockSize > math.MaxUint16 {
-		return errors.New("sector size too large")
+		return fsys.pathErr("mount", "/", errors.New("sector size too large"))
 	}
 	fr := fsys.mount_volume(bd, uint16(blockSize), uint8(mode))
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("mount", "/", fr)
 }
 
 // OpenFile opens the named file for reading or writing, depending on the mode.
 // The path must be absolute (starting with a slash) and must not contain
 // any elements that are "." or "..".
 func (fsys *FS) OpenFile(fp *File, path string, mode Mode) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
 	prohibited := (mode & ModeRW) &^ fsys.perm
 	if mode&^allowedModes != 0 {
-		return errInvalidMode
+		return fsys.pathErr("open", path, errInvalidMode)
 	} else if prohibited != 0 {
-		return errForbiddenMode
+		return fsys.pathErr("open", path, errForbiddenMode)
 	}
+	fp.name = path
 	fr := fsys.f_open(fp, path, uint8(mode))
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("open", path, fr)
 }
 
-// lock acquires the file's filesystem lock, guarding against a concurrent
-// Close: the handle is validated once the lock is held since Close
-// invalidates it (by id, never by clearing obj.fs) under the same lock,
-// making the unsynchronized read of obj.fs safe. On success the FS is
-// returned locked and the caller must Unlock it.
-func (fp *File) lock() (*FS, fileResult) {
+// lock acquires the file's own lock and then its filesystem lock, guarding
+// against a concurrent Close: the handle is validated once the locks are held
+// since Close invalidates it (by id, never by clearing obj.fs) under the same
+// locks. On success the FS is returned locked and the caller must release
+// both with unlock. Data transfers of the file may release the FS lock
+// meanwhile, see (*File).data_read. On failure the error is that of operation op.
+func (fp *File) lock(op string) (*FS, error) {
+	fp.mu.Lock()
 	fsys := fp.obj.fs
 	if fsys == nil {
-		return nil, frInvalidObject
+		err := (*FS)(nil).pathErr(op, fp.name, frInvalidObject)
+		fp.mu.Unlock()
+		return nil, err
 	}
 	fsys.mu.Lock()
 	if fr := fp.obj.validate(); fr != frOK {
+		err := fsys.pathErr(op, fp.name, fr)
 		fsys.mu.Unlock()
-		return nil, fr
+		fp.mu.Unlock()
+		return nil, err
 	}
-	return fsys, frOK
+	fp.fsLocked = true
+	return fsys, nil
+}
+
+// unlock releases the locks taken by a successful lock.
+func (fp *File) unlock(fsys *FS) {
+	fp.fsLocked = false
+	fsys.mu.Unlock()
+	fp.mu.Unlock()
 }
 
 // lock is the Dir counterpart of (*File).lock.
-func (dp *Dir) lock() (*FS, fileResult) {
+func (dp *Dir) lock(op string) (*FS, error) {
 	fsys := dp.obj.fs
 	if fsys == nil {
-		return nil, frInvalidObject
+		return nil, (*FS)(nil).pathErr(op, dp.name, frInvalidObject)
 	}
 	fsys.mu.Lock()
 	if fr := dp.obj.validate(); fr != frOK {
+		err := fsys.pathErr(op, dp.name, fr)
 		fsys.mu.Unlock()
-		return nil, fr
+		return nil, err
 	}
-	return fsys, frOK
+	return fsys, nil
 }
 
 // Read reads up to len(buf) bytes from the File. It implements the [io.Reader] interface.
 func (fp *File) Read(buf []byte) (int, error) {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return 0, fr
+	fsys, err := fp.lock("read")
+	if err != nil {
+		return 0, err
 	}
-	defer fsys.mu.Unlock()
+	defer fp.unlock(fsys)
+	n, err := fp.read(buf)
+	return n, fsys.pathErr("read", fp.name, err)
+}
+
+// read is Read with the file locked.
+func (fp *File) read(buf []byte) (int, error) {
 	if fp.pos > fp.obj.objsize {
 		// The position was seeked past the end. There is nothing there to read, and
 		// it must not be reached by seeking FatFs' pointer to it: that would clip
@@ -246,7 +552,7 @@ func (fp *File) Read(buf []byte) (int, error) {
 		}
 		return 0, io.EOF
 	}
-	if fr = fp.f_lseek(fp.pos); fr != frOK {
+	if fr := fp.f_lseek(fp.pos); fr != frOK {
 		return 0, fr
 	}
 	br, fr := fp.f_read(buf)
@@ -265,11 +571,17 @@ func (fp *File) Read(buf []byte) (int, error) {
 // skipped over are zero-filled — see [FSConfig.NoZeroFilling] for what that costs
 // and how to turn it off.
 func (fp *File) Write(buf []byte) (int, error) {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return 0, fr
+	fsys, err := fp.lock("write")
+	if err != nil {
+		return 0, err
 	}
-	defer fsys.mu.Unlock()
+	defer fp.unlock(fsys)
+	n, err := fp.write(buf)
+	return n, fsys.pathErr("write", fp.name, err)
+}
+
+// write is Write with the file locked.
+func (fp *File) write(buf []byte) (int, error) {
 	pos := fp.pos
 	if fp.flag&faAppend != 0 {
 		// POSIX append: to the end of the file before each write. Not committed
@@ -278,7 +590,7 @@ func (fp *File) Write(buf []byte) (int, error) {
 	}
 	// Make the position real before writing at it: it may be past the end of the
 	// file, in which case the gap in between has to be allocated and filled.
-	if fr = fp.growTo(pos); fr != frOK {
+	if fr := fp.growTo(pos); fr != frOK {
 		return 0, fr
 	}
 	bw, fr := fp.f_write(buf)
@@ -288,7 +600,7 @@ func (fp *File) Write(buf []byte) (int, error) {
 	if fr != frOK {
 		return bw, fr
 	} else if bw < len(buf) {
-		return bw, io.ErrShortWrite // Disk full.
+		return bw, frDiskFull
 	}
 	return bw, nil
 }
@@ -305,19 +617,20 @@ func (fp *File) WriteString(s string) (int, error) {
 // Seek is saved and restored, so ReadAt neither affects nor is affected by it.
 // When fewer than len(p) bytes are read it returns a non-nil error (io.EOF at
 // end of file).
-func (fp *File) ReadAt(p []byte, off int64) (int, error) {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return 0, fr
+func (fp *File) ReadAt(p []byte, off int64) (_ int, err error) {
+	fsys, err := fp.lock("read")
+	if err != nil {
+		return 0, err
 	}
-	defer fsys.mu.Unlock()
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "read", fp.name)
 	if off < 0 {
 		return 0, errNegativeOffset
 	} else if off >= fp.obj.objsize {
 		return 0, io.EOF
 	}
 	cur := fp.pos
-	if fr = fp.f_lseek(off); fr != frOK {
+	if fr := fp.f_lseek(off); fr != frOK {
 		return 0, fr
 	}
 	n, fr := fp.f_read(p)
@@ -336,19 +649,20 @@ func (fp *File) ReadAt(p []byte, off int64) (int, error) {
 // implements the [io.WriterAt] interface: the offset used by Read, Write and
 // Seek is saved and restored, so WriteAt does not affect it. Writing past the
 // end of the file extends it, zero-filling the gap; see [FSConfig.NoZeroFilling].
-func (fp *File) WriteAt(p []byte, off int64) (int, error) {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return 0, fr
+func (fp *File) WriteAt(p []byte, off int64) (_ int, err error) {
+	fsys, err := fp.lock("write")
+	if err != nil {
+		return 0, err
 	}
-	defer fsys.mu.Unlock()
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "write", fp.name)
 	if off < 0 {
 		return 0, errNegativeOffset
 	} else if fp.flag&faWrite == 0 {
 		return 0, frWriteProtected
 	}
 	cur := fp.pos
-	if fr = fp.growTo(off); fr != frOK {
+	if fr := fp.growTo(off); fr != frOK {
 		return 0, fr
 	}
 	n, fr := fp.f_write(p)
@@ -356,7 +670,7 @@ func (fp *File) WriteAt(p []byte, off int64) (int, error) {
 	if fr != frOK {
 		return n, fr
 	} else if n < len(p) {
-		return n, io.ErrShortWrite // Disk full.
+		return n, frDiskFull
 	}
 	return n, nil
 }
@@ -380,12 +694,13 @@ func (fp *File) Size() int64 {
 // It does not move the file offset, as POSIX ftruncate does not. An offset left
 // beyond the new end of the file stays there, and a write at it will extend the
 // file back out.
-func (fp *File) Truncate(size int64) error {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return fr
+func (fp *File) Truncate(size int64) (err error) {
+	fsys, err := fp.lock("truncate")
+	if err != nil {
+		return err
 	}
-	defer fsys.mu.Unlock()
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "truncate", fp.name)
 	if fp.err != frOK {
 		return fp.err
 	} else if size < 0 {
@@ -397,7 +712,7 @@ func (fp *File) Truncate(size int64) error {
 	// f_truncate cuts the file at FatFs' pointer — it takes no size — so the
 	// pointer has to be put where the new end belongs. growTo does that, and
 	// allocates and fills the extension if the new end is past the old one.
-	fr = fp.growTo(size)
+	fr := fp.growTo(size)
 	if fr == frOK {
 		fr = fp.f_truncate()
 	}
@@ -413,6 +728,118 @@ func (fp *File) Truncate(size int64) error {
 	return nil
 }
 
+// BuildLinkMap enables fast seek on the file. It walks the file's cluster chain
+// once and records its fragments in a link map, FatFs' cluster link map table,
+// so that Read, Write, ReadAt and WriteAt at an offset reached by Seek find its
+// cluster without following the chain on the FAT from the start of the file.
+// It pays off for random access into large files.
+//
+// tbl is the storage for the map: two items per fragment of the file plus two,
+// so a contiguous file needs four. If tbl is nil the map is allocated to size.
+// BuildLinkMap returns the number of items the map needs; if tbl is shorter
+// than that it also returns an error and fast seek stays disabled, and the
+// caller can retry with a larger tbl.
+//
+// The map follows the file as it is written. When the file grows into clusters
+// the map does not cover it is rebuilt on the next seek, in the same storage,
+// and an allocated map is reallocated as needed. A caller-provided tbl that
+// can no longer hold the map is let go: fast seek is disabled and seeking
+// falls back to following the chain. The map is discarded when the file is
+// closed or reopened.
+func (fp *File) BuildLinkMap(tbl []uint32) (int, error) {
+	fsys, err := fp.lock("buildlinkmap")
+	if err != nil {
+		return 0, err
+	}
+	defer fp.unlock(fsys)
+	auto := tbl == nil
+	if auto {
+		tbl = make([]uint32, 32) // Fits 15 fragments without a second walk.
+	} else if len(tbl) < 2 {
+		return 0, fsys.pathErr("buildlinkmap", fp.name, frInvalidParameter)
+	}
+	fp.cltbl = tbl
+	fp.clmtAuto = auto
+	fr := fp.clmt_build()
+	n := int(fp.cltbl[0])
+	if fr != frOK {
+		fp.cltbl = nil
+	}
+	return n, fsys.pathErr("buildlinkmap", fp.name, fr)
+}
+
+// DropLinkMap disables fast seek on the file, letting go of the link map built
+// by BuildLinkMap. It is a no-op if there is none.
+func (fp *File) DropLinkMap() error {
+	fsys, err := fp.lock("droplinkmap")
+	if err != nil {
+		return err
+	}
+	defer fp.unlock(fsys)
+	fp.cltbl = nil
+	fp.clmtAuto = false
+	return nil
+}
+
+// Expand allocates size bytes to the empty file as a single contiguous run of
+// clusters and sets its size to size, so that writing it involves no cluster
+// allocation and, on exFAT, where the file is marked as having no FAT chain,
+// no FAT lookups either. Pair it with BuildLinkMap for the same on FAT
+// volumes. It is FatFs' f_expand.
+//
+// If zeroFill is true the allocated clusters are zeroed. Otherwise they hold
+// whatever the media last held until written over, which is what lets a
+// recorder claim its space up front without writing it twice.
+//
+// The file must be open for writing and empty. Expand fails if no free run of
+// clusters is large enough, in which case nothing is allocated.
+func (fp *File) Expand(size int64, zeroFill bool) (err error) {
+	fsys, err := fp.lock("expand")
+	if err != nil {
+		return err
+	}
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "expand", fp.name)
+	if fp.err != frOK {
+		return fp.err
+	} else if size < 0 {
+		return errNegativeOffset
+	} else if fp.flag&faWrite == 0 || fsys.perm&ModeWrite == 0 {
+		return frWriteProtected
+	} else if fp.obj.objsize != 0 {
+		return frDenied
+	} else if size == 0 {
+		return nil
+	}
+	fr := fp.f_expand(size, true)
+	if fr == frOK && zeroFill {
+		fr = fp.zero_run(size)
+	}
+	return fr
+}
+
+// zero_run zeroes the sectors holding the first size bytes of the contiguous
+// file fp, writing up to a cluster at a time.
+func (fp *File) zero_run(size int64) fileResult {
+	fsys := fp.obj.fs
+	ss := int64(fsys.ssize)
+	sect := fsys.clst2sect(fp.obj.sclust)
+	if sect == 0 {
+		return frIntErr
+	}
+	nsect := (size + ss - 1) / ss
+	buf := make([]byte, min(min(int64(fsys.csize), nsect), 64)*ss)
+	for nsect > 0 {
+		n := min(int64(len(buf))/ss, nsect)
+		if fsys.disk_write(buf[:n*ss], sect, int(n)) != drOK {
+			return frDiskErr
+		}
+		sect += lba(n)
+		nsect -= n
+	}
+	return frOK
+}
+
 // Seek sets the offset for the next Read or Write on the file to offset,
 // interpreted according to whence: [io.SeekStart], [io.SeekCurrent] or
 // [io.SeekEnd]. It returns the new offset and implements the [io.Seeker]
@@ -427,12 +854,13 @@ func (fp *File) Truncate(size int64) error {
 // size, so it extends the file on a writable handle and silently clips the seek
 // back to the end on a read-only one — a caller who seeks to 48 in an empty file
 // is told it is at 0. Neither happens here; see File.pos.
-func (fp *File) Seek(offset int64, whence int) (int64, error) {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return 0, fr
+func (fp *File) Seek(offset int64, whence int) (_ int64, err error) {
+	fsys, err := fp.lock("seek")
+	if err != nil {
+		return 0, err
 	}
-	defer fsys.mu.Unlock()
+	defer fp.unlock(fsys)
+	defer fsys.wrapErr(&err, "seek", fp.name)
 	var abs int64
 	switch whence {
 	case io.SeekStart:
@@ -450,7 +878,7 @@ func (fp *File) Seek(offset int64, whence int) (int64, error) {
 	if abs <= fp.obj.objsize {
 		// Within the file: move FatFs' pointer now, so a seek to an unreachable
 		// offset still reports the disk error that finding it produced.
-		if fr = fp.f_lseek(abs); fr != frOK {
+		if fr := fp.f_lseek(abs); fr != frOK {
 			return 0, fr
 		}
 	}
@@ -460,16 +888,12 @@ func (fp *File) Seek(offset int64, whence int) (int64, error) {
 
 // Close closes the file and syncs any unwritten data to the underlying device.
 func (fp *File) Close() error {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return fr
+	fsys, err := fp.lock("close")
+	if err != nil {
+		return err
 	}
-	defer fsys.mu.Unlock()
-	fr = fp.f_close()
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	defer fp.unlock(fsys)
+	return fsys.pathErr("close", fp.name, fp.f_close())
 }
 
 // Unmount unmounts the FAT filesystem, syncing any pending writes to the
@@ -478,8 +902,9 @@ func (fp *File) Close() error {
 func (fsys *FS) Unmount() error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
+	fsys.inflight.Wait() // Let data transfers of open files finish with the device.
 	if fsys.fstype == _FormatUnknown {
-		return frNoFilesystem // Not mounted.
+		return fsys.pathErr("unmount", "/", frNoFilesystem) // Not mounted.
 	}
 	var fr fileResult = frOK
 	if fsys.perm&ModeWrite != 0 {
@@ -489,10 +914,7 @@ func (fsys *FS) Unmount() error {
 	fsys.id++                    // Invalidate open files and directories.
 	fsys.perm = 0
 	fsys.device = nil
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("unmount", "/", fr)
 }
 
 // Mkdir creates a new directory with the given path. The parent directory
@@ -500,11 +922,7 @@ func (fsys *FS) Unmount() error {
 func (fsys *FS) Mkdir(path string) error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
-	fr := fsys.f_mkdir(path)
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("mkdir", path, fsys.f_mkdir(path))
 }
 
 // Rename renames (moves) oldpath to newpath, which may be in a different
@@ -512,59 +930,39 @@ func (fsys *FS) Mkdir(path string) error {
 func (fsys *FS) Rename(oldpath, newpath string) error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
-	fr := fsys.f_rename(oldpath, newpath)
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("rename", oldpath, fsys.f_rename(oldpath, newpath))
 }
 
 // Stat stores information describing the named file or directory into info.
 func (fsys *FS) Stat(path string, info *FileInfo) error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
-	fr := fsys.f_stat(path, info)
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("stat", path, fsys.f_stat(path, info))
 }
 
 // Remove removes the named file or empty directory from the filesystem.
 func (fsys *FS) Remove(path string) error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
-	fr := fsys.f_unlink(path)
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("remove", path, fsys.f_unlink(path))
 }
 
 // Sync commits all pending writes of the filesystem to the underlying device.
 func (fsys *FS) Sync() error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
-	fr := fsys.sync()
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("sync", "/", fsys.sync())
 }
 
 // Sync commits the current contents of the file to the filesystem immediately.
 // It flushes the file's cached data and its directory entry to the device.
 func (fp *File) Sync() error {
-	fsys, fr := fp.lock()
-	if fr != frOK {
-		return fr
+	fsys, err := fp.lock("sync")
+	if err != nil {
+		return err
 	}
-	defer fsys.mu.Unlock()
-	fr = fsys.f_sync(fp)
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	defer fp.unlock(fsys)
+	return fsys.pathErr("sync", fp.name, fsys.f_sync(fp))
 }
 
 // Mode returns the lowest 2 bits of the file's permission (read, write or both).
@@ -576,24 +974,49 @@ func (fp *File) Mode() Mode {
 	return Mode(fp.flag & 3)
 }
 
+// Chmod changes the attribute bits of the named file or directory selected
+// by mask to their values in attr. Only AttrReadOnly, AttrHidden,
+// AttrSystem and AttrArchive can be changed, other bits in mask are ignored.
+func (fsys *FS) Chmod(path string, attr, mask byte) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.pathErr("chmod", path, fsys.f_chmod(path, attr, mask))
+}
+
+// Chtimes sets the modification time of the named file or directory.
+//
+// FAT timestamps carry no time zone and are read back by [FileInfo.ModTime]
+// as UTC, so mtime is stored as its UTC wall clock. The stored time has a
+// resolution of 2 seconds and is clamped to the FAT range of years 1980
+// through 2107.
+func (fsys *FS) Chtimes(path string, mtime time.Time) error {
+	mtime = mtime.UTC()
+	if min := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC); mtime.Before(min) {
+		mtime = min
+	} else if max := time.Date(2107, 12, 31, 23, 59, 58, 0, time.UTC); mtime.After(max) {
+		mtime = max
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.pathErr("chtimes", path, fsys.f_utime(path, newDatetime(mtime).fattime()))
+}
+
 // OpenDir opens the named directory for reading.
 func (fsys *FS) OpenDir(dp *Dir, path string) error {
 	fsys.mu.Lock()
 	defer fsys.mu.Unlock()
-	fr := fsys.f_opendir(&dp.dir, path)
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	dp.pat = "" // FindNext matches nothing on a Dir not opened by FindFirst.
+	dp.name = path
+	return fsys.pathErr("open", path, fsys.f_opendir(&dp.dir, path))
 }
 
 // Close closes the directory, invalidating the handle. A directory holds no
 // unwritten state, so unlike (*File).Close this flushes nothing to the device.
 // The Dir can be reused by passing it to OpenDir again.
 func (dp *Dir) Close() error {
-	fsys, fr := dp.lock()
-	if fr != frOK {
-		return fr
+	fsys, err := dp.lock("close")
+	if err != nil {
+		return err
 	}
 	defer fsys.mu.Unlock()
 	// Invalidate the handle by id instead of clearing obj.fs, matching
@@ -607,23 +1030,29 @@ func (dp *Dir) Close() error {
 // The callback runs with the filesystem lock held: calling any method of
 // the same FS or of its files from within the callback deadlocks.
 func (dp *Dir) ForEachFile(callback func(*FileInfo) error) error {
-	fsys, fr := dp.lock()
-	if fr != frOK {
-		return fr
+	fsys, err := dp.lock("readdir")
+	if err != nil {
+		return err
 	}
 	defer fsys.mu.Unlock()
+	return dp.forEachFile(callback)
+}
+
+// forEachFile is ForEachFile with the filesystem locked. The errors of
+// callback are returned as they are.
+func (dp *Dir) forEachFile(callback func(*FileInfo) error) error {
+	fsys := dp.obj.fs
 	if fsys.perm&ModeRead == 0 {
-		return errForbiddenMode
+		return fsys.pathErr("readdir", dp.name, errForbiddenMode)
 	}
-
-	fr = dp.sdi(0) // Rewind directory.
+	fr := dp.sdi(0) // Rewind directory.
 	if fr != frOK {
-		return fr
+		return fsys.pathErr("readdir", dp.name, fr)
 	}
 	for {
 		fr := dp.f_readdir(&dp.inlineInfo)
 		if fr != frOK {
-			return fr
+			return fsys.pathErr("readdir", dp.name, fr)
 		} else if dp.inlineInfo.fname[0] == 0 {
 			return nil // End of directory.
 		}
@@ -635,19 +1064,15 @@ func (dp *Dir) ForEachFile(callback func(*FileInfo) error) error {
 }
 
 // Rewind resets the directory cursor to the first entry, so the next
-// ReadNext starts the walk over. It is the only way to restart a walk: a
-// directory cursor cannot be seeked to an arbitrary entry.
+// ReadNext starts the walk over. To continue a walk from elsewhere use
+// SetPos with a cookie from Pos.
 func (dp *Dir) Rewind() error {
-	fsys, fr := dp.lock()
-	if fr != frOK {
-		return fr
+	fsys, err := dp.lock("rewind")
+	if err != nil {
+		return err
 	}
 	defer fsys.mu.Unlock()
-	fr = dp.sdi(0) // Rewind directory.
-	if fr != frOK {
-		return fr
-	}
-	return nil
+	return fsys.pathErr("rewind", dp.name, dp.sdi(0)) // Rewind directory.
 }
 
 // ReadNext reads the next directory entry into dst. The "." and ".."
@@ -660,21 +1085,171 @@ func (dp *Dir) Rewind() error {
 // then not atomic: entries added or removed mid-walk may be skipped or
 // repeated.
 func (dp *Dir) ReadNext(dst *FileInfo) error {
-	fsys, fr := dp.lock()
-	if fr != frOK {
-		return fr
+	fsys, err := dp.lock("readdir")
+	if err != nil {
+		return err
 	}
 	defer fsys.mu.Unlock()
 	if fsys.perm&ModeRead == 0 {
-		return errForbiddenMode
+		return fsys.pathErr("readdir", dp.name, errForbiddenMode)
 	}
-	fr = dp.f_readdir(dst)
-	if fr != frOK {
-		return fr
-	} else if dst.fname[0] == 0 {
+	fr := dp.f_readdir(dst)
+	if fr == frOK && dst.fname[0] == 0 {
 		return io.EOF
 	}
-	return nil
+	return fsys.pathErr("readdir", dp.name, fr)
+}
+
+// All returns an iterator over the directory's entries, starting from the
+// first one. The "." and ".." pseudo-entries and the volume label are
+// skipped. The yielded *FileInfo is reused between iterations and must be
+// copied to be retained. On error the iterator yields a nil FileInfo and
+// the error, then stops.
+//
+// Like ReadNext the filesystem lock is held only while reading each entry,
+// not while the loop body runs, so the FS may be used from within the loop.
+func (dp *Dir) All() iter.Seq2[*FileInfo, error] {
+	return func(yield func(*FileInfo, error) bool) {
+		if err := dp.Rewind(); err != nil {
+			yield(nil, err)
+			return
+		}
+		for {
+			err := dp.ReadNext(&dp.inlineInfo)
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(&dp.inlineInfo, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ReadDir reads the directory from the current cursor position and returns
+// a slice of up to n entries, with the semantics of [os.File.ReadDir]:
+//
+// If n > 0 at most n entries are returned and io.EOF is returned with an
+// empty slice once the directory is exhausted. If n <= 0 all remaining
+// entries are returned with a nil error at the end of the directory.
+// On failure the entries read before the error are returned alongside it.
+func (dp *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	if n > 0 {
+		entries = make([]fs.DirEntry, 0, n)
+	}
+	for n <= 0 || len(entries) < n {
+		info := new(FileInfo)
+		err := dp.ReadNext(info)
+		if err == io.EOF {
+			if n > 0 && len(entries) == 0 {
+				return entries, io.EOF
+			}
+			break
+		} else if err != nil {
+			return entries, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// FindFirst opens the directory at path into dp and reads into dst the
+// first entry whose name matches pattern. It returns io.EOF if no entry
+// matches. Subsequent matches are read with FindNext.
+//
+// In the pattern '?' matches any single character and '*' any sequence of
+// characters, including none. Matching ignores case using the same up-case
+// conversion as name lookup, and an entry also matches if its alternate
+// (8.3) name does, so "*.TXT" finds "notes.txt" and "*~1.TXT" finds
+// "notes and more.txt". A pattern holds at most 4 wildcard terms.
+//
+// Matching runs with the filesystem lock held, so skipped entries cost no
+// more than reading them.
+func (fsys *FS) FindFirst(dp *Dir, dst *FileInfo, path, pattern string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.perm&ModeRead == 0 {
+		return fsys.pathErr("findfirst", path, errForbiddenMode)
+	}
+	dp.name = path
+	fr := fsys.f_findfirst(&dp.dir, dst, path, pattern)
+	if fr == frOK && dst.fname[0] == 0 {
+		return io.EOF
+	}
+	return fsys.pathErr("findfirst", path, fr)
+}
+
+// FindNext reads into dst the next entry matching the pattern given to
+// FindFirst. It returns io.EOF once no entries are left to match. After
+// Rewind or SetPos, FindNext resumes the search from the new position.
+func (dp *Dir) FindNext(dst *FileInfo) error {
+	fsys, err := dp.lock("findnext")
+	if err != nil {
+		return err
+	}
+	defer fsys.mu.Unlock()
+	if fsys.perm&ModeRead == 0 {
+		return fsys.pathErr("findnext", dp.name, errForbiddenMode)
+	}
+	fr := dp.f_findnext(dst)
+	if fr == frOK && dst.fname[0] == 0 {
+		return io.EOF
+	}
+	return fsys.pathErr("findnext", dp.name, fr)
+}
+
+// dirPosEnd is the position cookie of an exhausted directory cursor.
+const dirPosEnd = -1
+
+// Pos returns an opaque cookie for the directory cursor position: the
+// entry the next ReadNext or ReadDir call returns. Passing it to SetPos on
+// a Dir opened on the same directory, possibly after the original handle
+// was closed, resumes the listing from that entry. An exhausted cursor
+// reports -1.
+//
+// The cookie is a byte offset into the directory table. It stays valid
+// across Close and reopen, but if the directory is modified in between
+// entries may be skipped or repeated, as with any non-atomic walk.
+func (dp *Dir) Pos() (int64, error) {
+	fsys, err := dp.lock("pos")
+	if err != nil {
+		return 0, err
+	}
+	defer fsys.mu.Unlock()
+	if dp.sect == 0 {
+		return dirPosEnd, nil
+	}
+	return int64(dp.dptr), nil
+}
+
+// SetPos moves the directory cursor to a position previously returned by
+// Pos. A cookie of -1 leaves the cursor exhausted, and SetPos(0) is
+// equivalent to Rewind.
+func (dp *Dir) SetPos(pos int64) error {
+	fsys, err := dp.lock("setpos")
+	if err != nil {
+		return err
+	}
+	defer fsys.mu.Unlock()
+	if pos == dirPosEnd {
+		dp.sect = 0 // Terminate read op, like reaching the end of table.
+		return nil
+	} else if pos < 0 || pos >= maxDIREx || pos%sizeDirEntry != 0 {
+		return fsys.pathErr("setpos", dp.name, frInvalidParameter)
+	}
+	fr := dp.sdi(uint32(pos))
+	if fr != frOK {
+		dp.sect = 0 // Leave the cursor exhausted rather than half-moved.
+		if fr == frIntErr {
+			// sdi reports positions beyond the table as internal errors.
+			fr = frInvalidParameter
+		}
+	}
+	return fsys.pathErr("setpos", dp.name, fr)
 }
 
 var _ fs.FileInfo = (*FileInfo)(nil)
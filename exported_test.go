@@ -3,7 +3,9 @@ package fat
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"strings"
 	"testing"
 )
@@ -316,7 +318,7 @@ func TestReadAtWriteAt(t *testing.T) {
 	if f.Size() != size {
 		t.Fatalf("ReadAt past EOF grew file to %d", f.Size())
 	}
-	if _, err = f.ReadAt(buf, -1); err != errNegativeOffset {
+	if _, err = f.ReadAt(buf, -1); !errors.Is(err, errNegativeOffset) {
 		t.Fatalf("ReadAt negative offset: %v", err)
 	}
 
@@ -344,7 +346,7 @@ func TestReadAtWriteAt(t *testing.T) {
 	if f.Size() != size+104 {
 		t.Fatalf("WriteAt past EOF: size=%d want %d", f.Size(), size+104)
 	}
-	if _, err = f.WriteAt(repl, -1); err != errNegativeOffset {
+	if _, err = f.WriteAt(repl, -1); !errors.Is(err, errNegativeOffset) {
 		t.Fatalf("WriteAt negative offset: %v", err)
 	}
 	if err := f.Close(); err != nil {
@@ -470,7 +472,7 @@ func TestTruncate(t *testing.T) {
 	if f.Size() != 0 {
 		t.Fatalf("after zero-truncate Size=%d", f.Size())
 	}
-	if err := f.Truncate(-1); err != errNegativeOffset {
+	if err := f.Truncate(-1); !errors.Is(err, errNegativeOffset) {
 		t.Fatalf("negative truncate: %v", err)
 	}
 	// Write after zero-truncate reallocates a fresh chain.
@@ -722,6 +724,230 @@ func TestFileInfoName(t *testing.T) {
 	}
 }
 
+// TestDirIterators lists a directory through All, ReadDir and a Pos cookie
+// carried across Close and reopen, on FAT and exFAT: every entry must be
+// seen exactly once by each walk.
+func TestDirIterators(t *testing.T) {
+	t.Run("FAT", func(t *testing.T) {
+		fsys, _ := initTestFAT()
+		testDirIterators(t, fsys)
+	})
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		fsys, _, err := initTestExFAT(0x1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDirIterators(t, fsys)
+	})
+}
+
+func testDirIterators(t *testing.T, fsys *FS) {
+	const numFiles = 40 // Spans several directory sectors.
+	if err := fsys.Mkdir("iter"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{}
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("F%02d.TXT", i)
+		writeStr(t, fsys, "iter/"+name, name)
+		want[name] = true
+	}
+	checkAll := func(walk string, got []string) {
+		t.Helper()
+		seen := map[string]bool{}
+		for _, name := range got {
+			name = strings.ToUpper(name)
+			if !want[name] {
+				t.Errorf("%s: unexpected entry %q", walk, name)
+			} else if seen[name] {
+				t.Errorf("%s: entry %q listed twice", walk, name)
+			}
+			seen[name] = true
+		}
+		if len(seen) != len(want) {
+			t.Errorf("%s: listed %d entries, want %d", walk, len(seen), len(want))
+		}
+	}
+	var dir Dir
+	if err := fsys.OpenDir(&dir, "iter"); err != nil {
+		t.Fatal(err)
+	}
+
+	// All, including early termination and use of the FS inside the loop.
+	var got []string
+	for fi, err := range dir.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info FileInfo
+		if err := fsys.Stat("iter/"+fi.Name(), &info); err != nil {
+			t.Fatalf("Stat inside All loop: %v", err)
+		}
+		got = append(got, fi.Name())
+	}
+	checkAll("All", got)
+	n := 0
+	for range dir.All() {
+		if n++; n == 3 {
+			break
+		}
+	}
+
+	// ReadDir(n > 0) in chunks until io.EOF, then again returns io.EOF.
+	if err := dir.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for {
+		entries, err := dir.ReadDir(7)
+		if err == io.EOF {
+			if len(entries) != 0 {
+				t.Errorf("ReadDir at EOF returned %d entries", len(entries))
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if len(entries) == 0 || len(entries) > 7 {
+			t.Fatalf("ReadDir(7) returned %d entries", len(entries))
+		}
+		for _, e := range entries {
+			if e.IsDir() || !e.Type().IsRegular() {
+				t.Errorf("%s: unexpected type %v", e.Name(), e.Type())
+			}
+			info, err := e.Info()
+			if err != nil || info.Size() != int64(len(e.Name())) {
+				t.Errorf("%s: Info = %v, %v", e.Name(), info, err)
+			}
+			got = append(got, e.Name())
+		}
+	}
+	checkAll("ReadDir(7)", got)
+	if _, err := dir.ReadDir(1); err != io.EOF {
+		t.Errorf("ReadDir past EOF = %v, want io.EOF", err)
+	}
+	// ReadDir(n <= 0) returns the rest with a nil error, even when empty.
+	if entries, err := dir.ReadDir(0); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir(0) at EOF = %d entries, %v", len(entries), err)
+	}
+	if err := dir.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	checkAll("ReadDir(-1)", got)
+
+	// Resume through a Pos cookie after closing the handle.
+	if err := dir.Rewind(); err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for {
+		entries, err := dir.ReadDir(5)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		pos, err := dir.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dir.Pos(); err == nil {
+			t.Error("Pos on closed Dir succeeded")
+		}
+		if err := fsys.OpenDir(&dir, "iter"); err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.SetPos(pos); err != nil {
+			t.Fatalf("SetPos(%d): %v", pos, err)
+		}
+	}
+	checkAll("Pos/SetPos", got)
+	if pos, err := dir.Pos(); err != nil || pos != -1 {
+		t.Errorf("Pos at EOF = %d, %v; want -1", pos, err)
+	}
+	for _, bad := range []int64{-2, 1, 33, maxDIREx} {
+		if err := dir.SetPos(bad); err == nil {
+			t.Errorf("SetPos(%d) succeeded", bad)
+		}
+	}
+	if err := dir.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFindFirst searches a directory by wildcard pattern, matching long
+// names case-insensitively and falling back to the 8.3 alternate name.
+func TestFindFirst(t *testing.T) {
+	fsys, _ := initTestFAT()
+	names := []string{"notes.txt", "todo.TXT", "data.bin", "readme"}
+	if lfnEnabled {
+		names = append(names, "notes and more.txt", "Ünïcode.txt")
+	}
+	for _, name := range names {
+		writeStr(t, fsys, "rootdir/"+name, name)
+	}
+	find := func(pattern string) (got []string) {
+		t.Helper()
+		var dir Dir
+		var fi FileInfo
+		err := fsys.FindFirst(&dir, &fi, "rootdir", pattern)
+		for err == nil {
+			got = append(got, strings.ToLower(fi.Name()))
+			err = dir.FindNext(&fi)
+		}
+		if err != io.EOF {
+			t.Fatalf("%q: %v", pattern, err)
+		}
+		if err := dir.FindNext(&fi); err != io.EOF {
+			t.Errorf("%q: FindNext past end = %v", pattern, err)
+		}
+		return got
+	}
+	for _, test := range []struct {
+		pattern string
+		want    []string
+		lfn     bool // Test needs long file names.
+	}{
+		{pattern: "*.txt", want: []string{"notes.txt", "todo.txt"}},
+		{pattern: "NOTES.*", want: []string{"notes.txt"}},
+		{pattern: "????.*", want: []string{"todo.txt", "data.bin"}},
+		{pattern: "*file", want: []string{"dirfile"}},
+		{pattern: "nomatch*", want: nil},
+		{pattern: "*.txt", want: []string{"notes.txt", "todo.txt", "notes and more.txt", "ünïcode.txt"}, lfn: true},
+		{pattern: "ÜNÏ*", want: []string{"ünïcode.txt"}, lfn: true},
+		// Matches the alternate name NOTESA~1.TXT only.
+		{pattern: "*~1.txt", want: []string{"notes and more.txt"}, lfn: true},
+	} {
+		if test.lfn != lfnEnabled {
+			continue
+		}
+		got := find(test.pattern)
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%q: found %q, want %q", test.pattern, got, test.want)
+		}
+	}
+	// A missing directory is reported as such.
+	var dir Dir
+	var fi FileInfo
+	if err := fsys.FindFirst(&dir, &fi, "nodir", "*"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("FindFirst in missing dir = %v", err)
+	}
+}
+
 // The tests here cover the file position and what happens when it outruns the
 // file. FatFs has no such position — f_lseek will not let its pointer exceed the
 // file size — so all of this is behavior that File.pos adds on top, and it is the
@@ -975,3 +1201,219 @@ func TestFailedWriteDoesNotMoveOffset(t *testing.T) {
 		t.Fatalf("offset = %d after a denied write, want 3: a failed write must not move it", pos)
 	}
 }
+
+// TestLinkMap checks fast seek through BuildLinkMap on a fragmented file: the
+// map is sized and used, follows the file as it grows and shrinks, and is let
+// go when caller storage can no longer hold it.
+func TestLinkMap(t *testing.T) {
+	fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	var f, filler File
+	if err := fsys.OpenFile(&f, "frag.dat", ModeCreateNew|ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.OpenFile(&filler, "filler.dat", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	// fragment appends a one-cluster fragment to frag.dat.
+	fragment := func() {
+		t.Helper()
+		if _, err := f.Seek(int64(size), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		writePat(t, &f, 1, size, 512)
+		writePat(t, &filler, 2, int(filler.Size()), 512)
+		size += 512
+	}
+	check := func() {
+		t.Helper()
+		buf := make([]byte, 100)
+		for off := size - len(buf); off >= 0; off -= 397 {
+			if _, err := f.ReadAt(buf, int64(off)); err != nil {
+				t.Fatalf("ReadAt(%d): %v", off, err)
+			}
+			for i, b := range buf {
+				if b != pat(1, off+i) {
+					t.Fatalf("ReadAt(%d): content mismatch at %d", off, off+i)
+				}
+			}
+		}
+	}
+	for i := 0; i < 8; i++ {
+		fragment()
+	}
+
+	// Caller storage too small: the required size is reported.
+	n, err := f.BuildLinkMap(make([]uint32, 4))
+	if err == nil || n != 2+2*8 {
+		t.Fatalf("short table: n=%d err=%v, want n=%d and an error", n, err, 2+2*8)
+	} else if f.cltbl != nil {
+		t.Fatal("short table left attached")
+	}
+
+	// Allocated map follows growth.
+	if n, err = f.BuildLinkMap(nil); err != nil || n != 2+2*8 {
+		t.Fatalf("BuildLinkMap(nil): n=%d err=%v", n, err)
+	}
+	check()
+	for i := 0; i < 20; i++ {
+		fragment()
+	}
+	check()
+	if f.cltbl == nil || f.cltbl[0] != 2+2*28 || f.clmtLen != 28 {
+		t.Errorf("allocated map not rebuilt after growth: %v", f.cltbl)
+	}
+
+	// Shrinking and regrowing into different clusters.
+	if err = f.Truncate(int64(size / 2)); err != nil {
+		t.Fatal(err)
+	}
+	size /= 2
+	fragment()
+	fragment()
+	check()
+
+	// Caller storage that fits exactly is let go when the file outgrows it.
+	tbl := make([]uint32, 2+2*16)
+	if n, err = f.BuildLinkMap(tbl); err != nil {
+		t.Fatalf("BuildLinkMap: n=%d err=%v", n, err)
+	}
+	check()
+	fragment()
+	check()
+	if f.cltbl != nil {
+		t.Error("outgrown caller table still attached")
+	}
+
+	// Growing by seeking past the end without zero filling stretches the chain.
+	if _, err = f.BuildLinkMap(nil); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Configure(FSConfig{NoZeroFilling: true})
+	if _, err = f.WriteAt([]byte{pat(1, size+2000)}, int64(size+2000)); err != nil {
+		t.Fatal(err)
+	} else if got := f.Size(); got != int64(size+2001) {
+		t.Fatalf("size after WriteAt past end = %d, want %d", got, size+2001)
+	}
+	check()
+	if err = f.DropLinkMap(); err != nil || f.cltbl != nil {
+		t.Errorf("DropLinkMap: %v", err)
+	}
+	check()
+
+	// The map does not survive reopening.
+	if _, err = f.BuildLinkMap(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fsys.OpenFile(&f, "frag.dat", ModeRead); err != nil {
+		t.Fatal(err)
+	} else if f.cltbl != nil {
+		t.Error("link map survived reopen")
+	}
+	f.Close()
+	filler.Close()
+}
+
+func TestExpand(t *testing.T) {
+	t.Run("FAT", func(t *testing.T) {
+		fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+		testExpand(t, fsys)
+	})
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		fsys, _ := formatAndMount(t, 4096, FormatParams{Format: FormatExFAT, ClusterSize: 1})
+		testExpand(t, fsys)
+	})
+}
+
+func testExpand(t *testing.T, fsys *FS) {
+	// Leave a 4-cluster hole in the free space and stale data everywhere.
+	createPat(t, fsys, "a.dat", 1, 4*512)
+	createPat(t, fsys, "hole.dat", 2, 4*512)
+	createPat(t, fsys, "c.dat", 3, 4*512)
+	var f File
+	if err := fsys.OpenFile(&f, "fill.dat", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	stale := bytes.Repeat([]byte{0xa5}, 512)
+	for {
+		if _, err := f.Write(stale); err != nil {
+			break // Disk full.
+		}
+	}
+	f.Close()
+	for _, name := range []string{"hole.dat", "fill.dat"} {
+		if err := fsys.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expand := func(name string, size int64, zeroFill bool) error {
+		t.Helper()
+		var f File
+		if err := fsys.OpenFile(&f, name, ModeCreateAlways|ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return f.Expand(size, zeroFill)
+	}
+	if err := expand("huge.dat", 1<<30, false); err == nil {
+		t.Fatal("expand beyond the volume succeeded")
+	}
+
+	const size = 8*512 + 100
+	if err := expand("raw.dat", size, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := expand("zero.dat", size, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"raw.dat", "zero.dat"} {
+		if err := fsys.OpenFile(&f, name, ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		if f.Size() != size {
+			t.Errorf("%s: size = %d, want %d", name, f.Size(), size)
+		}
+		// One contiguous run that skipped the 4-cluster hole.
+		scl := f.obj.sclust
+		if f.obj.fs.isExfat() && f.obj.stat != 2 {
+			t.Errorf("%s: no NoFatChain flag, stat=%d", name, f.obj.stat)
+		}
+		for cl := scl; cl < scl+8; cl++ {
+			if next := f.obj.clusterstat(cl); next != cl+1 {
+				t.Fatalf("%s: cluster %d followed by %d, want contiguous", name, cl, next)
+			}
+		}
+		data, err := io.ReadAll(&f)
+		if err != nil || len(data) != size {
+			t.Fatalf("%s: read %d bytes: %v", name, len(data), err)
+		}
+		zeroed := bytes.Count(data, []byte{0}) == size
+		if zeroed != (name == "zero.dat") {
+			t.Errorf("%s: zeroed = %v", name, zeroed)
+		}
+		if err := f.Expand(size, false); err == nil {
+			t.Errorf("%s: expanding a non-empty file succeeded", name)
+		}
+		// Writing into the allocation does not grow it.
+		if _, err := f.WriteAt([]byte("recorded"), 512); err != nil {
+			t.Fatal(err)
+		} else if f.Size() != size || f.obj.sclust != scl {
+			t.Errorf("%s: allocation changed by writing into it", name)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readAllFile(t, fsys, "zero.dat"); string(got[512:520]) != "recorded" {
+		t.Errorf("zero.dat content after write = %q", got[512:520])
+	}
+	// Neighbors are intact.
+	if got := readAllFile(t, fsys, "c.dat"); got[0] != pat(3, 0) || got[len(got)-1] != pat(3, 4*512-1) {
+		t.Error("c.dat corrupted")
+	}
+}
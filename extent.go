@@ -0,0 +1,66 @@
+package fat
+
+// Extent is a run of a file's data lying contiguous on the device, see
+// [File.Extents].
+type Extent struct {
+	Offset    int64 // Byte offset of the run in the file.
+	Block     int64 // First device block of the run, counted from the start of the device.
+	NumBlocks int64 // Length of the run in blocks of [FS.BlockSize] bytes.
+}
+
+// Extents appends the extents of the file to dst and returns the result: the
+// runs of device blocks holding its data, in file order, each as long as the
+// clusters under it are contiguous on the device. Together they span the
+// blocks holding the file's size; the last block may be partly past the end
+// of the file. An empty file has none.
+//
+// Blocks are device addresses, as passed to [BlockDevice.ReadBlocks]. For
+// addresses relative to the volume, as within a partition, subtract
+// [FS.VolumeBase]. Data written to the file but not yet synced may not have
+// reached its blocks; call Sync first. The extents hold until the file is
+// written past its end, truncated or removed.
+func (fp *File) Extents(dst []Extent) ([]Extent, error) {
+	fsys, err := fp.lock("extents")
+	if err != nil {
+		return dst, err
+	}
+	defer fp.unlock(fsys)
+	dst, fr := fp.extents(dst)
+	return dst, fsys.pathErr("extents", fp.name, fr)
+}
+
+// extents follows the cluster chain of the file over its size, which on
+// exFAT also covers files without a FAT chain: clusterstat generates their
+// links.
+func (fp *File) extents(dst []Extent) ([]Extent, fileResult) {
+	fsys := fp.obj.fs
+	ss := int64(fsys.ssize)
+	cs := int64(fsys.csize)
+	remain := (fp.obj.objsize + ss - 1) / ss // Sectors left to map.
+	first := len(dst)
+	cl := fp.obj.sclust
+	var ofs int64
+	for remain > 0 {
+		if cl < 2 || cl >= fsys.n_fatent {
+			return dst, frIntErr
+		}
+		n := cs
+		if n > remain {
+			n = remain
+		}
+		sect := int64(fsys.clst2sect(cl))
+		if last := len(dst) - 1; last >= first && dst[last].Block+dst[last].NumBlocks == sect {
+			dst[last].NumBlocks += n
+		} else {
+			dst = append(dst, Extent{Offset: ofs, Block: sect, NumBlocks: n})
+		}
+		ofs += n * ss
+		remain -= n
+		if remain > 0 {
+			if cl = fp.obj.clusterstat(cl); cl == badCluster {
+				return dst, frDiskErr
+			}
+		}
+	}
+	return dst, frOK
+}
@@ -0,0 +1,164 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// readExtents reads the first size bytes of the file held in extents
+// straight from the device.
+func readExtents(t *testing.T, dev BlockDevice, extents []Extent, size int) []byte {
+	t.Helper()
+	var got []byte
+	for _, ext := range extents {
+		if ext.Offset != int64(len(got)) {
+			t.Fatalf("extent at offset %d, want %d", ext.Offset, len(got))
+		}
+		buf := make([]byte, ext.NumBlocks*512)
+		if _, err := dev.ReadBlocks(buf, ext.Block); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf...)
+	}
+	if len(got) < size || len(got)-size >= 512 {
+		t.Fatalf("extents span %d bytes for a %d byte file", len(got), size)
+	}
+	return got[:size]
+}
+
+func TestExtents(t *testing.T) {
+	fsys, dev := formatAndMount(t, 16384, FormatParams{Format: FormatFAT16, ClusterSize: 2})
+	// Two files written in turns a cluster at a time interleave their chains.
+	var a, b File
+	if err := fsys.OpenFile(&a, "a.bin", ModeWrite|ModeCreateAlways); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.OpenFile(&b, "b.bin", ModeWrite|ModeCreateAlways); err != nil {
+		t.Fatal(err)
+	}
+	const size = 5*1024 + 100
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = pat(9, i)
+	}
+	for off := 0; off < size; off += 1024 {
+		end := min(int64(off+1024), size)
+		if _, err := a.Write(data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Write(data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Extend a on contiguous clusters now that b no longer takes every other.
+	more := bytes.Repeat([]byte{0x5a}, 3000)
+	if _, err := a.Write(more); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	extents, err := a.Extents(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(extents); n != 7 || extents[n-1].NumBlocks <= 2 {
+		t.Errorf("got extents %v, want 6 single clusters and a coalesced tail", extents)
+	}
+	if got := readExtents(t, dev, extents, size+len(more)); !bytes.Equal(got, append(data, more...)) {
+		t.Error("data at extents differs from file")
+	}
+	a.Close()
+
+	// An empty file has no extents.
+	writeStr(t, fsys, "empty.txt", "")
+	var e File
+	if err := fsys.OpenFile(&e, "empty.txt", ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if extents, err := e.Extents(nil); err != nil || len(extents) != 0 {
+		t.Errorf("empty file extents = %v, %v", extents, err)
+	}
+}
+
+// TestExtentsExFATNoChain maps an exFAT file allocated by Expand, which has
+// no FAT chain, and one grown fragmented, which has.
+func TestExtentsExFATNoChain(t *testing.T) {
+	skipIfNoExFAT(t)
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatExFAT, ClusterSize: 2})
+	const size = 40000
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = pat(10, i)
+	}
+	var fp File
+	if err := fsys.OpenFile(&fp, "contig.bin", ModeRW|ModeCreateAlways); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Expand(size, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	extents, err := fp.Extents(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(extents) != 1 {
+		t.Fatalf("contiguous file has %d extents: %v", len(extents), extents)
+	}
+	if got := readExtents(t, dev, extents, size); !bytes.Equal(got, data) {
+		t.Error("data at extent differs from file")
+	}
+	fp.Close()
+}
+
+// TestExtentsPartition maps a file of a volume in a partition: extents are
+// device blocks, VolumeBase the partition start.
+func TestExtentsPartition(t *testing.T) {
+	const partStart = 2048
+	vol := goldenImage(t, "golden-fmt16.img")
+	buf := make([]byte, partStart*512+len(vol))
+	copy(buf[partStart*512:], vol)
+	buf[446+4] = 0x0E
+	binary.LittleEndian.PutUint32(buf[446+8:], partStart)
+	binary.LittleEndian.PutUint32(buf[446+12:], uint32(len(vol)/512))
+	buf[510] = 0x55
+	buf[511] = 0xAA
+	blk, _ := makeBlockIndexer(512)
+	dev := &BlockByteSlice{blk: blk, buf: buf}
+	var fsys FS
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	if base := fsys.VolumeBase(); base != partStart {
+		t.Fatalf("VolumeBase = %d, want %d", base, partStart)
+	}
+	createPat(t, &fsys, "f.bin", 11, 3000)
+	var fp File
+	if err := fsys.OpenFile(&fp, "f.bin", ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	extents, err := fp.Extents(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readExtents(t, dev, extents, 3000)
+	for i, c := range got {
+		if c != pat(11, i) {
+			t.Fatalf("byte %d at extents = %#x, want %#x", i, c, pat(11, i))
+		}
+	}
+	if extents[0].Block < partStart {
+		t.Errorf("extent block %d not a device address", extents[0].Block)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"io"
 	"io/fs"
 	"log/slog"
 	"math/bits"
@@ -13,6 +14,10 @@ import (
 
 // var _ fs.FS = (*FS)(nil)
 
+// BlockDevice is the storage a volume is mounted from. An FS calls it from
+// one goroutine at a time, under its lock, unless [FSConfig.ConcurrentDevice]
+// declares it safe for concurrent use: the transfers of file data of
+// distinct open files may then call ReadBlocks and WriteBlocks at once.
 type BlockDevice interface {
 	ReadBlocks(dst []byte, startBlock int64) (int, error)
 	WriteBlocks(data []byte, startBlock int64) (int, error)
@@ -27,14 +32,25 @@ type lba uint32
 // FS is the FAT filesystem type. The zero value is unmounted; call Mount
 // before use. FS must not be copied while mounted.
 //
-// FS and its open files and directories are safe for concurrent use:
-// every exported operation takes a single per-filesystem lock, so calls
-// are serialized, never parallel.
+// FS and its open files and directories are safe for concurrent use.
+// Operations on the FAT, directories and other shared state of the volume
+// are serialized by a per-filesystem lock, and so are the calls to the
+// device. With [FSConfig.ConcurrentDevice] the transfer of file data
+// between the device and the caller's buffer is not: reads and writes of
+// distinct open files overlap their I/O. Operations on the same File are
+// serialized by a lock of its own.
 type FS struct {
-	// mu is the coarse per-filesystem lock. File and Dir operations take
-	// it too: files share the FS's disk access window win[] and FAT/FSInfo
-	// state, so there is no finer grain.
-	mu sync.Mutex
+	// mu is the per-filesystem lock. File and Dir operations take it too:
+	// files share the FS's disk access window win[], the sector cache and
+	// FAT/FSInfo state. With concurrentDev a File operation releases it
+	// while transferring the file's data sectors, counted in inflight so
+	// Mount and Unmount can wait for them to finish before the device goes
+	// away.
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+	// ctx is the context of the running Context operation that only reads
+	// the volume, passed to the device by disk_read. nil outside of one.
+	ctx context.Context
 
 	fstype   Format
 	nFATs    uint8
@@ -44,6 +60,42 @@ type FS struct {
 
 	// noZeroFill is [Config.NoZeroFilling]. See [FS.Configure].
 	noZeroFill bool
+	// cacheFAT and cacheDir are [FSConfig.CacheFATSectors] and
+	// [FSConfig.CacheDirSectors], applied to cache on mount.
+	cacheFAT, cacheDir int
+	cache              *sectorCache // Write-back sector cache. nil if disabled.
+	// amapBytes is [FSConfig.AllocMapBytes], applied to amap on mount.
+	amapBytes int
+	amap      *allocMap // In-RAM allocation map. nil if disabled.
+	// trimOn and trimMin are [FSConfig.Trim] and [FSConfig.TrimMinBlocks].
+	trimOn  bool
+	trimMin int
+	trim    []trimRun // Freed sector runs to erase at the next sync.
+	// raSectors and wcSectors are [FSConfig.ReadAheadSectors] and
+	// [FSConfig.WriteCoalesceSectors], applied to files on open.
+	raSectors, wcSectors int
+	// dcacheEntries is [FSConfig.DirCacheEntries], applied to dcache on mount.
+	dcacheEntries int
+	dcache        *dirCache // Directory lookup cache. nil if disabled.
+	// jnlOn is [FSConfig.Journal], applied on mount.
+	jnlOn bool
+	jnl   journal // Metadata journal. Unused if jnl.base is 0.
+	// remapBad is [FSConfig.RemapBadClusters].
+	remapBad bool
+	// scrubMode is [FSConfig.Scrub].
+	scrubMode ScrubMode
+	// verifyOn is [FSConfig.VerifyWrites]. vbuf holds the sectors read back.
+	verifyOn bool
+	vbuf     []byte
+	vstats   VerifyStats
+	// concurrentDev is [FSConfig.ConcurrentDevice].
+	concurrentDev bool
+	// retry is [FSConfig.Retry]. rstats counts its retries.
+	retry  RetryPolicy
+	rstats RetryStats
+	// deverr is the device error the operation under way failed with, see
+	// pathErr.
+	deverr *DeviceError
 
 	blk    blkIdxer
 	csize  uint16    // Cluster size in sectors.
@@ -54,6 +106,10 @@ type FS struct {
 	device    BlockDevice
 	last_clst uint32 // Last allocated clusters.
 	free_clst uint32 // Number of free clusters.
+	// last_alloc is the cluster allocated last since mount, 0 if none. Unlike
+	// last_clst it is not moved back to reuse freed space.
+	last_alloc uint32
+	alloc      Allocator // [FSConfig.Allocator]. nil allocates as FatFs.
 
 	// No relative pathing, we can always use a [fs.FS] wrapper.
 
@@ -91,9 +147,19 @@ type objid struct {
 }
 
 type File struct {
+	// mu serializes the operations on the File. It is taken before FS.mu.
+	mu sync.Mutex
+	// fsLocked is set while an exported operation holds mu and FS.mu, which
+	// data transfers may then release.
+	fsLocked bool
+	// ctx is the context of the running ReadContext, passed to the device by
+	// data_read. nil outside of one.
+	ctx context.Context
+
 	obj  objid
 	flag uint8
 	err  fileResult // abort flag (error code)
+	name string     // Path opened, in the errors of the File.
 
 	// fptr is FatFs' file pointer, and it cannot exceed the file size: f_lseek
 	// clips it on a read-only handle and GROWS THE FILE on a writable one, so it
@@ -112,7 +178,19 @@ type File struct {
 	dir_sect lba
 	dir_ptr  []byte
 	cltbl    []uint32  // Pointer to the cluster link map table (Nulled on file open, set by application)
+	clmtLen  uint32    // Number of clusters of the chain mapped by cltbl.
+	clmtAuto bool      // cltbl was allocated by BuildLinkMap and is resized as needed.
 	buf      [512]byte // Private read/write sector buffer.
+
+	// ra holds raN sectors read ahead from raSect. nil if disabled.
+	ra     []byte
+	raSect lba
+	raN    int
+	// wc holds wcN consecutive sectors from wcSect written back from buf and
+	// not yet to the device. nil if disabled.
+	wc     []byte
+	wcSect lba
+	wcN    int
 }
 
 type dir struct {
@@ -125,6 +203,8 @@ type dir struct {
 
 	// Use LFN:
 	blk_ofs uint32 // Offset of current entry block being processed (0:sfn, 1-:lfn)
+
+	pat string // Name matching pattern of f_findfirst/f_findnext.
 }
 
 const (
@@ -164,6 +244,7 @@ const (
 	drWriteProtected                   // write protected
 	drNotReady                         // not ready
 	drParError                         // invalid parameter
+	drVerifyErr                        // written data read back different
 )
 
 // fileResult is file function return code.
@@ -193,6 +274,8 @@ const (
 	frUnsupported                        // the operation is not supported
 	frClosed                             // the file is closed
 	frGeneric                            // fat generic error
+	frVerifyErr                          // written data read back different
+	frDiskFull                           // the volume is full
 )
 
 func (fr fileResult) Error() string {
@@ -200,7 +283,7 @@ func (fr fileResult) Error() string {
 }
 
 // Is maps FAT results onto the standard library sentinels so callers can use
-// errors.Is with fs.ErrNotExist and friends.
+// errors.Is with fs.ErrNotExist and friends, and io.ErrShortWrite.
 func (fr fileResult) Is(target error) bool {
 	switch target {
 	case fs.ErrNotExist:
@@ -211,6 +294,8 @@ func (fr fileResult) Is(target error) bool {
 		return fr == frInvalidName || fr == frInvalidParameter || fr == frInvalidObject
 	case fs.ErrPermission:
 		return fr == frDenied || fr == frWriteProtected
+	case io.ErrShortWrite:
+		return fr == frDiskFull
 	}
 	return false
 }
@@ -263,6 +348,9 @@ func (fp *File) f_read(buff []byte) (br int, res fileResult) {
 			if csect == 0 {
 				if fp.fptr == 0 {
 					clst = fp.obj.sclust
+				} else if fp.clmt_maps(fp.fptr) {
+					// Get cluster# from the CLMT.
+					clst = fp.clmt_clust(fp.fptr)
 				} else {
 					// Follow cluster chain on the FAT.
 					clst = fp.obj.clusterstat(fp.clust)
@@ -286,8 +374,8 @@ func (fp *File) f_read(buff []byte) (br int, res fileResult) {
 					// Clip at cluster boundary.
 					cc = int(cs) - int(csect)
 				}
-				if fsys.disk_read(buff[br:br+cc*int(ss)], sect, cc) != drOK {
-					return br, fp.abort(frDiskErr)
+				if fr := fp.data_read(buff[br:br+cc*int(ss)], sect, cc); fr != frOK {
+					return br, fp.abort(fr)
 				}
 				if fp.flag&faDIRTY != 0 && fp.sect-sect < lba(cc) {
 					off := (fp.sect - sect) * lba(ss)
@@ -299,13 +387,13 @@ func (fp *File) f_read(buff []byte) (br int, res fileResult) {
 			}
 			if fp.flag&faDIRTY != 0 {
 				// Write back dirty cache.
-				if fsys.disk_write(fp.buf[:], fp.sect, 1) != drOK {
-					return br, fp.abort(frDiskErr)
+				if fr := fp.buf_write(); fr != frOK {
+					return br, fp.abort(fr)
 				}
 				fp.flag &^= faDIRTY
 			}
-			if fsys.disk_read(fp.buf[:], sect, 1) != drOK {
-				return br, fp.abort(frDiskErr)
+			if fr := fp.buf_load(sect, true); fr != frOK {
+				return br, fp.abort(fr)
 			}
 			fp.sect = sect
 		}
@@ -352,11 +440,14 @@ func (fsys *FS) f_sync(fp *File) (fr fileResult) {
 		return frOK // No pending changes to file.
 	}
 	if fp.flag&faDIRTY != 0 {
-		if fsys.disk_write(fp.buf[:], fp.sect, 1) != drOK {
-			return frDiskErr
+		if fr = fp.buf_write(); fr != frOK {
+			return fr
 		}
 		fp.flag &^= faDIRTY
 	}
+	if fr = fp.wc_flush(); fr != frOK {
+		return fr
+	}
 
 	// Update directory entry.
 	tm := fsys.time()
@@ -399,6 +490,7 @@ func (fp *File) f_write(buf []byte) (bw int, fr fileResult) {
 	} else if fp.obj.fs.perm&ModeWrite == 0 {
 		return 0, frWriteProtected
 	}
+	fp.raN = 0 // Data read ahead may be overwritten.
 	fs := fp.obj.fs
 	btw := len(buf)
 	if fs.fstype != FormatExFAT && fp.fptr+int64(btw) < fp.fptr {
@@ -430,6 +522,9 @@ outerLoop:
 						// No cluster allocated yet.
 						clst = fp.obj.create_chain(0)
 					}
+				} else if fp.clmt_maps(fp.fptr) {
+					// Get cluster# from the CLMT.
+					clst = fp.clmt_clust(fp.fptr)
 				} else {
 					// Middle or end of file.
 					clst = fp.obj.create_chain(fp.clust)
@@ -451,8 +546,8 @@ outerLoop:
 			}
 			if fp.flag&faDIRTY != 0 {
 				// Write-back sector cache if needed.
-				if fs.disk_write(fp.buf[:], fp.sect, 1) != drOK {
-					return bw, fp.abort(frDiskErr)
+				if fr := fp.buf_write(); fr != frOK {
+					return bw, fp.abort(fr)
 				}
 				fp.flag &^= faDIRTY
 			}
@@ -466,8 +561,8 @@ outerLoop:
 				if csect+cc > uint32(fs.csize) {
 					cc = uint32(fs.csize) - csect // clip at cluster boundary.
 				}
-				if fs.disk_write(wbuff[:cc*uint32(fs.ssize)], sect, int(cc)) != drOK {
-					return bw, fp.abort(frDiskErr)
+				if fr := fp.data_write(wbuff[:cc*uint32(fs.ssize)], sect, int(cc)); fr != frOK {
+					return bw, fp.abort(fr)
 				}
 				off := fp.sect - sect
 				if off < lba(cc) {
@@ -479,9 +574,10 @@ outerLoop:
 				continue
 			}
 			// Fill sector cache with file data.
-			if fp.sect != sect && fp.fptr < fp.obj.objsize &&
-				fs.disk_read(fp.buf[:], sect, 1) != drOK {
-				return bw, fp.abort(frDiskErr)
+			if fp.sect != sect && fp.fptr < fp.obj.objsize {
+				if fr := fp.buf_load(sect, false); fr != frOK {
+					return bw, fp.abort(fr)
+				}
 			}
 			fp.sect = sect
 		}
@@ -630,6 +726,14 @@ func (fsys *FS) f_open(fp *File, name string, mode accessmode) fileResult {
 	fp.obj.id = fsys.id
 	fp.flag = mode
 	fp.err = 0
+	fp.cltbl = nil
+	fp.clmtAuto = false
+	fp.ra, fp.raN = sizeBuf(fp.ra, fsys.raSectors, fsys.ssize), 0
+	wc := fp.wc
+	fp.wc, fp.wcN = nil, 0
+	if mode&faWrite != 0 {
+		fp.wc = sizeBuf(wc, fsys.wcSectors, fsys.ssize)
+	}
 	fp.sect = 0
 	fp.fptr = 0
 	fp.pos = 0
@@ -708,49 +812,15 @@ func (fp *File) f_lseek(ofs int64) (res fileResult) {
 	if fp.cltbl != nil {
 		// Fast seek.
 		if ofs == createLinkmap {
-			// Create CLMT.
-			tbl := fp.cltbl[1:]
-			tlen := fp.cltbl[0] // Given table size.
-			ulen := uint32(2)   // Required table size.
-			cl := fp.obj.sclust // Origin of the chain.
-			if cl != 0 {
-				for {
-					// Get a fragment.
-					tcl := cl // Top of the fragment.
-					ncl := uint32(0)
-					ulen += 2
-					for {
-						pcl := cl
-						ncl++
-						cl = fp.obj.clusterstat(cl)
-						if cl <= 1 {
-							return fp.abort(frIntErr)
-						} else if cl == badCluster {
-							return fp.abort(frDiskErr)
-						}
-						if cl != pcl+1 {
-							break
-						}
-					}
-					if ulen <= tlen {
-						// Store the length and top of the fragment.
-						tbl[0] = ncl
-						tbl[1] = tcl
-						tbl = tbl[2:]
-					}
-					if cl >= fsys.n_fatent {
-						break // End of chain.
-					}
-				}
-			}
-			fp.cltbl[0] = ulen // Number of items used.
-			if ulen <= tlen {
-				tbl[0] = 0 // Terminate table.
-			} else {
-				res = frNotEnoughCore // Given table size is smaller than required.
-			}
+			return fp.create_linkmap()
+		}
+		// Rebuild the table if the chain grew past it. This may drop the table.
+		res = fp.clmt_refresh()
+		if res != frOK {
 			return res
 		}
+	}
+	if fp.cltbl != nil {
 		// Fast seek to ofs.
 		if ofs > fp.obj.objsize {
 			ofs = fp.obj.objsize // Clip offset at the file size.
@@ -767,13 +837,13 @@ func (fp *File) f_lseek(ofs int64) (res fileResult) {
 				// Refill sector cache if needed.
 				if fp.flag&faDIRTY != 0 {
 					// Write-back dirty sector cache.
-					if fsys.disk_write(fp.buf[:], fp.sect, 1) != drOK {
-						return fp.abort(frDiskErr)
+					if fr := fp.buf_write(); fr != frOK {
+						return fp.abort(fr)
 					}
 					fp.flag &^= faDIRTY
 				}
-				if fsys.disk_read(fp.buf[:], dsc, 1) != drOK {
-					return fp.abort(frDiskErr)
+				if fr := fp.buf_load(dsc, false); fr != frOK {
+					return fp.abort(fr)
 				}
 				fp.sect = dsc
 			}
@@ -863,13 +933,13 @@ func (fp *File) f_lseek(ofs int64) (res fileResult) {
 		// Fill sector cache if needed.
 		if fp.flag&faDIRTY != 0 {
 			// Write-back dirty sector cache.
-			if fsys.disk_write(fp.buf[:], fp.sect, 1) != drOK {
-				return fp.abort(frDiskErr)
+			if fr := fp.buf_write(); fr != frOK {
+				return fp.abort(fr)
 			}
 			fp.flag &^= faDIRTY
 		}
-		if fsys.disk_read(fp.buf[:], nsect, 1) != drOK {
-			return fp.abort(frDiskErr)
+		if fr := fp.buf_load(nsect, false); fr != frOK {
+			return fp.abort(fr)
 		}
 		fp.sect = nsect
 	}
@@ -884,6 +954,10 @@ func (fp *File) f_truncate() (res fileResult) {
 	if fp.fptr >= fp.obj.objsize {
 		return frOK
 	}
+	fp.raN = 0
+	if fr := fp.wc_flush(); fr != frOK {
+		return fp.abort(fr)
+	}
 	if fp.fptr == 0 {
 		// Set file size to zero: remove entire cluster chain.
 		res = fp.obj.remove_chain(fp.obj.sclust, 0)
@@ -900,12 +974,22 @@ func (fp *File) f_truncate() (res fileResult) {
 		if res == frOK && ncl < fsys.n_fatent {
 			res = fp.obj.remove_chain(ncl, fp.clust)
 		}
+		if res == frOK && fsys.scrubMode != ScrubOff {
+			res = fp.scrub_tail()
+		}
 	}
 	fp.obj.objsize = fp.fptr // Set file size to current read/write point.
 	fp.flag |= faMODIFIED
+	if fp.cltbl != nil {
+		// Clusters past the new end are free: regrowing must rebuild the CLMT.
+		bcs := int64(fsys.csize) * int64(fsys.ssize)
+		if ncl := uint32((fp.obj.objsize + bcs - 1) / bcs); ncl < fp.clmtLen {
+			fp.clmtLen = ncl
+		}
+	}
 	if res == frOK && fp.flag&faDIRTY != 0 {
-		if fsys.disk_write(fp.buf[:], fp.sect, 1) != drOK {
-			res = frDiskErr
+		if ret := fsys.disk_write(fp.buf[:], fp.sect, 1); ret != drOK {
+			res = ret.write_result()
 		} else {
 			fp.flag &^= faDIRTY
 		}
@@ -916,6 +1000,128 @@ func (fp *File) f_truncate() (res fileResult) {
 	return frOK
 }
 
+// f_expand allocates a contiguous block of clusters of fsz bytes to the empty
+// file fp. If opt is false nothing is allocated: the block found becomes the
+// suggested start of the next allocation. The contents of the block are left
+// as they lie. Fails with frDenied if no contiguous block is large enough.
+func (fp *File) f_expand(fsz int64, opt bool) (res fileResult) {
+	fsys := fp.obj.fs
+	fsys.trace("f_expand", slog.Int64("fsz", fsz))
+	res = fp.obj.validate()
+	if res != frOK {
+		return res
+	} else if fp.err != frOK {
+		return fp.err
+	} else if fsz <= 0 || fp.obj.objsize != 0 || fp.flag&faWrite == 0 {
+		return frDenied
+	} else if !fsys.isExfat() && fsz >= 0x1_0000_0000 {
+		return frDenied // Check if in size limit.
+	}
+	bcs := int64(fsys.csize) * int64(fsys.ssize)
+	if (fsz+bcs-1)/bcs >= int64(fsys.n_fatent) {
+		return frDenied // Larger than the volume.
+	}
+	tcl := uint32((fsz + bcs - 1) / bcs) // Number of clusters required.
+	stcl := fsys.last_clst
+	if fsys.alloc != nil {
+		stcl = fsys.alloc_start(0, tcl)
+	} else if stcl < 2 || stcl >= fsys.n_fatent {
+		stcl = 2
+	}
+	var scl, lclst uint32
+	if fsys.isExfat() {
+		scl = fsys.find_bitmap(stcl, tcl) // Find a contiguous cluster block.
+	} else {
+		scl = fp.obj.find_fat_run(stcl, tcl)
+	}
+	switch scl {
+	case 0:
+		return frDenied
+	case 1:
+		return frIntErr
+	case badCluster:
+		return frDiskErr
+	}
+	if !opt {
+		fsys.last_clst = scl - 1 // Set suggested start cluster to start next.
+		return frOK
+	}
+	if fsys.isExfat() {
+		res = fsys.change_bitmap(scl, tcl, true) // Mark the cluster block 'in use'.
+		lclst = scl + tcl - 1
+	} else {
+		// Create a cluster chain on the FAT.
+		for clst, n := scl, tcl; n > 0; clst, n = clst+1, n-1 {
+			next := clst + 1
+			if n == 1 {
+				next = badCluster
+			}
+			res = fsys.put_clusterstat(clst, next)
+			if res != frOK {
+				break
+			}
+			lclst = clst
+		}
+	}
+	if res != frOK {
+		return res
+	}
+	fsys.last_clst = lclst
+	fsys.last_alloc = lclst
+	fp.obj.sclust = scl
+	fp.obj.objsize = fsz
+	if fsys.isExfat() {
+		fp.obj.stat = 2 // Set status 'contiguous chain'.
+	}
+	fp.flag |= faMODIFIED
+	if fsys.free_clst <= fsys.n_fatent-2 {
+		// Update FSINFO.
+		fsys.free_clst -= tcl
+		fsys.fsi_flag |= 1
+	}
+	return frOK
+}
+
+// find_fat_run scans the FAT from clst for a block of ncl contiguous free
+// clusters, wrapping around at the end of the volume. It is the FAT
+// counterpart of find_bitmap. Returns the first cluster of the block found,
+// 0 if not found, 1 on internal error or badCluster on disk error.
+func (obj *objid) find_fat_run(clst, ncl uint32) uint32 {
+	fsys := obj.fs
+	fsys.trace("obj:find_fat_run", slog.Uint64("clst", uint64(clst)), slog.Uint64("ncl", uint64(ncl)))
+	if fsys.amap_ready() {
+		return fsys.amap_find(clst, ncl)
+	}
+	scl, cl := clst, clst
+	var ctr uint32
+	for {
+		val := obj.clusterstat(cl)
+		if val == 1 || val == badCluster {
+			return val
+		}
+		if val == 0 {
+			// A free cluster: check if run length is sufficient.
+			ctr++
+			if ctr == ncl {
+				return scl
+			}
+		} else {
+			ctr = 0 // Encountered a cluster in-use, restart the scan.
+		}
+		if cl++; cl >= fsys.n_fatent {
+			// Next cluster with wrap-around. A block does not wrap.
+			cl = 2
+			ctr = 0
+		}
+		if ctr == 0 {
+			scl = cl
+		}
+		if cl == clst {
+			return 0 // All clusters scanned.
+		}
+	}
+}
+
 // f_unlink removes a file or an empty sub-directory at path.
 func (fsys *FS) f_unlink(path string) (res fileResult) {
 	fsys.trace("f_unlink", slog.String("path", path))
@@ -964,6 +1170,9 @@ func (fsys *FS) f_unlink(path string) (res fileResult) {
 		}
 	}
 	// It is ready to remove the object.
+	if dj.obj.attr&amDIR != 0 {
+		fsys.dindex_drop(dclst)
+	}
 	res = dj.dir_remove()
 	if res == frOK && dclst != 0 {
 		// Remove the cluster chain if it exists.
@@ -1000,6 +1209,63 @@ func (fsys *FS) f_stat(path string, fno *FileInfo) (res fileResult) {
 	return res
 }
 
+// f_chmod changes the attribute bits of the object at path selected by
+// mask to those in attr. Only amRDO, amHID, amSYS and amARC can be changed.
+func (fsys *FS) f_chmod(path string, attr, mask byte) (res fileResult) {
+	fsys.trace("f_chmod", slog.String("path", path), slog.Uint64("attr", uint64(attr)), slog.Uint64("mask", uint64(mask)))
+	if fsys.perm&ModeWrite == 0 {
+		return frWriteProtected
+	}
+	var dj dir
+	dj.obj.fs = fsys
+	res = dj.follow_path(path)
+	if res == frOK && dj.fn[nsFLAG]&(nsDOT|nsNONAME) != 0 {
+		res = frInvalidName
+	}
+	if res != frOK {
+		return res
+	}
+	mask &= amRDO | amHID | amSYS | amARC // Valid attribute mask.
+	if fsys.isExfat() {
+		res = dj.chmod_exfat(attr, mask)
+	} else {
+		dj.dir[dirAttrOff] = attr&mask | dj.dir[dirAttrOff]&^mask // Apply attribute change.
+		fsys.wflag = 1
+	}
+	if res == frOK {
+		res = fsys.sync()
+	}
+	return res
+}
+
+// f_utime sets the modification timestamp of the object at path to tm, in
+// the packed date<<16|time format returned by (*FS).time.
+func (fsys *FS) f_utime(path string, tm uint32) (res fileResult) {
+	fsys.trace("f_utime", slog.String("path", path), slog.Uint64("tm", uint64(tm)))
+	if fsys.perm&ModeWrite == 0 {
+		return frWriteProtected
+	}
+	var dj dir
+	dj.obj.fs = fsys
+	res = dj.follow_path(path)
+	if res == frOK && dj.fn[nsFLAG]&(nsDOT|nsNONAME) != 0 {
+		res = frInvalidName
+	}
+	if res != frOK {
+		return res
+	}
+	if fsys.isExfat() {
+		res = dj.utime_exfat(tm)
+	} else {
+		binary.LittleEndian.PutUint32(dj.dir[dirModTimeOff:], tm)
+		fsys.wflag = 1
+	}
+	if res == frOK {
+		res = fsys.sync()
+	}
+	return res
+}
+
 // f_getlabel appends the volume label to dst and returns the extended buffer.
 // A volume with no label entry in its root directory has an empty label and
 // appends nothing. Ported from FatFs' f_getlabel; the volume serial number is
@@ -1076,7 +1342,8 @@ func (fsys *FS) f_mkdir(path string) (res fileResult) {
 			fsys.st_clust(fsys.win[sizeDirEntry:], dj.obj.sclust) // Containing directory; 0 means root.
 			fsys.wflag = 1
 		}
-		res = dj.register() // Register the object to the parent directory.
+		fsys.dindex_drop(dcl) // The cluster may have held a removed directory.
+		res = dj.register()   // Register the object to the parent directory.
 	}
 	if res != frOK {
 		sobj.remove_chain(dcl, 0) // Could not register, remove the allocated cluster.
@@ -1177,6 +1444,7 @@ func (fsys *FS) f_rename(oldpath, newpath string) (res fileResult) {
 func (dp *dir) dir_remove() (res fileResult) {
 	fsys := dp.obj.fs
 	fsys.trace("dir:dir_remove")
+	dp.dindex_remove()
 	last := dp.dptr
 	if dp.blk_ofs == badLBA {
 		res = frOK // SFN only, no LFN entries.
@@ -1191,6 +1459,9 @@ func (dp *dir) dir_remove() (res fileResult) {
 		if res != frOK {
 			break
 		}
+		if fsys.scrubMode != ScrubOff {
+			clear(dp.dir[1:sizeDirEntry]) // Scrub all but the mark set below.
+		}
 		if fsys.isExfat() {
 			dp.dir[xdirType] &^= etMaskUsed // Clear the entry InUse flag.
 		} else {
@@ -1239,6 +1510,100 @@ func (dp *dir) f_readdir(fno *FileInfo) fileResult {
 	return fr
 }
 
+// f_findfirst opens the directory at path and finds its first item whose
+// name matches pattern. fno.fname[0] is zero if there is no match.
+func (fsys *FS) f_findfirst(dp *dir, fno *FileInfo, path, pattern string) fileResult {
+	fsys.trace("f_findfirst", slog.String("path", path), slog.String("pattern", pattern))
+	dp.pat = pattern
+	fr := fsys.f_opendir(dp, path)
+	if fr == frOK {
+		fr = dp.f_findnext(fno)
+	}
+	return fr
+}
+
+// f_findnext reads directory items until one whose name or alternate (8.3)
+// name matches the pattern set by f_findfirst. fno.fname[0] is zero once
+// the end of the directory is reached.
+func (dp *dir) f_findnext(fno *FileInfo) (fr fileResult) {
+	fsys := dp.obj.fs
+	for {
+		fr = dp.f_readdir(fno)
+		if fr != frOK || fno.fname[0] == 0 {
+			break // Terminate on error or end of directory.
+		}
+		if fsys.pattern_match(dp.pat, bview(fno.fname[:]), 0, findRecurs) {
+			break
+		}
+		if fno.altname[0] != 0 && fsys.pattern_match(dp.pat, bview(fno.altname[:]), 0, findRecurs) {
+			break // Test the alternative name if it exists.
+		}
+	}
+	return fr
+}
+
+// findRecurs is the maximum number of wildcard terms in a pattern.
+const findRecurs = 4
+
+// pattern_match reports whether nam matches the wildcard pattern pat, where
+// '?' matches any one character and '*' any run of characters, ignoring
+// case. skip is the number of name characters the calling wildcard term
+// consumes, with bit 8 set if it also contains a '*'.
+func (fsys *FS) pattern_match(pat, nam string, skip uint, recur int) bool {
+	for skip&0xFF != 0 {
+		// Pre-skip name chars.
+		var c rune
+		if c, nam = fsys.get_achar(nam); c == 0 {
+			return false // Branch mismatched if less name chars.
+		}
+		skip--
+	}
+	if len(pat) == 0 && skip != 0 {
+		return true // Matched (short circuit).
+	}
+	for {
+		pptr, nptr := pat, nam // Top of pattern and name to match.
+		var pchr, nchr rune
+		for {
+			if len(pptr) != 0 && (pptr[0] == '?' || pptr[0] == '*') {
+				// Wildcard term.
+				if recur == 0 {
+					return false // Too many wildcard terms.
+				}
+				var sk uint
+				for len(pptr) != 0 && (pptr[0] == '?' || pptr[0] == '*') {
+					// Analyze the wildcard term.
+					if pptr[0] == '?' {
+						sk++
+					} else {
+						sk |= 0x100
+					}
+					pptr = pptr[1:]
+				}
+				if fsys.pattern_match(pptr, nptr, sk, recur-1) {
+					return true // Test new branch (recursive call).
+				}
+				nchr = 0
+				if len(nptr) != 0 {
+					nchr = 1 // Name chars left to retry on.
+				}
+				break // Branch mismatched.
+			}
+			pchr, pptr = fsys.get_achar(pptr)
+			nchr, nptr = fsys.get_achar(nptr)
+			if pchr != nchr {
+				break // Branch mismatched.
+			} else if pchr == 0 {
+				return true // Matched at end of both strings.
+			}
+		}
+		_, nam = fsys.get_achar(nam)
+		if skip == 0 || nchr == 0 {
+			return false // Retry until end of name only if infinite search.
+		}
+	}
+}
+
 func (dp *dir) read(vol bool) (fr fileResult) {
 	fsys := dp.obj.fs
 	fsys.trace("dir:read", slog.Bool("vol", vol))
@@ -1297,18 +1662,27 @@ func (dp *dir) read(vol bool) (fr fileResult) {
 func (fsys *FS) sync() fileResult {
 	fsys.trace("fs:sync")
 	fr := fsys.sync_window()
+	if fr == frOK && fsys.jnl.base != 0 && fsys.fsi_flag == 1 && fsys.fstype == FormatFAT32 {
+		// Journal the FSInfo sector with the FAT it counts.
+		fsys.fsi_flag = 0
+		if fr = fsys.move_window(fsys.volbase + 1); fr == frOK {
+			fsys.fsinfo_fill()
+			fsys.wflag = 1
+			fr = fsys.sync_window()
+		}
+	}
+	if fr == frOK {
+		fr = fsys.cache_flush(fsys.cache_seq()) // Write back everything.
+	}
+	if fr == frOK {
+		fsys.trim_flush() // Freed clusters are no longer referenced on the device.
+	}
 	if fr != frOK || fsys.fsi_flag != 1 {
 		return fr
 	}
 	fsys.fsi_flag = 0
 	if fsys.fstype == FormatFAT32 {
-		// Create FSInfo structure.
-		fsys.window_clr()
-		binary.LittleEndian.PutUint16(fsys.win[bs55AA:], 0xAA55)
-		binary.LittleEndian.PutUint32(fsys.win[fsiLeadSig:], 0x41615252)
-		binary.LittleEndian.PutUint32(fsys.win[fsiStrucSig:], 0x61417272)
-		binary.LittleEndian.PutUint32(fsys.win[fsiFree_Count:], fsys.free_clst)
-		binary.LittleEndian.PutUint32(fsys.win[fsiNxt_Free:], fsys.last_clst)
+		fsys.fsinfo_fill()
 		fsys.winsect = fsys.volbase + 1
 		fsys.disk_write(fsys.win[:], fsys.winsect, 1) // Write backup copy.
 	} else if fsys.isExfat() {
@@ -1328,6 +1702,34 @@ func (fsys *FS) sync() fileResult {
 	return fr
 }
 
+// fsinfo_load loads the free cluster count and the last allocated cluster
+// from the FSInfo sector, enabling its update, or leaves them unknown if it is
+// not valid.
+func (fsys *FS) fsinfo_load() {
+	fsys.last_clst = 0xffff_ffff
+	fsys.free_clst = 0xffff_ffff
+	if fsys.move_window(fsys.volbase+1) != frOK {
+		return
+	}
+	fsys.fsi_flag = 0
+	ok := fsys.window_u16(bs55AA) == 0xaa55 && fsys.window_u32(fsiLeadSig) == 0x41615252 &&
+		fsys.window_u32(fsiStrucSig) == 0x61417272
+	if ok {
+		fsys.free_clst = fsys.window_u32(fsiFree_Count)
+		fsys.last_clst = fsys.window_u32(fsiNxt_Free)
+	}
+}
+
+// fsinfo_fill creates the FSInfo structure in the window.
+func (fsys *FS) fsinfo_fill() {
+	fsys.window_clr()
+	binary.LittleEndian.PutUint16(fsys.win[bs55AA:], 0xAA55)
+	binary.LittleEndian.PutUint32(fsys.win[fsiLeadSig:], 0x41615252)
+	binary.LittleEndian.PutUint32(fsys.win[fsiStrucSig:], 0x61417272)
+	binary.LittleEndian.PutUint32(fsys.win[fsiFree_Count:], fsys.free_clst)
+	binary.LittleEndian.PutUint32(fsys.win[fsiNxt_Free:], fsys.last_clst)
+}
+
 // mount initializes the FS with the given BlockDevice.
 func (fsys *FS) mount_volume(bd BlockDevice, ssize uint16, mode uint8) (fr fileResult) {
 	fsys.trace("fs:mount_volume", slog.Int("mode", int(mode)))
@@ -1343,6 +1745,21 @@ func (fsys *FS) mount_volume(bd BlockDevice, ssize uint16, mode uint8) (fr fileR
 	}
 	fsys.device = bd
 	fsys.id++ // Invalidate open files.
+	nfat, ndir := fsys.cacheFAT, fsys.cacheDir
+	if fsys.jnlOn && nfat == 0 && ndir == 0 {
+		nfat, ndir = jnlCacheSectors, jnlCacheSectors // Transactions gather in the cache.
+	}
+	if c := fsys.cache; c == nil || c.nfat != nfat || len(c.slots)-c.nfat != ndir {
+		fsys.cache = newSectorCache(nfat, ndir)
+	}
+	fsys.cache_reset()
+	fsys.amap_reset()
+	fsys.dcache_reset()
+	fsys.jnl.base = 0 // Until jnl_mount finds it.
+	fsys.last_alloc = 0
+	fsys.trim = fsys.trim[:0]
+	fsys.vstats = VerifyStats{}
+	fsys.rstats = RetryStats{}
 	fsys.blk = blk
 	fsys.ssize = ssize
 	fsys.perm = Mode(mode)
@@ -1355,9 +1772,108 @@ func (fsys *FS) mount_volume(bd BlockDevice, ssize uint16, mode uint8) (fr fileR
 	}
 	fsys.initNames()
 	if fmt == bootsectorstatusExFAT {
-		return fsys.init_exfat()
+		fr = fsys.init_exfat()
+	} else {
+		fr = fsys.init_fat()
 	}
-	return fsys.init_fat()
+	if fr == frOK && fsys.jnlOn {
+		if fr = fsys.jnl_mount(); fr != frOK {
+			fsys.fstype = _FormatUnknown
+		}
+	}
+	return fr
+}
+
+// create_linkmap creates the CLMT in fp.cltbl, whose given size is fp.cltbl[0].
+// On return fp.cltbl[0] holds the number of items required.
+func (fp *File) create_linkmap() (res fileResult) {
+	fsys := fp.obj.fs
+	tbl := fp.cltbl[1:]
+	tlen := fp.cltbl[0] // Given table size.
+	ulen := uint32(2)   // Required table size.
+	mapped := uint32(0) // Number of clusters in the chain.
+	cl := fp.obj.sclust // Origin of the chain.
+	if cl != 0 {
+		for {
+			// Get a fragment.
+			tcl := cl // Top of the fragment.
+			ncl := uint32(0)
+			ulen += 2
+			for {
+				pcl := cl
+				ncl++
+				cl = fp.obj.clusterstat(cl)
+				if cl <= 1 {
+					return fp.abort(frIntErr)
+				} else if cl == badCluster {
+					return fp.abort(frDiskErr)
+				}
+				if cl != pcl+1 {
+					break
+				}
+			}
+			mapped += ncl
+			if ulen <= tlen {
+				// Store the length and top of the fragment.
+				tbl[0] = ncl
+				tbl[1] = tcl
+				tbl = tbl[2:]
+			}
+			if cl >= fsys.n_fatent {
+				break // End of chain.
+			}
+		}
+	}
+	fp.cltbl[0] = ulen // Number of items used.
+	if ulen <= tlen {
+		tbl[0] = 0 // Terminate table.
+		fp.clmtLen = mapped
+	} else {
+		res = frNotEnoughCore // Given table size is smaller than required.
+	}
+	return res
+}
+
+// clmt_build (re)creates the CLMT in the storage of fp.cltbl, reallocating it
+// when it was allocated by BuildLinkMap and is too small.
+func (fp *File) clmt_build() fileResult {
+	fp.cltbl[0] = uint32(len(fp.cltbl))
+	res := fp.create_linkmap()
+	if res == frNotEnoughCore && fp.clmtAuto {
+		need := fp.cltbl[0]
+		fp.cltbl = make([]uint32, need)
+		fp.cltbl[0] = need
+		res = fp.create_linkmap()
+	}
+	return res
+}
+
+// clmt_refresh rebuilds the CLMT when the file has grown into clusters it
+// does not map. A table that cannot hold the rebuilt map is dropped and the
+// file falls back to following the chain on the FAT.
+func (fp *File) clmt_refresh() fileResult {
+	fsys := fp.obj.fs
+	bcs := int64(fsys.csize) * int64(fsys.ssize)
+	if (fp.obj.objsize+bcs-1)/bcs <= int64(fp.clmtLen) {
+		return frOK
+	}
+	res := fp.clmt_build()
+	if res == frNotEnoughCore {
+		fp.cltbl = nil
+		res = frOK
+	}
+	return res
+}
+
+// clmt_maps reports whether fp.cltbl maps the cluster holding offset ofs.
+// Unlike FatFs, which fails writes past the CLMT, the cluster chain is
+// followed for offsets it does not map.
+func (fp *File) clmt_maps(ofs int64) bool {
+	if fp.cltbl == nil {
+		return false
+	}
+	fsys := fp.obj.fs
+	return ofs/(int64(fsys.csize)*int64(fsys.ssize)) < int64(fp.clmtLen)
 }
 
 func (fp *File) clmt_clust(ofs int64) (cl uint32) {
@@ -1475,14 +1991,8 @@ func (fsys *FS) init_fat() fileResult { // Part of mount_volume.
 	fsys.fsi_flag = 1 << 7
 
 	// Update FSInfo.
-	if fmt == FormatFAT32 && fsys.window_u16(bpbFSInfo32) == 1 && fsys.move_window(baseSector+1) == frOK {
-		fsys.fsi_flag = 0
-		ok := fsys.window_u16(bs55AA) == 0xaa55 && fsys.window_u32(fsiLeadSig) == 0x41615252 &&
-			fsys.window_u32(fsiStrucSig) == 0x61417272
-		if ok {
-			fsys.free_clst = fsys.window_u32(fsiFree_Count)
-			fsys.last_clst = fsys.window_u32(fsiNxt_Free)
-		}
+	if fmt == FormatFAT32 && fsys.window_u16(bpbFSInfo32) == 1 {
+		fsys.fsinfo_load()
 	}
 	fsys.fstype = fmt // Validate the filesystem.
 	fsys.id++         // Increment filesystem ID, invalidates open files.
@@ -1685,6 +2195,9 @@ func (fsys *FS) put_clusterstat(cluster, value uint32) fileResult {
 		binary.LittleEndian.PutUint32(fsys.win[winIdx:], value)
 		fsys.wflag = 1
 	}
+	if fsys.fstype != FormatExFAT {
+		fsys.cluster_marked(cluster, value != 0) // exFAT allocation is on the bitmap.
+	}
 	return frOK
 }
 
@@ -1697,7 +2210,12 @@ func (fsys *FS) move_window(sector lba) (fr fileResult) {
 	if fr != frOK {
 		return fr
 	}
-	dr := fsys.disk_read(fsys.win[:], sector, 1)
+	var dr diskresult
+	if fsys.cache != nil {
+		dr = fsys.cache_read(sector)
+	} else {
+		dr = fsys.disk_read(fsys.win[:], sector, 1)
+	}
 	if dr != drOK {
 		fsys.logerror("move_window:dr", slog.Int("dret", int(dr)))
 		sector = badLBA // Invalidate window offset if disk error occured.
@@ -1737,11 +2255,17 @@ func (fsys *FS) sync_window() (fr fileResult) {
 	fsys.trace("fs:sync_window")
 	if fsys.wflag == 0 {
 		return frOK // Diska access window not dirty.
+	} else if fsys.cache != nil {
+		fr = fsys.cache_write() // Write back on sync.
+		if fr == frOK {
+			fsys.wflag = 0
+		}
+		return fr
 	}
 	ret := fsys.disk_write(fsys.win[:], fsys.winsect, 1)
 	if ret != drOK {
 		fsys.logerror("sync_window:dw", slog.Int("dret", int(ret)))
-		return frDiskErr
+		return ret.write_result()
 	}
 	if fsys.nFATs == 2 && fsys.winsect-fsys.fatbase < lba(fsys.fsize) { // Is in 1st FAT?
 		// Reflect it to second FAT if needed.
@@ -1799,11 +2323,19 @@ func (fsys *FS) disk_write(buf []byte, sector lba, numsectors int) diskresult {
 		fsys.logerror("disk_write:unaligned")
 		return drParError
 	}
-	_, err := fsys.device.WriteBlocks(buf, int64(sector))
+	tries, err := fsys.retry.transfer(nil, int(fsys.ssize), buf, int64(sector), fsys.device.WriteBlocks)
+	fsys.retry_count(tries, err)
 	if err != nil {
 		fsys.logerror("disk_write", slog.String("err", err.Error()))
+		fsys.device_error("write", sector, err)
 		return drError
 	}
+	if fsys.cache != nil {
+		fsys.cache_update(buf, sector, numsectors)
+	}
+	if fsys.verifyOn {
+		return fsys.disk_verify(buf, sector, numsectors)
+	}
 	return drOK
 }
 func (fsys *FS) disk_read(dst []byte, sector lba, numsectors int) diskresult {
@@ -1814,18 +2346,152 @@ func (fsys *FS) disk_read(dst []byte, sector lba, numsectors int) diskresult {
 		fsys.logerror("disk_read:unaligned")
 		return drParError
 	}
-	_, err := fsys.device.ReadBlocks(dst, int64(sector))
+	tries, err := fsys.retry.transfer(fsys.ctx, int(fsys.ssize), dst, int64(sector), func(dst []byte, start int64) (int, error) {
+		return readBlocks(fsys.ctx, fsys.device, dst, start)
+	})
+	fsys.retry_count(tries, err)
 	if err != nil {
-		fsys.logerror("disk_read", slog.String("err", err.Error()))
+		if fsys.ctx == nil || fsys.ctx.Err() == nil {
+			fsys.logerror("disk_read", slog.String("err", err.Error()))
+		}
+		fsys.device_error("read", sector, err)
 		return drError
 	}
+	if fsys.cache != nil {
+		fsys.cache_overlay(dst, sector, numsectors)
+	}
 	return drOK
 }
+
+// data_read reads data sectors of file fp from the device. When called from
+// an exported operation, which holds fp.mu, on a device safe for concurrent
+// use the FS lock is released during the transfer so that other files can be
+// operated on meanwhile. The file is validated again once the lock is
+// retaken, a concurrent Unmount having invalidated it.
+func (fp *File) data_read(dst []byte, sector lba, numsectors int) fileResult {
+	fsys := fp.obj.fs
+	if !fp.fsLocked {
+		if fsys.disk_read(dst, sector, numsectors) != drOK {
+			return frDiskErr
+		}
+		fp.wc_overlay(dst, sector, numsectors)
+		return frOK
+	}
+	fsys.trace("fs:data_read", slog.Uint64("start", uint64(sector)), slog.Int("numsectors", numsectors))
+	if fsys.blk.off(int64(len(dst))) != 0 || fsys.blk._divideBlockSize(int64(len(dst))) != int64(numsectors) {
+		fsys.logerror("data_read:unaligned")
+		return frDiskErr
+	}
+	dev, rp, ss := fsys.device, fsys.retry, int(fsys.ssize)
+	unlocked := fsys.data_unlock()
+	tries, err := rp.transfer(fp.ctx, ss, dst, int64(sector), func(dst []byte, start int64) (int, error) {
+		return readBlocks(fp.ctx, dev, dst, start)
+	})
+	fsys.data_relock(unlocked)
+	fsys.retry_count(tries, err)
+	if fr := fp.obj.validate(); fr != frOK {
+		return fr
+	} else if err != nil {
+		if fp.ctx == nil || fp.ctx.Err() == nil {
+			fsys.logerror("data_read", slog.String("err", err.Error()))
+		}
+		fsys.device_error("read", sector, err)
+		return frDiskErr
+	}
+	if fsys.cache != nil {
+		fsys.cache_overlay(dst, sector, numsectors)
+	}
+	fp.wc_overlay(dst, sector, numsectors)
+	return frOK
+}
+
+// data_unlock releases the FS lock for a transfer of file data if the device
+// is safe for concurrent use, see [FSConfig.ConcurrentDevice], and reports
+// whether it did.
+func (fsys *FS) data_unlock() bool {
+	if !fsys.concurrentDev {
+		return false
+	}
+	fsys.inflight.Add(1)
+	fsys.mu.Unlock()
+	return true
+}
+
+// data_relock retakes the FS lock if data_unlock released it.
+func (fsys *FS) data_relock(unlocked bool) {
+	if unlocked {
+		fsys.inflight.Done()
+		fsys.mu.Lock()
+	}
+}
+
+// data_write is the write counterpart of data_read. Cached copies of the
+// sectors are updated before the FS lock is released so that a flush of the
+// cache in the meantime cannot write stale contents over the file's data.
+func (fp *File) data_write(buf []byte, sector lba, numsectors int) fileResult {
+	fr := fp.data_write_dev(buf, sector, numsectors)
+	if fp.obj.fs.remapBad && fp.obj.fs.remappable(fr) {
+		fr = fp.remap_write(buf, sector, numsectors)
+	}
+	return fr
+}
+
+// data_write_dev is data_write without moving data off clusters that fail,
+// see [FSConfig.RemapBadClusters].
+func (fp *File) data_write_dev(buf []byte, sector lba, numsectors int) fileResult {
+	fsys := fp.obj.fs
+	if fp.wc_overlaps(sector, numsectors) {
+		// Older contents of the sectors must not be written over these later.
+		if fr := fp.wc_flush(); fr != frOK {
+			return fr
+		}
+	}
+	if !fp.fsLocked {
+		if ret := fsys.disk_write(buf, sector, numsectors); ret != drOK {
+			return ret.write_result()
+		}
+		return frOK
+	}
+	if fsys.perm&ModeWrite == 0 {
+		return frDiskErr
+	}
+	fsys.trace("fs:data_write", slog.Uint64("start", uint64(sector)), slog.Int("numsectors", numsectors))
+	if fsys.blk.off(int64(len(buf))) != 0 || fsys.blk._divideBlockSize(int64(len(buf))) != int64(numsectors) {
+		fsys.logerror("data_write:unaligned")
+		return frDiskErr
+	}
+	if fsys.cache != nil {
+		fsys.cache_update(buf, sector, numsectors)
+	}
+	dev, rp, ss := fsys.device, fsys.retry, int(fsys.ssize)
+	unlocked := fsys.data_unlock()
+	tries, err := rp.transfer(nil, ss, buf, int64(sector), dev.WriteBlocks)
+	fsys.data_relock(unlocked)
+	fsys.retry_count(tries, err)
+	if fr := fp.obj.validate(); fr != frOK {
+		return fr
+	} else if err != nil {
+		fsys.logerror("data_write", slog.String("err", err.Error()))
+		fsys.device_error("write", sector, err)
+		return frDiskErr
+	} else if fsys.verifyOn {
+		return fsys.disk_verify(buf, sector, numsectors).write_result()
+	}
+	return frOK
+}
+
 func (fsys *FS) disk_erase(startSector lba, numSectors int) diskresult {
 	fsys.trace("fs:disk_erase", slog.Uint64("start", uint64(startSector)), slog.Int("numsectors", numSectors))
-	err := fsys.device.EraseBlocks(int64(startSector), int64(numSectors))
+	if fsys.cache != nil {
+		fsys.cache_discard(startSector, numSectors)
+	}
+	tries, err := fsys.retry.transfer(nil, int(fsys.ssize), nil, int64(startSector), func(_ []byte, start int64) (int, error) {
+		return 0, fsys.device.EraseBlocks(start, int64(numSectors))
+	})
+	fsys.retry_count(tries, err)
 	if err != nil {
 		fsys.logerror("disk_erase", slog.String("err", err.Error()))
+		fsys.device_error("erase", startSector, err)
 		return drError
 	}
 	return drOK
@@ -1949,6 +2615,8 @@ func (dp *dir) register() (fr fileResult) {
 	}
 	fr = dp.alloc(nent)
 	nent--
+	pos := dp.dptr - uint32(nent*sizeDirEntry) // First entry of the block.
+	hasLFN := nent != 0
 	if fr == frOK && nent != 0 {
 		// Set LFN entry if needed.
 		fr = dp.sdi(dp.dptr - uint32(nent*sizeDirEntry))
@@ -1978,6 +2646,7 @@ func (dp *dir) register() (fr fileResult) {
 			copy(dp.dir[dirNameOff:], dp.fn[:11])
 			dp.dir[dirNTresOff] = dp.fn[nsFLAG] & (nsBODY | nsEXT)
 			fsys.wflag = 1
+			dp.dindex_add(pos, hasLFN)
 		}
 	}
 	return fr
@@ -2084,13 +2753,34 @@ func (dp *dir) dirbuf_clr() {
 func (dp *dir) find() fileResult {
 	fsys := dp.obj.fs
 	fsys.trace("dir:find")
+	if fsys.dcache != nil {
+		if fr, ok := dp.find_indexed(); ok {
+			return fr
+		}
+	}
 	fr := dp.sdi(0) // Rewind directory object.
 	if fr != frOK {
 		return fr
 	}
 	if exfatEnabled && fsys.fstype == FormatExFAT {
-		return dp.find_exfat()
+		return dp.find_exfat(false)
 	}
+	return dp.find_fat(false)
+}
+
+// find_at matches the name to find against the object at the current entry
+// only.
+func (dp *dir) find_at() fileResult {
+	if exfatEnabled && dp.obj.fs.fstype == FormatExFAT {
+		return dp.find_exfat(true)
+	}
+	return dp.find_fat(true)
+}
+
+// find_fat is the FAT branch of dir.find, from the current entry on. With
+// one set it gives up after the first object.
+func (dp *dir) find_fat(one bool) (fr fileResult) {
+	fsys := dp.obj.fs
 	var ord, sum byte = 0xff, 0xff
 	dp.blk_ofs = badLBA // Reset LFN sequence.
 	for fr == frOK {
@@ -2108,6 +2798,9 @@ func (dp *dir) find() fileResult {
 		attr := dp.dir[dirAttrOff] & amMASK
 		dp.obj.attr = attr
 		if c == mskDDEM || (attr&amVOL != 0 && attr != amLFN) {
+			if one {
+				return frNoFile
+			}
 			ord = 0xff
 			dp.blk_ofs = badLBA // Reset LFN sequence.
 		} else {
@@ -2131,6 +2824,8 @@ func (dp *dir) find() fileResult {
 					break // LFN matches.
 				} else if dp.fn[nsFLAG]&nsLOSS == 0 && !memcmp(&dp.dir[0], &dp.fn[0], 11) {
 					break // SFN matches.
+				} else if one {
+					return frNoFile
 				}
 				// Reset LFN sequence.
 				ord = 0xff
@@ -2295,6 +2990,13 @@ func (obj *objid) create_chain(clst uint32) uint32 {
 	if fsys.free_clst == 0 {
 		return 0 // No free cluster.
 	}
+	if fsys.alloc != nil {
+		// The allocation policy decides where the search starts.
+		scl = fsys.alloc_start(clst, 1)
+		if !fsys.isExfat() {
+			scl-- // The FAT search starts after scl.
+		}
+	}
 	var fr fileResult
 	if fsys.isExfat() {
 		ncl, fr = obj.create_chain_exfat(clst, scl)
@@ -2302,7 +3004,7 @@ func (obj *objid) create_chain(clst uint32) uint32 {
 			return ncl // No free cluster or error status.
 		}
 	} else {
-		if scl == clst {
+		if fsys.alloc == nil && scl == clst {
 			ncl = scl + 1
 			if ncl >= fsys.n_fatent {
 				ncl = 2
@@ -2320,7 +3022,13 @@ func (obj *objid) create_chain(clst uint32) uint32 {
 				ncl = 0
 			}
 		}
-		if ncl == 0 {
+		if ncl == 0 && fsys.amap_ready() {
+			// New cluster not contiguous, find another fragment on the map.
+			ncl = fsys.amap_find(scl+1, 1)
+			if ncl < 2 || ncl == badCluster {
+				return ncl // No free cluster or error status.
+			}
+		} else if ncl == 0 {
 			// New cluster not contiguous, find another fragment.
 			ncl = scl
 			for {
@@ -2350,6 +3058,7 @@ func (obj *objid) create_chain(clst uint32) uint32 {
 	}
 	if fr == frOK {
 		fsys.last_clst = ncl
+		fsys.last_alloc = ncl
 		if fsys.free_clst > 0 && fsys.free_clst <= fsys.n_fatent-2 {
 			fsys.free_clst--
 			fsys.fsi_flag |= 1
@@ -2374,6 +3083,13 @@ func (obj *objid) remove_chain(clst, pclst uint32) (res fileResult) {
 	if clst < 2 || clst >= fsys.n_fatent {
 		return frIntErr // Invalid range.
 	}
+	if fsys.scrubMode != ScrubOff {
+		// Destroy the data while the FAT still holds the chain.
+		res = obj.scrub_chain(clst)
+		if res != frOK {
+			return res
+		}
+	}
 
 	if pclst != 0 && (!fsys.isExfat() || obj.stat != 2) {
 		// Mark previous cluster EOC on the FAT if exists.
@@ -2419,6 +3135,7 @@ func (obj *objid) remove_chain(clst, pclst uint32) (res fileResult) {
 					return res
 				}
 			}
+			fsys.trim_add(scl, ecl) // Erase the block once unreferenced.
 			scl = nxt
 			ecl = nxt
 		}
@@ -2564,6 +3281,13 @@ func bstr(s []byte) []byte {
 	return s[:i]
 }
 
+// bview returns the NUL terminated string in s without copying it. The
+// result aliases s and must not outlive a modification of it.
+func bview(s []byte) string {
+	s = bstr(s)
+	return unsafe.String(unsafe.SliceData(s), len(s))
+}
+
 func str(s []byte) string {
 	var buf []byte
 	return string(append(buf, bstr(s)...))
@@ -369,3 +369,38 @@ func TestBootSector(t *testing.T) {
 	_ = fatSz
 
 }
+
+func TestPatternMatch(t *testing.T) {
+	fs, _ := initTestFAT()
+	for _, test := range []struct {
+		pat, name string
+		want      bool
+	}{
+		{"*", "rootfile", true},
+		{"*", "", true},
+		{"", "rootfile", false},
+		{"rootfile", "ROOTFILE", true},
+		{"ROOT*", "rootdir", true},
+		{"*dir", "rootdir", true},
+		{"*dir", "rootdir2", false},
+		{"r?ot*", "rootfile", true},
+		{"r?ot*", "rot", false},
+		{"????", "abcd", true},
+		{"????", "abc", false},
+		{"????", "abcde", false},
+		{"*.TXT", "notes.txt", true},
+		{"*.txt", "notes.txt.bak", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b*", "xxbxxaxx", false},
+		{"a*?", "a", false},
+		{"a*?", "ab", true},
+		{"*?*?*", "abc", true}, // Adjacent wildcards form one term.
+		{"*a*b*c*d", "abcd", true},
+		{"*a*b*c*d*", "abcd", false}, // Too many wildcard terms.
+	} {
+		got := fs.pattern_match(test.pat, test.name, 0, findRecurs)
+		if got != test.want {
+			t.Errorf("pattern_match(%q, %q) = %v, want %v", test.pat, test.name, got, test.want)
+		}
+	}
+}
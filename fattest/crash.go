@@ -0,0 +1,122 @@
+package fattest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/soypat/fat"
+)
+
+// CrashConfig configures [CrashTest].
+type CrashConfig struct {
+	// Image is the device the volume is on before Run. It is not modified.
+	Image *Memory
+	// Config configures the FS of Run and of every crash point, so that a
+	// journaled volume is mounted with journal and replays it.
+	Config fat.FSConfig
+	// Run operates on the volume, mounted for reading and writing. The
+	// volume is unmounted after it returns: files Run leaves open are not
+	// closed.
+	Run func(fsys *fat.FS) error
+	// Check reports whether the volume is as expected after a power loss
+	// once the first crash writes and erases of Run reached the device. The
+	// volume is mounted for reading and writing. nil requires [Consistent].
+	Check func(fsys *fat.FS, crash int) error
+	// Torn also checks a power loss halfway through each write of more than
+	// one block, its first half reaching the device.
+	Torn bool
+}
+
+// CrashTest simulates a power loss at every point of cfg.Run: it runs
+// cfg.Run once, recording its writes, then for each prefix of them mounts a
+// copy of cfg.Image with the prefix applied and checks it with cfg.Check.
+// It returns the errors of Run and of the crash points that failed, joined,
+// or nil if none did. Like [testing/fstest.TestFS], it is meant to be called
+// from a test:
+//
+//	if err := fattest.CrashTest(cfg); err != nil {
+//		t.Fatal(err)
+//	}
+func CrashTest(cfg CrashConfig) error {
+	if cfg.Image == nil || cfg.Run == nil {
+		return errors.New("fattest: CrashTest needs an Image and Run")
+	}
+	check := cfg.Check
+	if check == nil {
+		check = func(fsys *fat.FS, _ int) error { return Consistent(fsys) }
+	}
+	bs := cfg.Image.BlockSize()
+	dev := NewDevice(cfg.Image.Clone(), bs)
+	var fsys fat.FS
+	fsys.Configure(cfg.Config)
+	if err := fsys.Mount(dev, bs, fat.ModeRW); err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	err := cfg.Run(&fsys)
+	if uerr := fsys.Unmount(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return fmt.Errorf("run: %w", err)
+	}
+	log := dev.Log()
+	var errs []error
+	crash := func(n int, torn bool) {
+		img, err := dev.ImageAt(cfg.Image, n)
+		if err == nil && torn {
+			w := log[n]
+			w.Applied = (w.Applied + 1) / 2
+			err = Replay(img, bs, []Write{w}, 1)
+		}
+		if err == nil {
+			err = checkImage(img, cfg.Config, check, n)
+		}
+		if err != nil {
+			at := fmt.Sprintf("crash after %d writes", n)
+			if torn {
+				at += fmt.Sprintf(", write %d torn", n+1)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", at, err))
+		}
+	}
+	for n := 0; n <= len(log); n++ {
+		crash(n, false)
+		if cfg.Torn && n < len(log) && log[n].Applied > 1 {
+			crash(n, true)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkImage mounts img, powered back on after crash, and checks it.
+func checkImage(img *Memory, config fat.FSConfig, check func(*fat.FS, int) error, crash int) error {
+	var fsys fat.FS
+	fsys.Configure(config)
+	if err := fsys.Mount(img, img.BlockSize(), fat.ModeRW); err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	err := check(&fsys, crash)
+	if uerr := fsys.Unmount(); err == nil && uerr != nil {
+		err = fmt.Errorf("unmount: %w", uerr)
+	}
+	return err
+}
+
+// Consistent returns an error listing the problems [fat.FS.Check] finds on
+// the volume, nil if it finds none.
+func Consistent(fsys *fat.FS) error {
+	rep, err := fsys.Check()
+	if err != nil {
+		return err
+	} else if rep.OK() {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("inconsistent volume:")
+	for _, p := range rep.Problems {
+		b.WriteString("\n\t")
+		b.WriteString(p.String())
+	}
+	return errors.New(b.String())
+}
@@ -0,0 +1,281 @@
+package fattest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/soypat/fat"
+)
+
+// ErrInjected is the error of a faulted operation whose [Fault] has no Err.
+var ErrInjected = errors.New("fattest: injected fault")
+
+// Op is an operation on a block device, or a set of them.
+type Op uint8
+
+const (
+	OpRead Op = 1 << iota
+	OpWrite
+	OpErase
+)
+
+// FaultKind is what a [Fault] does to the operation it fires on.
+type FaultKind uint8
+
+const (
+	// FaultFail fails the operation without it reaching the device.
+	FaultFail FaultKind = iota
+	// FaultTear tears a write or erase: only its first TearBlocks blocks
+	// reach the device, and the operation fails.
+	FaultTear
+	// FaultDrop reports a write or erase done without it reaching the
+	// device, as a drive losing its volatile cache does.
+	FaultDrop
+)
+
+// Fault selects operations of a [Device] to fail, tear or drop. An
+// operation matches a fault if it is one of Ops and touches a block Match
+// selects; the fault fires on the Nth match, and on every one after it if
+// Sticky. Tear and drop faults fail the reads they fire on.
+type Fault struct {
+	Kind FaultKind
+	// Ops are the operations the fault applies to. 0 applies it to writes
+	// and erases.
+	Ops Op
+	// N is the match to fire on, counted from 1. 0 fires on the first.
+	N int
+	// Match reports whether the fault applies to block. An operation over
+	// several blocks matches if any of them does. nil matches every block.
+	Match func(block int64) bool
+	// Sticky keeps the fault firing on every match after the Nth, as a
+	// device gone bad or powered off does.
+	Sticky bool
+	// TearBlocks is the number of blocks of a torn write that reach the
+	// device, clipped to the blocks of the write.
+	TearBlocks int
+	// Err is the error of the faulted operation, ErrInjected if nil.
+	Err error
+}
+
+// Write is a write or erase of a [Device], as recorded in its log.
+type Write struct {
+	Op    Op // OpWrite or OpErase.
+	Block int64
+	// NumBlocks is the number of blocks written or erased, and Data the
+	// data written, a copy.
+	NumBlocks int64
+	Data      []byte
+	// Applied is the number of blocks that reached the device: NumBlocks,
+	// or fewer if a fault tore or dropped the operation.
+	Applied int64
+	// Err is the error the operation returned.
+	Err error
+}
+
+// Device wraps a block device to inject faults and to record the writes and
+// erases that go through it. It is safe for concurrent use.
+type Device struct {
+	mu        sync.Mutex
+	dev       fat.BlockDevice
+	blockSize int64
+	faults    []faultState
+	log       []Write
+	ops       int
+}
+
+type faultState struct {
+	Fault
+	matches int
+}
+
+// NewDevice returns a Device wrapping dev, of blocks of blockSize bytes.
+func NewDevice(dev fat.BlockDevice, blockSize int) *Device {
+	if blockSize <= 0 {
+		panic("fattest: invalid block size")
+	}
+	return &Device{dev: dev, blockSize: int64(blockSize)}
+}
+
+// Inject adds fault f to the faults of d. Its matches are counted from the
+// next operation.
+func (d *Device) Inject(f Fault) {
+	if f.Ops == 0 {
+		f.Ops = OpWrite | OpErase
+	}
+	if f.N <= 0 {
+		f.N = 1
+	}
+	if f.Err == nil {
+		f.Err = ErrInjected
+	}
+	d.mu.Lock()
+	d.faults = append(d.faults, faultState{Fault: f})
+	d.mu.Unlock()
+}
+
+// ClearFaults removes the faults of d.
+func (d *Device) ClearFaults() {
+	d.mu.Lock()
+	d.faults = d.faults[:0]
+	d.mu.Unlock()
+}
+
+// Ops returns the number of operations on d so far, faulted ones included.
+func (d *Device) Ops() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ops
+}
+
+// Log returns the writes and erases of d so far, in order, faulted ones
+// included. The caller must not modify it.
+func (d *Device) Log() []Write {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.log[:len(d.log):len(d.log)]
+}
+
+// ResetLog empties the log of d.
+func (d *Device) ResetLog() {
+	d.mu.Lock()
+	d.log = nil
+	d.mu.Unlock()
+}
+
+func (d *Device) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f := d.fire(OpRead, startBlock, int64(len(dst))/d.blockSize); f != nil {
+		return 0, f.Err
+	}
+	return d.dev.ReadBlocks(dst, startBlock)
+}
+
+func (d *Device) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := Write{
+		Op:        OpWrite,
+		Block:     startBlock,
+		NumBlocks: int64(len(data)) / d.blockSize,
+		Data:      append([]byte(nil), data...),
+	}
+	w.Applied = w.NumBlocks
+	f := d.fire(OpWrite, startBlock, w.NumBlocks)
+	if f != nil {
+		w.Applied, w.Err = f.applied(w.NumBlocks), f.result()
+	}
+	n := 0
+	if w.Applied > 0 {
+		var err error
+		n, err = d.dev.WriteBlocks(data[:w.Applied*d.blockSize], startBlock)
+		if err != nil {
+			w.Applied, w.Err = int64(n)/d.blockSize, err
+		}
+	}
+	d.log = append(d.log, w)
+	if f != nil && f.Kind == FaultDrop && w.Err == nil {
+		n = len(data)
+	}
+	return n, w.Err
+}
+
+func (d *Device) EraseBlocks(startBlock, numBlocks int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := Write{Op: OpErase, Block: startBlock, NumBlocks: numBlocks, Applied: numBlocks}
+	f := d.fire(OpErase, startBlock, numBlocks)
+	if f != nil {
+		w.Applied, w.Err = f.applied(numBlocks), f.result()
+	}
+	if w.Applied > 0 {
+		if err := d.dev.EraseBlocks(startBlock, w.Applied); err != nil {
+			w.Applied, w.Err = 0, err
+		}
+	}
+	d.log = append(d.log, w)
+	return w.Err
+}
+
+// fire counts an operation op on numBlocks blocks from startBlock and
+// returns the fault that fires on it, nil if none. A dropped read fails.
+func (d *Device) fire(op Op, startBlock, numBlocks int64) *Fault {
+	d.ops++
+	var fired *Fault
+	for i := range d.faults {
+		f := &d.faults[i]
+		if f.Ops&op == 0 || !f.match(startBlock, numBlocks) {
+			continue
+		}
+		f.matches++
+		if fired == nil && (f.matches == f.N || f.Sticky && f.matches > f.N) {
+			fired = &f.Fault
+		}
+	}
+	if fired != nil && op == OpRead && fired.Kind != FaultFail {
+		fail := *fired
+		fail.Kind = FaultFail
+		return &fail
+	}
+	return fired
+}
+
+func (f *faultState) match(startBlock, numBlocks int64) bool {
+	if f.Match == nil {
+		return true
+	}
+	for b := startBlock; b < startBlock+max(numBlocks, 1); b++ {
+		if f.Match(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// applied returns the blocks of an operation on numBlocks blocks that
+// reach the device when f fires on it.
+func (f *Fault) applied(numBlocks int64) int64 {
+	if f.Kind == FaultTear {
+		return min(int64(max(f.TearBlocks, 0)), numBlocks)
+	}
+	return 0 // Failed or dropped.
+}
+
+// result returns the error of an operation f fires on.
+func (f *Fault) result() error {
+	if f.Kind == FaultDrop {
+		return nil
+	}
+	return f.Err
+}
+
+// Replay applies the first n writes and erases of log to dev, each as far
+// as it reached the device it was recorded on: dev is left as that device
+// would be had it lost power after the nth.
+func Replay(dev fat.BlockDevice, blockSize int, log []Write, n int) error {
+	for _, w := range log[:n] {
+		if w.Applied == 0 {
+			continue
+		}
+		var err error
+		if w.Op == OpErase {
+			err = dev.EraseBlocks(w.Block, w.Applied)
+		} else {
+			_, err = dev.WriteBlocks(w.Data[:w.Applied*int64(blockSize)], w.Block)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImageAt returns a copy of base, the device before the log of d was
+// recorded, with the first n writes and erases of the log applied.
+func (d *Device) ImageAt(base *Memory, n int) (*Memory, error) {
+	img := base.Clone()
+	if err := Replay(img, int(d.blockSize), d.Log(), n); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
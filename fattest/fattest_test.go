@@ -0,0 +1,242 @@
+package fattest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/soypat/fat"
+)
+
+func formatImage(t *testing.T, numBlocks int64, cfg fat.FormatParams) *Memory {
+	t.Helper()
+	img := NewMemory(512, numBlocks)
+	var f fat.Formatter
+	if err := f.Format(img, 512, int(numBlocks), cfg); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestDeviceFaults(t *testing.T) {
+	blk := func(b byte) []byte { return bytes.Repeat([]byte{b}, 512) }
+	errBoom := errors.New("boom")
+	mem := NewMemory(512, 16)
+	dev := NewDevice(mem, 512)
+
+	// Fail the 2nd write, once.
+	dev.Inject(Fault{Kind: FaultFail, N: 2, Err: errBoom})
+	for i := int64(0); i < 3; i++ {
+		_, err := dev.WriteBlocks(blk(1), i)
+		if wantErr := i == 1; (err != nil) != wantErr || wantErr && err != errBoom {
+			t.Errorf("write %d: %v", i, err)
+		}
+	}
+	if got := mem.Bytes()[512]; got != 0 {
+		t.Error("failed write reached the device")
+	}
+	dev.ClearFaults()
+
+	// Tear a write to its first block, at the first one touching block 5.
+	dev.Inject(Fault{Kind: FaultTear, TearBlocks: 1, Match: func(b int64) bool { return b == 5 }})
+	if _, err := dev.WriteBlocks(blk(2), 3); err != nil {
+		t.Error(err)
+	}
+	if n, err := dev.WriteBlocks(append(blk(3), blk(3)...), 4); err != ErrInjected || n != 512 {
+		t.Errorf("torn write: n=%d err=%v", n, err)
+	}
+	if mem.Bytes()[4*512] != 3 || mem.Bytes()[5*512] != 0 {
+		t.Error("torn write did not reach the device as far as torn")
+	}
+	dev.ClearFaults()
+
+	// Drop writes and erases of blocks 8 and up, silently, from the first.
+	dev.Inject(Fault{Kind: FaultDrop, Sticky: true, Match: func(b int64) bool { return b >= 8 }})
+	for i := int64(8); i < 10; i++ {
+		if n, err := dev.WriteBlocks(blk(4), i); err != nil || n != 512 {
+			t.Errorf("dropped write: n=%d err=%v", n, err)
+		}
+	}
+	if err := dev.EraseBlocks(0, 16); err != nil {
+		t.Error(err)
+	}
+	if mem.Bytes()[8*512] != 0 || mem.Bytes()[0] != 1 {
+		t.Error("dropped operation reached the device")
+	}
+
+	// A dropped read fails.
+	dev.Inject(Fault{Kind: FaultDrop, Ops: OpRead, Sticky: true})
+	if _, err := dev.ReadBlocks(blk(0), 0); err != ErrInjected {
+		t.Errorf("read: %v", err)
+	}
+	if got := dev.Ops(); got != 9 {
+		t.Errorf("ops = %d, want 9", got)
+	}
+
+	log := dev.Log()
+	if len(log) != 8 {
+		t.Fatalf("log has %d writes, want 8", len(log))
+	}
+	for i, want := range []int64{1, 0, 1, 1, 1, 0, 0, 0} {
+		if log[i].Applied != want {
+			t.Errorf("write %d applied %d blocks, want %d", i, log[i].Applied, want)
+		}
+	}
+	if log[7].Op != OpErase || log[7].NumBlocks != 16 || log[1].Err != errBoom {
+		t.Errorf("log entries recorded wrong: %+v %+v", log[1], log[7])
+	}
+}
+
+// TestReplay records a volume being formatted and written, and replays its
+// log: the whole log rebuilds the device, and the log of Format alone the
+// volume as formatted.
+func TestReplay(t *testing.T) {
+	base := NewMemory(512, 8192)
+	mem := base.Clone()
+	dev := NewDevice(mem, 512)
+	var f fat.Formatter
+	if err := f.Format(dev, 512, 8192, fat.FormatParams{Format: fat.FormatFAT16, ClusterSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	nfmt := len(dev.Log())
+	var fsys fat.FS
+	if err := fsys.Mount(dev, 512, fat.ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, &fsys, "hello.txt", "hello, world")
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := dev.ImageAt(base, len(dev.Log()))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(img.Bytes(), mem.Bytes()) {
+		t.Fatal("replayed log differs from the device")
+	}
+	img, err = dev.ImageAt(base, nfmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mount(img, 512, fat.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	var fi fat.FileInfo
+	if err := fsys.Stat("hello.txt", &fi); err == nil {
+		t.Error("file found on the volume as formatted")
+	}
+}
+
+// TestFaultedFS requires the errors of a failing device to reach the caller.
+func TestFaultedFS(t *testing.T) {
+	dev := NewDevice(formatImage(t, 8192, fat.FormatParams{Format: fat.FormatFAT16, ClusterSize: 1}), 512)
+	var fsys fat.FS
+	if err := fsys.Mount(dev, 512, fat.ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	dev.Inject(Fault{Kind: FaultFail, Sticky: true})
+	var fp fat.File
+	err := fsys.OpenFile(&fp, "a.txt", fat.ModeCreateNew|fat.ModeWrite)
+	if err == nil {
+		_, err = fp.Write([]byte("data"))
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		t.Error("no error writing to a failing device")
+	}
+	dev.ClearFaults()
+	fsys.Unmount()
+}
+
+func TestCrashTest(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fmt  fat.FormatParams
+	}{
+		{"FAT16", fat.FormatParams{Format: fat.FormatFAT16, ClusterSize: 1}},
+		{"exFAT", fat.FormatParams{Format: fat.FormatExFAT, ClusterSize: 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			img := NewMemory(512, 8192)
+			var f fat.Formatter
+			if err := f.Format(img, 512, 8192, test.fmt); err != nil {
+				t.Skip("format unsupported in this build:", err)
+			}
+			// Create the journal before the crash test.
+			var fsys fat.FS
+			fsys.Configure(fat.FSConfig{Journal: true})
+			if err := fsys.Mount(img, 512, fat.ModeRW); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, &fsys, "old.txt", strings.Repeat("old", 700))
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			run := func(fsys *fat.FS) error {
+				if err := fsys.Mkdir("dir"); err != nil {
+					return err
+				}
+				var fp fat.File
+				if err := fsys.OpenFile(&fp, "dir/new.txt", fat.ModeCreateNew|fat.ModeWrite); err != nil {
+					return err
+				}
+				if _, err := fp.Write([]byte(strings.Repeat("new", 2000))); err != nil {
+					fp.Close()
+					return err
+				}
+				if err := fp.Close(); err != nil {
+					return err
+				}
+				return fsys.Remove("old.txt")
+			}
+			crashes := 0
+			err := CrashTest(CrashConfig{
+				Image:  img,
+				Config: fat.FSConfig{Journal: true},
+				Run:    run,
+				Torn:   true,
+				Check: func(fsys *fat.FS, crash int) error {
+					crashes++
+					if err := Consistent(fsys); err != nil {
+						return err
+					}
+					var fi fat.FileInfo
+					if fsys.Stat("old.txt", &fi) == nil && fi.Size() != 2100 {
+						return errors.New("old.txt changed size")
+					}
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("%d crash points", crashes)
+			if crashes < 10 {
+				t.Errorf("only %d crash points checked", crashes)
+			}
+
+			// Without journal some crash points leave the volume damaged.
+			err = CrashTest(CrashConfig{Image: img, Run: run})
+			if err == nil {
+				t.Error("no crash point damaged the volume without journal")
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, fsys *fat.FS, name, data string) {
+	t.Helper()
+	var fp fat.File
+	if err := fsys.OpenFile(&fp, name, fat.ModeCreateAlways|fat.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(&fp, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+// Package fattest implements block devices for testing code that uses
+// package fat against device errors and power loss: an in-memory device,
+// [Memory], a wrapper that injects faults and records writes, [Device], and
+// a harness that checks a volume at every point a power loss could leave it,
+// [CrashTest].
+package fattest
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Memory is an in-memory block device. Erased blocks read as zeros.
+type Memory struct {
+	blockSize int
+	buf       []byte
+}
+
+// NewMemory returns a zeroed device of numBlocks blocks of blockSize bytes.
+func NewMemory(blockSize int, numBlocks int64) *Memory {
+	if blockSize <= 0 || numBlocks < 0 {
+		panic("fattest: invalid memory size")
+	}
+	return &Memory{blockSize: blockSize, buf: make([]byte, int64(blockSize)*numBlocks)}
+}
+
+// BlockSize returns the size of the blocks of m in bytes.
+func (m *Memory) BlockSize() int { return m.blockSize }
+
+// Size returns the size of m in bytes.
+func (m *Memory) Size() int64 { return int64(len(m.buf)) }
+
+// Bytes returns the contents of m. Modifying them modifies the device.
+func (m *Memory) Bytes() []byte { return m.buf }
+
+// Clone returns a copy of m.
+func (m *Memory) Clone() *Memory {
+	return &Memory{blockSize: m.blockSize, buf: append([]byte(nil), m.buf...)}
+}
+
+func (m *Memory) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	off, err := m.span(int64(len(dst)), startBlock, 1)
+	if err != nil {
+		return 0, err
+	}
+	return copy(dst, m.buf[off:]), nil
+}
+
+func (m *Memory) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	off, err := m.span(int64(len(data)), startBlock, 1)
+	if err != nil {
+		return 0, err
+	}
+	return copy(m.buf[off:], data), nil
+}
+
+func (m *Memory) EraseBlocks(startBlock, numBlocks int64) error {
+	off, err := m.span(numBlocks*int64(m.blockSize), startBlock, numBlocks)
+	if err != nil {
+		return err
+	}
+	clear(m.buf[off : off+numBlocks*int64(m.blockSize)])
+	return nil
+}
+
+// span returns the offset of a transfer of size bytes at startBlock,
+// checking it is made of whole blocks within the device.
+func (m *Memory) span(size, startBlock, numBlocks int64) (int64, error) {
+	bs := int64(m.blockSize)
+	if size%bs != 0 {
+		return 0, errors.New("fattest: transfer not a multiple of the block size")
+	} else if startBlock < 0 || numBlocks <= 0 {
+		return 0, errors.New("fattest: invalid block range")
+	}
+	off := startBlock * bs
+	if end := off + size; end > int64(len(m.buf)) || end < off {
+		return 0, fmt.Errorf("fattest: access past end of device: %d > %d", end, len(m.buf))
+	}
+	return off, nil
+}
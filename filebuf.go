@@ -0,0 +1,127 @@
+package fat
+
+// Read-ahead and write coalescing of file data, see [FSConfig.ReadAheadSectors]
+// and [FSConfig.WriteCoalesceSectors]. Both sit beneath the File's sector
+// buffer buf: FatFs' f_read and f_write go through buf for every transfer
+// that is not of whole sectors, which buf_load and buf_write serve from and
+// into the larger per-file buffers.
+
+// sizeBuf returns b resized to n sectors of ss bytes, reusing its memory if
+// large enough, or nil for fewer than two sectors: one is what buf holds.
+func sizeBuf(b []byte, n int, ss uint16) []byte {
+	if n < 2 {
+		return nil
+	}
+	sz := n * int(ss)
+	if cap(b) >= sz {
+		return b[:sz]
+	}
+	return make([]byte, sz)
+}
+
+// buf_load loads data sector sect into buf, from the read-ahead buffer if it
+// holds it. With ahead set a miss fills the read-ahead buffer from sect on.
+func (fp *File) buf_load(sect lba, ahead bool) fileResult {
+	ss := lba(fp.obj.fs.ssize)
+	if fp.raN > 0 && sect-fp.raSect < lba(fp.raN) {
+		copy(fp.buf[:], fp.ra[(sect-fp.raSect)*ss:])
+		return frOK
+	}
+	if ahead && fp.ra != nil {
+		if n := fp.ra_span(sect); n > 1 {
+			fp.raN = 0
+			if fr := fp.data_read(fp.ra[:lba(n)*ss], sect, n); fr != frOK {
+				return fr
+			}
+			fp.raSect, fp.raN = sect, n
+			copy(fp.buf[:], fp.ra[:ss])
+			return frOK
+		}
+	}
+	return fp.data_read(fp.buf[:], sect, 1)
+}
+
+// ra_span returns the number of sectors to read ahead from sect, the sector
+// of fp.clust at the file pointer: up to the end of the file or of the
+// read-ahead buffer, following the cluster chain while it is contiguous.
+func (fp *File) ra_span(sect lba) int {
+	fsys := fp.obj.fs
+	ss := int64(fsys.ssize)
+	lim := len(fp.ra) / int(ss)
+	if nfile := (fp.obj.objsize - fp.fptr + ss - 1) / ss; nfile < int64(lim) {
+		lim = int(nfile)
+	}
+	csect := int(sect - fsys.clst2sect(fp.clust))
+	n := int(fsys.csize) - csect // Sectors left in the cluster.
+	for cl := fp.clust; n < lim; cl++ {
+		if fp.obj.clusterstat(cl) != cl+1 {
+			break // Fragmented, end of chain or error: read up to here.
+		}
+		n += int(fsys.csize)
+	}
+	if n > lim {
+		n = lim
+	}
+	return n
+}
+
+// buf_write writes buf back to sector fp.sect, into the coalescing buffer if
+// there is one. Consecutive sectors accumulate there and are written by a
+// single device call when the run breaks, the buffer is full or the file is
+// synced.
+func (fp *File) buf_write() fileResult {
+	if fp.wc == nil {
+		return fp.data_write(fp.buf[:], fp.sect, 1)
+	}
+	ss := lba(fp.obj.fs.ssize)
+	if fp.wcN > 0 && fp.sect-fp.wcSect < lba(fp.wcN) {
+		copy(fp.wc[(fp.sect-fp.wcSect)*ss:], fp.buf[:]) // Rewritten before reaching the device.
+		return frOK
+	}
+	if fp.wcN > 0 && (fp.sect != fp.wcSect+lba(fp.wcN) || fp.wcN == len(fp.wc)/int(ss)) {
+		if fr := fp.wc_flush(); fr != frOK {
+			return fr
+		}
+	}
+	if fp.wcN == 0 {
+		fp.wcSect = fp.sect
+	}
+	copy(fp.wc[lba(fp.wcN)*ss:], fp.buf[:])
+	fp.wcN++
+	return frOK
+}
+
+// wc_flush writes the sectors held in the coalescing buffer to the device.
+// The buffer keeps them if the write fails, for a later sync to retry.
+func (fp *File) wc_flush() fileResult {
+	n := fp.wcN
+	if n == 0 {
+		return frOK
+	}
+	fp.wcN = 0 // data_write must not find them pending and flush them again.
+	fr := fp.data_write(fp.wc[:n*int(fp.obj.fs.ssize)], fp.wcSect, n)
+	if fr != frOK {
+		fp.wcN = n
+	}
+	return fr
+}
+
+// wc_overlaps reports whether the coalescing buffer holds any of the
+// numsectors sectors from sector on.
+func (fp *File) wc_overlaps(sector lba, numsectors int) bool {
+	return fp.wcN > 0 && sector < fp.wcSect+lba(fp.wcN) && fp.wcSect < sector+lba(numsectors)
+}
+
+// wc_overlay patches sectors read from the device with those held in the
+// coalescing buffer, which are newer.
+func (fp *File) wc_overlay(dst []byte, sector lba, numsectors int) {
+	if !fp.wc_overlaps(sector, numsectors) {
+		return
+	}
+	ss := lba(fp.obj.fs.ssize)
+	for i := lba(0); i < lba(numsectors); i++ {
+		if s := sector + i; s-fp.wcSect < lba(fp.wcN) {
+			copy(dst[i*ss:(i+1)*ss], fp.wc[(s-fp.wcSect)*ss:])
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// TestFileBufGoldenTorture runs the golden torture scripts with read-ahead
+// and write coalescing enabled: they change how data reaches the device,
+// never what ends up on it.
+func TestFileBufGoldenTorture(t *testing.T) {
+	skipIfNoLFN(t)
+	for _, test := range []struct {
+		baseline, torture string
+		exfat             bool
+		script            func(*testing.T, *FS)
+	}{
+		{"golden-fmt16.img", "golden-torture16.img", false, tortureScriptSmall},
+		{"golden-fmt32.img", "golden-torture32.img", false, tortureScript32},
+		{"golden-fmtex.img", "golden-tortureex.img", true, func(t *testing.T, fsys *FS) {
+			tortureScript32(t, fsys)
+			tortureScriptExFAT(t, fsys)
+		}},
+	} {
+		t.Run(test.torture, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			dev := goldenDevice(t, test.baseline)
+			var fsys FS
+			fsys.Configure(FSConfig{NoZeroFilling: true, ReadAheadSectors: 16, WriteCoalesceSectors: 8})
+			if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+				t.Fatal(err)
+			}
+			test.script(t, &fsys)
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			compareGolden(t, dev, test.torture)
+		})
+	}
+}
+
+// TestFileBufReducesCalls streams a file in and out in pieces smaller than a
+// sector and requires read-ahead and write coalescing to cut device calls.
+func TestFileBufReducesCalls(t *testing.T) {
+	const size = 64 << 10
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = pat(5, i)
+	}
+	run := func(cfg FSConfig) (readCalls, writeCalls int) {
+		fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+		cd := &countingDevice{BlockDeviceExtended: dev}
+		if err := fsys.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+		fsys.Configure(cfg)
+		if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		var fp File
+		if err := fsys.OpenFile(&fp, "f.bin", ModeRW|ModeCreateAlways); err != nil {
+			t.Fatal(err)
+		}
+		for off := 0; off < size; off += 100 {
+			if _, err := fp.Write(data[off:min(int64(off+100), size)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		writeCalls = cd.writeCalls
+		if err := fsys.OpenFile(&fp, "f.bin", ModeRead); err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		cd.readCalls = 0
+		got := make([]byte, 0, size)
+		buf := make([]byte, 100)
+		for {
+			n, err := fp.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data read back differs")
+		}
+		return cd.readCalls, writeCalls
+	}
+	r0, w0 := run(FSConfig{})
+	r1, w1 := run(FSConfig{ReadAheadSectors: 32, WriteCoalesceSectors: 32})
+	t.Logf("device calls: reads %d -> %d, writes %d -> %d", r0, r1, w0, w1)
+	if r1*8 > r0 {
+		t.Errorf("read-ahead made %d read calls, want well under %d", r1, r0)
+	}
+	if w1*8 > w0 {
+		t.Errorf("write coalescing made %d write calls, want well under %d", w1, w0)
+	}
+}
+
+// TestFileBufRandom interleaves reads, writes and seeks on files whose
+// cluster chains interleave, so read-ahead meets fragmented chains, and
+// checks every read against a model of the contents.
+func TestFileBufRandom(t *testing.T) {
+	t.Run("FAT16", func(t *testing.T) {
+		fsys, _ := formatAndMount(t, 16384, FormatParams{Format: FormatFAT16, ClusterSize: 2})
+		runFileBufRandom(t, fsys)
+	})
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatExFAT, ClusterSize: 2})
+		runFileBufRandom(t, fsys)
+	})
+}
+
+func runFileBufRandom(t *testing.T, fsys *FS) {
+	fsys.Configure(FSConfig{ReadAheadSectors: 8, WriteCoalesceSectors: 4})
+	const nfiles = 2
+	var files [nfiles]File
+	var model [nfiles][]byte
+	for i := range files {
+		if err := fsys.OpenFile(&files[i], fmt.Sprintf("f%d.bin", i), ModeRW|ModeCreateAlways); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for step := 0; step < 3000; step++ {
+		i := rng.Intn(nfiles)
+		fp, m := &files[i], model[i]
+		switch op := rng.Intn(10); {
+		case op < 4: // Write at the position, growing the file.
+			pos, _ := fp.Seek(0, io.SeekCurrent)
+			p := make([]byte, 1+rng.Intn(1500))
+			rng.Read(p)
+			if _, err := fp.Write(p); err != nil {
+				t.Fatalf("step %d: write: %v", step, err)
+			}
+			if end := int(pos) + len(p); end > len(m) {
+				m = append(m, make([]byte, end-len(m))...)
+			}
+			copy(m[pos:], p)
+			model[i] = m
+		case op < 8: // Read at the position.
+			pos, _ := fp.Seek(0, io.SeekCurrent)
+			p := make([]byte, 1+rng.Intn(1500))
+			n, err := fp.Read(p)
+			if err != nil && err != io.EOF {
+				t.Fatalf("step %d: read: %v", step, err)
+			}
+			var want []byte
+			if int(pos) < len(m) {
+				want = m[pos:min(int64(len(m)), pos+int64(len(p)))]
+			}
+			if !bytes.Equal(p[:n], want) {
+				t.Fatalf("step %d: read %d bytes at %d differ from model", step, n, pos)
+			}
+		default: // Seek within the file.
+			if _, err := fp.Seek(int64(rng.Intn(len(m)+1)), io.SeekStart); err != nil {
+				t.Fatalf("step %d: seek: %v", step, err)
+			}
+		}
+		if step%500 == 499 {
+			if err := fp.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := range files {
+		if err := files[i].Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAllFile(t, fsys, fmt.Sprintf("f%d.bin", i)); !bytes.Equal(got, model[i]) {
+			t.Errorf("f%d.bin differs from model after close", i)
+		}
+	}
+}
+
+// TestFileBufFlushError fails the write of the coalescing buffer at a sync
+// and requires the sectors kept for the sync that follows.
+func TestFileBufFlushError(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	fd := &flakyDevice{BlockByteSlice: dev, fail: map[int64]int{}, written: map[int64]int{}}
+	fsys.Configure(FSConfig{WriteCoalesceSectors: 8})
+	if err := fsys.Mount(fd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	var fp File
+	if err := fsys.OpenFile(&fp, "f.bin", ModeWrite|ModeCreateNew); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*512)
+	for i := range data {
+		data[i] = pat(3, i)
+	}
+	for off := 0; off < len(data); off += 100 {
+		if _, err := fp.Write(data[off:min(int64(off+100), int64(len(data)))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fp.wcN < 2 {
+		t.Fatalf("%d sectors coalesced, want 2", fp.wcN)
+	}
+	first := int64(fp.wcSect)
+	fd.fail[first+1] = 1
+	if err := fp.Sync(); !errors.Is(err, ErrDisk) {
+		t.Fatalf("sync failing to write: %v, want %v", err, ErrDisk)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	var plain FS
+	if err := plain.Mount(dev, 512, ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllFile(t, &plain, "f.bin"); !bytes.Equal(got, data) {
+		t.Error("data of the failed sync lost")
+	}
+}
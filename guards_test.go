@@ -15,7 +15,7 @@ func TestMountGuards(t *testing.T) {
 	dev := &BlockByteSlice{blk: blk, buf: make([]byte, 64*512)}
 
 	// Invalid permission bits.
-	if err := fsys.Mount(dev, 512, Mode(0b100)); err != errInvalidMode {
+	if err := fsys.Mount(dev, 512, Mode(0b100)); !errors.Is(err, errInvalidMode) {
 		t.Errorf("invalid mode: %v", err)
 	}
 	// Sector size too large for uint16.
@@ -38,7 +38,7 @@ func TestOpenFileGuards(t *testing.T) {
 	fs, _ := initTestFAT()
 	var f File
 	// Invalid mode bits.
-	if err := fs.OpenFile(&f, "rootfile", Mode(0x40)); err != errInvalidMode {
+	if err := fs.OpenFile(&f, "rootfile", Mode(0x40)); !errors.Is(err, errInvalidMode) {
 		t.Errorf("invalid mode: %v", err)
 	}
 	// Nonexistent file.
@@ -78,7 +78,7 @@ func TestReadOnlyMount(t *testing.T) {
 		t.Fatal(err)
 	}
 	var f File
-	if err := fsys.OpenFile(&f, "cc.dat", ModeWrite); err != errForbiddenMode {
+	if err := fsys.OpenFile(&f, "cc.dat", ModeWrite); !errors.Is(err, errForbiddenMode) {
 		t.Errorf("write open on RO mount: %v", err)
 	}
 	if err := fsys.Remove("cc.dat"); err == nil {
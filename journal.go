@@ -0,0 +1,248 @@
+package fat
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log/slog"
+)
+
+// journal is the optional metadata journal, see [FSConfig.Journal]. It lives
+// in the data of a contiguous file at the root, jnlName. Its first sector is
+// the header and the sectors after it hold the contents of the sectors of a
+// transaction:
+//
+//	0:  jnlMagic
+//	8:  sequence number of the transaction
+//	12: number of sectors n, 0 if the journal is clean
+//	16: CRC-32 of the n sectors and of the header with this field zeroed
+//	32: n sector numbers, 4 bytes each, where the sectors go
+//
+// A commit writes the sectors to the journal, then the header, which
+// commits them, then the sectors in place and finally the header cleared.
+// Mount replays a committed transaction and discards one whose header or
+// sectors do not match the CRC, cut short before its header was written.
+type journal struct {
+	base lba    // First sector of the journal, 0 if none.
+	n    int    // Sectors of transaction the journal holds, after the header.
+	seq  uint32 // Sequence number of the last transaction.
+	idx  []int  // Cache slots of the transaction being committed.
+	hdr  [512]byte
+}
+
+const (
+	jnlName     = "JOURNAL.SYS"
+	jnlMagic    = "FATJRNL1"
+	jnlSeqOff   = 8
+	jnlCountOff = 12
+	jnlCRCOff   = 16
+	jnlListOff  = 32
+	// jnlSectors is the size of a journal created by Mount, header
+	// included: a transaction of as many sectors as the header can list.
+	jnlSectors = 1 + (512-jnlListOff)/4
+	// jnlCacheSectors sizes each pool of the sector cache of a journaled
+	// volume configured without one.
+	jnlCacheSectors = 8
+)
+
+// jnl_mount finds the journal of the volume, creating it on a volume
+// mounted for writing, and replays the transaction it holds. A volume
+// mounted read-only is left as it lies.
+func (fsys *FS) jnl_mount() fileResult {
+	fsys.jnl.base, fsys.jnl.n = 0, 0
+	var fp File
+	fr := fsys.f_open(&fp, jnlName, faRead)
+	if fr == frNoFile && fsys.perm&ModeWrite != 0 {
+		fr = fsys.jnl_create()
+		if fr == frOK {
+			fr = fsys.f_open(&fp, jnlName, faRead)
+		}
+	}
+	if fr == frNoFile {
+		return frOK // Nothing to replay.
+	} else if fr != frOK {
+		return fr
+	}
+	ext, fr := fp.extents(nil)
+	if fr != frOK {
+		return fr
+	} else if fr = fp.f_close(); fr != frOK {
+		return fr
+	} else if len(ext) != 1 || ext[0].NumBlocks < 2 {
+		fsys.logerror("jnl_mount:fragmented")
+		return frIntErr // The journal must be contiguous.
+	}
+	fsys.jnl.base = lba(ext[0].Block)
+	fsys.jnl.n = int(min(ext[0].NumBlocks, jnlSectors)) - 1
+	if fsys.perm&ModeWrite == 0 {
+		return frOK
+	}
+	return fsys.jnl_replay()
+}
+
+// jnl_create creates the journal file, hidden and system, with a clean
+// header.
+func (fsys *FS) jnl_create() fileResult {
+	var fp File
+	fr := fsys.f_open(&fp, jnlName, faCreateNew|faWrite)
+	if fr != frOK {
+		return fr
+	}
+	fr = fp.f_expand(jnlSectors*int64(fsys.ssize), true)
+	if fr == frOK {
+		fr = fp.f_close()
+	}
+	if fr != frOK {
+		return fr
+	}
+	clear(fsys.jnl.hdr[:])
+	if fsys.disk_write(fsys.jnl.hdr[:fsys.ssize], fsys.clst2sect(fp.obj.sclust), 1) != drOK {
+		return frDiskErr
+	}
+	return fsys.f_chmod(jnlName, amHID|amSYS, amHID|amSYS)
+}
+
+// jnl_replay writes the sectors of the committed transaction in the journal
+// in place, or discards a transaction cut short, and clears the journal.
+func (fsys *FS) jnl_replay() fileResult {
+	j := &fsys.jnl
+	ss := int(fsys.ssize)
+	hdr := j.hdr[:ss]
+	if fsys.disk_read(hdr, j.base, 1) != drOK {
+		return frDiskErr
+	}
+	n := int(binary.LittleEndian.Uint32(hdr[jnlCountOff:]))
+	if string(hdr[:len(jnlMagic)]) != jnlMagic {
+		return frOK // Never committed to.
+	}
+	j.seq = binary.LittleEndian.Uint32(hdr[jnlSeqOff:])
+	if n == 0 {
+		return frOK
+	}
+	var sect [512]byte
+	ok := n <= j.n && n <= jnlSectors-1
+	if ok {
+		crc := uint32(0)
+		for k := 0; k < n; k++ {
+			if fsys.disk_read(sect[:ss], j.base+1+lba(k), 1) != drOK {
+				return frDiskErr
+			}
+			crc = crc32.Update(crc, crc32.IEEETable, sect[:ss])
+		}
+		want := binary.LittleEndian.Uint32(hdr[jnlCRCOff:])
+		binary.LittleEndian.PutUint32(hdr[jnlCRCOff:], 0)
+		ok = crc32.Update(crc, crc32.IEEETable, hdr) == want
+	}
+	fsys.trace("jnl_replay", slog.Int("sectors", n), slog.Bool("committed", ok))
+	for k := 0; ok && k < n; k++ {
+		if fsys.disk_read(sect[:ss], j.base+1+lba(k), 1) != drOK {
+			return frDiskErr
+		}
+		if fsys.jnl_home(sect[:ss], lba(binary.LittleEndian.Uint32(hdr[jnlListOff+4*k:]))) != frOK {
+			return frDiskErr
+		}
+	}
+	if ok {
+		// The window, the allocation counts of FSInfo and the maps loaded
+		// by the mount may predate the sectors replayed.
+		fsys.invalidate_window()
+		if fsys.fstype == FormatFAT32 && fsys.fsi_flag&0x80 == 0 {
+			fsys.fsinfo_load()
+		} else {
+			fsys.last_clst = 0xffff_ffff
+			fsys.free_clst = 0xffff_ffff
+		}
+		fsys.amap_reset()
+		fsys.dcache_reset()
+	}
+	return fsys.jnl_clear()
+}
+
+// jnl_commit writes the dirty slots of the cache modified up to sequence
+// number upto to the device through the journal, in modification order, in
+// as many transactions as the journal needs to hold them.
+func (fsys *FS) jnl_commit(upto uint64) fileResult {
+	c := fsys.cache
+	j := &fsys.jnl
+	for {
+		j.idx = j.idx[:0]
+		for i := range c.slots {
+			if seq := c.slots[i].dirty; seq != 0 && seq <= upto {
+				j.idx = append(j.idx, i)
+			}
+		}
+		if len(j.idx) == 0 {
+			return frOK
+		}
+		// Insertion sort by modification order: there are few slots.
+		for a := 1; a < len(j.idx); a++ {
+			for b := a; b > 0 && c.slots[j.idx[b]].dirty < c.slots[j.idx[b-1]].dirty; b-- {
+				j.idx[b], j.idx[b-1] = j.idx[b-1], j.idx[b]
+			}
+		}
+		if len(j.idx) > j.n {
+			j.idx = j.idx[:j.n]
+		}
+		if fr := fsys.jnl_write(j.idx); fr != frOK {
+			return fr
+		}
+	}
+}
+
+// jnl_write commits the cache slots idx as one transaction.
+func (fsys *FS) jnl_write(idx []int) fileResult {
+	c := fsys.cache
+	j := &fsys.jnl
+	ss := int(fsys.ssize)
+	hdr := j.hdr[:ss]
+	clear(hdr)
+	crc := uint32(0)
+	for k, i := range idx {
+		data := c.data(i)[:ss]
+		if fsys.disk_write(data, j.base+1+lba(k), 1) != drOK {
+			return frDiskErr
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, data)
+		binary.LittleEndian.PutUint32(hdr[jnlListOff+4*k:], uint32(c.slots[i].sect))
+	}
+	j.seq++
+	copy(hdr, jnlMagic)
+	binary.LittleEndian.PutUint32(hdr[jnlSeqOff:], j.seq)
+	binary.LittleEndian.PutUint32(hdr[jnlCountOff:], uint32(len(idx)))
+	binary.LittleEndian.PutUint32(hdr[jnlCRCOff:], crc32.Update(crc, crc32.IEEETable, hdr))
+	if fsys.disk_write(hdr, j.base, 1) != drOK {
+		return frDiskErr // Not committed: the sectors are still dirty.
+	}
+	for _, i := range idx {
+		// disk_write marks the slot clean through cache_update.
+		if fr := fsys.jnl_home(c.data(i)[:ss], c.slots[i].sect); fr != frOK {
+			return fr
+		}
+	}
+	return fsys.jnl_clear()
+}
+
+// jnl_home writes the journaled sector data in place, mirroring FAT sectors
+// to the second FAT like sync_window.
+func (fsys *FS) jnl_home(data []byte, sect lba) fileResult {
+	if ret := fsys.disk_write(data, sect, 1); ret != drOK {
+		fsys.logerror("jnl_home:dw", slog.Int("dret", int(ret)))
+		return ret.write_result()
+	}
+	if fsys.nFATs == 2 && sect-fsys.fatbase < lba(fsys.fsize) { // Is in 1st FAT?
+		fsys.disk_write(data, sect+lba(fsys.fsize), 1) // Redundancy write, ignore error.
+	}
+	return frOK
+}
+
+// jnl_clear writes the header of a clean journal.
+func (fsys *FS) jnl_clear() fileResult {
+	j := &fsys.jnl
+	hdr := j.hdr[:fsys.ssize]
+	clear(hdr)
+	copy(hdr, jnlMagic)
+	binary.LittleEndian.PutUint32(hdr[jnlSeqOff:], j.seq)
+	if fsys.disk_write(hdr, j.base, 1) != drOK {
+		return frDiskErr
+	}
+	return frOK
+}
@@ -0,0 +1,213 @@
+package fat
+
+import (
+	"errors"
+	"testing"
+)
+
+var errPowerCut = errors.New("power cut")
+
+// cutDevice loses power after writes more write calls: later writes fail
+// without reaching the device. A negative writes never cuts.
+type cutDevice struct {
+	*BlockByteSlice
+	writes int
+}
+
+func (cd *cutDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	if cd.writes == 0 {
+		return 0, errPowerCut
+	}
+	cd.writes--
+	return cd.BlockByteSlice.WriteBlocks(data, startBlock)
+}
+
+func (cd *cutDevice) EraseBlocks(startBlock, numBlocks int64) error {
+	if cd.writes == 0 {
+		return errPowerCut
+	}
+	return cd.BlockByteSlice.EraseBlocks(startBlock, numBlocks)
+}
+
+func TestJournal(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1}, false},
+		{"FAT32", 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1}, false},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 1}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			fsys.Configure(FSConfig{Journal: true})
+			if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+				t.Fatal(err)
+			}
+			var fi FileInfo
+			if err := fsys.Stat(jnlName, &fi); err != nil {
+				t.Fatal(err)
+			} else if fi.fattrib&(amHID|amSYS) != amHID|amSYS || fi.Size() != jnlSectors*512 {
+				t.Errorf("journal attributes %#x, size %d", fi.fattrib, fi.Size())
+			}
+			createPat(t, fsys, "a.bin", 1, 5000)
+			if err := fsys.Mkdir("d"); err != nil {
+				t.Fatal(err)
+			}
+			createPat(t, fsys, "d/b.bin", 2, 700)
+			if err := fsys.Remove("a.bin"); err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A driver without journal finds a consistent volume.
+			var plain FS
+			if err := plain.Mount(dev, 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			rep, err := plain.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, rep)
+			checkPat(t, &plain, "d/b.bin", 2, 700)
+		})
+	}
+}
+
+// TestJournalPowerCut cuts power at every write of a few operations and
+// requires the volume mounted with journal afterwards to be consistent, each
+// operation done whole or not at all, where without journal some cuts leave
+// it damaged.
+func TestJournalPowerCut(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1}, false},
+		{"FAT32", 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1}, false},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 1}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+			createPat(t, fsys, "old.bin", 1, 3000)
+			fsys.Configure(FSConfig{Journal: true})
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.Mount(dev, 512, ModeRW); err != nil { // Creates the journal.
+				t.Fatal(err)
+			}
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			base := dev.buf
+			damaged := func(journal bool, writes int) (bad, done bool) {
+				img := &BlockByteSlice{blk: dev.blk, buf: append([]byte(nil), base...)}
+				cd := &cutDevice{BlockByteSlice: img, writes: writes}
+				var fsys FS
+				fsys.Configure(FSConfig{Journal: journal})
+				if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+					t.Fatal(err)
+				}
+				err := powerCutScript(&fsys)
+				fsys.Unmount()
+				if err != nil && !errors.Is(err, errPowerCut) && cd.writes != 0 {
+					t.Fatalf("cut at %d: %v", writes, err)
+				}
+				// Power back on.
+				fsys.Configure(FSConfig{Journal: journal})
+				if err := fsys.Mount(img, 512, ModeRW); err != nil {
+					t.Fatal(err)
+				}
+				defer fsys.Unmount()
+				if journal {
+					// The replayed volume takes allocations like any other.
+					createPat(t, &fsys, "after.bin", 3, 700)
+				}
+				rep, err := fsys.Check()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if journal {
+					wantProblems(t, rep)
+					powerCutState(t, &fsys)
+				}
+				return !rep.OK(), cd.writes != 0
+			}
+			for _, journal := range []bool{true, false} {
+				nbad := 0
+				writes := 0
+				for ; ; writes++ {
+					bad, done := damaged(journal, writes)
+					if bad {
+						nbad++
+					}
+					if done || t.Failed() {
+						break
+					}
+				}
+				t.Logf("journal %v: %d of %d cuts left problems", journal, nbad, writes)
+				if !journal && nbad == 0 {
+					t.Error("no cut damaged the volume without journal")
+				}
+			}
+		})
+	}
+}
+
+// powerCutScript creates, grows, removes and renames files.
+func powerCutScript(fsys *FS) error {
+	var fp File
+	if err := fsys.OpenFile(&fp, "new.bin", ModeWrite|ModeCreateAlways); err != nil {
+		return err
+	}
+	buf := make([]byte, 5000)
+	for i := range buf {
+		buf[i] = pat(2, i)
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Remove("old.bin"); err != nil {
+		return err
+	}
+	if err := fsys.Mkdir("dir"); err != nil {
+		return err
+	}
+	return fsys.Rename("new.bin", "dir/new.bin")
+}
+
+// powerCutState requires each step of powerCutScript to be done whole or
+// not at all.
+func powerCutState(t *testing.T, fsys *FS) {
+	t.Helper()
+	var fi FileInfo
+	for _, path := range []string{"new.bin", "dir/new.bin"} {
+		if fsys.Stat(path, &fi) == nil {
+			checkPat(t, fsys, path, 2, 5000)
+		}
+	}
+	if fsys.Stat("old.bin", &fi) == nil {
+		checkPat(t, fsys, "old.bin", 1, 3000)
+	}
+}
@@ -2,6 +2,7 @@ package fat
 
 import (
 	"encoding/binary"
+	"errors"
 	"testing"
 	"unicode/utf16"
 )
@@ -93,7 +94,7 @@ func TestLabel(t *testing.T) {
 			if err = fsys.Unmount(); err != nil {
 				t.Fatal("unmount:", err)
 			}
-			if _, err = fsys.AppendLabel(nil); err != frNoFilesystem {
+			if _, err = fsys.AppendLabel(nil); !errors.Is(err, ErrNoFilesystem) {
 				t.Errorf("Label of unmounted FS = %v, want %v", err, frNoFilesystem)
 			}
 			if err = fsys.Mount(dev, 512, ModeRW); err != nil {
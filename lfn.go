@@ -71,8 +71,6 @@ func (fsys *FS) lfnlen() (ln int) {
 	return ln
 }
 
-var lfnOffsets = [...]byte{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
-
 func (fsys *FS) put_lfn(dir []byte, ord, sum byte) {
 	fsys.trace("put_lfn", slog.Uint64("ord", uint64(ord)))
 	// TODO(soypat): maybe this should receive a *dir and avoid two word copies?
@@ -407,6 +405,19 @@ func (fsys *FS) getlabel_sfn(dst, dir []byte) []byte {
 	return dst
 }
 
+// get_achar returns the up-case code point at the head of s and the rest
+// of s, or 0 at the end of s or on an invalid UTF-8 sequence.
+func (fsys *FS) get_achar(s string) (rune, string) {
+	if len(s) == 0 {
+		return 0, s
+	}
+	uc, n := utf8.DecodeRuneInString(s)
+	if uc == utf8.RuneError && n <= 1 {
+		return 0, s[n:] // Wrong character.
+	}
+	return ff_wtoupper(uc), s[n:]
+}
+
 func put_utf8(r rune, buf []byte) int {
 	if utf8.RuneLen(r) > len(buf) {
 		return 0
@@ -414,6 +425,19 @@ func put_utf8(r rune, buf []byte) int {
 	return int(utf8.EncodeRune(buf, r))
 }
 
+// lfn_hash returns the FNV-1a hash of the upcased, null terminated name lfn,
+// the directory lookup cache key of a long name.
+func lfn_hash(lfn []uint16) uint32 {
+	h := uint32(2166136261)
+	for _, c := range lfn {
+		if c == 0 {
+			break
+		}
+		h = (h ^ uint32(ff_wtoupper(rune(c)))) * 16777619
+	}
+	return h | 1
+}
+
 // cmp_lfn returns true if entry matches LFN.
 func (fsys *FS) cmp_lfn(dir []byte) bool {
 	fsys.trace("fs:cmp_lfn")
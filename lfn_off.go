@@ -26,6 +26,9 @@ func (fsys *FS) initNames() {
 // pick_lfn always fails without LFN support so that directory reads skip LFN entries.
 func (fsys *FS) pick_lfn(dir []byte) bool { return false }
 
+// lfn_hash is never called without LFN support: no entry has a long name.
+func lfn_hash(lfn []uint16) uint32 { return 0 }
+
 // cmp_lfn always fails without LFN support so that name search matches SFN entries only.
 func (fsys *FS) cmp_lfn(dir []byte) bool { return false }
 
@@ -34,6 +37,21 @@ func (fsys *FS) put_lfn(dir []byte, ord, sum byte) {}
 
 func (fsys *FS) lfnlen() int { return 0 }
 
+// get_achar returns the up-case OEM character at the head of s and the
+// rest of s, or 0 at the end of s.
+func (fsys *FS) get_achar(s string) (rune, string) {
+	if len(s) == 0 {
+		return 0, s
+	}
+	c := s[0]
+	if 'a' <= c && c <= 'z' {
+		c -= 0x20
+	} else if c >= 0x80 {
+		c = fsys.exCvt[c&0x7f] // To upper extended characters (SBCS).
+	}
+	return rune(c), s[1:]
+}
+
 // getlabel_sfn appends the 11-byte volume label of the AM_VOL entry at dir to
 // dst verbatim, in the OEM encoding, with trailing spaces trimmed. Without LFN
 // support there is no unicode conversion table to map it through.
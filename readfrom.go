@@ -0,0 +1,128 @@
+package fat
+
+import "io"
+
+// copyBuf returns the transfer buffer of a ReadFrom or WriteTo on fp, of
+// whole clusters of csz bytes: buf trimmed to them if it holds one, else a
+// new buffer of copyBufSize bytes rounded up to them. Small clusters are so
+// batched and the locks not taken per sector.
+func (fp *File) copyBuf(buf []byte, op string) (_ []byte, csz int64, err error) {
+	fsys, err := fp.lock(op)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fp.unlock(fsys)
+	csz = int64(fsys.csize) * int64(fsys.ssize)
+	if n := int64(len(buf)) / csz * csz; n > 0 {
+		return buf[:n], csz, nil
+	}
+	return make([]byte, (copyBufSize+csz-1)/csz*csz), csz, nil
+}
+
+// WriteTo writes the file from the current position to its end to w. It
+// implements the [io.WriterTo] interface, used by [io.Copy] in place of Read.
+//
+// The file is read a chunk of whole clusters at a time, aligned on cluster
+// boundaries past the first, so that f_read transfers each chunk from the
+// device straight into the buffer handed to w. The file is unlocked while w
+// is written to.
+func (fp *File) WriteTo(w io.Writer) (int64, error) {
+	return fp.writeTo(w, nil)
+}
+
+// writeTo is WriteTo with a transfer buffer, see copyBuf.
+func (fp *File) writeTo(w io.Writer, buf []byte) (int64, error) {
+	buf, csz, err := fp.copyBuf(buf, "read")
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for {
+		nr, err := fp.readChunk(buf, csz)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			} else if nw < nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+// readChunk reads into buf up to the first cluster boundary at least
+// len(buf)-csz bytes past the position.
+func (fp *File) readChunk(buf []byte, csz int64) (int, error) {
+	fsys, err := fp.lock("read")
+	if err != nil {
+		return 0, err
+	}
+	defer fp.unlock(fsys)
+	chunk := int64(len(buf)) - fp.pos%csz
+	n, err := fp.read(buf[:chunk])
+	return n, fsys.pathErr("read", fp.name, err)
+}
+
+// ReadFrom writes the data read from r until EOF to the file. It implements
+// the [io.ReaderFrom] interface, used by [io.Copy] in place of Write.
+//
+// The data is gathered from r a chunk of whole clusters at a time, aligned on
+// cluster boundaries past the first, so that f_write transfers each chunk
+// straight to the device however small the reads of r are. The file is
+// unlocked while r is read from.
+func (fp *File) ReadFrom(r io.Reader) (int64, error) {
+	return fp.readFrom(r, nil)
+}
+
+// readFrom is ReadFrom with a transfer buffer, see copyBuf.
+func (fp *File) readFrom(r io.Reader, buf []byte) (int64, error) {
+	buf, csz, err := fp.copyBuf(buf, "write")
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	_, chunk, err := fp.writeChunk(nil, len(buf), csz)
+	for err == nil {
+		nr, rerr := io.ReadFull(r, buf[:chunk])
+		if nr > 0 {
+			var nw int
+			nw, chunk, err = fp.writeChunk(buf[:nr], len(buf), csz)
+			n += int64(nw)
+			if err != nil {
+				break
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		err = rerr
+	}
+	return n, err
+}
+
+// writeChunk writes data at the position, then returns the size of the next
+// chunk of a transfer with a buffer of buflen bytes: up to the first cluster
+// boundary at least buflen-csz bytes past where the next write goes.
+func (fp *File) writeChunk(data []byte, buflen int, csz int64) (bw, next int, err error) {
+	fsys, err := fp.lock("write")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fp.unlock(fsys)
+	if len(data) > 0 {
+		if bw, err = fp.write(data); err != nil {
+			return bw, 0, fsys.pathErr("write", fp.name, err)
+		}
+	}
+	pos := fp.pos
+	if fp.flag&faAppend != 0 {
+		pos = fp.obj.objsize
+	}
+	return bw, int(int64(buflen) - pos%csz), nil
+}
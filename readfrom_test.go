@@ -0,0 +1,128 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns at most n bytes per Read, as a network connection does.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > cr.n {
+		p = p[:cr.n]
+	}
+	return cr.r.Read(p)
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		fmt   FormatParams
+		exfat bool
+	}{
+		{"FAT16", FormatParams{Format: FormatFAT16, ClusterSize: 4}, false},
+		{"FAT16/sector clusters", FormatParams{Format: FormatFAT16, ClusterSize: 1}, false},
+		{"exFAT", FormatParams{Format: FormatExFAT, ClusterSize: 8}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			fsys, _ := formatAndMount(t, 8192, test.fmt)
+			data := make([]byte, 100000)
+			for i := range data {
+				data[i] = pat(7, i)
+			}
+			var fp File
+			if err := fsys.OpenFile(&fp, "f.bin", ModeRW|ModeCreateAlways); err != nil {
+				t.Fatal(err)
+			}
+			defer fp.Close()
+			// Start unaligned, then gather odd sized reads into aligned chunks.
+			if _, err := fp.Write(data[:300]); err != nil {
+				t.Fatal(err)
+			}
+			n, err := fp.ReadFrom(&chunkReader{r: bytes.NewReader(data[300:]), n: 1400})
+			if err != nil || n != int64(len(data)-300) {
+				t.Fatalf("ReadFrom = %d, %v; want %d", n, err, len(data)-300)
+			}
+			if _, err := fp.Seek(777, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			n, err = fp.WriteTo(&got)
+			if err != nil || n != int64(len(data)-777) {
+				t.Fatalf("WriteTo = %d, %v; want %d", n, err, len(data)-777)
+			} else if !bytes.Equal(got.Bytes(), data[777:]) {
+				t.Fatal("WriteTo data differs")
+			}
+			// At end of file there is nothing more to write.
+			if n, err = fp.WriteTo(&got); n != 0 || err != nil {
+				t.Fatalf("WriteTo at end = %d, %v", n, err)
+			}
+
+			// A reader error is returned after the data read before it.
+			errBoom := io.ErrClosedPipe
+			if _, err := fp.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			r := io.MultiReader(bytes.NewReader(data[:5000]), iotest.ErrReader(errBoom))
+			if n, err := fp.ReadFrom(r); n != 5000 || err != errBoom {
+				t.Fatalf("ReadFrom = %d, %v; want 5000, %v", n, err, errBoom)
+			}
+		})
+	}
+}
+
+// TestReadFromReducesCalls copies a stream arriving in pieces smaller than
+// a sector into a file and requires ReadFrom to write it in few device calls.
+func TestReadFromReducesCalls(t *testing.T) {
+	const size = 64 << 10
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = pat(8, i)
+	}
+	run := func(copyTo func(fp *File, r io.Reader) error) int {
+		fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+		cd := &countingDevice{BlockDeviceExtended: dev}
+		if err := fsys.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsys.Mount(cd, 512, ModeRW); err != nil {
+			t.Fatal(err)
+		}
+		var fp File
+		if err := fsys.OpenFile(&fp, "f.bin", ModeWrite|ModeCreateAlways); err != nil {
+			t.Fatal(err)
+		}
+		if err := copyTo(&fp, &chunkReader{r: bytes.NewReader(data), n: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAllFile(t, fsys, "f.bin"); !bytes.Equal(got, data) {
+			t.Fatal("file contents differ")
+		}
+		return cd.writeCalls
+	}
+	w0 := run(func(fp *File, r io.Reader) error {
+		_, err := io.Copy(struct{ io.Writer }{fp}, r)
+		return err
+	})
+	w1 := run(func(fp *File, r io.Reader) error {
+		_, err := io.Copy(fp, r)
+		return err
+	})
+	t.Logf("write calls: %d -> %d", w0, w1)
+	// One write per cluster, clipped by f_write, plus the FAT and directory.
+	if w1*3 > w0 {
+		t.Errorf("ReadFrom made %d write calls, want well under %d", w1, w0)
+	}
+}
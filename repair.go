@@ -0,0 +1,291 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// RepairConfig configures [FS.Repair]. The zero value frees lost chains.
+type RepairConfig struct {
+	// RecoverLost saves lost chains as files FILE0000.CHK, FILE0001.CHK...
+	// of a new directory FOUND.000, or the first FOUND.nnn free, at the
+	// root instead of freeing them.
+	RecoverLost bool
+}
+
+// repairPasses bounds the checks of a Repair: fixes may reveal problems
+// that a check after them finds.
+const repairPasses = 4
+
+// Repair checks the volume as [FS.Check] does and fixes the problems found,
+// as dosfsck -a does:
+//   - lost chains are freed, or recovered, see [RepairConfig.RecoverLost].
+//   - chains longer than their file are truncated, and the clusters past
+//     the end freed; files longer than their chain are shortened to it.
+//   - chains linking to a bad cluster are cut before it.
+//   - cross-linked clusters are copied to new ones for the file found second.
+//     On exFAT, or if the volume is full, its chain is cut instead.
+//   - orphaned LFN entries and those with a wrong checksum are deleted.
+//   - "." and ".." entries pointing elsewhere are corrected.
+//   - the second FAT is rewritten from the first, and the FAT32 FSInfo
+//     free count from the FAT.
+//   - exFAT entry set and up-case table checksums are recomputed, and the
+//     allocation bitmap set to the clusters held.
+//
+// Fixes go through the sector window and sync like any write. Repair checks
+// again after fixing until a check finds nothing more to fix, so that a
+// second Repair finds no problem and writes nothing. The report lists the
+// problems fixed, with Fixed set, followed by those left; its counts are
+// those of the repaired volume. No file or directory may be open.
+func (fsys *FS) Repair(cfg *RepairConfig) (_ *CheckReport, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	defer fsys.wrapErr(&err, "repair", "/")
+	if fsys.fstype == _FormatUnknown {
+		return nil, frNotEnabled
+	} else if fsys.perm&ModeWrite == 0 {
+		return nil, frWriteProtected
+	}
+	if cfg == nil {
+		cfg = &RepairConfig{}
+	}
+	if fr := fsys.sync(); fr != frOK {
+		return nil, fr
+	}
+	var fixed []Problem
+	for pass := 0; ; pass++ {
+		c := newChecker(fsys, cfg)
+		fr := c.run()
+		fsys.dcache_reset() // Entries may have moved under the index.
+		if fr == frOK {
+			fr = c.recover()
+		}
+		if fr == frOK {
+			fr = fsys.sync()
+		}
+		if fr != frOK {
+			return nil, fr
+		}
+		var left []Problem
+		nfixed := len(fixed)
+		for _, p := range c.rep.Problems {
+			if p.Fixed {
+				fixed = append(fixed, p)
+			} else {
+				left = append(left, p)
+			}
+		}
+		if len(fixed) == nfixed || pass == repairPasses-1 {
+			c.rep.Problems = append(fixed, left...)
+			return c.rep, nil
+		}
+	}
+}
+
+// cut ends the chain of d after cluster prev, or empties it if prev is 0. It
+// reports whether it could.
+func (c *checker) cut(d *checkDir, prev uint32, block int64, ofs int) (bool, fileResult) {
+	if !d.fix {
+		return false, frOK
+	} else if prev == 0 {
+		d.sclust = 0
+		return c.rewrite(d, block, ofs)
+	} else if d.contig {
+		return true, frOK // Its size, fixed next, ends it.
+	}
+	fr := c.fsys.put_clusterstat(prev, 0xFFFF_FFFF)
+	return fr == frOK, fr
+}
+
+// trim cuts the chain of d, held by obj, to its first keep clusters and frees
+// the clusters past them that obj holds.
+func (c *checker) trim(obj uint32, d *checkDir, keep int64, block int64, ofs int) (bool, fileResult) {
+	fsys := c.fsys
+	var last uint32
+	cl := d.sclust
+	for i := int64(0); i < keep; i++ {
+		last = cl
+		if cl = c.link(d, cl); cl == badCluster {
+			return false, frDiskErr
+		}
+	}
+	ok, fr := c.cut(d, last, block, ofs)
+	if !ok || fr != frOK {
+		return ok, fr
+	}
+	for cl >= 2 && cl < fsys.n_fatent && c.owner[cl] == obj {
+		next := c.link(d, cl)
+		if next == badCluster {
+			return false, frDiskErr
+		}
+		c.owner[cl] = 0
+		c.rep.UsedClusters--
+		if fsys.isExfat() {
+			fr = fsys.change_bitmap(cl, 1, false)
+			if fr == frIntErr {
+				fr = frOK // Already free on the bitmap.
+			}
+		} else {
+			fr = fsys.put_clusterstat(cl, 0)
+		}
+		if fr != frOK {
+			return false, fr
+		}
+		cl = next
+	}
+	if int64(len(d.cls)) > keep {
+		d.cls = d.cls[:keep]
+	}
+	return true, frOK
+}
+
+// link returns the cluster after cl in the chain of d.
+func (c *checker) link(d *checkDir, cl uint32) uint32 {
+	if d.contig {
+		return cl + 1
+	}
+	return (&objid{fs: c.fsys}).clusterstat(cl)
+}
+
+// copy_tail breaks the cross-link of the chain of d, held by obj, at cluster
+// cl after prev: the clusters of the other chain from cl that d needs are
+// copied to new clusters that take their place. n and cls are the clusters
+// of d before cl, as chain returns them.
+func (c *checker) copy_tail(obj uint32, d *checkDir, n int64, cls []uint32, list bool, prev, cl uint32, block int64, ofs int) (int64, []uint32, bool, fileResult) {
+	fsys := c.fsys
+	clsz := int64(fsys.csize) * int64(fsys.ssize)
+	need := int64(fsys.n_fatent) // A directory takes the rest of the chain.
+	if !d.dir {
+		need = (d.size+clsz-1)/clsz - n
+	}
+	ok, fr := c.cut(d, prev, block, ofs)
+	if !ok || fr != frOK {
+		return n, cls, ok, fr
+	}
+	o := objid{fs: fsys}
+	var buf [512]byte
+	last, src := prev, cl
+	for k := int64(0); k < need; k++ {
+		ncl := o.create_chain(last)
+		if ncl == badCluster {
+			return n, cls, false, frDiskErr
+		} else if ncl == 1 {
+			return n, cls, false, frIntErr
+		} else if ncl == 0 {
+			break // Volume full, the chain stays cut.
+		}
+		if last == 0 {
+			d.sclust = ncl
+			if _, fr = c.rewrite(d, block, ofs); fr != frOK {
+				return n, cls, false, fr
+			}
+		}
+		c.owner[ncl] = obj
+		c.rep.UsedClusters++
+		n++
+		if list {
+			cls = append(cls, ncl)
+		}
+		for i := lba(0); i < lba(fsys.csize); i++ {
+			if fr = fsys.move_window(fsys.clst2sect(src) + i); fr != frOK {
+				return n, cls, false, fr
+			}
+			copy(buf[:fsys.ssize], fsys.win[:])
+			if fr = fsys.move_window(fsys.clst2sect(ncl) + i); fr != frOK {
+				return n, cls, false, fr
+			}
+			copy(fsys.win[:], buf[:fsys.ssize])
+			fsys.wflag = 1
+		}
+		last = ncl
+		next := o.clusterstat(src)
+		if next == badCluster {
+			return n, cls, false, frDiskErr
+		} else if c.eoc(next) || next < 2 || next >= fsys.n_fatent {
+			break
+		}
+		src = next
+	}
+	return n, cls, true, frOK
+}
+
+// rewrite stores the start cluster and size of d in its directory entry, at
+// block and ofs. It reports whether d has an entry to rewrite.
+func (c *checker) rewrite(d *checkDir, block int64, ofs int) (bool, fileResult) {
+	fsys := c.fsys
+	if !d.fix || block == 0 {
+		return false, frOK // The root directory has no entry.
+	} else if fsys.isExfat() {
+		fr := c.x.store(c, d)
+		return fr == frOK, fr
+	}
+	if fr := fsys.move_window(lba(block)); fr != frOK {
+		return false, fr
+	}
+	ent := fsys.win[ofs : ofs+sizeDirEntry]
+	fsys.st_clust(ent, d.sclust)
+	binary.LittleEndian.PutUint32(ent[dirFileSizeOff:], uint32(d.size))
+	fsys.wflag = 1
+	return true, frOK
+}
+
+// delete_entries marks the directory entries at locs deleted.
+func (c *checker) delete_entries(locs []entLoc) (bool, fileResult) {
+	fsys := c.fsys
+	for _, loc := range locs {
+		if fr := fsys.move_window(loc.sect); fr != frOK {
+			return false, fr
+		}
+		fsys.win[loc.ofs] = mskDDEM
+		fsys.wflag = 1
+	}
+	return true, frOK
+}
+
+// recover saves the lost chains found as files FILEnnnn.CHK of a new
+// directory FOUND.nnn at the root, sized to the clusters they hold.
+func (c *checker) recover() fileResult {
+	if len(c.found) == 0 {
+		return frOK
+	}
+	fsys := c.fsys
+	clsz := int64(fsys.csize) * int64(fsys.ssize)
+	var dir string
+	for i := 0; ; i++ {
+		if i == 1000 {
+			return frDenied
+		}
+		dir = "FOUND." + zero_pad(i, 3)
+		fr := fsys.f_mkdir(dir)
+		if fr == frOK {
+			break
+		} else if fr != frExist {
+			return fr
+		}
+	}
+	for i, p := range c.found {
+		var fp File
+		fr := fsys.f_open(&fp, dir+"/FILE"+zero_pad(i, 4)+".CHK", faCreateNew|faWrite)
+		if fr != frOK {
+			return fr
+		}
+		fp.obj.sclust = p.Cluster
+		fp.obj.objsize = int64(p.Count) * clsz
+		if fsys.isExfat() {
+			fp.obj.stat = 2 // A run of the allocation bitmap, without FAT chain.
+		}
+		if fr = fp.f_close(); fr != frOK {
+			return fr
+		}
+	}
+	return frOK
+}
+
+// zero_pad formats i in decimal with at least n digits.
+func zero_pad(i, n int) string {
+	s := strconv.Itoa(i)
+	for len(s) < n {
+		s = "0" + s
+	}
+	return s
+}
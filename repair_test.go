@@ -0,0 +1,304 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// repair repairs a copy of the volume corrupted by corrupt, requiring the
+// repaired volume to check clean and a second repair to find nothing and
+// write nothing. It returns the report and the volume, mounted.
+func (cv *checkVolume) repair(t *testing.T, corrupt func(img []byte), cfg *RepairConfig) (*CheckReport, *FS) {
+	t.Helper()
+	img := append([]byte(nil), cv.img...)
+	corrupt(img)
+	blk, _ := makeBlockIndexer(512)
+	return repairDevice(t, &BlockByteSlice{blk: blk, buf: img}, cfg)
+}
+
+func repairDevice(t *testing.T, dev *BlockByteSlice, cfg *RepairConfig) (*CheckReport, *FS) {
+	t.Helper()
+	var fsys FS
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := fsys.Repair(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range rep.Problems {
+		if !p.Fixed {
+			t.Errorf("not fixed: %v", p)
+		}
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	repaired := append([]byte(nil), dev.buf...)
+	if err := fsys.Mount(dev, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	again, err := fsys.Repair(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProblems(t, again)
+	if again.Files != rep.Files || again.Dirs != rep.Dirs || again.FreeClusters != rep.FreeClusters {
+		t.Errorf("second repair found %d files, %d dirs, %d free; want %d, %d, %d",
+			again.Files, again.Dirs, again.FreeClusters, rep.Files, rep.Dirs, rep.FreeClusters)
+	}
+	if err := fsys.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dev.buf, repaired) {
+		t.Error("second repair wrote to the volume")
+	}
+	return rep, &fsys
+}
+
+// checkPat requires the file at path to hold n bytes of pattern seed.
+func checkPat(t *testing.T, fsys *FS, path string, seed, n int) {
+	t.Helper()
+	got := readAllFile(t, fsys, path)
+	if len(got) != n {
+		t.Fatalf("%s holds %d bytes, want %d", path, len(got), n)
+	}
+	for i, b := range got {
+		if b != pat(seed, i) {
+			t.Fatalf("%s differs at %d", path, i)
+		}
+	}
+}
+
+func TestRepairFAT(t *testing.T) {
+	cv := newCheckVolume(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	a := cv.entry(t, "A       BIN")
+	b := cv.entry(t, "B       BIN")
+	acl := cv.clusterOf(a)
+	sub := cv.clusterOf(cv.entry(t, "SUB        "))
+	const asize = 6*512 - 100
+	intact := func(t *testing.T, fsys *FS) {
+		t.Helper()
+		checkPat(t, fsys, "a.bin", 1, asize)
+		checkPat(t, fsys, "sub/c.bin", 3, 3000)
+	}
+
+	clean, _ := cv.repair(t, func([]byte) {}, nil)
+	wantProblems(t, clean)
+
+	t.Run("lost", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			cv.setFAT16(img, 4000, 4001)
+			cv.setFAT16(img, 4001, 0xFFFF)
+			cv.setFAT16(img, 5000, 0xFFFF)
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemLostChain, Cluster: 4000, Count: 2}, Problem{Kind: ProblemLostChain, Cluster: 5000, Count: 1})
+		intact(t, fsys)
+	})
+	t.Run("recover", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			cv.setFAT16(img, 4000, 4001)
+			cv.setFAT16(img, 4001, uint16(acl)) // Lost chain joining a.bin's.
+			copy(img[cv.clusterOffset(4000):], "lost data")
+		}, &RepairConfig{RecoverLost: true})
+		wantProblems(t, rep, Problem{Kind: ProblemLostChain, Cluster: 4000, Count: 2})
+		intact(t, fsys)
+		got := readAllFile(t, fsys, "FOUND.000/FILE0000.CHK")
+		if len(got) != 2*512 || !strings.HasPrefix(string(got), "lost data") {
+			t.Errorf("recovered %d bytes %.9q", len(got), got)
+		}
+	})
+	t.Run("crosslink", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			copy(img[b+dirFstClusLOOff:b+dirFstClusLOOff+2], img[a+dirFstClusLOOff:])
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemCrossLinked, Path: "/B.BIN", Cluster: acl},
+			Problem{Kind: ProblemLostChain, Count: 2})
+		intact(t, fsys)
+		// b.bin holds a copy of the start of a.bin, which keeps its own.
+		checkPat(t, fsys, "b.bin", 1, 1000)
+	})
+	t.Run("short", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			binary.LittleEndian.PutUint32(img[a+dirFileSizeOff:], 10*512)
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemChainShort, Path: "/A.BIN", Got: 6, Want: 10})
+		got := readAllFile(t, fsys, "a.bin")
+		if len(got) != 6*512 {
+			t.Errorf("a.bin holds %d bytes, want %d", len(got), 6*512)
+		}
+	})
+	t.Run("long", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			binary.LittleEndian.PutUint32(img[a+dirFileSizeOff:], 100)
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemChainLong, Path: "/A.BIN", Got: 6, Want: 1})
+		checkPat(t, fsys, "a.bin", 1, 100)
+		if rep.UsedClusters != clean.UsedClusters-5 || rep.FreeClusters != clean.FreeClusters+5 {
+			t.Errorf("%d clusters used and %d free after trimming, want %d and %d",
+				rep.UsedClusters, rep.FreeClusters, clean.UsedClusters-5, clean.FreeClusters+5)
+		}
+	})
+	t.Run("badcluster", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			cv.setFAT16(img, acl+2, 0)
+		}, nil)
+		// The chain is cut at the free cluster, which then ends it.
+		wantProblems(t, rep, Problem{Kind: ProblemBadCluster, Path: "/A.BIN", Cluster: acl + 2},
+			Problem{Kind: ProblemChainShort, Path: "/A.BIN", Got: 3, Want: 6},
+			Problem{Kind: ProblemLostChain, Cluster: acl + 3, Count: 3})
+		got := readAllFile(t, fsys, "a.bin")
+		if len(got) != 3*512 {
+			t.Errorf("a.bin holds %d bytes, want %d", len(got), 3*512)
+		}
+	})
+	t.Run("dotdot", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			binary.LittleEndian.PutUint16(img[cv.clusterOffset(sub)+sizeDirEntry+dirFstClusLOOff:], 7)
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemBadDot, Path: "/SUB", Got: 7})
+		intact(t, fsys)
+	})
+	t.Run("fatcopy", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			img[(cv.fatbase+cv.fsize+3)*512+10] ^= 1
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemFATMismatch, Count: 1})
+		intact(t, fsys)
+	})
+	t.Run("lfn", func(t *testing.T) {
+		skipIfNoLFN(t)
+		l := cv.entry(t, "LONGFI~1TXT")
+		rep, fsys := cv.repair(t, func(img []byte) {
+			img[l] = mskDDEM
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemOrphanLFN, Path: "/", Count: 2}, Problem{Kind: ProblemLostChain, Count: 2})
+		intact(t, fsys)
+		rep, fsys = cv.repair(t, func(img []byte) {
+			img[l+8] = 'X'
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemLFNChecksum, Path: "/LONGFI~1.XXT", Count: 2})
+		checkPat(t, fsys, "LONGFI~1.XXT", 4, 700)
+	})
+}
+
+func TestRepairExFAT(t *testing.T) {
+	skipIfNoExFAT(t)
+	cv := newCheckVolume(t, 8192, FormatParams{Format: FormatExFAT, ClusterSize: 1})
+	a := cv.xentry(t, "a.bin")
+	acl := binary.LittleEndian.Uint32(cv.img[a+xdirFstClus:])
+	bit := func(img []byte, cl uint32) *byte {
+		return &img[cv.bitbase*512+int64(cl-2)/8]
+	}
+
+	t.Run("setsum", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			img[a+xdirModTime] ^= 1
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemBadEntrySet, Path: "/a.bin"})
+		checkPat(t, fsys, "a.bin", 1, 6*512-100)
+	})
+	t.Run("long", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			binary.LittleEndian.PutUint64(img[a+xdirFileSize:], 100)
+			binary.LittleEndian.PutUint64(img[a+xdirValidFileSize:], 100)
+		}, nil)
+		// Without FAT chain the file holds as many clusters as its size
+		// needs: the others are lost.
+		wantProblems(t, rep, Problem{Kind: ProblemBadEntrySet, Path: "/a.bin"},
+			Problem{Kind: ProblemLostChain, Cluster: acl + 1, Count: 5})
+		checkPat(t, fsys, "a.bin", 1, 100)
+	})
+	t.Run("bitmap", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			*bit(img, acl+1) &^= 1 << ((acl - 1) % 8)
+		}, nil)
+		wantProblems(t, rep, Problem{Kind: ProblemBitmap, Cluster: acl + 1, Count: 1})
+		checkPat(t, fsys, "a.bin", 1, 6*512-100)
+	})
+	t.Run("recover", func(t *testing.T) {
+		rep, fsys := cv.repair(t, func(img []byte) {
+			*bit(img, 7000) |= 1 << (6998 % 8)
+			copy(img[cv.clusterOffset(7000):], "lost data")
+		}, &RepairConfig{RecoverLost: true})
+		wantProblems(t, rep, Problem{Kind: ProblemLostChain, Cluster: 7000, Count: 1})
+		if got := readAllFile(t, fsys, "FOUND.000/FILE0000.CHK"); len(got) != 512 || !strings.HasPrefix(string(got), "lost data") {
+			t.Errorf("recovered %d bytes %.9q", len(got), got)
+		}
+	})
+}
+
+// TestRepairGolden corrupts the golden torture images in ways that leave
+// the data intact and requires a repair to restore them byte for byte.
+func TestRepairGolden(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		exfat   bool
+		corrupt func(t *testing.T, fsys *FS, img []byte)
+		want    []Problem
+	}{
+		{"golden-torture16.img", false, corruptGoldenFAT, []Problem{
+			{Kind: ProblemLostChain, Count: 2}, {Kind: ProblemFATMismatch}}},
+		{"golden-torture32.img", false, func(t *testing.T, fsys *FS, img []byte) {
+			corruptGoldenFAT(t, fsys, img)
+			binary.LittleEndian.PutUint32(img[(fsys.volbase+1)*512+fsiFree_Count:], 1234)
+		}, []Problem{{Kind: ProblemLostChain, Count: 2}, {Kind: ProblemFATMismatch}, {Kind: ProblemFreeCount, Got: 1234}}},
+		{"golden-tortureex.img", true, func(t *testing.T, fsys *FS, img []byte) {
+			// Flip the checksum of the first entry set of the root, and of
+			// the up-case table, and mark the last cluster used.
+			root := int(fsys.clst2sect(uint32(fsys.dirbase))) * 512
+			for off := root; img[off] != 0; off += sizeDirEntry {
+				if img[off] == etFILEDIR {
+					img[off+xdirSetSum] ^= 0x55
+					break
+				}
+			}
+			for off := root; img[off] != 0; off += sizeDirEntry {
+				if img[off] == etUPCASE {
+					img[off+xdirCaseSum] ^= 0x55
+					break
+				}
+			}
+			last := fsys.n_fatent - 1
+			img[int64(fsys.bitbase)*512+int64(last-2)/8] |= 1 << ((last - 2) % 8)
+		}, []Problem{{Kind: ProblemBadEntrySet}, {Kind: ProblemUpcaseChecksum}, {Kind: ProblemLostChain, Count: 1}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			dev := goldenDevice(t, test.name)
+			var fsys FS
+			if err := fsys.Mount(dev, 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			test.corrupt(t, &fsys, dev.buf)
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			rep, _ := repairDevice(t, dev, nil)
+			wantProblems(t, rep, test.want...)
+			compareGolden(t, dev, test.name)
+		})
+	}
+}
+
+// corruptGoldenFAT makes a lost chain of the last two clusters, on both
+// FATs, and flips a byte of the second FAT.
+func corruptGoldenFAT(t *testing.T, fsys *FS, img []byte) {
+	t.Helper()
+	last := fsys.n_fatent - 1
+	for i := int64(0); i < int64(fsys.nFATs); i++ {
+		fat := (int64(fsys.fatbase) + i*int64(fsys.fsize)) * 512
+		if fsys.fstype == FormatFAT16 {
+			binary.LittleEndian.PutUint16(img[fat+int64(last-1)*2:], uint16(last))
+			binary.LittleEndian.PutUint16(img[fat+int64(last)*2:], 0xFFFF)
+		} else {
+			binary.LittleEndian.PutUint32(img[fat+int64(last-1)*4:], last)
+			binary.LittleEndian.PutUint32(img[fat+int64(last)*4:], 0x0FFF_FFFF)
+		}
+	}
+	img[(int64(fsys.fatbase)+int64(fsys.fsize)+1)*512+7] ^= 0x10
+}
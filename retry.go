@@ -0,0 +1,117 @@
+package fat
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy retries the transfers of the device that fail, see
+// [FSConfig.Retry]. The zero value tries each transfer once.
+type RetryPolicy struct {
+	// Attempts is the most times a transfer is tried, the first included.
+	// 0 and 1 do not retry.
+	Attempts int
+	// Backoff is the wait before the first retry, doubled before each next
+	// one up to MaxBackoff if it is not 0.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable reports whether the device error err is worth a retry, as a
+	// timeout is and a write protected card is not. nil retries every error.
+	// The error of a context done is never retried.
+	Retryable func(err error) bool
+}
+
+// RetryStats counts the transfers of the device retried by [FSConfig.Retry]
+// since Mount. Without a policy that retries, Attempts of 2 or more, nothing
+// is counted.
+type RetryStats struct {
+	// Retries counts the attempts past the first of every transfer.
+	Retries uint64
+	// Recovered counts the transfers that failed and then succeeded once
+	// retried.
+	Recovered uint64
+	// Failed counts the transfers that failed every attempt they were
+	// allowed, or with an error not retryable.
+	Failed uint64
+}
+
+// RetryStats returns the retry counts of the mounted volume.
+func (fsys *FS) RetryStats() RetryStats {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.rstats
+}
+
+// transfer calls xfer for the blocks of buf from block start, of bs bytes,
+// as many times as rp allows while it fails, and returns the times it did
+// and its last error. xfer returns the bytes it transferred: a retry starts
+// at the first block of those not wholly transferred, so that blocks a
+// failed write did reach are not written again, nor any out of order. A
+// retry of ctx done is abandoned.
+func (rp *RetryPolicy) transfer(ctx context.Context, bs int, buf []byte, start int64, xfer func(buf []byte, start int64) (int, error)) (tries int, err error) {
+	wait := rp.Backoff
+	for {
+		var n int
+		n, err = xfer(buf, start)
+		tries++
+		if err == nil || tries >= rp.Attempts || !rp.retryable(ctx, err) {
+			return tries, err
+		}
+		if done := n / bs; done > 0 && done*bs < len(buf) {
+			buf = buf[done*bs:]
+			start += int64(done)
+		}
+		if wait > 0 {
+			if werr := sleepContext(ctx, wait); werr != nil {
+				return tries, err
+			}
+			if wait *= 2; rp.MaxBackoff > 0 && wait > rp.MaxBackoff {
+				wait = rp.MaxBackoff
+			}
+		}
+	}
+}
+
+// retryable reports whether err of a transfer of ctx is to be retried.
+func (rp *RetryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx != nil && ctx.Err() != nil {
+		return false
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return rp.Retryable == nil || rp.Retryable(err)
+}
+
+// sleepContext waits for d, or until ctx, if not nil, is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retry_count counts a transfer tried tries times that ended with err. Nothing
+// is counted without a policy that retries.
+func (fsys *FS) retry_count(tries int, err error) {
+	if fsys.retry.Attempts <= 1 {
+		return
+	}
+	if tries > 1 {
+		fsys.rstats.Retries += uint64(tries - 1)
+		if err == nil {
+			fsys.rstats.Recovered++
+		}
+	}
+	if err != nil {
+		fsys.rstats.Failed++
+	}
+}
@@ -0,0 +1,238 @@
+package fat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTimeout = errors.New("timeout")
+
+// flakyDevice fails the transfers touching a block of fail, as many times as
+// it maps to, with errTimeout. A failed write first writes the blocks before
+// the failing one, as a torn write does. written counts the writes of each
+// block.
+type flakyDevice struct {
+	*BlockByteSlice
+	fail    map[int64]int
+	written map[int64]int
+}
+
+// failing returns the first block from start of n that fails, -1 if none.
+func (fd *flakyDevice) failing(start, n int64) int64 {
+	for b := start; b < start+n; b++ {
+		if fd.fail[b] > 0 {
+			fd.fail[b]--
+			return b
+		}
+	}
+	return -1
+}
+
+func (fd *flakyDevice) ReadBlocks(dst []byte, startBlock int64) (int, error) {
+	if fd.failing(startBlock, int64(len(dst))/512) >= 0 {
+		return 0, errTimeout
+	}
+	return fd.BlockByteSlice.ReadBlocks(dst, startBlock)
+}
+
+func (fd *flakyDevice) WriteBlocks(data []byte, startBlock int64) (int, error) {
+	n := int64(len(data)) / 512
+	var err error
+	if b := fd.failing(startBlock, n); b >= 0 {
+		n, err = b-startBlock, errTimeout
+	}
+	for i := int64(0); i < n; i++ {
+		fd.written[startBlock+i]++
+	}
+	fd.BlockByteSlice.WriteBlocks(data[:n*512], startBlock)
+	return int(n) * 512, err
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4}, false},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 4}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+			createPat(t, fsys, "a.bin", 1, 4*2048)
+			first := fileExtents(t, fsys, "a.bin")[0].Block
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			fd := &flakyDevice{BlockByteSlice: dev, fail: map[int64]int{}, written: map[int64]int{}}
+			fsys.Configure(FSConfig{Retry: RetryPolicy{Attempts: 3}})
+			if err := fsys.Mount(fd, 512, ModeRW); err != nil {
+				t.Fatal(err)
+			}
+
+			// A read failing twice succeeds on the third attempt.
+			fd.fail[first+5] = 2
+			checkPat(t, fsys, "a.bin", 1, 4*2048)
+			if got, want := fsys.RetryStats(), (RetryStats{Retries: 2, Recovered: 1}); got != want {
+				t.Errorf("after read: stats %+v, want %+v", got, want)
+			}
+
+			// A torn write resumes at the block it failed at.
+			fd.fail[first+2] = 1
+			var fp File
+			if err := fsys.OpenFile(&fp, "a.bin", ModeWrite); err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, 2048)
+			for i := range data {
+				data[i] = pat(2, i)
+			}
+			if _, err := fp.WriteAt(data, 0); err != nil {
+				t.Fatal(err)
+			} else if err = fp.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for b := first; b < first+4; b++ {
+				if fd.written[b] != 1 {
+					t.Errorf("block %d written %d times, want once", b, fd.written[b])
+				}
+			}
+			if got, want := fsys.RetryStats(), (RetryStats{Retries: 3, Recovered: 2}); got != want {
+				t.Errorf("after write: stats %+v, want %+v", got, want)
+			}
+
+			// Metadata writes are retried too.
+			root := fsys.dirbase
+			if test.exfat {
+				root = fsys.clst2sect(uint32(fsys.dirbase))
+			}
+			fd.fail[int64(root)] = 2
+			if err := fsys.Mkdir("dir"); err != nil {
+				t.Fatal(err)
+			}
+
+			// A transfer failing every attempt fails with the device error.
+			fd.fail[first+9] = 3
+			var buf [512]byte
+			if err := fsys.OpenFile(&fp, "a.bin", ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			_, err := fp.ReadAt(buf[:], 9*512)
+			fp.Close()
+			if !errors.Is(err, ErrDisk) || !errors.Is(err, errTimeout) {
+				t.Errorf("read failing every attempt: %v, want %v", err, errTimeout)
+			}
+			st := fsys.RetryStats()
+			if st.Failed != 1 {
+				t.Errorf("stats %+v, want 1 failed", st)
+			}
+
+			// An error the policy does not retry fails at once.
+			fsys.Configure(FSConfig{Retry: RetryPolicy{Attempts: 3, Retryable: func(err error) bool { return err != errTimeout }}})
+			fd.fail[first+9] = 1
+			if err := fsys.OpenFile(&fp, "a.bin", ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = fp.ReadAt(buf[:], 9*512); !errors.Is(err, errTimeout) {
+				t.Errorf("read failing with an error not retryable: %v, want %v", err, errTimeout)
+			}
+			fp.Close()
+			if got := fsys.RetryStats(); got.Retries != st.Retries || got.Failed != 2 {
+				t.Errorf("stats %+v after an error not retryable, want %d retries and 2 failed", got, st.Retries)
+			}
+
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			var plain FS
+			if err := plain.Mount(dev, 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, 4*2048)
+			for i := range want {
+				want[i] = pat(1, i)
+			}
+			copy(want, data)
+			if got := readAllFile(t, &plain, "a.bin"); string(got) != string(want) {
+				t.Error("a.bin content differs after retried writes")
+			}
+			rep, err := plain.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, rep)
+		})
+	}
+}
+
+// TestRetryStatsNoPolicy fails transfers without a retry policy and requires
+// nothing counted.
+func TestRetryStatsNoPolicy(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	createPat(t, fsys, "a.bin", 1, 1024)
+	first := fileExtents(t, fsys, "a.bin")[0].Block
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	fd := &flakyDevice{BlockByteSlice: dev, fail: map[int64]int{}, written: map[int64]int{}}
+	if err := fsys.Mount(fd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	fd.fail[first] = 1
+	var fp File
+	if err := fsys.OpenFile(&fp, "a.bin", ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fp.Read(make([]byte, 512))
+	fp.Close()
+	if !errors.Is(err, errTimeout) {
+		t.Fatalf("read failing: %v, want %v", err, errTimeout)
+	}
+	if got := fsys.RetryStats(); got != (RetryStats{}) {
+		t.Errorf("stats %+v without a policy, want none", got)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	createPat(t, fsys, "a.bin", 1, 1024)
+	first := fileExtents(t, fsys, "a.bin")[0].Block
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	fd := &flakyDevice{BlockByteSlice: dev, fail: map[int64]int{}, written: map[int64]int{}}
+	fsys.Configure(FSConfig{Retry: RetryPolicy{Attempts: 4, Backoff: 2 * time.Millisecond, MaxBackoff: 4 * time.Millisecond}})
+	if err := fsys.Mount(fd, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	// Waits of 2, 4 and 4 milliseconds.
+	fd.fail[first] = 3
+	start := time.Now()
+	checkPat(t, fsys, "a.bin", 1, 1024)
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("3 retries took %v, want at least 10ms of backoff", d)
+	}
+
+	// A backoff is cut short by the context of the operation.
+	fsys.Configure(FSConfig{Retry: RetryPolicy{Attempts: 2, Backoff: time.Hour}})
+	fd.fail[first+1] = 1
+	var fp File
+	if err := fsys.OpenFile(&fp, "a.bin", ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if _, err := fp.Seek(512, 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fp.ReadContext(ctx, make([]byte, 512)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("read in a backoff past its deadline: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
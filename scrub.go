@@ -0,0 +1,91 @@
+package fat
+
+import "log/slog"
+
+// scrubChunkSectors is the most sectors overwritten at once by scrub_sectors.
+const scrubChunkSectors = 64
+
+// scrub_chain destroys the data of the chain from clst, run by run of
+// contiguous clusters, before remove_chain frees it.
+func (obj *objid) scrub_chain(clst uint32) fileResult {
+	fsys := obj.fs
+	scl, ecl := clst, clst
+	for {
+		nxt := obj.clusterstat(clst)
+		switch nxt {
+		case 1:
+			return frIntErr
+		case badCluster:
+			return frDiskErr
+		}
+		if nxt != 0 && ecl+1 == nxt {
+			ecl = nxt // Next cluster is contiguous.
+		} else {
+			fr := fsys.scrub_sectors(fsys.clst2sect(scl), int(ecl-scl+1)*int(fsys.csize))
+			if fr != frOK || nxt == 0 || nxt >= fsys.n_fatent {
+				return fr // End of the chain.
+			}
+			scl, ecl = nxt, nxt
+		}
+		clst = nxt
+	}
+}
+
+// scrub_tail destroys the data past the end of the file fp, just truncated
+// at fp.fptr, in its last cluster. The sector of the end, held in fp.buf,
+// is cleared past it and written by f_truncate.
+func (fp *File) scrub_tail() fileResult {
+	fsys := fp.obj.fs
+	ss := int64(fsys.ssize)
+	clsz := int64(fsys.csize) * ss
+	ofs := fp.fptr % clsz
+	if ofs == 0 {
+		return frOK // The file ends with its last cluster.
+	}
+	if ofs%ss != 0 {
+		clear(fp.buf[ofs%ss : ss])
+		fp.flag |= faDIRTY
+	}
+	n := int((clsz - ofs) / ss) // Whole sectors past the end.
+	if n == 0 {
+		return frOK
+	}
+	return fsys.scrub_sectors(fsys.clst2sect(fp.clust)+lba(fsys.csize)-lba(n), n)
+}
+
+// scrub_sectors erases or overwrites with zeros n sectors from sect, as
+// [FSConfig.Scrub] selects.
+func (fsys *FS) scrub_sectors(sect lba, n int) fileResult {
+	fsys.trace("fs:scrub_sectors", slog.Uint64("start", uint64(sect)), slog.Int("numsectors", n))
+	if fsys.winsect-sect < lba(n) {
+		// The window holds one of them: write it first if modified.
+		if fr := fsys.sync_window(); fr != frOK {
+			return fr
+		}
+		fsys.winsect = badLBA
+	}
+	if fsys.scrubMode == ScrubErase {
+		if fsys.disk_erase(sect, n) == drOK {
+			return frOK
+		}
+		fsys.deverr = nil // Zeros are written instead.
+	}
+	chunk := n
+	if chunk > scrubChunkSectors {
+		chunk = scrubChunkSectors
+	}
+	ss := int(fsys.ssize)
+	zero := make([]byte, chunk*ss)
+	for n > 0 {
+		c := chunk
+		if c > n {
+			c = n
+		}
+		if fsys.disk_write(zero[:c*ss], sect, c) != drOK {
+			return frDiskErr
+		}
+		sect += lba(c)
+		n -= c
+	}
+	return frOK
+}
@@ -0,0 +1,117 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// noEraseDevice fails every erase.
+type noEraseDevice struct {
+	*BlockByteSlice
+}
+
+func (nd noEraseDevice) EraseBlocks(start, num int64) error {
+	return errors.New("erase unsupported")
+}
+
+// utf16le encodes s as the UTF-16 of LFN and exFAT name entries.
+func utf16le(s string) string {
+	var b []byte
+	for _, r := range s {
+		b = append(b, byte(r), byte(r>>8))
+	}
+	return string(b)
+}
+
+func TestScrub(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		numBlocks  int
+		fmt        FormatParams
+		exfat      bool
+		mode       ScrubMode
+		eraseFails bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4}, false, ScrubZero, false},
+		{"FAT32/erase", 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1}, false, ScrubErase, false},
+		{"FAT16/erasefails", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1}, false, ScrubErase, true},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 2}, true, ScrubZero, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			const secret, tail = "PATIENT-RECORD-", "TRUNCATED-TAIL-"
+			// The data and names that must not survive removal.
+			needles := []string{secret + secret, tail + tail}
+			if test.exfat {
+				needles = append(needles, utf16le("SECRET"))
+			} else {
+				needles = append(needles, "ECRET  TXT")
+			}
+			if lfnEnabled {
+				needles = append(needles, utf16le("Secre"))
+			}
+			for _, mode := range []ScrubMode{ScrubOff, test.mode} {
+				fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+				if test.eraseFails {
+					if err := fsys.Unmount(); err != nil {
+						t.Fatal(err)
+					}
+					if err := fsys.Mount(noEraseDevice{dev}, 512, ModeRW); err != nil {
+						t.Fatal(err)
+					}
+				}
+				fsys.Configure(FSConfig{Scrub: mode})
+				data := strings.Repeat(secret, 700)
+				names := []string{"SECRET.TXT"}
+				if lfnEnabled {
+					names = append(names, "Secret long name.txt")
+				}
+				for _, name := range names {
+					writeStr(t, fsys, name, data)
+				}
+				writeStr(t, fsys, "trunc.txt", strings.Repeat("k", 700)+strings.Repeat(tail, 700))
+				for _, name := range names {
+					if err := fsys.Remove(name); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var fp File
+				if err := fsys.OpenFile(&fp, "trunc.txt", ModeWrite); err != nil {
+					t.Fatal(err)
+				}
+				if err := fp.Truncate(700); err != nil {
+					t.Fatal(err)
+				} else if err = fp.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if got := readAllFile(t, fsys, "trunc.txt"); string(got) != strings.Repeat("k", 700) {
+					t.Error("trunc.txt differs after truncating")
+				}
+				rep, err := fsys.Check()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantProblems(t, rep)
+				deleted, err := fsys.ListDeleted("")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := fsys.Unmount(); err != nil {
+					t.Fatal(err)
+				}
+				for _, needle := range needles {
+					if found := bytes.Contains(dev.buf, []byte(needle)); found != (mode == ScrubOff) {
+						t.Errorf("scrub mode %d: %q found on the device: %v", mode, needle, found)
+					}
+				}
+				if mode != ScrubOff && len(deleted) != 0 {
+					t.Errorf("scrubbed entries listed deleted: %q", deleted[0].Name())
+				}
+			}
+		})
+	}
+}
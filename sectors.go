@@ -45,6 +45,12 @@ func newDatetime(t time.Time) datetime {
 	}
 }
 
+// fattime returns dt packed as date<<16|time, the layout of the directory
+// entry timestamp fields.
+func (dt datetime) fattime() uint32 {
+	return uint32(dt.date)<<16 | uint32(dt.time)
+}
+
 func (dt datetime) Milliseconds() int {
 	if dt.fine >= 100 {
 		return 10 * int(dt.fine-100)
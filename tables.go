@@ -160,6 +160,9 @@ const (
 	clustMaxExFAT = 0x7FFFFFFD // Max exFAT clusters (differs from specs, implementation limit)
 )
 
+// lfnOffsets are the offsets of the 13 name characters in an LFN entry.
+var lfnOffsets = [...]byte{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
 // window offsets.
 const (
 	dirNameOff       = 0  // Short file name (11-byte)
@@ -267,14 +270,16 @@ func _() {
 	_ = x[frUnsupported-20]
 	_ = x[frClosed-21]
 	_ = x[frGeneric-22]
+	_ = x[frVerifyErr-23]
+	_ = x[frDiskFull-24]
 }
 
 // generated with command:
 //
 //	stringer -type=fileResult -linecomment -output=stringer_fileResult.go
-const _fileResult_name = "succeededa hard error occurred in the low level disk I/O layerassertion failedthe physical drive cannot workcould not find the filecould not find the paththe path name format is invalidaccess denied due to prohibited access or directory fullaccess denied due to prohibited accessthe file/directory object is invalidthe physical drive is write protectedthe logical drive number is invalidthe volume has no work areathere is no valid FAT volumethe f_mkfs() aborted due to any problemcould not get a grant to access the volume within defined periodthe operation is rejected according to the file sharing policyLFN working buffer could not be allocatednumber of open files > FF_FS_LOCKgiven parameter is invalidthe operation is not supportedthe file is closedfat generic error"
+const _fileResult_name = "succeededa hard error occurred in the low level disk I/O layerassertion failedthe physical drive cannot workcould not find the filecould not find the paththe path name format is invalidaccess denied due to prohibited access or directory fullaccess denied due to prohibited accessthe file/directory object is invalidthe physical drive is write protectedthe logical drive number is invalidthe volume has no work areathere is no valid FAT volumethe f_mkfs() aborted due to any problemcould not get a grant to access the volume within defined periodthe operation is rejected according to the file sharing policyLFN working buffer could not be allocatednumber of open files > FF_FS_LOCKgiven parameter is invalidthe operation is not supportedthe file is closedfat generic errorwritten data read back differentthe volume is full"
 
-var _fileResult_index = [...]uint16{0, 9, 62, 78, 108, 131, 154, 185, 241, 279, 315, 352, 387, 414, 442, 481, 545, 607, 648, 681, 707, 737, 755, 772}
+var _fileResult_index = [...]uint16{0, 9, 62, 78, 108, 131, 154, 185, 241, 279, 315, 352, 387, 414, 442, 481, 545, 607, 648, 681, 707, 737, 755, 772, 804, 822}
 
 func (i fileResult) String() string {
 	if i < 0 || i >= fileResult(len(_fileResult_index)-1) {
@@ -0,0 +1,112 @@
+package fat
+
+import (
+	"cmp"
+	"slices"
+)
+
+// trimMaxRuns is the maximum number of freed sector runs held for erasing.
+// When full, the smallest runs are let go.
+const trimMaxRuns = 64
+
+// trimRun is a run of freed sectors [start, end) pending erase.
+type trimRun struct {
+	start, end lba
+}
+
+// trim_add queues the sectors of the freed clusters scl to ecl for erasing
+// at the next sync, FatFs' FF_USE_TRIM. Runs adjacent to or overlapping a
+// queued run are merged with it.
+func (fsys *FS) trim_add(scl, ecl uint32) {
+	if !fsys.trimOn {
+		return
+	}
+	start := fsys.clst2sect(scl)
+	end := fsys.clst2sect(ecl) + lba(fsys.csize)
+	if start == 0 || end <= start {
+		return
+	}
+	for i := 0; i < len(fsys.trim); {
+		r := fsys.trim[i]
+		if r.end < start || r.start > end {
+			i++
+			continue
+		}
+		// Merge and check the merged run against the other runs again.
+		if r.start < start {
+			start = r.start
+		}
+		if r.end > end {
+			end = r.end
+		}
+		fsys.trim[i] = fsys.trim[len(fsys.trim)-1]
+		fsys.trim = fsys.trim[:len(fsys.trim)-1]
+	}
+	run := trimRun{start: start, end: end}
+	if len(fsys.trim) < trimMaxRuns {
+		fsys.trim = append(fsys.trim, run)
+		return
+	}
+	// Full: replace the smallest run if the new one is larger.
+	small := 0
+	for i, r := range fsys.trim {
+		if r.end-r.start < fsys.trim[small].end-fsys.trim[small].start {
+			small = i
+		}
+	}
+	if r := fsys.trim[small]; r.end-r.start < end-start {
+		fsys.trim[small] = run
+	}
+}
+
+// trim_cancel removes the sectors of cluster cl from the queued runs as it is
+// allocated again, so that erasing them does not destroy its new contents.
+func (fsys *FS) trim_cancel(cl uint32) {
+	if len(fsys.trim) == 0 {
+		return
+	}
+	start := fsys.clst2sect(cl)
+	end := start + lba(fsys.csize)
+	for i := 0; i < len(fsys.trim); i++ {
+		r := fsys.trim[i]
+		if r.end <= start || r.start >= end {
+			continue
+		}
+		head := trimRun{start: r.start, end: start}
+		tail := trimRun{start: end, end: r.end}
+		switch {
+		case head.start < head.end && tail.start < tail.end:
+			fsys.trim[i] = head
+			if len(fsys.trim) < trimMaxRuns {
+				fsys.trim = append(fsys.trim, tail)
+			}
+		case head.start < head.end:
+			fsys.trim[i] = head
+		case tail.start < tail.end:
+			fsys.trim[i] = tail
+		default:
+			fsys.trim[i] = fsys.trim[len(fsys.trim)-1]
+			fsys.trim = fsys.trim[:len(fsys.trim)-1]
+			i--
+		}
+	}
+}
+
+// trim_flush erases the queued runs of at least trimMin sectors, in sector
+// order. Called by sync once the FAT and directories no longer reference
+// them on the device. Erase errors are ignored: erasing is only a hint to the
+// device that the data is no longer needed.
+func (fsys *FS) trim_flush() {
+	if len(fsys.trim) == 0 {
+		return
+	}
+	slices.SortFunc(fsys.trim, func(a, b trimRun) int { return cmp.Compare(a.start, b.start) })
+	for _, r := range fsys.trim {
+		if n := int(r.end - r.start); n >= fsys.trimMin {
+			if fsys.disk_erase(r.start, n) != drOK {
+				fsys.deverr = nil
+			}
+		}
+	}
+	fsys.trim = fsys.trim[:0]
+}
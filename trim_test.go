@@ -0,0 +1,148 @@
+package fat
+
+import (
+	"bytes"
+	"testing"
+)
+
+// erasingDevice wraps a BlockDevice and records erase requests.
+type erasingDevice struct {
+	BlockDeviceExtended
+	erases [][2]int64 // Start and number of blocks.
+}
+
+func (ed *erasingDevice) EraseBlocks(start, num int64) error {
+	ed.erases = append(ed.erases, [2]int64{start, num})
+	return ed.BlockDeviceExtended.EraseBlocks(start, num)
+}
+
+func mountTrim(t *testing.T, dev BlockDeviceExtended, cfg FSConfig) (*FS, *erasingDevice) {
+	t.Helper()
+	ed := &erasingDevice{BlockDeviceExtended: dev}
+	var fsys FS
+	cfg.Trim = true
+	fsys.Configure(cfg)
+	if err := fsys.Mount(ed, 512, ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	return &fsys, ed
+}
+
+func TestTrim(t *testing.T) {
+	t.Run("FAT", func(t *testing.T) { testTrim(t, FormatFAT16) })
+	t.Run("exFAT", func(t *testing.T) {
+		skipIfNoExFAT(t)
+		testTrim(t, FormatExFAT)
+	})
+}
+
+func testTrim(t *testing.T, format Format) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: format, ClusterSize: 1})
+	// Interleave the clusters of a.dat and b.dat.
+	var a, b File
+	if err := fsys.OpenFile(&a, "a.dat", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.OpenFile(&b, "b.dat", ModeCreateNew|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		writePat(t, &a, 1, i*512, 512)
+		writePat(t, &b, 2, i*512, 512)
+	}
+	a.Close()
+	b.Close()
+	createPat(t, fsys, "c.dat", 3, 3*512)
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	fsys, ed := mountTrim(t, dev, FSConfig{})
+	var info FileInfo
+	if err := fsys.Stat("a.dat", &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(ed.erases) != 0 {
+		t.Fatal("erased without freeing")
+	}
+
+	// Truncating a.dat frees four single-cluster runs, erased only on sync
+	// and then merged with those of b.dat into one run.
+	if err := fsys.OpenFile(&a, "a.dat", ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(ed.erases) != 0 {
+		t.Fatal("erased before sync")
+	}
+	if err := fsys.Remove("b.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ed.erases) != 1 || ed.erases[0][1] != 8 {
+		t.Fatalf("erases = %v, want one run of 8 blocks", ed.erases)
+	}
+	a.Close()
+
+	// Clusters allocated again before the sync are not erased.
+	ed.erases = nil
+	if err := fsys.OpenFile(&a, "c.dat", ModeRW); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	fsys.last_clst = 0 // Allocate from the start of the volume, over what was freed.
+	writePat(t, &a, 4, 0, 12*512)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ed.erases) != 0 {
+		t.Errorf("erases = %v after reallocating freed clusters, want none", ed.erases)
+	}
+	got := readAllFile(t, fsys, "c.dat")
+	for i := range got {
+		if got[i] != pat(4, i) {
+			t.Fatalf("c.dat corrupted at %d", i)
+		}
+	}
+
+	// ModeCreateAlways frees the old contents.
+	if err := fsys.OpenFile(&a, "c.dat", ModeCreateAlways|ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, e := range ed.erases {
+		n += e[1]
+	}
+	if n != 12 {
+		t.Errorf("erased %d blocks recreating c.dat, want 12", n)
+	}
+	if err := fsys.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Short runs are left alone.
+	fsys, ed = mountTrim(t, dev, FSConfig{TrimMinBlocks: 4})
+	createPat(t, fsys, "short.dat", 5, 2*512)
+	createPat(t, fsys, "long.dat", 6, 6*512)
+	ed.erases = nil
+	for _, name := range []string{"short.dat", "long.dat"} {
+		if err := fsys.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ed.erases) != 1 || ed.erases[0][1] != 6 {
+		t.Errorf("erases = %v, want only the 6-block run", ed.erases)
+	}
+	// The erased sectors read back as the device erases them.
+	sect := make([]byte, 512)
+	if _, err := ed.ReadBlocks(sect, ed.erases[0][0]); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(sect, make([]byte, 512)) {
+		t.Error("erased sector not cleared")
+	}
+}
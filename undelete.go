@@ -0,0 +1,294 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// DeletedFile is a deleted file or directory found by [FS.ListDeleted], which
+// [FS.Undelete] restores. Its FileInfo is that of the deleted entry.
+type DeletedFile struct {
+	FileInfo
+	// Cluster is the first cluster the file held, 0 if it held none.
+	Cluster uint32
+	// Exact reports whether the clusters the file held are known: those of an
+	// exFAT file without FAT chain, or of a file of a single cluster. Deleting
+	// frees the FAT chain of the others, which are presumed to have held the
+	// run of contiguous clusters from Cluster their size needs, as FAT
+	// allocation mostly leaves them. A directory on FAT is presumed to have
+	// held one cluster.
+	Exact bool
+	// Free reports whether those clusters are all still free. If not, the
+	// file cannot be restored: others have been allocated its clusters.
+	Free bool
+
+	dir      string // Directory the entry was found in.
+	size     int64  // Size of the data, of a directory too on exFAT.
+	nclst    uint32 // Clusters presumed held.
+	crt, mod uint32 // Created and modified time.
+}
+
+// ListDeleted returns the deleted entries of the directory at dirpath that
+// still hold a name, as undelete tools find them. The first cluster of each
+// is read from its entry, and whether its clusters are still free from the
+// FAT or the exFAT allocation bitmap.
+//
+// Deleting an entry on FAT overwrites the first byte of its short name and
+// of its long name entries. The long name is rebuilt from the deleted long
+// name entries before the short name entry, and the first byte of the short
+// name found from their checksum. A short name without long name has lost
+// its first character, which reads '_'. On exFAT deleting only clears the in
+// use bit of the entry set, which is restored as it was if its checksum
+// matches.
+func (fsys *FS) ListDeleted(dirpath string) (_ []DeletedFile, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	defer fsys.wrapErr(&err, "listdeleted", dirpath)
+	if fsys.fstype == _FormatUnknown {
+		return nil, frNotEnabled
+	}
+	var dj dir
+	fr := fsys.f_opendir(&dj, dirpath)
+	if fr != frOK {
+		return nil, fr
+	}
+	var files []DeletedFile
+	if fsys.isExfat() {
+		files, fr = dj.read_deleted_exfat(files)
+	} else {
+		files, fr = dj.read_deleted(files)
+	}
+	for i := 0; fr == frOK && i < len(files); i++ {
+		files[i].dir = dirpath
+		fr = fsys.deleted_chain(&files[i])
+	}
+	if fr != frOK {
+		return nil, fr
+	}
+	return files, nil
+}
+
+// Undelete restores the deleted file or directory d, listed by
+// [FS.ListDeleted], to a new entry named name in the directory it was found
+// in, or under its own name if name is empty. Its clusters are allocated
+// again as its FAT chain, or as a run without FAT chain on exFAT, and its
+// entry is given its size, attributes and times. A restored directory holds
+// the entries it held when deleted, deleted too: list them to restore them.
+//
+// Undelete returns an error if the clusters are no longer free, see
+// [DeletedFile.Free], or if name exists. Free clusters may have been
+// allocated and freed again since the file was deleted: only data of the
+// presumed run that was not overwritten is that of the file. A restored
+// entry may take the place of other deleted entries of the directory, so
+// list again before restoring past files not listed in one go.
+func (fsys *FS) Undelete(d *DeletedFile, name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if name == "" {
+		name = d.Name()
+	}
+	path := strings.TrimRight(d.dir, "/") + "/" + name
+	if fsys.fstype == _FormatUnknown {
+		return fsys.pathErr("undelete", path, frNotEnabled)
+	} else if fsys.perm&ModeWrite == 0 {
+		return fsys.pathErr("undelete", path, frWriteProtected)
+	} else if d.fname[0] == 0 {
+		return fsys.pathErr("undelete", path, frInvalidParameter)
+	}
+	return fsys.pathErr("undelete", path, fsys.f_undelete(d, path))
+}
+
+// read_deleted appends the deleted entries of the FAT directory dp, rewound,
+// to dst.
+func (dp *dir) read_deleted(dst []DeletedFile) ([]DeletedFile, fileResult) {
+	fsys := dp.obj.fs
+	var lfn [(lfnBufSize + 12) / 13][sizeDirEntry]byte // Deleted LFN entries before the SFN entry.
+	var nlfn int
+	for {
+		fr := fsys.move_window(dp.sect)
+		if fr != frOK {
+			return dst, fr
+		}
+		b := dp.dir[dirNameOff]
+		if b == 0 {
+			return dst, frOK // End of the directory.
+		}
+		attr := dp.dir[dirAttrOff] & amMASK
+		if b != mskDDEM {
+			nlfn = 0
+		} else if attr == amLFN {
+			if nlfn == len(lfn) {
+				copy(lfn[:], lfn[1:]) // Keep the nearest.
+				nlfn--
+			}
+			copy(lfn[nlfn][:], dp.dir[:sizeDirEntry])
+			nlfn++
+		} else {
+			if attr&amVOL == 0 && dp.dir[dirNameOff+1] != 0 { // Not scrubbed, see FSConfig.Scrub.
+				dst = append(dst, dp.deleted_sfn(lfn[:nlfn]))
+			}
+			nlfn = 0
+		}
+		fr = dp.next(false)
+		if fr == frNoFile {
+			return dst, frOK
+		} else if fr != frOK {
+			return dst, fr
+		}
+	}
+}
+
+// deleted_sfn returns the deleted SFN entry at dp, named from the deleted
+// LFN entries lfn before it, nearest last.
+func (dp *dir) deleted_sfn(lfn [][sizeDirEntry]byte) DeletedFile {
+	fsys := dp.obj.fs
+	var sfn [sizeDirEntry]byte
+	copy(sfn[:], dp.dir[:sizeDirEntry])
+	// The LFN entries of the SFN are the nearest of the same checksum. The
+	// checksum is a permutation of the first byte of the SFN, which it finds.
+	haslfn := false
+	if n := len(lfn); n > 0 {
+		sum := lfn[n-1][ldirChksumOff]
+		for n > 1 && lfn[n-2][ldirChksumOff] == sum {
+			n--
+		}
+		lfn = lfn[n-1:]
+		for c := 1; c < 0x100 && !haslfn; c++ {
+			sfn[dirNameOff] = byte(c)
+			haslfn = sum_sfn(sfn[:]) == sum
+		}
+		for i := 0; haslfn && i < len(lfn); i++ {
+			ent := lfn[len(lfn)-1-i]
+			ent[ldirOrdOff] = byte(i + 1)
+			if i == len(lfn)-1 {
+				ent[ldirOrdOff] |= mskLLEF
+			}
+			haslfn = fsys.pick_lfn(ent[:])
+		}
+	}
+	if !haslfn {
+		sfn[dirNameOff] = '_' // Lost.
+	}
+	var d DeletedFile
+	win := dp.dir
+	dp.dir = sfn[:]
+	dp.blk_ofs = 0
+	if !haslfn {
+		dp.blk_ofs = badLBA
+	}
+	dp.get_fileinfo(&d.FileInfo)
+	dp.dir = win
+	d.Cluster = fsys.ld_clust(sfn[:])
+	d.size = d.fsize
+	d.crt = binary.LittleEndian.Uint32(sfn[dirCrtTimeOff:])
+	d.mod = binary.LittleEndian.Uint32(sfn[dirModTimeOff:])
+	return d
+}
+
+// deleted_chain sets the clusters presumed held by d, and whether they are
+// free.
+func (fsys *FS) deleted_chain(d *DeletedFile) fileResult {
+	clsz := int64(fsys.csize) * int64(fsys.ssize)
+	d.nclst = uint32((d.size + clsz - 1) / clsz)
+	if d.IsDir() && d.nclst == 0 {
+		d.nclst = 1
+	}
+	if d.nclst <= 1 && !(d.IsDir() && !fsys.isExfat()) {
+		d.Exact = true
+	}
+	if d.Cluster == 0 && d.size == 0 && !d.IsDir() {
+		d.nclst = 0
+		d.Free = true // Empty file.
+		return frOK
+	}
+	d.Free = false
+	if d.Cluster < 2 || d.Cluster >= fsys.n_fatent || d.nclst > fsys.n_fatent-d.Cluster {
+		return frOK
+	}
+	for i := uint32(0); i < d.nclst; i++ {
+		used, fr := fsys.cluster_used(d.Cluster + i)
+		if fr != frOK {
+			return fr
+		} else if used {
+			return frOK
+		}
+	}
+	d.Free = true
+	return frOK
+}
+
+// f_undelete restores d at path.
+func (fsys *FS) f_undelete(d *DeletedFile, path string) fileResult {
+	// The clusters may have been allocated since d was listed.
+	fr := fsys.deleted_chain(d)
+	if fr != frOK {
+		return fr
+	} else if !d.Free {
+		return frDenied
+	}
+	var fp File
+	if fr = fsys.f_open(&fp, path, faCreateNew|faWrite); fr != frOK {
+		return fr
+	}
+	if d.nclst > 0 {
+		if fr = fsys.undelete_chain(d); fr != frOK {
+			fp.f_close()
+			fsys.f_unlink(path)
+			return fr
+		}
+		fp.obj.sclust = d.Cluster
+		fp.obj.objsize = d.size
+		if fsys.isExfat() {
+			fp.obj.stat = 2 // A run of the allocation bitmap, without FAT chain.
+		}
+	}
+	if fr = fp.f_close(); fr != frOK {
+		return fr
+	}
+	// Give the entry the attributes and times of d.
+	var dj dir
+	dj.obj.fs = fsys
+	if fr = dj.follow_path(path); fr != frOK {
+		return fr
+	}
+	if fsys.isExfat() {
+		fr = dj.undelete_exfat(d.fattrib, d.crt, d.mod)
+	} else {
+		dj.dir[dirAttrOff] = d.fattrib
+		binary.LittleEndian.PutUint32(dj.dir[dirCrtTimeOff:], d.crt)
+		binary.LittleEndian.PutUint32(dj.dir[dirModTimeOff:], d.mod)
+		fsys.wflag = 1
+	}
+	if fr != frOK {
+		return fr
+	}
+	if d.IsDir() {
+		fsys.dindex_drop(d.Cluster)
+	}
+	return fsys.sync()
+}
+
+// undelete_chain allocates the clusters of d: a FAT chain through them, or
+// on exFAT their bits of the allocation bitmap.
+func (fsys *FS) undelete_chain(d *DeletedFile) fileResult {
+	if fsys.isExfat() {
+		if fr := fsys.change_bitmap(d.Cluster, d.nclst, true); fr != frOK {
+			return fr
+		}
+	} else {
+		for i := uint32(0); i < d.nclst; i++ {
+			next := d.Cluster + i + 1
+			if i == d.nclst-1 {
+				next = badCluster // End of chain.
+			}
+			if fr := fsys.put_clusterstat(d.Cluster+i, next); fr != frOK {
+				return fr
+			}
+		}
+	}
+	if fsys.free_clst >= d.nclst && fsys.free_clst <= fsys.n_fatent-2 {
+		fsys.free_clst -= d.nclst
+		fsys.fsi_flag |= 1
+	}
+	return frOK
+}
@@ -0,0 +1,170 @@
+package fat
+
+import (
+	"errors"
+	"testing"
+)
+
+// findDeleted returns the deleted file named name of files.
+func findDeleted(t *testing.T, files []DeletedFile, name string) *DeletedFile {
+	t.Helper()
+	for i := range files {
+		if files[i].Name() == name {
+			return &files[i]
+		}
+	}
+	var names []string
+	for i := range files {
+		names = append(names, files[i].Name())
+	}
+	t.Fatalf("%q not among deleted files %q", name, names)
+	return nil
+}
+
+func TestUndelete(t *testing.T) {
+	skipIfNoLFN(t)
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1}, false},
+		{"FAT32", 140000, FormatParams{Format: FormatFAT32, ClusterSize: 1}, false},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 1}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			const long = "A long file name.bin"
+			fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+			createPat(t, fsys, "keep.bin", 1, 3000)
+			createPat(t, fsys, long, 2, 5000)
+			if err := fsys.Mkdir("Sub Dir"); err != nil {
+				t.Fatal(err)
+			}
+			createPat(t, fsys, "Sub Dir/inner file.txt", 3, 1500)
+			var fi FileInfo
+			if err := fsys.Stat(long, &fi); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{long, "Sub Dir/inner file.txt", "Sub Dir"} {
+				if err := fsys.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, err := fsys.ListDeleted("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := findDeleted(t, files, long)
+			if d.Size() != 5000 || d.IsDir() || !d.Free || d.Cluster < 2 || d.Exact != test.exfat {
+				t.Errorf("deleted %s: size %d, dir %v, free %v, cluster %d, exact %v", long, d.Size(), d.IsDir(), d.Free, d.Cluster, d.Exact)
+			}
+			if !d.ModTime().Equal(fi.ModTime()) {
+				t.Errorf("deleted %s modified %v, want %v", long, d.ModTime(), fi.ModTime())
+			}
+			if err := fsys.Undelete(d, "keep.bin"); !errors.Is(err, ErrExist) {
+				t.Errorf("restoring %s over keep.bin: %v, want %v", long, err, frExist)
+			}
+			if err := fsys.Undelete(d, ""); err != nil {
+				t.Fatal(err)
+			}
+			checkPat(t, fsys, long, 2, 5000)
+			var got FileInfo
+			if err := fsys.Stat(long, &got); err != nil {
+				t.Fatal(err)
+			} else if !got.ModTime().Equal(fi.ModTime()) || got.Mode() != fi.Mode() {
+				t.Errorf("restored %s: %v %v, want %v %v", long, got.ModTime(), got.Mode(), fi.ModTime(), fi.Mode())
+			}
+			if err := fsys.Undelete(d, ""); !errors.Is(err, ErrDenied) {
+				t.Errorf("restoring %s twice: %v, want %v", long, err, frDenied)
+			}
+
+			// A restored directory holds its deleted entries.
+			d = findDeleted(t, files, "Sub Dir")
+			if !d.IsDir() || !d.Free {
+				t.Fatalf("deleted Sub Dir: dir %v, free %v", d.IsDir(), d.Free)
+			}
+			if err := fsys.Undelete(d, ""); err != nil {
+				t.Fatal(err)
+			}
+			files, err = fsys.ListDeleted("Sub Dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fsys.Undelete(findDeleted(t, files, "inner file.txt"), ""); err != nil {
+				t.Fatal(err)
+			}
+			checkPat(t, fsys, "Sub Dir/inner file.txt", 3, 1500)
+			rep, err := fsys.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems(t, rep)
+			if rep.Files != 3 || rep.Dirs != 1 {
+				t.Errorf("check counts %d files, %d dirs, want 3 and 1", rep.Files, rep.Dirs)
+			}
+
+			if err := fsys.Unmount(); err != nil {
+				t.Fatal(err)
+			}
+			var plain FS
+			if err := plain.Mount(dev, 512, ModeRead); err != nil {
+				t.Fatal(err)
+			}
+			checkPat(t, &plain, long, 2, 5000)
+			checkPat(t, &plain, "keep.bin", 1, 3000)
+		})
+	}
+}
+
+// TestUndeleteShortName restores a file without long name, whose first
+// character is lost, and requires its clusters to be free.
+func TestUndeleteShortName(t *testing.T) {
+	fsys, _ := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	createPat(t, fsys, "DATA.BIN", 1, 4000)
+	createPat(t, fsys, "FILL.BIN", 2, 0)
+	if err := fsys.Remove("DATA.BIN"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fsys.ListDeleted("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := findDeleted(t, files, "_ATA.BIN")
+	if !d.Free || d.Exact {
+		t.Errorf("deleted DATA.BIN: free %v, exact %v", d.Free, d.Exact)
+	}
+	if err := fsys.Undelete(d, "DATA.BIN"); err != nil {
+		t.Fatal(err)
+	}
+	checkPat(t, fsys, "DATA.BIN", 1, 4000)
+
+	// Once its clusters are allocated again it cannot be restored.
+	if err := fsys.Remove("DATA.BIN"); err != nil {
+		t.Fatal(err)
+	}
+	free, err := fsys.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPat(t, fsys, "FILL.BIN", 2, int(free))
+	if files, err = fsys.ListDeleted(""); err != nil {
+		t.Fatal(err)
+	}
+	d = findDeleted(t, files, "_ATA.BIN")
+	if d.Free {
+		t.Error("clusters of DATA.BIN free on a full volume")
+	}
+	if err := fsys.Undelete(d, "DATA.BIN"); !errors.Is(err, ErrDenied) {
+		t.Errorf("restoring over allocated clusters: %v, want %v", err, frDenied)
+	}
+	rep, err := fsys.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProblems(t, rep)
+}
@@ -0,0 +1,82 @@
+package fat
+
+import (
+	"bytes"
+	"log/slog"
+)
+
+// verifyChunkSectors is the most sectors disk_verify reads back at once.
+const verifyChunkSectors = 64
+
+// VerifyStats counts the sectors read back by [FSConfig.VerifyWrites] and the
+// clusters of file data moved by [FSConfig.RemapBadClusters] since Mount.
+type VerifyStats struct {
+	// Sectors counts the sectors written and read back.
+	Sectors uint64
+	// Mismatches counts the sectors that read back different from what was
+	// written. A device acknowledging writes it does not keep, as counterfeit
+	// SD cards do once written past their real capacity, shows here.
+	Mismatches uint64
+	// Remapped counts the clusters replaced in the chain of a file as
+	// writing to them failed or did not read back.
+	Remapped uint64
+}
+
+// VerifyStats returns the verification counts of the mounted volume.
+func (fsys *FS) VerifyStats() VerifyStats {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.vstats
+}
+
+// disk_verify reads back the numsectors sectors from sector just written
+// from buf and compares them with it. A read the device fails is a device
+// error, not a mismatch: what the sectors hold is unknown.
+func (fsys *FS) disk_verify(buf []byte, sector lba, numsectors int) diskresult {
+	ss := int(fsys.ssize)
+	chunk := numsectors
+	if chunk > verifyChunkSectors {
+		chunk = verifyChunkSectors
+	}
+	if len(fsys.vbuf) < chunk*ss {
+		fsys.vbuf = make([]byte, chunk*ss)
+	}
+	ret := drOK
+	for done := 0; done < numsectors; done += chunk {
+		n := numsectors - done
+		if n > chunk {
+			n = chunk
+		}
+		rb := fsys.vbuf[:n*ss]
+		start := sector + lba(done)
+		tries, err := fsys.retry.transfer(fsys.ctx, ss, rb, int64(start), func(dst []byte, start int64) (int, error) {
+			return readBlocks(fsys.ctx, fsys.device, dst, start)
+		})
+		fsys.retry_count(tries, err)
+		if err != nil {
+			fsys.logerror("disk_verify", slog.String("err", err.Error()))
+			fsys.device_error("read", start, err)
+			return drError
+		}
+		fsys.vstats.Sectors += uint64(n)
+		for i := 0; i < n; i++ {
+			if !bytes.Equal(rb[i*ss:(i+1)*ss], buf[(done+i)*ss:(done+i+1)*ss]) {
+				fsys.logerror("disk_verify:mismatch", slog.Uint64("sect", uint64(sector)+uint64(done+i)))
+				fsys.vstats.Mismatches++
+				ret = drVerifyErr
+			}
+		}
+	}
+	return ret
+}
+
+// write_result returns the fileResult of a disk_write that returned dr.
+func (dr diskresult) write_result() fileResult {
+	switch dr {
+	case drOK:
+		return frOK
+	case drVerifyErr:
+		return frVerifyErr
+	}
+	return frDiskErr
+}
@@ -0,0 +1,165 @@
+package fat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyWrites(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		numBlocks int
+		fmt       FormatParams
+		exfat     bool
+	}{
+		{"FAT16", 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4}, false},
+		{"exFAT", 8192, FormatParams{Format: FormatExFAT, ClusterSize: 2}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.exfat {
+				skipIfNoExFAT(t)
+			}
+			for _, remap := range []bool{false, true} {
+				fsys, dev := formatAndMount(t, test.numBlocks, test.fmt)
+				bd := remountBad(t, fsys, dev, FSConfig{VerifyWrites: true, RemapBadClusters: remap})
+				clsz := int(fsys.csize) * 512
+				createPat(t, fsys, "a.bin", 1, clsz)
+				if st := fsys.VerifyStats(); st.Sectors == 0 || st.Mismatches != 0 {
+					t.Fatalf("stats after a good write: %+v", st)
+				}
+				first := fsys.sect2clst(lba(fileExtents(t, fsys, "a.bin")[0].Block))
+
+				// The file grows onto a cluster that drops writes.
+				bd.drop[int64(fsys.clst2sect(first+1))] = true
+				var fp File
+				if err := fsys.OpenFile(&fp, "a.bin", ModeOpenAppend|ModeWrite); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, clsz)
+				for i := range buf {
+					buf[i] = pat(1, clsz+i)
+				}
+				_, err := fp.Write(buf)
+				if cerr := fp.Close(); err == nil {
+					err = cerr
+				}
+				st := fsys.VerifyStats()
+				if !remap {
+					if !errors.Is(err, ErrVerify) {
+						t.Errorf("write that did not read back: %v, want %v", err, frVerifyErr)
+					}
+					if st.Mismatches != 1 || st.Remapped != 0 {
+						t.Errorf("stats: %+v", st)
+					}
+					continue
+				}
+				// The write is retried once before the cluster is replaced.
+				if err != nil {
+					t.Fatal(err)
+				} else if st.Mismatches != 2 || st.Remapped != 1 {
+					t.Errorf("stats: %+v", st)
+				}
+				checkPat(t, fsys, "a.bin", 1, 2*clsz)
+				avoidClusters(t, fsys, "a.bin", first+1)
+				rep, err := fsys.Check()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantProblems(t, rep)
+				if rep.BadClusters != 1 {
+					t.Errorf("check counts %d bad clusters, want 1", rep.BadClusters)
+				}
+			}
+		})
+	}
+}
+
+// TestVerifyMetadata requires a directory sector that does not read back to
+// fail the operation writing it.
+func TestVerifyMetadata(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 1})
+	bd := remountBad(t, fsys, dev, FSConfig{VerifyWrites: true})
+	bd.drop[int64(fsys.dirbase)] = true
+	if err := fsys.Mkdir("dir"); !errors.Is(err, ErrVerify) {
+		t.Errorf("mkdir on a root directory sector dropping writes: %v, want %v", err, frVerifyErr)
+	}
+	if st := fsys.VerifyStats(); st.Mismatches == 0 {
+		t.Errorf("stats: %+v", st)
+	}
+	// Without VerifyWrites the loss goes unnoticed.
+	fsys.Configure(FSConfig{})
+	if err := fsys.Mkdir("dir2"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestVerifyReadError fails the read back of a file's data and requires a
+// device error of the read, the cluster left in place.
+func TestVerifyReadError(t *testing.T) {
+	fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+	createPat(t, fsys, "a.bin", 1, 2048)
+	first := fileExtents(t, fsys, "a.bin")[0].Block
+	bd := remountBad(t, fsys, dev, FSConfig{VerifyWrites: true, RemapBadClusters: true})
+	bd.badRead[first+1] = true
+	var fp File
+	if err := fsys.OpenFile(&fp, "a.bin", ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fp.WriteAt(make([]byte, 2048), 0)
+	fp.Close()
+	var derr *DeviceError
+	if errors.Is(err, ErrVerify) || !errors.As(err, &derr) {
+		t.Fatalf("write failing to read back: %v, want a device error", err)
+	} else if derr.Op != "read" || derr.Block != first {
+		t.Errorf("device error: op %q, block %d, want %q and %d", derr.Op, derr.Block, "read", first)
+	}
+	if st := fsys.VerifyStats(); st.Mismatches != 0 || st.Remapped != 0 {
+		t.Errorf("stats: %+v", st)
+	}
+	if got := fileExtents(t, fsys, "a.bin")[0].Block; got != first {
+		t.Errorf("file moved to block %d from %d", got, first)
+	}
+
+	// The read back is retried as any other read.
+	fsys.Configure(FSConfig{VerifyWrites: true, Retry: RetryPolicy{Attempts: 3}})
+	before := fsys.RetryStats()
+	if err := fsys.OpenFile(&fp, "a.bin", ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt(make([]byte, 2048), 0)
+	fp.Close()
+	if !errors.Is(err, ErrDisk) {
+		t.Errorf("write failing to read back: %v, want %v", err, ErrDisk)
+	}
+	if st := fsys.RetryStats(); st.Retries-before.Retries != 2 || st.Failed-before.Failed != 1 {
+		t.Errorf("retry stats: %+v from %+v, want 2 retries and 1 failed more", st, before)
+	}
+}
+
+// TestVerifyPartialSector writes part of a sector that drops writes and
+// requires Sync and Close, which write it, to fail with ErrVerify.
+func TestVerifyPartialSector(t *testing.T) {
+	for _, cfg := range []FSConfig{
+		{VerifyWrites: true},
+		{VerifyWrites: true, WriteCoalesceSectors: 8},
+	} {
+		fsys, dev := formatAndMount(t, 8192, FormatParams{Format: FormatFAT16, ClusterSize: 4})
+		createPat(t, fsys, "a.bin", 1, 2048)
+		first := fileExtents(t, fsys, "a.bin")[0].Block
+		bd := remountBad(t, fsys, dev, cfg)
+		bd.drop[first] = true
+		var fp File
+		if err := fsys.OpenFile(&fp, "a.bin", ModeWrite); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fp.Write([]byte("short")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fp.Sync(); !errors.Is(err, ErrVerify) {
+			t.Errorf("coalesce %d: sync: %v, want %v", cfg.WriteCoalesceSectors, err, ErrVerify)
+		}
+		if err := fp.Close(); !errors.Is(err, ErrVerify) {
+			t.Errorf("coalesce %d: close: %v, want %v", cfg.WriteCoalesceSectors, err, ErrVerify)
+		}
+	}
+}